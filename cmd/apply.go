@@ -0,0 +1,199 @@
+/*
+Copyright © 2024 Mariano Zunino <marianoz@posteo.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package cmd
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	ropconfig "github.com/marianozunino/rop/internal/config"
+	"github.com/marianozunino/rop/internal/k8s"
+	"github.com/marianozunino/rop/internal/logger"
+	"github.com/marianozunino/rop/internal/notify"
+	"github.com/marianozunino/rop/internal/ui"
+	"github.com/marianozunino/rop/pkg/rop"
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/rest"
+)
+
+type applyConfig struct {
+	playbook       string
+	artifactsDir   string
+	noConfirm      bool
+	showPlan       bool
+	connectTimeout time.Duration
+	noRedact       bool
+	verbose        bool
+}
+
+func NewApplyCmd() *cobra.Command {
+	cfg := &applyConfig{}
+
+	applyCmd := &cobra.Command{
+		Use:   "apply",
+		Short: "Run a playbook of steps across pods",
+		Long: `Run the steps of a YAML playbook in order. Each step runs a file on a pod like a single
+rop run, and can use the output, exit code and artifacts of earlier steps in its args
+and env. The plan of all steps is shown for approval once, before the first step runs.`,
+		Example: `rop apply -f incident.yaml
+rop apply -f incident.yaml --show-plan
+rop apply -f incident.yaml --no-confirm --artifacts-dir ./incident-42`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			logger.ConfigureLogger(cfg.verbose)
+			if err := runApply(cmd.Context(), cfg); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	applyCmd.Flags().StringVarP(&cfg.playbook, "file", "f", "", "The playbook to run")
+	applyCmd.Flags().StringVar(&cfg.artifactsDir, "artifacts-dir", "rop-artifacts", "Directory the artifacts of the steps are fetched into")
+	applyCmd.Flags().BoolVar(&cfg.noConfirm, "no-confirm", false, "Skip confirmation prompt")
+	applyCmd.Flags().BoolVar(&cfg.showPlan, "show-plan", false, "Print the plan of the playbook and exit without running it")
+	applyCmd.Flags().BoolVar(&cfg.noRedact, "no-redact", false, "Don't redact secrets from the output")
+	applyCmd.Flags().DurationVar(&cfg.connectTimeout, "connect-timeout", 0, "Maximum time for API requests and connecting to the cluster (0 means no timeout)")
+	applyCmd.Flags().BoolVarP(&cfg.verbose, "verbose", "v", false, "Verbose output")
+	applyCmd.MarkFlagRequired("file")
+	applyCmd.Flags().SortFlags = false
+
+	return applyCmd
+}
+
+func runApply(ctx context.Context, cfg *applyConfig) error {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	playbook, err := rop.LoadPlaybook(cfg.playbook)
+	if err != nil {
+		return err
+	}
+
+	ropConfig, err := ropconfig.Load()
+	if err != nil {
+		return err
+	}
+	for _, step := range playbook.Steps {
+		if err := checkApprovalPolicy(cmp.Or(step.Context, playbook.Context)); err != nil {
+			return fmt.Errorf("step %s: %w", step.Name, err)
+		}
+	}
+
+	connect := func(kubeContext, namespace string) (*rest.Config, string, error) {
+		restConfig, namespace, err := k8s.LoadConfig(kubeContext, namespace, cfg.connectTimeout)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to load kubeconfig: %w", err)
+		}
+		return restConfig, namespace, nil
+	}
+
+	// Steps connect to their own context; the runner uses the one of the first step.
+	kubeContext := cmp.Or(playbook.Steps[0].Context, playbook.Context)
+	restConfig, _, err := connect(kubeContext, "")
+	if err != nil {
+		return err
+	}
+
+	keys, err := trustedKeys()
+	if err != nil {
+		return err
+	}
+	redaction, err := redactionOptions(cfg.noRedact)
+	if err != nil {
+		return err
+	}
+
+	runner, err := rop.NewRunner(append([]rop.Option{
+		rop.WithRESTConfig(restConfig),
+		rop.WithContextName(kubeContext),
+		rop.WithStdout(os.Stdout),
+		rop.WithStderr(os.Stderr),
+		rop.WithContainerSelector(ui.RunContainerSelection),
+		rop.WithTrustedKeys(keys...),
+	}, redaction...)...)
+	if err != nil {
+		return err
+	}
+
+	opts := rop.ApplyOptions{
+		Connect:      connect,
+		ArtifactsDir: cfg.artifactsDir,
+		OnStepStart: func(index int, step rop.PlaybookStep) {
+			fmt.Fprintln(os.Stderr, ui.RenderStepStart(index, len(playbook.Steps), step))
+		},
+		OnStep: func(run rop.StepRun) {
+			fmt.Fprintln(os.Stderr, ui.RenderStepRun(run))
+			step := playbook.Steps[run.Index]
+			target := rop.Target{Namespace: step.Namespace, Pod: step.Pod, Clone: step.Clone, Container: step.Container}
+			kubeContext := cmp.Or(step.Context, playbook.Context)
+			tail := notify.NewTail(outputTailSize)
+			tail.Write([]byte(run.Output))
+			recordRun(ctx, configNotifier(ropConfig, kubeContext), kubeContext, step.File, target, run.Result, run.Err, tail.String())
+		},
+		RequireSignature: ropConfig.RequiresSignature,
+		Hooks: func(kubeContext string) []rop.Hook {
+			return configHooks(ropConfig, kubeContext)
+		},
+	}
+	switch {
+	case cfg.showPlan:
+		opts.Confirm = func(plan rop.PlaybookPlan) error {
+			fmt.Println(ui.RenderPlaybookPlan(plan, ropConfig.IsProtected))
+			return errPlanShown
+		}
+	case !cfg.noConfirm:
+		opts.Confirm = func(plan rop.PlaybookPlan) error {
+			return ui.ConfirmPlaybook(plan, ropConfig.IsProtected)
+		}
+	}
+
+	runs, err := runner.Apply(ctx, playbook, opts)
+	if errors.Is(err, errPlanShown) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, run := range runs {
+		if run.Failed() {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d steps failed", failed, len(runs))
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(NewApplyCmd())
+}
@@ -0,0 +1,439 @@
+/*
+Copyright © 2024 Mariano Zunino <marianoz@posteo.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package cmd
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/marianozunino/rop/internal/approval"
+	ropconfig "github.com/marianozunino/rop/internal/config"
+	"github.com/marianozunino/rop/internal/k8s"
+	"github.com/marianozunino/rop/internal/logger"
+	"github.com/marianozunino/rop/internal/ui"
+	"github.com/marianozunino/rop/pkg/rop"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"k8s.io/client-go/kubernetes"
+)
+
+type requestConfig struct {
+	config
+	reason    string
+	expiresIn time.Duration
+}
+
+func NewRequestCmd() *cobra.Command {
+	cfg := &requestConfig{}
+
+	requestCmd := &cobra.Command{
+		Use:   "request [-- ARGS...]",
+		Short: "Request approval to run a file, for contexts that require a second pair of eyes",
+		Long: `Record a proposed run in the cluster: the target, the SHA-256 of the file, its
+arguments and environment, and how it runs (type, runner, user, destination and
+resource limits). Someone else approves it with 'rop approve <id>', and the run is then
+started with 'rop --approved <id>', which refuses unless the approval exists, is
+unexpired and unused, the file still has the approved SHA-256 and the run uses
+the requested settings.
+
+Requests are stored as ConfigMaps in the namespace given by approvalNamespace in
+the configuration file (default rop-approvals).`,
+		Example: `rop request -c prod-eu -n payments -p api-7d9f -f ./fix-orders.sh --reason "INC-1234" -- --apply`,
+		Args:    argsBeforeDash(cobra.NoArgs),
+		Run: func(cmd *cobra.Command, args []string) {
+			_, fileArgs := splitArgsAtDash(cmd, args)
+			if err := setFileArgs(&cfg.config, fileArgs); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			logger.ConfigureLogger(cfg.verbose)
+			if err := requestApproval(cmd.Context(), cfg); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	requestCmd.Flags().StringVarP(&cfg.kubeContext, "context", contextShorthand(), "", "Kubernetes context")
+	requestCmd.Flags().StringVarP(&cfg.namespace, "namespace", "n", "", "Kubernetes namespace")
+	requestCmd.Flags().StringVarP(&cfg.podName, "pod", "p", "", "The target pod name")
+	requestCmd.Flags().StringVar(&cfg.cloneRef, "clone", "", "Run on a temporary pod cloned from a workload (e.g. 'deploy/api')")
+	requestCmd.Flags().BoolVar(&cfg.cloneInit, "clone-init", false, "Also run the init containers that aren't sidecars in the cloned pod")
+	requestCmd.Flags().StringVarP(&cfg.containerName, "container", containerShorthand(), "", "The container name (optional for single-container pods)")
+	requestCmd.Flags().StringVarP(&cfg.filePath, "file", "f", "", "The file path to execute")
+	requestCmd.Flags().StringArrayVarP(&cfg.fileArgs, "args", "a", []string{}, "File arguments")
+	requestCmd.Flags().StringArrayVarP(&cfg.env, "env", "e", []string{}, "Environment variables for the command (KEY=VALUE)")
+	requestCmd.Flags().StringVarP(&cfg.destPath, "dest-path", "d", "", "Destination path for the script or binary (default /tmp, or a writable directory of the container)")
+	requestCmd.Flags().StringVar(&cfg.asUser, "as-user", "", "Run as this numeric uid, switching with setpriv, runuser or su in the container")
+	requestCmd.Flags().StringVarP(&cfg.runner, "runner", "r", "", "Custom runner for the script (e.g., 'python', 'node')")
+	requestCmd.Flags().StringVarP(&cfg.fileType, "type", "t", "auto", "File type: 'script', 'binary', or 'auto'")
+	addLimitFlags(requestCmd.Flags(), &cfg.config)
+	requestCmd.Flags().StringVar(&cfg.reason, "reason", "", "Why the run is needed, shown to the approver")
+	requestCmd.Flags().DurationVar(&cfg.expiresIn, "expires-in", time.Hour, "How long the request and its approval stay valid")
+	requestCmd.Flags().DurationVar(&cfg.connectTimeout, "connect-timeout", 0, "Maximum time for API requests and connecting to the cluster (0 means no timeout)")
+	requestCmd.Flags().BoolVarP(&cfg.verbose, "verbose", "v", false, "Verbose output")
+	requestCmd.MarkFlagRequired("context")
+	requestCmd.MarkFlagRequired("file")
+	requestCmd.MarkFlagsMutuallyExclusive("pod", "clone")
+	requestCmd.RegisterFlagCompletionFunc("context", contextCompletion)
+	requestCmd.RegisterFlagCompletionFunc("namespace", namespaceCompletion)
+	requestCmd.RegisterFlagCompletionFunc("pod", podCompletion)
+	requestCmd.RegisterFlagCompletionFunc("clone", cloneCompletion)
+	requestCmd.RegisterFlagCompletionFunc("container", containerCompletion)
+	requestCmd.Flags().SortFlags = false
+
+	return requestCmd
+}
+
+func NewApproveCmd() *cobra.Command {
+	cfg := &config{}
+
+	approveCmd := &cobra.Command{
+		Use:   "approve [id]",
+		Short: "Approve a run requested by someone else, or list the requests",
+		Long: `Show a run requested with 'rop request' and approve it after confirmation. Nobody
+can approve their own request; users are identified by the cluster, which must support
+self subject reviews. Without an ID, the requests are listed.`,
+		Example: `rop approve -c prod-eu
+rop approve 3f9a1c2e -c prod-eu`,
+		Args: cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logger.ConfigureLogger(cfg.verbose)
+			var err error
+			if len(args) == 0 {
+				err = listApprovals(cmd.Context(), cfg)
+			} else {
+				err = approve(cmd.Context(), cfg, args[0])
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	approveCmd.Flags().StringVarP(&cfg.kubeContext, "context", contextShorthand(), "", "Kubernetes context")
+	approveCmd.Flags().BoolVar(&cfg.noConfirm, "no-confirm", false, "Skip confirmation prompt")
+	approveCmd.Flags().DurationVar(&cfg.connectTimeout, "connect-timeout", 0, "Maximum time for API requests and connecting to the cluster (0 means no timeout)")
+	approveCmd.Flags().BoolVarP(&cfg.verbose, "verbose", "v", false, "Verbose output")
+	approveCmd.MarkFlagRequired("context")
+	approveCmd.RegisterFlagCompletionFunc("context", contextCompletion)
+	approveCmd.Flags().SortFlags = false
+
+	return approveCmd
+}
+
+// approvalStore returns the store of approvals in the cluster of the context, and the user
+// the cluster knows us as.
+func approvalStore(ctx context.Context, kubeContext string, connectTimeout time.Duration) (*approval.Store, string, error) {
+	ropConfig, err := ropconfig.Load()
+	if err != nil {
+		return nil, "", err
+	}
+	restConfig, _, err := k8s.LoadConfig(kubeContext, "", connectTimeout)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to load kubeconfig: %w", err)
+	}
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create Kubernetes clientset: %w", err)
+	}
+
+	// The local user name isn't used as a fallback, anyone could approve their own request
+	// by changing it.
+	user, err := approval.Identity(ctx, clientset)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to identify the user with the cluster: %w", err)
+	}
+	return &approval.Store{Clientset: clientset, Namespace: ropConfig.ApprovalNamespace}, user, nil
+}
+
+func requestApproval(ctx context.Context, cfg *requestConfig) error {
+	if cfg.podName == "" && cfg.cloneRef == "" {
+		return fmt.Errorf("either --pod or --clone is required")
+	}
+
+	_, namespace, err := k8s.LoadConfig(cfg.kubeContext, cfg.namespace, cfg.connectTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to load kubeconfig: %w", err)
+	}
+	digest, err := fileSHA256(cfg.filePath)
+	if err != nil {
+		return err
+	}
+	store, user, err := approvalStore(ctx, cfg.kubeContext, cfg.connectTimeout)
+	if err != nil {
+		return err
+	}
+
+	request, err := store.Request(ctx, approval.Approval{
+		Context:     cfg.kubeContext,
+		Namespace:   namespace,
+		Pod:         cfg.podName,
+		Clone:       cfg.cloneRef,
+		CloneInit:   cfg.cloneInit,
+		Container:   cfg.containerName,
+		File:        cfg.filePath,
+		SHA256:      digest,
+		Args:        cfg.fileArgs,
+		Env:         cfg.env,
+		Type:        approvedFileType(cfg.fileType),
+		Runner:      cfg.runner,
+		AsUser:      cfg.asUser,
+		DestPath:    cfg.destPath,
+		Nice:        cfg.nice,
+		IONice:      cfg.ionice,
+		MaxMemory:   cfg.maxMemory,
+		MaxCPUTime:  cfg.maxCPUTime,
+		Reason:      cfg.reason,
+		RequestedBy: user,
+	}, cfg.expiresIn)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Requested approval %s, valid until %s\n\n", request.ID, request.ExpiresAt.Local().Format(time.DateTime))
+	fmt.Printf("Someone else approves it with:\n  rop approve %s -c %s\n", request.ID, cfg.kubeContext)
+	fmt.Printf("and you run it with:\n  rop --approved %s -c %s -f %s\n", request.ID, cfg.kubeContext, cfg.filePath)
+	return nil
+}
+
+func approve(ctx context.Context, cfg *config, id string) error {
+	store, user, err := approvalStore(ctx, cfg.kubeContext, cfg.connectTimeout)
+	if err != nil {
+		return err
+	}
+
+	request, err := store.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if request.Context != cfg.kubeContext {
+		return fmt.Errorf("request %s is for context %s, not %s", id, request.Context, cfg.kubeContext)
+	}
+	if !cfg.noConfirm {
+		if err := ui.ConfirmApproval(request); err != nil {
+			return err
+		}
+	}
+
+	approved, err := store.Approve(ctx, id, user)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Approved request %s of %s, valid until %s\n", approved.ID, approved.RequestedBy, approved.ExpiresAt.Local().Format(time.DateTime))
+	return nil
+}
+
+func listApprovals(ctx context.Context, cfg *config) error {
+	store, _, err := approvalStore(ctx, cfg.kubeContext, cfg.connectTimeout)
+	if err != nil {
+		return err
+	}
+	approvals, err := store.List(ctx)
+	if err != nil {
+		return err
+	}
+	if len(approvals) == 0 {
+		fmt.Println("No requests found")
+		return nil
+	}
+
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATE\tREQUESTED BY\tAGE\tTARGET\tFILE\tREASON")
+	for _, a := range approvals {
+		target := fmt.Sprintf("%s/%s", a.Namespace, cmp.Or(a.Pod, "clone of "+a.Clone))
+		age := duration.HumanDuration(now.Sub(a.RequestedAt))
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", a.ID, a.State(now), a.RequestedBy, age, target, a.File, a.Reason)
+	}
+	return w.Flush()
+}
+
+// approvedRun is the approval a run was started with.
+type approvedRun struct {
+	store    *approval.Store
+	approval *approval.Approval
+	user     string
+}
+
+// loadApproval fetches the approval given with --approved and applies it to the run.
+func loadApproval(ctx context.Context, cfg *config) (*approvedRun, error) {
+	if cfg.kubeContext == "" {
+		return nil, fmt.Errorf("--approved needs the context of the request")
+	}
+	store, user, err := approvalStore(ctx, cfg.kubeContext, cfg.connectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	a, err := store.Get(ctx, cfg.approved)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.Valid(time.Now()); err != nil {
+		return nil, err
+	}
+	if err := applyApproval(cfg, a); err != nil {
+		return nil, err
+	}
+	return &approvedRun{store: store, approval: a, user: user}, nil
+}
+
+// applyApproval fills in the run of cfg from the approval and rejects flags that
+// contradict it.
+func applyApproval(cfg *config, a *approval.Approval) error {
+	fileType := approvedFileType(cfg.fileType)
+	nice, maxCPUTime := "", ""
+	if cfg.nice != 0 {
+		nice = strconv.Itoa(cfg.nice)
+	}
+	if cfg.maxCPUTime != 0 {
+		maxCPUTime = cfg.maxCPUTime.String()
+	}
+	approvedNice, approvedMaxCPUTime := "", ""
+	if a.Nice != 0 {
+		approvedNice = strconv.Itoa(a.Nice)
+	}
+	if a.MaxCPUTime != 0 {
+		approvedMaxCPUTime = a.MaxCPUTime.String()
+	}
+
+	fields := []struct {
+		flag     string
+		value    *string
+		approved string
+	}{
+		{"namespace", &cfg.namespace, a.Namespace},
+		{"pod", &cfg.podName, a.Pod},
+		{"clone", &cfg.cloneRef, a.Clone},
+		{"container", &cfg.containerName, a.Container},
+		{"type", &fileType, a.Type},
+		{"runner", &cfg.runner, a.Runner},
+		{"as-user", &cfg.asUser, a.AsUser},
+		{"dest-path", &cfg.destPath, a.DestPath},
+		{"nice", &nice, approvedNice},
+		{"ionice", &cfg.ionice, a.IONice},
+		{"max-memory", &cfg.maxMemory, a.MaxMemory},
+		{"max-cpu-time", &maxCPUTime, approvedMaxCPUTime},
+	}
+	for _, field := range fields {
+		if *field.value != "" && *field.value != field.approved {
+			return fmt.Errorf("--%s %s differs from request %s, which has %s", field.flag, *field.value, a.ID, cmp.Or(field.approved, "none"))
+		}
+		*field.value = field.approved
+	}
+	if cfg.cloneInit && !a.CloneInit {
+		return fmt.Errorf("--clone-init differs from request %s, which doesn't run the init containers", a.ID)
+	}
+	cfg.cloneInit = a.CloneInit
+	cfg.fileType = cmp.Or(fileType, "auto")
+	cfg.nice = a.Nice
+	cfg.maxCPUTime = a.MaxCPUTime
+
+	if len(cfg.fileArgs) > 0 && !slices.Equal(cfg.fileArgs, a.Args) {
+		return fmt.Errorf("the file arguments differ from request %s, which has %q", a.ID, strings.Join(a.Args, " "))
+	}
+	cfg.fileArgs = a.Args
+	if len(cfg.env) > 0 && !slices.Equal(cfg.env, a.Env) {
+		return fmt.Errorf("the environment differs from request %s, which has %q", a.ID, strings.Join(a.Env, " "))
+	}
+	cfg.env = a.Env
+	return nil
+}
+
+// approvedFileType returns the file type as recorded in approvals, where "auto" is left
+// out like every other default.
+func approvedFileType(fileType string) string {
+	if fileType == "auto" {
+		return ""
+	}
+	return fileType
+}
+
+// confirm checks the plan against the approval before the confirmation of the run, and
+// uses the approval up once the run is confirmed. The digest of the plan is the one of the
+// content the runner buffered and copies, so changing the file afterwards has no effect.
+func (r *approvedRun) confirm(ctx context.Context, next func(plan rop.Plan) error) func(plan rop.Plan) error {
+	return func(plan rop.Plan) error {
+		if err := r.approval.Check(plan.Context, plan.Namespace, plan.FileSHA256, time.Now()); err != nil {
+			return err
+		}
+		if next != nil {
+			if err := next(plan); err != nil {
+				return err
+			}
+		}
+		if err := r.store.Use(ctx, r.approval, r.user); err != nil {
+			return err
+		}
+		log.Debug().Msgf("Using request %s approved by %s", r.approval.ID, r.approval.ApprovedBy)
+		return nil
+	}
+}
+
+// checkApprovalPolicy refuses runs without an approval in contexts where the configuration
+// file requires one.
+func checkApprovalPolicy(kubeContext string) error {
+	ropConfig, err := ropconfig.Load()
+	if err != nil {
+		return err
+	}
+	if ropConfig.RequiresApproval(kubeContext) {
+		return fmt.Errorf("%w: context %s requires an approved request, see 'rop request'", approval.ErrNotApproved, kubeContext)
+	}
+	return nil
+}
+
+// fileSHA256 returns the hex SHA-256 of the file.
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("input file not found: %s", path)
+	}
+	if err != nil {
+		return "", fmt.Errorf("error opening file: %w", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("error reading file: %w", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func init() {
+	rootCmd.AddCommand(NewRequestCmd())
+	rootCmd.AddCommand(NewApproveCmd())
+}
@@ -0,0 +1,169 @@
+/*
+Copyright © 2024 Mariano Zunino <marianoz@posteo.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marianozunino/rop/internal/approval"
+	"github.com/marianozunino/rop/internal/k8s/k8stest"
+	"github.com/marianozunino/rop/pkg/rop"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestApprovedRunCopiesApprovedContent(t *testing.T) {
+	const approved = "echo approved\n"
+	path := filepath.Join(t.TempDir(), "fix.sh")
+	if err := os.WriteFile(path, []byte(approved), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(approved))
+
+	clientset := fake.NewSimpleClientset(k8stest.RunningPod("payments", "api-7d9f", "main"))
+	store := &approval.Store{Clientset: clientset}
+	ctx := context.Background()
+	request, err := store.Request(ctx, approval.Approval{
+		Context:     "prod-eu",
+		Namespace:   "payments",
+		Pod:         "api-7d9f",
+		File:        path,
+		SHA256:      hex.EncodeToString(sum[:]),
+		RequestedBy: "alice",
+	}, time.Hour)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	a, err := store.Approve(ctx, request.ID, "bob")
+	if err != nil {
+		t.Fatalf("Approve failed: %v", err)
+	}
+
+	var uploaded []string
+	var server *k8stest.ExecServer
+	server = k8stest.NewExecServer(func(exec *k8stest.Exec) int {
+		for _, file := range server.Files() {
+			content, _ := server.File(file)
+			uploaded = append(uploaded, string(content))
+		}
+		return 0
+	})
+	defer server.Close()
+
+	run := &approvedRun{store: store, approval: a, user: "alice"}
+	runner, err := rop.NewRunner(
+		rop.WithRESTConfig(server.RESTConfig()),
+		rop.WithClientset(clientset),
+		rop.WithContextName("prod-eu"),
+		// The file is edited once the approval was checked, while the prompt is open.
+		rop.WithConfirm(run.confirm(ctx, func(plan rop.Plan) error {
+			return os.WriteFile(path, []byte("echo tampered\n"), 0o644)
+		})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	result, err := runner.Run(ctx, rop.Request{
+		Target: rop.Target{Namespace: "payments", Pod: "api-7d9f"},
+		File:   rop.File{Name: path, Reader: file, Mode: 0o644},
+	})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if len(uploaded) == 0 {
+		t.Fatal("the file was never copied")
+	}
+	for _, content := range uploaded {
+		if content != approved {
+			t.Errorf("ran %q, but %q was approved", content, approved)
+		}
+	}
+	if result.FileSHA256 != a.SHA256 {
+		t.Errorf("result digest %s, approved %s", result.FileSHA256, a.SHA256)
+	}
+	used, err := store.Get(ctx, request.ID)
+	if err != nil || used.State(time.Now()) != approval.StateUsed {
+		t.Errorf("approval not used: %+v, %v", used, err)
+	}
+}
+
+func TestApplyApprovalRejectsUnapprovedSettings(t *testing.T) {
+	a := &approval.Approval{
+		ID:         "3f9a1c2e",
+		Namespace:  "payments",
+		Pod:        "api-7d9f",
+		Args:       []string{"--apply"},
+		Env:        []string{"MODE=fix"},
+		Type:       "script",
+		Runner:     "bash",
+		AsUser:     "1000",
+		Nice:       10,
+		MaxCPUTime: 30 * time.Second,
+	}
+
+	cfg := &config{fileType: "auto"}
+	if err := applyApproval(cfg, a); err != nil {
+		t.Fatalf("applyApproval failed: %v", err)
+	}
+	if cfg.podName != "api-7d9f" || cfg.fileType != "script" || cfg.runner != "bash" || cfg.asUser != "1000" ||
+		cfg.nice != 10 || cfg.maxCPUTime != 30*time.Second || !slices.Equal(cfg.env, a.Env) || !slices.Equal(cfg.fileArgs, a.Args) {
+		t.Errorf("run not taken from the approval: %+v", cfg)
+	}
+
+	tests := []struct {
+		name    string
+		cfg     config
+		wantErr string
+	}{
+		{"extra env", config{fileType: "auto", env: []string{"MODE=fix", "LD_PRELOAD=/tmp/x.so"}}, "the environment differs"},
+		{"other runner", config{fileType: "auto", runner: "python"}, "--runner python differs"},
+		{"other type", config{fileType: "binary"}, "--type binary differs"},
+		{"other user", config{fileType: "auto", asUser: "0"}, "--as-user 0 differs"},
+		{"other dest path", config{fileType: "auto", destPath: "/dev/shm"}, "--dest-path /dev/shm differs"},
+		{"other nice", config{fileType: "auto", nice: -5}, "--nice -5 differs"},
+		{"added memory limit", config{fileType: "auto", maxMemory: "1Gi"}, "--max-memory 1Gi differs"},
+		{"init containers", config{fileType: "auto", cloneInit: true}, "--clone-init differs"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := applyApproval(&tt.cfg, a)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+/*
+Copyright © 2024 Mariano Zunino <marianoz@posteo.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/marianozunino/rop/internal/k8s"
+	"github.com/marianozunino/rop/internal/state"
+	"github.com/marianozunino/rop/pkg/rop"
+	"github.com/spf13/cobra"
+)
+
+const (
+	completionCacheState = "completion-cache"
+
+	// completionCacheTTL is how long listings of the cluster are reused by completions, so
+	// that completing several flags of a command doesn't query the API server every time.
+	completionCacheTTL = 30 * time.Second
+
+	// completionTimeout bounds the API requests of completions when --connect-timeout isn't
+	// given, so a cluster that can't be reached doesn't freeze the shell.
+	completionTimeout = 3 * time.Second
+)
+
+type completionCacheEntry struct {
+	Fetched time.Time `json:"fetched"`
+	Values  []string  `json:"values"`
+}
+
+func contextCompletion(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	contexts, err := k8s.GetAvailableContexts()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting contexts: %v\n", err)
+		return nil, cobra.ShellCompDirectiveError
+	}
+	return contexts, cobra.ShellCompDirectiveNoFileComp
+}
+
+func namespaceCompletion(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	namespaces, err := clusterCompletion(cmd, "namespaces", "", func(ctx context.Context, client *k8s.Client) ([]string, error) {
+		return client.ListNamespaces(ctx)
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting namespaces: %v\n", err)
+		return nil, cobra.ShellCompDirectiveError
+	}
+	return namespaces, cobra.ShellCompDirectiveNoFileComp
+}
+
+// podCompletion completes the running pods of the namespace.
+func podCompletion(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	pods, err := clusterCompletion(cmd, "pods", "", func(ctx context.Context, client *k8s.Client) ([]string, error) {
+		pods, err := client.ListRunningPods(ctx, "")
+		if err != nil {
+			return nil, err
+		}
+		names := make([]string, 0, len(pods))
+		for _, pod := range pods {
+			names = append(names, pod.Name)
+		}
+		return names, nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting pods: %v\n", err)
+		return nil, cobra.ShellCompDirectiveError
+	}
+	return pods, cobra.ShellCompDirectiveNoFileComp
+}
+
+// cloneCompletion completes the workloads of the namespace that pods can be cloned from.
+func cloneCompletion(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	refs, err := clusterCompletion(cmd, "workloads", "", func(ctx context.Context, client *k8s.Client) ([]string, error) {
+		return client.ListWorkloadRefs(ctx)
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting workloads: %v\n", err)
+		return nil, cobra.ShellCompDirectiveError
+	}
+	return refs, cobra.ShellCompDirectiveNoFileComp
+}
+
+// containerCompletion completes the containers of the chosen pod, described by their image.
+func containerCompletion(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	podName, _ := cmd.Flags().GetString("pod")
+	if podName == "" && kubectlCompat && len(args) > 0 {
+		podName = args[0]
+	}
+	if podName == "" {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	containers, err := clusterCompletion(cmd, "containers", podName, func(ctx context.Context, client *k8s.Client) ([]string, error) {
+		pod, err := client.FindPodByName(ctx, podName)
+		if err != nil {
+			return nil, err
+		}
+		names := make([]string, 0, len(pod.Spec.Containers))
+		for _, container := range pod.Spec.Containers {
+			names = append(names, container.Name+"\t"+container.Image)
+		}
+		return names, nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting containers: %v\n", err)
+		return nil, cobra.ShellCompDirectiveError
+	}
+	return containers, cobra.ShellCompDirectiveNoFileComp
+}
+
+func runnerCompletion(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return rop.Runners(), cobra.ShellCompDirectiveNoFileComp
+}
+
+// clusterCompletion returns what list finds in the context and namespace given on the command
+// line, reusing a result cached on disk for completionCacheTTL. The API requests are bounded
+// by --connect-timeout, or completionTimeout without it.
+func clusterCompletion(cmd *cobra.Command, kind, object string, list func(ctx context.Context, client *k8s.Client) ([]string, error)) ([]string, error) {
+	kubeContext, _ := cmd.Flags().GetString("context")
+	namespace, _ := cmd.Flags().GetString("namespace")
+	timeout, _ := cmd.Flags().GetDuration("connect-timeout")
+	if timeout <= 0 {
+		timeout = completionTimeout
+	}
+
+	restConfig, namespace, err := k8s.LoadConfig(kubeContext, namespace, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	key := strings.Join([]string{kind, k8s.Kubeconfig, kubeContext, namespace, object}, "|")
+	cache := map[string]completionCacheEntry{}
+	// A cache that can't be read is only slower.
+	_ = state.Load(completionCacheState, &cache)
+
+	now := time.Now()
+	if entry, ok := cache[key]; ok && now.Sub(entry.Fetched) < completionCacheTTL {
+		return entry.Values, nil
+	}
+
+	client, err := k8s.NewClientForConfig(restConfig, nil, namespace)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(cmd.Context(), timeout)
+	defer cancel()
+	values, err := list(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	for cached, entry := range cache {
+		if now.Sub(entry.Fetched) >= completionCacheTTL {
+			delete(cache, cached)
+		}
+	}
+	cache[key] = completionCacheEntry{Fetched: now, Values: values}
+	_ = state.Save(completionCacheState, cache)
+	return values, nil
+}
@@ -0,0 +1,155 @@
+/*
+Copyright © 2024 Mariano Zunino <marianoz@posteo.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/marianozunino/rop/internal/k8s"
+	"github.com/marianozunino/rop/internal/logger"
+	"github.com/marianozunino/rop/pkg/rop"
+	"github.com/spf13/cobra"
+)
+
+type gcConfig struct {
+	config
+	selector string
+	ttl      time.Duration
+	dryRun   bool
+}
+
+func NewGCCmd() *cobra.Command {
+	cfg := &gcConfig{}
+
+	gcCmd := &cobra.Command{
+		Use:   "gc",
+		Short: "Remove files and cloned pods left behind by runs that couldn't clean up",
+		Long: `Scan the running pods of a namespace for files uploaded by rop that are older than
+the TTL and remove them. Uploads are named rop-<unix time>-<random>-<file name>, so
+they are left behind only when a run was killed or lost its connection to the
+cluster before cleaning up. Every running container of the scanned pods is checked.
+Uploads of runs that are still going, as recorded in their PID file with --timeout
+or when watching, are kept. Pods cloned with --clone that are older than the TTL are deleted as well, unless a
+single pod is scanned with --pod. Clones kept with --keep and clones of runs still
+going are left alone.`,
+		Example: `rop gc -c staging -n payments --dry-run
+rop gc -c staging -n payments -l app.kubernetes.io/name=api --ttl 24h`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			logger.ConfigureLogger(cfg.verbose)
+			if err := runGC(cmd.Context(), cfg); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	gcCmd.Flags().StringVarP(&cfg.kubeContext, "context", contextShorthand(), "", "Kubernetes context")
+	gcCmd.Flags().StringVarP(&cfg.namespace, "namespace", "n", "", "Kubernetes namespace")
+	gcCmd.Flags().StringVarP(&cfg.podName, "pod", "p", "", "Only scan this pod")
+	gcCmd.Flags().StringVarP(&cfg.selector, "selector", "l", "", "Only scan pods matching the label selector")
+	gcCmd.Flags().StringVarP(&cfg.destPath, "dest-path", "d", "", "Directory the files were copied to (default /tmp, or a writable directory of each container)")
+	gcCmd.Flags().DurationVar(&cfg.ttl, "ttl", time.Hour, "Minimum age of the files and cloned pods to remove")
+	gcCmd.Flags().BoolVar(&cfg.dryRun, "dry-run", false, "Only report what would be removed")
+	gcCmd.Flags().DurationVar(&cfg.connectTimeout, "connect-timeout", 0, "Maximum time for API requests and connecting to the cluster (0 means no timeout)")
+	gcCmd.Flags().BoolVarP(&cfg.verbose, "verbose", "v", false, "Verbose output")
+	gcCmd.MarkFlagRequired("context")
+	gcCmd.MarkFlagsMutuallyExclusive("pod", "selector")
+	gcCmd.RegisterFlagCompletionFunc("context", contextCompletion)
+	gcCmd.RegisterFlagCompletionFunc("namespace", namespaceCompletion)
+	gcCmd.RegisterFlagCompletionFunc("pod", podCompletion)
+	gcCmd.Flags().SortFlags = false
+
+	return gcCmd
+}
+
+func runGC(ctx context.Context, cfg *gcConfig) error {
+	if cfg.ttl < 0 {
+		return fmt.Errorf("--ttl must not be negative")
+	}
+
+	restConfig, namespace, err := k8s.LoadConfig(cfg.kubeContext, cfg.namespace, cfg.connectTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to load kubeconfig: %w", err)
+	}
+
+	runner, err := rop.NewRunner(rop.WithRESTConfig(restConfig), rop.WithContextName(cfg.kubeContext))
+	if err != nil {
+		return err
+	}
+
+	artifacts, err := runner.CollectGarbage(ctx, namespace, cfg.podName, rop.GCOptions{
+		Selector: cfg.selector,
+		Dir:      cfg.destPath,
+		TTL:      cfg.ttl,
+		DryRun:   cfg.dryRun,
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(artifacts) == 0 {
+		fmt.Printf("Nothing older than %s found in %s\n", cfg.ttl, namespace)
+		return nil
+	}
+
+	removed, failed := 0, 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "POD\tCONTAINER\tPATH\tAGE\tSTATUS")
+	for _, artifact := range artifacts {
+		status := "would remove"
+		switch {
+		case artifact.Err != nil:
+			status = "failed: " + artifact.Err.Error()
+			failed++
+		case artifact.Removed:
+			status = "removed"
+			removed++
+		}
+		container, path := artifact.Container, artifact.Path
+		if artifact.Clone {
+			container, path = "-", "(cloned pod)"
+		}
+		age := time.Since(artifact.Uploaded).Round(time.Minute)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", artifact.Pod, container, path, age, status)
+	}
+	w.Flush()
+
+	if cfg.dryRun {
+		fmt.Printf("\nFound %d leftovers, nothing removed (dry run)\n", len(artifacts))
+		return nil
+	}
+	fmt.Printf("\nFound %d leftovers, removed %d\n", len(artifacts), removed)
+	if failed > 0 {
+		return fmt.Errorf("failed to remove %d leftovers", failed)
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(NewGCCmd())
+}
@@ -0,0 +1,47 @@
+/*
+Copyright © 2024 Mariano Zunino <marianoz@posteo.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package cmd
+
+import (
+	ropconfig "github.com/marianozunino/rop/internal/config"
+	"github.com/marianozunino/rop/pkg/rop"
+)
+
+// hookOptions returns the runner options running the hooks of the configuration file that
+// apply to the context.
+func hookOptions(kubeContext string) ([]rop.Option, error) {
+	ropConfig, err := ropconfig.Load()
+	if err != nil {
+		return nil, err
+	}
+	return []rop.Option{rop.WithHooks(configHooks(ropConfig, kubeContext)...)}, nil
+}
+
+// configHooks returns the hooks of the configuration file that apply to the context.
+func configHooks(ropConfig *ropconfig.Config, kubeContext string) []rop.Hook {
+	var hooks []rop.Hook
+	for _, hook := range ropConfig.HooksFor(kubeContext) {
+		hooks = append(hooks, rop.Hook{Stage: hook.Stage, Command: hook.Command, Remote: hook.Remote})
+	}
+	return hooks
+}
@@ -0,0 +1,73 @@
+/*
+Copyright © 2024 Mariano Zunino <marianoz@posteo.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/marianozunino/rop/internal/state"
+	"github.com/marianozunino/rop/internal/ui"
+	"github.com/rs/zerolog/log"
+)
+
+// lastTargetState is the state document holding the last interactively chosen target.
+const lastTargetState = "last-target"
+
+func needsTargetPicker(cfg *config) bool {
+	return cfg.kubeContext == "" || cfg.filePath == "" || (cfg.podName == "" && cfg.cloneRef == "")
+}
+
+// pickMissingTarget prompts for the target fields that weren't given as flags, using the
+// previous choices as defaults.
+func pickMissingTarget(cfg *config) error {
+	if !ui.IsInteractive() {
+		return fmt.Errorf("context, file and pod (or --clone) are required when stdin is not a terminal")
+	}
+
+	var previous ui.Target
+	if err := state.Load(lastTargetState, &previous); err != nil {
+		log.Debug().Err(err).Msg("Ignoring previous target")
+	}
+
+	target, err := ui.RunTargetPicker(ui.Target{
+		Context:   cfg.kubeContext,
+		Namespace: cfg.namespace,
+		Pod:       cfg.podName,
+		Container: cfg.containerName,
+		File:      cfg.filePath,
+	}, previous, cfg.cloneRef != "")
+	if err != nil {
+		return err
+	}
+
+	cfg.kubeContext = target.Context
+	cfg.namespace = target.Namespace
+	cfg.podName = target.Pod
+	cfg.containerName = target.Container
+	cfg.filePath = target.File
+
+	if err := state.Save(lastTargetState, target); err != nil {
+		log.Debug().Err(err).Msg("Failed to remember target")
+	}
+	return nil
+}
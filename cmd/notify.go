@@ -0,0 +1,118 @@
+/*
+Copyright © 2024 Mariano Zunino <marianoz@posteo.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package cmd
+
+import (
+	"cmp"
+	"context"
+	"os/user"
+	"time"
+
+	ropconfig "github.com/marianozunino/rop/internal/config"
+	"github.com/marianozunino/rop/internal/notify"
+	"github.com/marianozunino/rop/pkg/rop"
+)
+
+// outputTailSize is how much of the output of a run notifications carry.
+const outputTailSize = 2048
+
+// currentUser returns the name of the local user, for the audit log and notifications.
+func currentUser() string {
+	current, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return current.Username
+}
+
+// newNotifier returns a notifier for the webhooks of the configuration file that apply to
+// the context, or nil when there are none.
+func newNotifier(kubeContext string) (*notify.Notifier, error) {
+	ropConfig, err := ropconfig.Load()
+	if err != nil {
+		return nil, err
+	}
+	return configNotifier(ropConfig, kubeContext), nil
+}
+
+func configNotifier(ropConfig *ropconfig.Config, kubeContext string) *notify.Notifier {
+	webhooks := ropConfig.WebhooksFor(kubeContext)
+	if len(webhooks) == 0 {
+		return nil
+	}
+
+	notifier := &notify.Notifier{}
+	for _, webhook := range webhooks {
+		notifier.Webhooks = append(notifier.Webhooks, notify.Webhook{URL: webhook.URL, Format: webhook.Format})
+	}
+	return notifier
+}
+
+// tailEvents returns an event handler keeping the output of the run in tail, before passing
+// events on to next, which may be nil.
+func tailEvents(tail *notify.Tail, next func(rop.Event)) func(rop.Event) {
+	return func(event rop.Event) {
+		if event.Type == rop.EventStdout || event.Type == rop.EventStderr {
+			tail.Write([]byte(event.Data))
+		}
+		if next != nil {
+			next(event)
+		}
+	}
+}
+
+// notifyRun posts a run of file to the webhooks of the notifier, if any. The result is nil
+// when the run failed before the file ran. Notifications never fail the run.
+func notifyRun(ctx context.Context, notifier *notify.Notifier, kubeContext, file string, target rop.Target, result *rop.Result, err error, output string) {
+	if notifier == nil {
+		return
+	}
+
+	notification := notify.Notification{
+		Time:      time.Now().UTC(),
+		User:      currentUser(),
+		Context:   kubeContext,
+		Namespace: target.Namespace,
+		Pod:       cmp.Or(target.Pod, target.Clone),
+		Container: target.Container,
+		File:      file,
+		Output:    output,
+	}
+	if result != nil {
+		notification.Namespace = result.Namespace
+		notification.Pod = result.Pod
+		notification.Container = result.Container
+		notification.SHA256 = result.FileSHA256
+		notification.Command = result.Command
+		notification.TimedOut = result.TimedOut
+		notification.DurationMS = result.Duration.Milliseconds()
+		if len(result.Command) > 0 {
+			notification.ExitCode = &result.ExitCode
+		}
+	}
+	if err != nil {
+		notification.Error = err.Error()
+	}
+
+	notifier.Notify(ctx, notification)
+}
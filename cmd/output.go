@@ -0,0 +1,113 @@
+/*
+Copyright © 2024 Mariano Zunino <marianoz@posteo.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/marianozunino/rop/pkg/rop"
+	"github.com/rs/zerolog/log"
+)
+
+// Output formats.
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// jsonOutput writes one JSON object per line. It is safe for concurrent use, since output
+// events arrive from the stdout and stderr streams at the same time.
+type jsonOutput struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+func newJSONOutput(w io.Writer) *jsonOutput {
+	return &jsonOutput{encoder: json.NewEncoder(w)}
+}
+
+func (o *jsonOutput) write(v any) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.encoder.Encode(v); err != nil {
+		log.Debug().Err(err).Msg("Failed to write JSON output")
+	}
+}
+
+func (o *jsonOutput) event(event rop.Event) {
+	o.write(event)
+}
+
+func (o *jsonOutput) plan(plan rop.Plan, protected bool) {
+	o.write(struct {
+		Type      string    `json:"type"`
+		Time      time.Time `json:"time"`
+		Plan      rop.Plan  `json:"plan"`
+		Protected bool      `json:"protected"`
+	}{"plan", time.Now(), plan, protected})
+}
+
+// summary is the last object written in JSON mode, for successful and failed runs alike.
+type summary struct {
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	Namespace  string    `json:"namespace,omitempty"`
+	Pod        string    `json:"pod,omitempty"`
+	Container  string    `json:"container,omitempty"`
+	Command    []string  `json:"command,omitempty"`
+	FileSHA256 string    `json:"file_sha256,omitempty"`
+	Signer     string    `json:"signer,omitempty"`
+	ExitCode   int       `json:"exit_code"`
+	TimedOut   bool      `json:"timed_out"`
+	DurationMS int64     `json:"duration_ms"`
+	Redactions int       `json:"redactions"`
+	// UnappliedLimits are the resource limits the container couldn't apply.
+	UnappliedLimits []string `json:"unapplied_limits,omitempty"`
+	Success         bool     `json:"success"`
+	Error           string   `json:"error,omitempty"`
+}
+
+func (o *jsonOutput) summary(result *rop.Result, err error) {
+	s := summary{Type: "summary", Time: time.Now()}
+	if result != nil {
+		s.Namespace = result.Namespace
+		s.Pod = result.Pod
+		s.Container = result.Container
+		s.Command = result.Command
+		s.FileSHA256 = result.FileSHA256
+		s.Signer = result.Signer
+		s.ExitCode = result.ExitCode
+		s.TimedOut = result.TimedOut
+		s.DurationMS = result.Duration.Milliseconds()
+		s.Redactions = result.Redactions
+		s.UnappliedLimits = result.UnappliedLimits
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	s.Success = err == nil && s.ExitCode == 0
+	o.write(s)
+}
@@ -0,0 +1,102 @@
+/*
+Copyright © 2024 Mariano Zunino <marianoz@posteo.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/marianozunino/rop/internal/k8s"
+	"github.com/spf13/cobra"
+)
+
+// kubectlCompat is set when rop runs as the kubectl plugin, "kubectl rop", or with
+// ROP_KUBECTL_COMPAT=1. Flags then follow kubectl: -c is the container instead of the
+// context, and the pod can be given as the first argument.
+var kubectlCompat = isKubectlPlugin(os.Args[0])
+
+func isKubectlPlugin(binary string) bool {
+	if os.Getenv("ROP_KUBECTL_COMPAT") == "1" {
+		return true
+	}
+	name := strings.TrimSuffix(filepath.Base(binary), ".exe")
+	return name == "kubectl-rop"
+}
+
+// contextShorthand and containerShorthand resolve the collision of rop's -c (context)
+// with kubectl's -c (container).
+func contextShorthand() string {
+	if kubectlCompat {
+		return ""
+	}
+	return "c"
+}
+
+func containerShorthand() string {
+	if kubectlCompat {
+		return "c"
+	}
+	return ""
+}
+
+// applyPositionalArgs takes the arguments of the file from the ones after "--" and, as
+// kubectl plugin, the pod from the first argument, as in "kubectl rop POD -f FILE -- ARGS".
+func applyPositionalArgs(cmd *cobra.Command, cfg *config, args []string) error {
+	positional, fileArgs := splitArgsAtDash(cmd, args)
+
+	if len(positional) == 1 {
+		switch {
+		case cfg.podName != "" && cfg.podName != positional[0]:
+			return fmt.Errorf("the pod is given both as argument (%s) and with --pod (%s)", positional[0], cfg.podName)
+		case cfg.cloneRef != "":
+			return fmt.Errorf("a pod can't be given together with --clone")
+		}
+		cfg.podName = positional[0]
+	}
+
+	return setFileArgs(cfg, fileArgs)
+}
+
+// defaultKubectlContext uses the current context of the kubeconfig when none is given to
+// the kubectl plugin, as kubectl does.
+func defaultKubectlContext(cfg *config) error {
+	if !kubectlCompat || cfg.kubeContext != "" {
+		return nil
+	}
+	current, err := k8s.GetCurrentContext()
+	if err != nil {
+		return err
+	}
+	cfg.kubeContext = current
+	return nil
+}
+
+// podArgCompletion completes the positional pod with the running pods of the namespace.
+func podArgCompletion(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 || cmd.ArgsLenAtDash() >= 0 {
+		return nil, cobra.ShellCompDirectiveDefault
+	}
+	return podCompletion(cmd, args, toComplete)
+}
@@ -0,0 +1,80 @@
+/*
+Copyright © 2024 Mariano Zunino <marianoz@posteo.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package cmd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/marianozunino/rop/internal/k8s"
+)
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+current-context: staging
+clusters:
+- name: staging
+  cluster:
+    server: https://127.0.0.1:6443
+contexts:
+- name: staging
+  context:
+    cluster: staging
+`
+
+func TestKubectlPluginInvocation(t *testing.T) {
+	kubeconfig := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(kubeconfig, []byte(testKubeconfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	compat, previous := kubectlCompat, k8s.Kubeconfig
+	kubectlCompat = true
+	t.Cleanup(func() { kubectlCompat, k8s.Kubeconfig = compat, previous })
+
+	cfg := &config{}
+	cmd := newRootCmd(cfg)
+	args := []string{"--kubeconfig", kubeconfig, "api-7d9f", "-n", "payments", "-f", "./check.sh", "--", "--verbose", "--limit=10"}
+	if err := cmd.ParseFlags(args); err != nil {
+		t.Fatalf("ParseFlags failed: %v", err)
+	}
+	if err := cmd.ValidateArgs(cmd.Flags().Args()); err != nil {
+		t.Fatalf("invalid arguments: %v", err)
+	}
+	if err := applyPositionalArgs(cmd, cfg, cmd.Flags().Args()); err != nil {
+		t.Fatalf("applyPositionalArgs failed: %v", err)
+	}
+
+	if _, err := resolveConfig(context.Background(), cfg); err != nil {
+		t.Fatalf("resolveConfig failed: %v", err)
+	}
+	if cfg.kubeContext != "staging" || cfg.namespace != "payments" || cfg.podName != "api-7d9f" || cfg.filePath != "./check.sh" {
+		t.Errorf("unexpected target: %+v", cfg)
+	}
+	if !slices.Equal(cfg.fileArgs, []string{"--verbose", "--limit=10"}) {
+		t.Errorf("file arguments = %q", cfg.fileArgs)
+	}
+}
@@ -0,0 +1,56 @@
+/*
+Copyright © 2024 Mariano Zunino <marianoz@posteo.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	ropconfig "github.com/marianozunino/rop/internal/config"
+	"github.com/marianozunino/rop/pkg/rop"
+)
+
+// redactionOptions returns the runner options redacting secrets from the output, with the
+// patterns of the configuration file, unless redaction is disabled.
+func redactionOptions(disabled bool) ([]rop.Option, error) {
+	if disabled {
+		return nil, nil
+	}
+
+	ropConfig, err := ropconfig.Load()
+	if err != nil {
+		return nil, err
+	}
+	patterns, err := ropConfig.RedactRegexps()
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	return []rop.Option{rop.WithRedaction(rop.Redaction{Patterns: patterns})}, nil
+}
+
+// reportRedactions tells how many secrets were redacted from the output of the file.
+func reportRedactions(result *rop.Result) {
+	if result != nil && result.Redactions > 0 {
+		fmt.Fprintf(os.Stderr, "redacted %d secret(s) from the output\n", result.Redactions)
+	}
+}
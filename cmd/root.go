@@ -24,29 +24,67 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"github.com/marianozunino/rop/internal/app"
+	ropconfig "github.com/marianozunino/rop/internal/config"
 	"github.com/marianozunino/rop/internal/k8s"
 	"github.com/marianozunino/rop/internal/logger"
+	"github.com/marianozunino/rop/internal/telemetry"
+	"github.com/marianozunino/rop/internal/ui"
+	"github.com/marianozunino/rop/pkg/rop"
+	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/client-go/rest"
 )
 
 type config struct {
 	kubeContext   string
 	filePath      string
 	podName       string
+	cloneRef      string
+	keepClone     bool
+	cloneInit     bool
 	containerName string
 	noConfirm     bool
 	fileType      string
 	fileArgs      []string
+	env           []string
+	showPlan      bool
+	output        string
+	timings       bool
+	watchFile     bool
 	destPath      string
+	asUser        string
+	nice          int
+	ionice        string
+	maxMemory     string
+	maxCPUTime    time.Duration
+	signature     string
+	noRedact      bool
+	approved      string
 	runner        string
 	namespace     string
 	verbose       bool
+
+	timeout        time.Duration
+	copyTimeout    time.Duration
+	connectTimeout time.Duration
 }
 
+// errPlanShown stops a run after --show-plan printed the plan.
+var errPlanShown = errors.New("plan shown")
+
+// exitCodeTimeout matches the exit code of coreutils' timeout(1).
+const exitCodeTimeout = 124
+
 var logo = `
  ______     ______     ______
 /\  == \   /\  __ \   /\  == \
@@ -55,42 +93,122 @@ var logo = `
   \/_/ /_/   \/_____/   \/_/     ` + VersionFromBuild()
 
 func NewRootCmd() *cobra.Command {
-	cfg := &config{}
+	return newRootCmd(&config{})
+}
 
+// newRootCmd returns the root command, parsing its flags into cfg.
+func newRootCmd(cfg *config) *cobra.Command {
 	rootCmd := &cobra.Command{
 		Use:   "rop",
 		Short: "Run a script or binary on a Kubernetes pod",
 		Long: logo + `
 
 Run on Pod (ROP) is a tool to execute scripts or binaries on Kubernetes pods.
-It simplifies the process of running files directly in your Kubernetes environment.`,
+It simplifies the process of running files directly in your Kubernetes environment.
+
+When the context, pod or file flags are omitted and stdin is a terminal, rop
+prompts for them interactively, remembering previous choices as defaults.`,
+		Example: `rop -c staging -p api -f ./check.sh -- --verbose --config=/etc/x`,
+		Args:    argsBeforeDash(cobra.NoArgs),
 		Run: func(cmd *cobra.Command, args []string) {
-			logger.ConfigureLogger(cfg.verbose)
+			if err := applyPositionalArgs(cmd, cfg, args); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			if cfg.output == outputJSON {
+				logger.ConfigureJSONLogger(cfg.verbose)
+			} else {
+				logger.ConfigureLogger(cfg.verbose)
+			}
 			runRop(cmd.Context(), cfg)
 		},
 	}
 
 	addFlags(rootCmd, cfg)
+	rootCmd.PersistentFlags().StringVar(&k8s.Kubeconfig, "kubeconfig", "", "Path to the kubeconfig file (defaults to $KUBECONFIG or ~/.kube/config)")
+
+	if kubectlCompat {
+		rootCmd.Use = "rop [POD] [-- ARGS...]"
+		rootCmd.Annotations = map[string]string{cobra.CommandDisplayNameAnnotation: "kubectl rop"}
+		rootCmd.Example = `kubectl rop api-7d9f -n payments -f ./check.sh -- --verbose
+kubectl rop api-7d9f --context staging -c sidecar -f ./dump.sh`
+		rootCmd.Args = argsBeforeDash(cobra.MaximumNArgs(1))
+		rootCmd.ValidArgsFunction = podArgCompletion
+	}
 
 	return rootCmd
 }
 
 func addFlags(cmd *cobra.Command, cfg *config) {
-	cmd.Flags().StringVarP(&cfg.kubeContext, "context", "c", "", "Kubernetes context")
+	addRunFlags(cmd, cfg)
+
+	cmd.Flags().BoolVar(&cfg.showPlan, "show-plan", false, "Print the execution plan and exit without running anything")
+	cmd.Flags().BoolVar(&cfg.timings, "timings", false, "Print how long each phase of the run took")
+	cmd.Flags().StringVar(&cfg.approved, "approved", "", "Run the request with this ID approved by 'rop approve', taking the target, arguments and settings from it")
+	cmd.Flags().BoolVar(&cfg.watchFile, "watch-file", false, "Run again on the same pod whenever the file is saved, interrupting a run still going")
+	cmd.Flags().StringVarP(&cfg.output, "output", "o", outputText, "Output format: 'text', or 'json' for NDJSON events on stdout without interactive prompts")
+
+	cmd.RegisterFlagCompletionFunc("output", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{outputText, outputJSON}, cobra.ShellCompDirectiveNoFileComp
+	})
+}
+
+// argsBeforeDash applies validate to the arguments before "--". The ones after it are the
+// arguments of the file.
+func argsBeforeDash(validate cobra.PositionalArgs) cobra.PositionalArgs {
+	return func(cmd *cobra.Command, args []string) error {
+		positional, _ := splitArgsAtDash(cmd, args)
+		return validate(cmd, positional)
+	}
+}
+
+func splitArgsAtDash(cmd *cobra.Command, args []string) (positional, fileArgs []string) {
+	if dash := cmd.ArgsLenAtDash(); dash >= 0 {
+		return args[:dash], args[dash:]
+	}
+	return args, nil
+}
+
+// setFileArgs uses the arguments given after "--" as the arguments of the file. They can't
+// be combined with --args.
+func setFileArgs(cfg *config, fileArgs []string) error {
+	if len(fileArgs) == 0 {
+		return nil
+	}
+	if len(cfg.fileArgs) > 0 {
+		return fmt.Errorf("file arguments are given both after '--' and with --args, use only one")
+	}
+	cfg.fileArgs = fileArgs
+	return nil
+}
+
+// addRunFlags adds the flags describing the target and the file, shared by the commands
+// that execute files.
+func addRunFlags(cmd *cobra.Command, cfg *config) {
+	cmd.Flags().StringVarP(&cfg.kubeContext, "context", contextShorthand(), "", "Kubernetes context")
 	cmd.Flags().StringVarP(&cfg.namespace, "namespace", "n", "", "Kubernetes namespace")
 	cmd.Flags().StringVarP(&cfg.podName, "pod", "p", "", "The target pod name")
-	cmd.Flags().StringVar(&cfg.containerName, "container", "", "The container name (optional for single-container pods)")
+	cmd.Flags().StringVar(&cfg.cloneRef, "clone", "", "Run on a temporary pod cloned from a workload (e.g. 'deploy/api')")
+	cmd.Flags().BoolVar(&cfg.keepClone, "keep", false, "Keep the cloned pod after execution")
+	cmd.Flags().BoolVar(&cfg.cloneInit, "clone-init", false, "Also run the init containers that aren't sidecars in the cloned pod")
+	cmd.Flags().StringVarP(&cfg.containerName, "container", containerShorthand(), "", "The container name (optional for single-container pods)")
 	cmd.Flags().StringVarP(&cfg.filePath, "file", "f", "", "The file path to execute")
 	cmd.Flags().StringArrayVarP(&cfg.fileArgs, "args", "a", []string{}, "File arguments")
-	cmd.Flags().StringVarP(&cfg.destPath, "dest-path", "d", "/tmp", "Destination path for the script or binary")
+	cmd.Flags().StringArrayVarP(&cfg.env, "env", "e", []string{}, "Environment variables for the command (KEY=VALUE)")
+	cmd.Flags().StringVarP(&cfg.destPath, "dest-path", "d", "", "Destination path for the script or binary (default /tmp, or a writable directory of the container)")
+	cmd.Flags().StringVar(&cfg.signature, "signature", "", "Minisign signature of the file to verify before running it (default <file>.minisig when it exists)")
+	cmd.Flags().BoolVar(&cfg.noRedact, "no-redact", false, "Don't redact secrets from the output")
+	cmd.Flags().StringVar(&cfg.asUser, "as-user", "", "Run as this numeric uid, switching with setpriv, runuser or su in the container")
+	addLimitFlags(cmd.Flags(), cfg)
 	cmd.Flags().StringVarP(&cfg.runner, "runner", "r", "", "Custom runner for the script (e.g., 'python', 'node')")
 	cmd.Flags().StringVarP(&cfg.fileType, "type", "t", "auto", "File type: 'script', 'binary', or 'auto'")
+	cmd.Flags().DurationVar(&cfg.timeout, "timeout", 0, "Maximum execution time before the remote process is killed (e.g. '5m', 0 means no timeout)")
+	cmd.Flags().DurationVar(&cfg.copyTimeout, "copy-timeout", 0, "Maximum time to copy the file to the pod (0 means no timeout)")
+	cmd.Flags().DurationVar(&cfg.connectTimeout, "connect-timeout", 0, "Maximum time for API requests and connecting to the cluster (0 means no timeout)")
 	cmd.Flags().BoolVar(&cfg.noConfirm, "no-confirm", false, "Skip confirmation prompt")
 	cmd.Flags().BoolVarP(&cfg.verbose, "verbose", "v", false, "Verbose output")
 
-	cmd.MarkFlagRequired("context")
-	cmd.MarkFlagRequired("file")
-	cmd.MarkFlagRequired("pod")
+	cmd.MarkFlagsMutuallyExclusive("pod", "clone")
 
 	cmd.RegisterFlagCompletionFunc("type", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 		return []string{"auto", "script", "binary"}, cobra.ShellCompDirectiveNoFileComp
@@ -98,59 +216,285 @@ func addFlags(cmd *cobra.Command, cfg *config) {
 
 	cmd.RegisterFlagCompletionFunc("context", contextCompletion)
 	cmd.RegisterFlagCompletionFunc("namespace", namespaceCompletion)
+	cmd.RegisterFlagCompletionFunc("pod", podCompletion)
+	cmd.RegisterFlagCompletionFunc("clone", cloneCompletion)
+	cmd.RegisterFlagCompletionFunc("container", containerCompletion)
+	cmd.RegisterFlagCompletionFunc("runner", runnerCompletion)
 
 	cmd.Flags().SortFlags = false
 }
 
-func contextCompletion(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
-	contexts, err := k8s.GetAvailableContexts()
+func runRop(ctx context.Context, cfg *config) {
+	// Interrupting a run still kills the remote process, removes the file and deletes the
+	// cloned pod.
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var output *jsonOutput
+	if cfg.output == outputJSON {
+		output = newJSONOutput(os.Stdout)
+	}
+
+	approved, err := resolveConfig(ctx, cfg)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error getting contexts: %v\n", err)
-		return nil, cobra.ShellCompDirectiveError
+		// Scripts reading the JSON output get a summary even when nothing ran.
+		if output != nil {
+			output.summary(nil, err)
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-	return contexts, cobra.ShellCompDirectiveNoFileComp
-}
 
-func namespaceCompletion(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
-	context, err := cmd.Flags().GetString("context")
+	if cfg.watchFile {
+		if err := runWatchFile(ctx, cfg); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var timings *telemetry.Timings
+	if cfg.timings {
+		timings = &telemetry.Timings{}
+	}
+	tracerProvider, err := telemetry.NewTracerProvider(ctx, VersionFromBuild(), timings)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error getting context flag: %v\n", err)
-		return nil, cobra.ShellCompDirectiveError
+		log.Warn().Err(err).Msg("Tracing disabled")
 	}
 
-	namespaces, err := k8s.GetAvailableNamespaces(context)
+	result, err := runRequest(ctx, cfg, approved, output, tracerProvider)
+	if tracerProvider != nil {
+		shutdownTracing(tracerProvider)
+	}
+	if timings != nil {
+		timings.Write(os.Stderr)
+	}
+	if errors.Is(err, errPlanShown) {
+		return
+	}
+	if output != nil {
+		output.summary(result, err)
+	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error getting namespaces: %v\n", err)
-		return nil, cobra.ShellCompDirectiveError
+		fmt.Fprintln(os.Stderr, err)
+		if errors.Is(err, rop.ErrTimeout) {
+			os.Exit(exitCodeTimeout)
+		}
+		os.Exit(1)
+	}
+
+	if output == nil {
+		reportRedactions(result)
+	}
+	if result.ExitCode != 0 {
+		fmt.Fprintf(os.Stderr, "command terminated with exit code %d\n", result.ExitCode)
+		os.Exit(1)
 	}
-	return namespaces, cobra.ShellCompDirectiveNoFileComp
 }
 
-func runRop(ctx context.Context, cfg *config) {
+// resolveConfig completes the command line before a run: as kubectl plugin the context
+// defaults to the current one, an approved request fills in its target and arguments, and
+// the missing target fields are prompted for.
+func resolveConfig(ctx context.Context, cfg *config) (*approvedRun, error) {
+	if err := defaultKubectlContext(cfg); err != nil {
+		return nil, err
+	}
+
+	var approved *approvedRun
+	if cfg.approved != "" {
+		var err error
+		if approved, err = loadApproval(ctx, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.output != outputJSON && needsTargetPicker(cfg) {
+		if err := pickMissingTarget(cfg); err != nil {
+			return nil, err
+		}
+	}
+
 	if err := validateConfig(cfg); err != nil {
-		fmt.Errorf("invalid config: %w", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("invalid config: %w", err)
 	}
+	return approved, nil
+}
 
-	appInstance := app.NewApp(
-		app.WithKubeContext(cfg.kubeContext),
-		app.WithNamespace(cfg.namespace),
-		app.WithFilePath(cfg.filePath),
-		app.WithPodName(cfg.podName),
-		app.WithContainerName(cfg.containerName),
-		app.WithNoConfirm(cfg.noConfirm),
-		app.WithFileType(cfg.fileType),
-		app.WithArgs(cfg.fileArgs),
-		app.WithDestPath(cfg.destPath),
-		app.WithRunner(cfg.runner),
-	)
-
-	if err := appInstance.Run(ctx); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+// runRequest maps the command line onto a rop.Runner and runs it. With a JSON output, the
+// output of the command is only reported as events and nothing is prompted for. Runs with
+// an approval are checked against it before they are confirmed.
+func runRequest(ctx context.Context, cfg *config, approved *approvedRun, output *jsonOutput, tracerProvider *sdktrace.TracerProvider) (*rop.Result, error) {
+	if approved == nil {
+		if err := checkApprovalPolicy(cfg.kubeContext); err != nil {
+			return nil, err
+		}
+	}
+
+	restConfig, req, file, err := newRequest(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var onEvent func(rop.Event)
+	if output != nil {
+		onEvent = output.event
+	}
+	setup, err := newRunSetup(restConfig, cfg.kubeContext, cfg.noRedact, onEvent)
+	if err != nil {
+		return nil, err
+	}
+	protected := setup.protected
+
+	opts := append(setup.opts, rop.WithStdin(os.Stdin))
+	if tracerProvider != nil {
+		opts = append(opts, rop.WithTracerProvider(tracerProvider))
+	}
+	if output == nil {
+		opts = append(opts,
+			rop.WithStdout(os.Stdout),
+			rop.WithStderr(os.Stderr),
+			rop.WithContainerSelector(ui.RunContainerSelection),
+		)
+	}
+
+	var confirm func(plan rop.Plan) error
+	switch {
+	case cfg.showPlan && output != nil:
+		confirm = func(plan rop.Plan) error {
+			output.plan(plan, protected)
+			return errPlanShown
+		}
+	case cfg.showPlan:
+		confirm = func(plan rop.Plan) error {
+			fmt.Println(ui.RenderPlan(plan, protected))
+			return errPlanShown
+		}
+	case !cfg.noConfirm:
+		confirm = func(plan rop.Plan) error {
+			return ui.ConfirmAction(plan, protected)
+		}
+	}
+	if approved != nil {
+		confirm = approved.confirm(ctx, confirm)
 	}
+	if confirm != nil {
+		opts = append(opts, rop.WithConfirm(confirm))
+	}
+
+	runner, err := rop.NewRunner(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := runner.Run(ctx, req)
+	if !errors.Is(err, errPlanShown) {
+		setup.record(ctx, cfg.filePath, req.Target, result, err)
+	}
+	return result, err
 }
 
+// newRequest loads the kubeconfig and opens the file to execute. The caller closes the file.
+func newRequest(cfg *config) (*rest.Config, rop.Request, *os.File, error) {
+	restConfig, namespace, err := k8s.LoadConfig(cfg.kubeContext, cfg.namespace, cfg.connectTimeout)
+	if err != nil {
+		return nil, rop.Request{}, nil, fmt.Errorf("failed to load kubeconfig: %w", err)
+	}
+
+	file, err := os.Open(cfg.filePath)
+	if os.IsNotExist(err) {
+		return nil, rop.Request{}, nil, fmt.Errorf("input file not found: %s", cfg.filePath)
+	}
+	if err != nil {
+		return nil, rop.Request{}, nil, fmt.Errorf("error opening file: %w", err)
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, rop.Request{}, nil, fmt.Errorf("error getting file info: %w", err)
+	}
+	log.Debug().Msgf("Input file '%s' exists, size: %d bytes", cfg.filePath, fileInfo.Size())
+
+	limits, err := resourceLimits(cfg)
+	if err != nil {
+		file.Close()
+		return nil, rop.Request{}, nil, err
+	}
+
+	req := rop.Request{
+		Target: rop.Target{
+			Namespace: namespace,
+			Pod:       cfg.podName,
+			Clone:     cfg.cloneRef,
+			KeepClone: cfg.keepClone,
+			CloneInit: cfg.cloneInit,
+			Container: cfg.containerName,
+		},
+		File: rop.File{
+			Name:   cfg.filePath,
+			Reader: file,
+			Mode:   fileInfo.Mode(),
+		},
+		Type:        cfg.fileType,
+		Args:        cfg.fileArgs,
+		Env:         cfg.env,
+		DestPath:    cfg.destPath,
+		AsUser:      cfg.asUser,
+		Limits:      limits,
+		Interpreter: cfg.runner,
+		Timeout:     cfg.timeout,
+		CopyTimeout: cfg.copyTimeout,
+	}
+	if err := loadSignature(cfg, &req); err != nil {
+		file.Close()
+		return nil, rop.Request{}, nil, err
+	}
+	return restConfig, req, file, nil
+}
+
+// addLimitFlags adds the flags bounding the resources of the executed file.
+func addLimitFlags(flags *pflag.FlagSet, cfg *config) {
+	flags.IntVar(&cfg.nice, "nice", 0, "Run with this niceness, from -20 to 19 (negative values need CAP_SYS_NICE)")
+	flags.StringVar(&cfg.ionice, "ionice", "", "I/O scheduling class: 'idle', 'best-effort' or 'realtime', optionally with a level (e.g. 'best-effort:7')")
+	flags.StringVar(&cfg.maxMemory, "max-memory", "", "Maximum virtual memory of the process (e.g. '512Mi')")
+	flags.DurationVar(&cfg.maxCPUTime, "max-cpu-time", 0, "Maximum CPU time of the process, after which it is killed (e.g. '30s')")
+}
+
+// resourceLimits returns the limits given with --nice, --ionice, --max-memory and
+// --max-cpu-time.
+func resourceLimits(cfg *config) (rop.ResourceLimits, error) {
+	limits := rop.ResourceLimits{Nice: cfg.nice, IONice: cfg.ionice, MaxCPUTime: cfg.maxCPUTime}
+	if cfg.maxMemory != "" {
+		quantity, err := resource.ParseQuantity(cfg.maxMemory)
+		if err != nil {
+			return rop.ResourceLimits{}, fmt.Errorf("invalid --max-memory %q: %w", cfg.maxMemory, err)
+		}
+		limits.MaxMemory = quantity.Value()
+	}
+	return limits, nil
+}
+
+// isProtected reports whether the configuration file marks the context as protected.
+func isProtected(kubeContext string) (bool, error) {
+	ropConfig, err := ropconfig.Load()
+	if err != nil {
+		return false, err
+	}
+	return ropConfig.IsProtected(kubeContext), nil
+}
+
+// shutdownTracing flushes pending spans, giving the exporter a few seconds at most.
+func shutdownTracing(tracerProvider *sdktrace.TracerProvider) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		log.Warn().Err(err).Msg("Failed to export traces")
+	}
+}
+
+// validateConfig checks the flags that don't map onto a rop.Request. Everything else is
+// validated by the runner.
 func validateConfig(cfg *config) error {
 	if cfg.kubeContext == "" {
 		return fmt.Errorf("kubernetes context is required")
@@ -158,11 +502,17 @@ func validateConfig(cfg *config) error {
 	if cfg.filePath == "" {
 		return fmt.Errorf("file path is required")
 	}
-	if cfg.podName == "" {
-		return fmt.Errorf("pod name is required")
+	if cfg.output != outputText && cfg.output != outputJSON {
+		return fmt.Errorf("invalid output format %q, expected 'text' or 'json'", cfg.output)
+	}
+	if cfg.watchFile && (cfg.output == outputJSON || cfg.showPlan || cfg.approved != "") {
+		return fmt.Errorf("--watch-file can't be combined with --output json, --show-plan or --approved")
+	}
+	if cfg.output == outputJSON && !cfg.noConfirm && !cfg.showPlan {
+		return fmt.Errorf("--output json can't prompt for confirmation, pass --no-confirm or --show-plan")
 	}
-	if cfg.fileType != "auto" && cfg.fileType != "script" && cfg.fileType != "binary" {
-		return fmt.Errorf("invalid file type: %s. Must be 'auto', 'script', or 'binary'", cfg.fileType)
+	if cfg.connectTimeout < 0 {
+		return fmt.Errorf("timeouts must not be negative")
 	}
 	return nil
 }
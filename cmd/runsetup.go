@@ -0,0 +1,100 @@
+/*
+Copyright © 2024 Mariano Zunino <marianoz@posteo.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package cmd
+
+import (
+	"context"
+
+	"github.com/marianozunino/rop/internal/notify"
+	"github.com/marianozunino/rop/pkg/rop"
+	"k8s.io/client-go/rest"
+)
+
+// runSetup is what the runs of a command share: the runner options built from the
+// configuration file, and the webhooks every run is posted to besides the audit log.
+type runSetup struct {
+	kubeContext string
+	protected   bool
+	opts        []rop.Option
+	notifier    *notify.Notifier
+	tail        *notify.Tail
+}
+
+// newRunSetup prepares runs in kubeContext with the trusted keys, redaction, hooks and
+// webhooks of the configuration file. onEvent, which may be nil, receives the events of
+// the runs.
+func newRunSetup(restConfig *rest.Config, kubeContext string, noRedact bool, onEvent func(rop.Event)) (*runSetup, error) {
+	protected, err := isProtected(kubeContext)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := trustedKeys()
+	if err != nil {
+		return nil, err
+	}
+	redaction, err := redactionOptions(noRedact)
+	if err != nil {
+		return nil, err
+	}
+	hooks, err := hookOptions(kubeContext)
+	if err != nil {
+		return nil, err
+	}
+	notifier, err := newNotifier(kubeContext)
+	if err != nil {
+		return nil, err
+	}
+
+	setup := &runSetup{
+		kubeContext: kubeContext,
+		protected:   protected,
+		notifier:    notifier,
+		tail:        notify.NewTail(outputTailSize),
+	}
+	setup.opts = append([]rop.Option{
+		rop.WithRESTConfig(restConfig),
+		rop.WithContextName(kubeContext),
+		rop.WithTrustedKeys(keys...),
+	}, append(redaction, hooks...)...)
+	if notifier != nil {
+		onEvent = tailEvents(setup.tail, onEvent)
+	}
+	if onEvent != nil {
+		setup.opts = append(setup.opts, rop.WithEvents(onEvent))
+	}
+	return setup, nil
+}
+
+// record writes a run of file to the audit log and posts it to the webhooks, then forgets
+// its output for the next run.
+func (s *runSetup) record(ctx context.Context, file string, target rop.Target, result *rop.Result, err error) {
+	recordRun(ctx, s.notifier, s.kubeContext, file, target, result, err, s.tail.String())
+	s.tail.Reset()
+}
+
+// recordRun writes a run of file to the audit log and posts it to the webhooks of the
+// notifier, if any.
+func recordRun(ctx context.Context, notifier *notify.Notifier, kubeContext, file string, target rop.Target, result *rop.Result, err error, output string) {
+	recordAudit(kubeContext, file, target, result, err)
+	notifyRun(ctx, notifier, kubeContext, file, target, result, err, output)
+}
@@ -0,0 +1,595 @@
+/*
+Copyright © 2024 Mariano Zunino <marianoz@posteo.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/marianozunino/rop/internal/k8s"
+	"github.com/marianozunino/rop/internal/logger"
+	"github.com/marianozunino/rop/internal/state"
+	"github.com/marianozunino/rop/internal/ui"
+	"github.com/marianozunino/rop/pkg/rop"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// sessionsState is the state document holding the sessions started on this machine, by ID.
+const sessionsState = "sessions"
+
+func NewSessionCmd() *cobra.Command {
+	sessionCmd := &cobra.Command{
+		Use:   "session",
+		Short: "Keep a working directory on a pod across several runs",
+		Long: `Sessions keep a working directory on a pod, so several files can be run one after
+another without copying and deleting them every time. Files are only copied again when
+they changed locally. Sessions are remembered on this machine until they are ended.`,
+		Example: `id=$(rop session start -c staging -p api)
+rop session run $id -f ./inspect.py
+rop session shell $id
+rop session end $id`,
+	}
+
+	sessionCmd.AddCommand(
+		newSessionStartCmd(),
+		newSessionRunCmd(),
+		newSessionShellCmd(),
+		newSessionEndCmd(),
+		newSessionListCmd(),
+		newSessionGCCmd(),
+	)
+	return sessionCmd
+}
+
+func newSessionStartCmd() *cobra.Command {
+	cfg := &config{}
+
+	startCmd := &cobra.Command{
+		Use:   "start",
+		Short: "Create a working directory on a pod and print the session ID",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			logger.ConfigureLogger(cfg.verbose)
+			session, err := startSession(cmd.Context(), cfg)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			fmt.Println(session.ID)
+		},
+	}
+
+	startCmd.Flags().StringVarP(&cfg.kubeContext, "context", contextShorthand(), "", "Kubernetes context")
+	startCmd.Flags().StringVarP(&cfg.namespace, "namespace", "n", "", "Kubernetes namespace")
+	startCmd.Flags().StringVarP(&cfg.podName, "pod", "p", "", "The target pod name")
+	startCmd.Flags().StringVarP(&cfg.containerName, "container", containerShorthand(), "", "The container name (optional for single-container pods)")
+	startCmd.Flags().StringVarP(&cfg.destPath, "dest-path", "d", "", "Directory the working directory of the session is created in (default /tmp, or a writable directory of the container)")
+	startCmd.Flags().DurationVar(&cfg.connectTimeout, "connect-timeout", 0, "Maximum time for API requests and connecting to the cluster (0 means no timeout)")
+	startCmd.Flags().BoolVarP(&cfg.verbose, "verbose", "v", false, "Verbose output")
+	startCmd.MarkFlagRequired("context")
+	startCmd.MarkFlagRequired("pod")
+	startCmd.RegisterFlagCompletionFunc("context", contextCompletion)
+	startCmd.RegisterFlagCompletionFunc("namespace", namespaceCompletion)
+	startCmd.RegisterFlagCompletionFunc("pod", podCompletion)
+	startCmd.RegisterFlagCompletionFunc("container", containerCompletion)
+	startCmd.Flags().SortFlags = false
+
+	return startCmd
+}
+
+func newSessionRunCmd() *cobra.Command {
+	cfg := &config{output: outputText}
+
+	runCmd := &cobra.Command{
+		Use:   "run <id> [-- ARGS...]",
+		Short: "Run a script or binary in the working directory of a session",
+		Args:  argsBeforeDash(cobra.ExactArgs(1)),
+		Run: func(cmd *cobra.Command, args []string) {
+			_, fileArgs := splitArgsAtDash(cmd, args)
+			if err := setFileArgs(cfg, fileArgs); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			logger.ConfigureLogger(cfg.verbose)
+			result, err := runInSession(cmd.Context(), args[0], cfg)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				if errors.Is(err, rop.ErrTimeout) {
+					os.Exit(exitCodeTimeout)
+				}
+				os.Exit(1)
+			}
+			reportRedactions(result)
+			if result.ExitCode != 0 {
+				fmt.Fprintf(os.Stderr, "command terminated with exit code %d\n", result.ExitCode)
+				os.Exit(1)
+			}
+		},
+	}
+
+	runCmd.Flags().StringVarP(&cfg.filePath, "file", "f", "", "The file path to execute")
+	runCmd.Flags().StringArrayVarP(&cfg.fileArgs, "args", "a", []string{}, "File arguments")
+	runCmd.Flags().StringArrayVarP(&cfg.env, "env", "e", []string{}, "Environment variables for the command (KEY=VALUE)")
+	runCmd.Flags().StringVarP(&cfg.runner, "runner", "r", "", "Custom runner for the script (e.g., 'python', 'node')")
+	runCmd.Flags().StringVar(&cfg.signature, "signature", "", "Minisign signature of the file to verify before running it (default <file>.minisig when it exists)")
+	runCmd.Flags().BoolVar(&cfg.noRedact, "no-redact", false, "Don't redact secrets from the output")
+	runCmd.Flags().StringVar(&cfg.asUser, "as-user", "", "Run as this numeric uid, switching with setpriv, runuser or su in the container")
+	addLimitFlags(runCmd.Flags(), cfg)
+	runCmd.Flags().StringVarP(&cfg.fileType, "type", "t", "auto", "File type: 'script', 'binary', or 'auto'")
+	runCmd.Flags().DurationVar(&cfg.timeout, "timeout", 0, "Maximum execution time before the remote process is killed (e.g. '5m', 0 means no timeout)")
+	runCmd.Flags().DurationVar(&cfg.copyTimeout, "copy-timeout", 0, "Maximum time to copy the file to the pod (0 means no timeout)")
+	runCmd.Flags().DurationVar(&cfg.connectTimeout, "connect-timeout", 0, "Maximum time for API requests and connecting to the cluster (0 means no timeout)")
+	runCmd.Flags().BoolVar(&cfg.noConfirm, "no-confirm", false, "Skip confirmation prompt")
+	runCmd.Flags().BoolVarP(&cfg.verbose, "verbose", "v", false, "Verbose output")
+	runCmd.MarkFlagRequired("file")
+	runCmd.RegisterFlagCompletionFunc("type", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"auto", "script", "binary"}, cobra.ShellCompDirectiveNoFileComp
+	})
+	runCmd.RegisterFlagCompletionFunc("runner", runnerCompletion)
+	runCmd.ValidArgsFunction = sessionCompletion
+	runCmd.Flags().SortFlags = false
+
+	return runCmd
+}
+
+func newSessionShellCmd() *cobra.Command {
+	cfg := &config{}
+
+	shellCmd := &cobra.Command{
+		Use:               "shell <id>",
+		Short:             "Open a shell in the working directory of a session",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: sessionCompletion,
+		Run: func(cmd *cobra.Command, args []string) {
+			logger.ConfigureLogger(cfg.verbose)
+			if err := sessionShell(cmd.Context(), args[0], cfg); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	shellCmd.Flags().DurationVar(&cfg.connectTimeout, "connect-timeout", 0, "Maximum time for API requests and connecting to the cluster (0 means no timeout)")
+	shellCmd.Flags().BoolVarP(&cfg.verbose, "verbose", "v", false, "Verbose output")
+
+	return shellCmd
+}
+
+func newSessionEndCmd() *cobra.Command {
+	cfg := &config{}
+
+	endCmd := &cobra.Command{
+		Use:               "end <id>",
+		Short:             "Remove the working directory of a session from its pod",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: sessionCompletion,
+		Run: func(cmd *cobra.Command, args []string) {
+			logger.ConfigureLogger(cfg.verbose)
+			if err := endSession(cmd.Context(), args[0], cfg); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	endCmd.Flags().DurationVar(&cfg.connectTimeout, "connect-timeout", 0, "Maximum time for API requests and connecting to the cluster (0 means no timeout)")
+	endCmd.Flags().BoolVarP(&cfg.verbose, "verbose", "v", false, "Verbose output")
+
+	return endCmd
+}
+
+func newSessionListCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List the sessions started on this machine",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			sessions, err := loadSessions()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tCONTEXT\tNAMESPACE\tPOD\tCONTAINER\tDIR\tLAST USED")
+			for _, session := range sortedSessions(sessions) {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", session.ID, session.Context, session.Namespace,
+					session.Pod, session.Container, session.Dir, session.LastUsed.Format(time.DateTime))
+			}
+			w.Flush()
+		},
+	}
+}
+
+func newSessionGCCmd() *cobra.Command {
+	cfg := &config{}
+	var maxIdle time.Duration
+
+	gcCmd := &cobra.Command{
+		Use:   "gc",
+		Short: "Forget sessions whose pod is gone and end idle ones",
+		Long: `Check every session started on this machine. Sessions whose pod or working directory
+no longer exist, e.g. after a rollout, are forgotten. With --max-idle, sessions unused
+for longer are ended and their working directory removed.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			logger.ConfigureLogger(cfg.verbose)
+			if err := gcSessions(cmd.Context(), cfg, maxIdle); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	gcCmd.Flags().DurationVar(&maxIdle, "max-idle", 0, "End sessions unused for longer than this (e.g. '24h', 0 keeps them)")
+	gcCmd.Flags().DurationVar(&cfg.connectTimeout, "connect-timeout", 0, "Maximum time for API requests and connecting to the cluster (0 means no timeout)")
+	gcCmd.Flags().BoolVarP(&cfg.verbose, "verbose", "v", false, "Verbose output")
+
+	return gcCmd
+}
+
+func startSession(ctx context.Context, cfg *config) (*rop.Session, error) {
+	// Sessions run files and shells at will, which approvals can't cover.
+	if err := checkApprovalPolicy(cfg.kubeContext); err != nil {
+		return nil, err
+	}
+
+	runner, namespace, err := newSessionRunner(cfg.kubeContext, cfg.namespace, cfg.connectTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := rop.NewSessionID()
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := runner.StartSession(ctx, id, rop.Target{
+		Namespace: namespace,
+		Pod:       cfg.podName,
+		Container: cfg.containerName,
+	}, cfg.destPath)
+	if err != nil {
+		return nil, err
+	}
+	session.Context = cfg.kubeContext
+
+	if err := saveSession(session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func runInSession(ctx context.Context, id string, cfg *config) (*rop.Result, error) {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	session, err := findSession(id)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.kubeContext = session.Context
+	cfg.namespace = session.Namespace
+	cfg.podName = session.Pod
+	if err := validateConfig(cfg); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	restConfig, req, file, err := newRequest(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	setup, err := newRunSetup(restConfig, session.Context, cfg.noRedact, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := append(setup.opts,
+		rop.WithStdin(os.Stdin),
+		rop.WithStdout(os.Stdout),
+		rop.WithStderr(os.Stderr),
+	)
+	if !cfg.noConfirm {
+		opts = append(opts, rop.WithConfirm(func(plan rop.Plan) error {
+			return ui.ConfirmAction(plan, setup.protected)
+		}))
+	}
+	runner, err := rop.NewRunner(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := runner.RunInSession(ctx, session, req)
+	setup.record(ctx, cfg.filePath, req.Target, result, err)
+	return result, updateSession(session, err)
+}
+
+func sessionShell(ctx context.Context, id string, cfg *config) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	session, err := findSession(id)
+	if err != nil {
+		return err
+	}
+
+	restConfig, _, err := k8s.LoadConfig(session.Context, session.Namespace, cfg.connectTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to load kubeconfig: %w", err)
+	}
+
+	opts := []rop.Option{
+		rop.WithRESTConfig(restConfig),
+		rop.WithContextName(session.Context),
+		rop.WithStdin(os.Stdin),
+		rop.WithStdout(os.Stdout),
+		rop.WithStderr(os.Stderr),
+	}
+
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		oldState, err := term.MakeRaw(fd)
+		if err != nil {
+			return fmt.Errorf("failed to set up the terminal: %w", err)
+		}
+		defer term.Restore(fd, oldState)
+
+		sizes := newTerminalSizeQueue(ctx, int(os.Stdout.Fd()))
+		opts = append(opts, rop.WithTerminal(sizes))
+	}
+
+	runner, err := rop.NewRunner(opts...)
+	if err != nil {
+		return err
+	}
+
+	return updateSession(session, runner.SessionShell(ctx, session))
+}
+
+func endSession(ctx context.Context, id string, cfg *config) error {
+	session, err := findSession(id)
+	if err != nil {
+		return err
+	}
+
+	runner, _, err := newSessionRunner(session.Context, session.Namespace, cfg.connectTimeout)
+	if err != nil {
+		return err
+	}
+
+	err = runner.EndSession(ctx, session)
+	if err != nil && !errors.Is(err, rop.ErrSessionGone) {
+		return err
+	}
+	return forgetSession(session.ID)
+}
+
+// gcSessions forgets the sessions that are gone and ends the ones idle for longer than
+// maxIdle, if set. Sessions that can't be checked, e.g. because their cluster is
+// unreachable, are kept.
+func gcSessions(ctx context.Context, cfg *config, maxIdle time.Duration) error {
+	sessions, err := loadSessions()
+	if err != nil {
+		return err
+	}
+
+	for _, session := range sortedSessions(sessions) {
+		runner, _, err := newSessionRunner(session.Context, session.Namespace, cfg.connectTimeout)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Skipping session %s", session.ID)
+			continue
+		}
+
+		idle := maxIdle > 0 && time.Since(session.LastUsed) > maxIdle
+		if idle {
+			err = runner.EndSession(ctx, session)
+		} else {
+			err = runner.CheckSession(ctx, session)
+		}
+
+		switch {
+		case errors.Is(err, rop.ErrSessionGone):
+			fmt.Printf("%s: gone, forgetting it\n", session.ID)
+		case err != nil:
+			log.Warn().Err(err).Msgf("Skipping session %s", session.ID)
+			continue
+		case idle:
+			fmt.Printf("%s: idle since %s, ended\n", session.ID, session.LastUsed.Format(time.DateTime))
+		default:
+			continue
+		}
+
+		if err := forgetSession(session.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newSessionRunner(kubeContext, namespace string, connectTimeout time.Duration) (*rop.Runner, string, error) {
+	restConfig, namespace, err := k8s.LoadConfig(kubeContext, namespace, connectTimeout)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to load kubeconfig: %w", err)
+	}
+
+	runner, err := rop.NewRunner(
+		rop.WithRESTConfig(restConfig),
+		rop.WithContextName(kubeContext),
+		rop.WithContainerSelector(ui.RunContainerSelection),
+	)
+	if err != nil {
+		return nil, "", err
+	}
+	return runner, namespace, nil
+}
+
+func loadSessions() (map[string]*rop.Session, error) {
+	sessions := map[string]*rop.Session{}
+	if err := state.Load(sessionsState, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func findSession(id string) (*rop.Session, error) {
+	sessions, err := loadSessions()
+	if err != nil {
+		return nil, err
+	}
+
+	session, ok := sessions[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown session %s, see 'rop session list'", id)
+	}
+	return session, nil
+}
+
+func saveSession(session *rop.Session) error {
+	sessions, err := loadSessions()
+	if err != nil {
+		return err
+	}
+
+	sessions[session.ID] = session
+	return state.Save(sessionsState, sessions)
+}
+
+func forgetSession(id string) error {
+	sessions, err := loadSessions()
+	if err != nil {
+		return err
+	}
+
+	delete(sessions, id)
+	return state.Save(sessionsState, sessions)
+}
+
+// updateSession stores the session after it was used, or forgets it when it turned out
+// to be gone. err is the error of using the session and is returned as is.
+func updateSession(session *rop.Session, err error) error {
+	if errors.Is(err, rop.ErrSessionGone) {
+		if forgetErr := forgetSession(session.ID); forgetErr != nil {
+			log.Debug().Err(forgetErr).Msg("Failed to forget session")
+		}
+		return fmt.Errorf("%w, start a new one with 'rop session start'", err)
+	}
+
+	if saveErr := saveSession(session); saveErr != nil {
+		log.Warn().Err(saveErr).Msg("Failed to store session")
+	}
+	return err
+}
+
+func sortedSessions(sessions map[string]*rop.Session) []*rop.Session {
+	sorted := make([]*rop.Session, 0, len(sessions))
+	for _, session := range sessions {
+		sorted = append(sorted, session)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Created.Before(sorted[j].Created)
+	})
+	return sorted
+}
+
+func sessionCompletion(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if cmd.ArgsLenAtDash() >= 0 {
+		// The arguments of the file, which are often paths.
+		return nil, cobra.ShellCompDirectiveDefault
+	}
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	sessions, err := loadSessions()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+
+	var completions []string
+	for _, session := range sortedSessions(sessions) {
+		completions = append(completions, fmt.Sprintf("%s\t%s/%s on %s", session.ID, session.Namespace, session.Pod, session.Context))
+	}
+	return completions, cobra.ShellCompDirectiveNoFileComp
+}
+
+// terminalSizeQueue reports the size of the local terminal when the shell starts and
+// whenever it is resized.
+type terminalSizeQueue struct {
+	sizes chan remotecommand.TerminalSize
+}
+
+func newTerminalSizeQueue(ctx context.Context, fd int) *terminalSizeQueue {
+	q := &terminalSizeQueue{sizes: make(chan remotecommand.TerminalSize, 1)}
+
+	resized := make(chan os.Signal, 1)
+	signal.Notify(resized, syscall.SIGWINCH)
+	resized <- syscall.SIGWINCH
+
+	go func() {
+		defer signal.Stop(resized)
+		defer close(q.sizes)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-resized:
+			}
+
+			width, height, err := term.GetSize(fd)
+			if err != nil {
+				continue
+			}
+			select {
+			case q.sizes <- remotecommand.TerminalSize{Width: uint16(width), Height: uint16(height)}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return q
+}
+
+func (q *terminalSizeQueue) Next() *remotecommand.TerminalSize {
+	size, ok := <-q.sizes
+	if !ok {
+		return nil
+	}
+	return &size
+}
+
+func init() {
+	rootCmd.AddCommand(NewSessionCmd())
+}
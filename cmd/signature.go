@@ -0,0 +1,130 @@
+/*
+Copyright © 2024 Mariano Zunino <marianoz@posteo.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package cmd
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"time"
+
+	ropconfig "github.com/marianozunino/rop/internal/config"
+	"github.com/marianozunino/rop/internal/state"
+	"github.com/marianozunino/rop/pkg/rop"
+	"github.com/rs/zerolog/log"
+)
+
+const auditLog = "audit"
+
+// trustedKeys returns the keys of the configuration file that signatures are verified against.
+func trustedKeys() ([]rop.TrustedKey, error) {
+	ropConfig, err := ropconfig.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]rop.TrustedKey, 0, len(ropConfig.TrustedKeys))
+	for _, configured := range ropConfig.TrustedKeys {
+		key, err := rop.ParseTrustedKey(configured.Name, configured.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted key in config: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// loadSignature reads the signature of the file, from --signature or next to the file, and
+// requires one when the configuration file says so for the context.
+func loadSignature(cfg *config, req *rop.Request) error {
+	ropConfig, err := ropconfig.Load()
+	if err != nil {
+		return err
+	}
+	req.RequireSignature = ropConfig.RequiresSignature(cfg.kubeContext)
+
+	req.File.Signature, err = readSignature(cfg)
+	return err
+}
+
+// readSignature reads the signature given with --signature, or the one next to the file,
+// which may be missing.
+func readSignature(cfg *config) ([]byte, error) {
+	if cfg.signature == "" {
+		return rop.ReadSignature(cfg.filePath)
+	}
+	signature, err := os.ReadFile(cfg.signature)
+	if err != nil {
+		return nil, fmt.Errorf("error reading signature: %w", err)
+	}
+	return signature, nil
+}
+
+// auditEntry is a line of the audit log, which records every run of a file.
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	User      string    `json:"user"`
+	Context   string    `json:"context"`
+	Namespace string    `json:"namespace"`
+	Pod       string    `json:"pod,omitempty"`
+	Container string    `json:"container,omitempty"`
+	File      string    `json:"file"`
+	SHA256    string    `json:"sha256,omitempty"`
+	// Signer names the trusted key the file was signed with, when it had a signature.
+	Signer   string   `json:"signer,omitempty"`
+	Command  []string `json:"command,omitempty"`
+	ExitCode *int     `json:"exit_code,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// recordAudit appends a run of file to the audit log. The result is nil when the run failed
+// before the file ran. Failing to write the log is not fatal.
+func recordAudit(kubeContext, file string, target rop.Target, result *rop.Result, err error) {
+	entry := auditEntry{
+		Time:      time.Now().UTC(),
+		Context:   kubeContext,
+		Namespace: target.Namespace,
+		Pod:       cmp.Or(target.Pod, target.Clone),
+		Container: target.Container,
+		File:      file,
+		User:      currentUser(),
+	}
+	if result != nil {
+		entry.Namespace = result.Namespace
+		entry.Pod = result.Pod
+		entry.Container = result.Container
+		entry.SHA256 = result.FileSHA256
+		entry.Signer = result.Signer
+		entry.Command = result.Command
+		if len(result.Command) > 0 {
+			entry.ExitCode = &result.ExitCode
+		}
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	if err := state.Append(auditLog, entry); err != nil {
+		log.Warn().Err(err).Msg("Failed to write audit log")
+	}
+}
@@ -0,0 +1,201 @@
+/*
+Copyright © 2024 Mariano Zunino <marianoz@posteo.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/marianozunino/rop/internal/logger"
+	"github.com/marianozunino/rop/internal/ui"
+	"github.com/marianozunino/rop/pkg/rop"
+	"github.com/robfig/cron/v3"
+	"github.com/spf13/cobra"
+)
+
+type watchConfig struct {
+	config
+	every         time.Duration
+	cron          string
+	followPod     bool
+	stopOnFailure bool
+}
+
+func NewWatchCmd() *cobra.Command {
+	cfg := &watchConfig{config: config{output: outputText}}
+
+	watchCmd := &cobra.Command{
+		Use:   "watch",
+		Short: "Run a script or binary on a pod repeatedly and show what changed",
+		Long: `Run the file on every tick of a schedule, keeping the connection to the cluster open.
+The target is confirmed once and the file stays on the pod between runs; it is only
+copied again when it changes locally. The output of every run is compared with the
+previous one, highlighting added and removed lines. Stop watching with Ctrl-C.`,
+		Example: `rop watch -c staging -p api -f ./health.sh --every 30s
+rop watch -c staging -p api -f ./health.sh --cron '*/5 * * * *' --follow --stop-on-failure
+rop watch -c staging -p api -f ./health.sh --every 1m -- --timeout=5s`,
+		Args: argsBeforeDash(cobra.NoArgs),
+		Run: func(cmd *cobra.Command, args []string) {
+			_, fileArgs := splitArgsAtDash(cmd, args)
+			if err := setFileArgs(&cfg.config, fileArgs); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			logger.ConfigureLogger(cfg.verbose)
+			runWatch(cmd.Context(), cfg)
+		},
+	}
+
+	addRunFlags(watchCmd, &cfg.config)
+	watchCmd.Flags().DurationVar(&cfg.every, "every", 0, "Interval between runs (e.g. '30s')")
+	watchCmd.Flags().StringVar(&cfg.cron, "cron", "", "Cron expression scheduling the runs (e.g. '*/5 * * * *')")
+	watchCmd.Flags().BoolVar(&cfg.followPod, "follow", false, "Find the pod again when it stops running, e.g. during a rolling restart")
+	watchCmd.Flags().BoolVar(&cfg.stopOnFailure, "stop-on-failure", false, "Stop after the first run that fails or exits with a non-zero code")
+	watchCmd.MarkFlagsMutuallyExclusive("every", "cron")
+	watchCmd.MarkFlagsOneRequired("every", "cron")
+
+	return watchCmd
+}
+
+func runWatch(ctx context.Context, cfg *watchConfig) {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := defaultKubectlContext(&cfg.config); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if needsTargetPicker(&cfg.config) {
+		if err := pickMissingTarget(&cfg.config); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	if err := validateConfig(&cfg.config); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid config: %v\n", err)
+		os.Exit(1)
+	}
+
+	next, err := watchSchedule(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid config: %v\n", err)
+		os.Exit(1)
+	}
+
+	var previous *rop.WatchRun
+	err = watch(ctx, &cfg.config, rop.WatchOptions{
+		Next:          next,
+		FollowPod:     cfg.followPod,
+		StopOnFailure: cfg.stopOnFailure,
+		OnRun: func(run rop.WatchRun) {
+			fmt.Print(ui.RenderWatchRun(run, previous))
+			previous = &run
+		},
+	})
+	if errors.Is(err, rop.ErrWatchFailed) {
+		fmt.Fprintf(os.Stderr, "stopped: %v\n", err)
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// watchSchedule turns --every or --cron into a schedule.
+func watchSchedule(cfg *watchConfig) (func(time.Time) time.Time, error) {
+	if cfg.cron != "" {
+		schedule, err := cron.ParseStandard(cfg.cron)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %w", cfg.cron, err)
+		}
+		return func(time.Time) time.Time { return schedule.Next(time.Now()) }, nil
+	}
+
+	if cfg.every <= 0 {
+		return nil, fmt.Errorf("--every must be positive")
+	}
+	return rop.Every(cfg.every), nil
+}
+
+// watch runs the file of the command line repeatedly. The file is reopened for every run,
+// so local changes are picked up.
+func watch(ctx context.Context, cfg *config, watchOpts rop.WatchOptions) error {
+	// Approvals are for a single run, so watching is refused where they are required.
+	if err := checkApprovalPolicy(cfg.kubeContext); err != nil {
+		return err
+	}
+
+	restConfig, req, file, err := newRequest(cfg)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	setup, err := newRunSetup(restConfig, cfg.kubeContext, cfg.noRedact, nil)
+	if err != nil {
+		return err
+	}
+
+	opts := append(setup.opts, rop.WithContainerSelector(ui.RunContainerSelection))
+	if watchOpts.Stream {
+		opts = append(opts, rop.WithStdout(os.Stdout), rop.WithStderr(os.Stderr))
+	}
+	if !cfg.noConfirm {
+		opts = append(opts, rop.WithConfirm(func(plan rop.Plan) error {
+			return ui.ConfirmAction(plan, setup.protected)
+		}))
+	}
+
+	runner, err := rop.NewRunner(opts...)
+	if err != nil {
+		return err
+	}
+
+	// Every run is recorded, like a single run of the file.
+	onRun := watchOpts.OnRun
+	watchOpts.OnRun = func(run rop.WatchRun) {
+		setup.record(ctx, cfg.filePath, req.Target, run.Result, run.Err)
+		if onRun != nil {
+			onRun(run)
+		}
+	}
+	watchOpts.OpenFile = func() (io.ReadCloser, error) {
+		return os.Open(cfg.filePath)
+	}
+	watchOpts.OpenSignature = func() ([]byte, error) {
+		return readSignature(cfg)
+	}
+	return runner.Watch(ctx, req, watchOpts)
+}
+
+func init() {
+	rootCmd.AddCommand(NewWatchCmd())
+}
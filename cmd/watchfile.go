@@ -0,0 +1,105 @@
+/*
+Copyright © 2024 Mariano Zunino <marianoz@posteo.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/marianozunino/rop/internal/ui"
+	"github.com/marianozunino/rop/pkg/rop"
+	"github.com/rs/zerolog/log"
+)
+
+// saveDebounce groups the events editors emit for a single save.
+const saveDebounce = 100 * time.Millisecond
+
+// runWatchFile runs the file once and again every time it is saved, on the same pod and
+// container, until interrupted.
+func runWatchFile(ctx context.Context, cfg *config) error {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	saved, err := watchSaves(ctx, cfg.filePath)
+	if err != nil {
+		return err
+	}
+
+	return watch(ctx, cfg, rop.WatchOptions{
+		Trigger: saved,
+		Stream:  true,
+		OnRun: func(run rop.WatchRun) {
+			fmt.Fprintln(os.Stderr, ui.RenderReloadRun(run, cfg.filePath))
+		},
+	})
+}
+
+// watchSaves reports changes of the file. The directory is watched rather than the file,
+// since many editors save by replacing the file.
+func watchSaves(ctx context.Context, path string) (<-chan struct{}, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving %s: %w", path, err)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch files: %w", err)
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("failed to watch %s: %w", filepath.Dir(path), err)
+	}
+
+	saved := make(chan struct{}, 1)
+	go func() {
+		defer watcher.Close()
+
+		var debounce <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-watcher.Events:
+				if event.Name == path && event.Has(fsnotify.Write|fsnotify.Create|fsnotify.Rename) {
+					debounce = time.After(saveDebounce)
+				}
+			case err := <-watcher.Errors:
+				log.Warn().Err(err).Msg("File watcher error")
+			case <-debounce:
+				debounce = nil
+				select {
+				case saved <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return saved, nil
+}
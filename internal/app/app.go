@@ -3,56 +3,93 @@ package app
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/marianozunino/rop/internal/k8s"
-	"github.com/marianozunino/rop/internal/ui"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/codes"
+	corev1 "k8s.io/api/core/v1"
 )
 
-func (app *App) Run(ctx context.Context) error {
-	if err := app.initialize(); err != nil {
-		return fmt.Errorf("initialization failed: %w", err)
+// Run executes the file on the target pod. A non-zero exit code of the remote command is
+// reported in the result rather than as an error.
+func (app *App) Run(ctx context.Context) (result *Result, err error) {
+	start := time.Now()
+	app.result = &Result{}
+
+	ctx, span := app.tracer.Start(ctx, "rop.run")
+	defer func() {
+		span.SetAttributes(app.targetAttributes()...)
+		span.SetAttributes(app.resultAttributes()...)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	if err := app.traced(ctx, "initialize", func(context.Context) error { return app.initialize() }); err != nil {
+		return nil, fmt.Errorf("initialization failed: %w", err)
 	}
 
-	if err := app.preparePodExecution(ctx); err != nil {
-		return fmt.Errorf("pod preparation failed: %w", err)
+	// The clone is deleted even when the run is interrupted.
+	defer app.releaseClonedPod(context.WithoutCancel(ctx))
+
+	if err := app.traced(ctx, "preparePodExecution", app.preparePodExecution); err != nil {
+		return nil, fmt.Errorf("pod preparation failed: %w", err)
 	}
 
-	if err := app.executeFile(ctx); err != nil {
-		return fmt.Errorf("file execution failed: %w", err)
+	err = app.traced(ctx, "executeFile", app.executeFile)
+	app.result.Duration = time.Since(start)
+	if err != nil {
+		return app.result, fmt.Errorf("file execution failed: %w", err)
 	}
 
-	return nil
+	return app.result, nil
 }
 
 func (app *App) initialize() error {
-	if err := app.validateInputFile(); err != nil {
-		return fmt.Errorf("input file validation failed: %w", err)
-	}
-
-	client, err := k8s.NewClient(app.kubeContext, app.namespace)
-	if err != nil {
-		return fmt.Errorf("failed to create K8s client: %w", err)
+	if app.client == nil {
+		client, err := k8s.NewClientForConfig(app.restConfig, app.clientset, app.namespace)
+		if err != nil {
+			return fmt.Errorf("failed to create K8s client: %w", err)
+		}
+		app.client = client
+		app.namespace = client.Namespace
 	}
-	app.client = client
+	app.result.Namespace = app.namespace
 
 	return nil
 }
 
 func (app *App) preparePodExecution(ctx context.Context) error {
-	pod, err := app.client.FindPodByName(ctx, app.podName)
+	pod, err := app.resolvePod(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to find pod: %w", err)
+		return err
 	}
 	app.pod = pod
-	log.Debug().Msgf("Found pod: %s", pod.Name)
+	app.result.Pod = pod.Name
 
 	if err := app.PreparePodEnvironment(); err != nil {
 		return fmt.Errorf("failed to prepare pod environment: %w", err)
 	}
+	app.result.Container = app.container
+	app.emit(Event{Type: EventTargetResolved})
 
-	if !app.noConfirm {
-		if err := ui.ConfirmAction(app.filePath, pod.Name, app.container); err != nil {
+	if err := app.prepareUserSwitch(ctx); err != nil {
+		return err
+	}
+	if err := app.prepareLimits(ctx); err != nil {
+		return err
+	}
+	app.prepareRedaction(ctx)
+
+	if app.confirm != nil {
+		plan, err := app.buildPlan(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to build execution plan: %w", err)
+		}
+		if err := app.confirm(plan); err != nil {
 			return fmt.Errorf("action not confirmed: %w", err)
 		}
 	}
@@ -60,3 +97,79 @@ func (app *App) preparePodExecution(ctx context.Context) error {
 	return nil
 }
 
+func (app *App) resolvePod(ctx context.Context) (*corev1.Pod, error) {
+	if app.cloneRef == "" {
+		pod, err := app.client.FindPodByName(ctx, app.podName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find pod: %w", err)
+		}
+		log.Debug().Msgf("Found pod: %s", pod.Name)
+		return pod, nil
+	}
+
+	log.Info().Msgf("Creating a temporary pod from %s", app.cloneRef)
+	pod, err := app.client.CreateClonePod(ctx, app.cloneRef, app.cloneInit)
+	// The pod may exist even if it never became ready, so keep track of it for cleanup.
+	app.clonedPod = pod
+	if err != nil {
+		return nil, fmt.Errorf("failed to clone pod from %s: %w", app.cloneRef, err)
+	}
+	log.Debug().Msgf("Cloned pod: %s", pod.Name)
+	app.startHeartbeat(ctx)
+	return pod, nil
+}
+
+// startHeartbeat refreshes the in-use annotation of the cloned pod until it is released,
+// so rop gc doesn't delete it during a long run.
+func (app *App) startHeartbeat(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	app.stopHeartbeat = func() {
+		cancel()
+		<-done
+	}
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(k8s.CloneHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				inUse := map[string]any{k8s.InUseAnnotation: now.UTC().Format(time.RFC3339)}
+				if err := app.client.AnnotatePod(ctx, app.clonedPod, inUse); err != nil && ctx.Err() == nil {
+					log.Warn().Err(err).Msgf("Failed to mark cloned pod %s as in use", app.clonedPod.Name)
+				}
+			}
+		}
+	}()
+}
+
+func (app *App) releaseClonedPod(ctx context.Context) {
+	if app.clonedPod == nil {
+		return
+	}
+
+	if app.stopHeartbeat != nil {
+		app.stopHeartbeat()
+		app.stopHeartbeat = nil
+	}
+
+	if app.keepClone {
+		// Marked, so rop gc leaves it alone.
+		kept := map[string]any{k8s.KeepAnnotation: "true", k8s.InUseAnnotation: nil}
+		if err := app.client.AnnotatePod(ctx, app.clonedPod, kept); err != nil {
+			log.Warn().Err(err).Msgf("Failed to mark cloned pod %s as kept", app.clonedPod.Name)
+		}
+		log.Info().Msgf("Keeping cloned pod %s", app.clonedPod.Name)
+		return
+	}
+
+	if err := app.client.DeletePod(ctx, app.clonedPod); err != nil {
+		log.Warn().Err(err).Msgf("Failed to delete cloned pod %s", app.clonedPod.Name)
+	} else {
+		log.Debug().Msgf("Deleted cloned pod %s", app.clonedPod.Name)
+	}
+}
@@ -0,0 +1,552 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/marianozunino/rop/internal/k8s"
+	"github.com/marianozunino/rop/internal/k8s/k8stest"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const testScript = "echo hello\n"
+
+// testUploadTag replaces the random tag of uploads, so tests know where the file goes.
+const (
+	testUploadTag  = "rop-1700000000-0a1b2c3d-"
+	testUploadPath = "/tmp/" + testUploadTag + "check.sh"
+)
+
+func newTestApp(t *testing.T, server *k8stest.ExecServer, clientset *fake.Clientset, opts ...func(app *App)) *App {
+	t.Helper()
+
+	client, err := k8s.NewClientForConfig(server.RESTConfig(), clientset, "default")
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+
+	defaults := []func(app *App){
+		WithClient(client),
+		WithNamespace("default"),
+		WithPodName("api"),
+		WithFile("./check.sh", strings.NewReader(testScript), 0o644),
+	}
+	app, err := NewApp(append(defaults, opts...)...)
+	if err != nil {
+		t.Fatalf("creating app: %v", err)
+	}
+	app.uploadTag = testUploadTag
+	return app
+}
+
+func commandLines(server *k8stest.ExecServer) []string {
+	var lines []string
+	for _, exec := range server.Commands() {
+		lines = append(lines, strings.Join(exec.Command, " "))
+	}
+	return lines
+}
+
+func assertCommands(t *testing.T, server *k8stest.ExecServer, want ...string) {
+	t.Helper()
+	got := commandLines(server)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected commands:\ngot:  %q\nwant: %q", got, want)
+	}
+}
+
+func TestRunCopiesExecutesAndCleansUp(t *testing.T) {
+	var uploaded []byte
+	var server *k8stest.ExecServer
+	server = k8stest.NewExecServer(func(exec *k8stest.Exec) int {
+		uploaded, _ = server.File(testUploadPath)
+		io.WriteString(exec.Stdout, "hello\n")
+		return 0
+	})
+	defer server.Close()
+
+	var stdout bytes.Buffer
+	app := newTestApp(t, server, fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main")),
+		WithArgs([]string{"--verbose"}),
+		WithStreams(k8s.IOStreams{Out: &stdout, ErrOut: io.Discard}),
+	)
+
+	result, err := app.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	assertCommands(t, server,
+		"cp /dev/stdin "+testUploadPath,
+		"sh "+testUploadPath+" --verbose",
+		"rm -f "+testUploadPath,
+	)
+	if string(uploaded) != testScript {
+		t.Errorf("uploaded file = %q, want %q", uploaded, testScript)
+	}
+	if files := server.Files(); len(files) != 0 {
+		t.Errorf("files left on the pod: %v", files)
+	}
+	if stdout.String() != "hello\n" {
+		t.Errorf("stdout = %q", stdout.String())
+	}
+	if result.Pod != "api-1" || result.Container != "main" || result.ExitCode != 0 {
+		t.Errorf("unexpected result: %+v", result)
+	}
+}
+
+func TestRunReportsEvents(t *testing.T) {
+	server := k8stest.NewExecServer(func(exec *k8stest.Exec) int {
+		io.WriteString(exec.Stdout, "hello\n")
+		return 2
+	})
+	defer server.Close()
+
+	var mu sync.Mutex
+	var events []Event
+	app := newTestApp(t, server, fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main")),
+		WithEvents(func(event Event) {
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, event)
+		}),
+	)
+
+	if _, err := app.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	var types []string
+	for _, event := range events {
+		types = append(types, event.Type)
+		if event.Pod != "api-1" || event.Container != "main" || event.Namespace != "default" {
+			t.Errorf("event without target: %+v", event)
+		}
+		switch event.Type {
+		case EventCopyFinished:
+			if event.Bytes != int64(len(testScript)) || event.Error != "" {
+				t.Errorf("unexpected copy event: %+v", event)
+			}
+		case EventStdout:
+			if event.Data != "hello\n" {
+				t.Errorf("stdout data = %q", event.Data)
+			}
+		case EventExit:
+			if event.ExitCode == nil || *event.ExitCode != 2 {
+				t.Errorf("unexpected exit event: %+v", event)
+			}
+		}
+	}
+
+	want := "target_resolved copy_started copy_finished exec_started stdout exit cleanup"
+	if strings.Join(types, " ") != want {
+		t.Errorf("events = %v, want %s", types, want)
+	}
+}
+
+func TestRunReportsNonZeroExitCode(t *testing.T) {
+	server := k8stest.NewExecServer(func(exec *k8stest.Exec) int { return 3 })
+	defer server.Close()
+
+	app := newTestApp(t, server, fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main")))
+
+	result, err := app.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if result.ExitCode != 3 {
+		t.Errorf("exit code = %d, want 3", result.ExitCode)
+	}
+	if files := server.Files(); len(files) != 0 {
+		t.Errorf("files left on the pod: %v", files)
+	}
+}
+
+func TestRunSelectsContainer(t *testing.T) {
+	server := k8stest.NewExecServer(nil)
+	defer server.Close()
+
+	var offered []string
+	app := newTestApp(t, server, fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main", "sidecar")),
+		WithContainerSelector(func(containers []Container) (string, error) {
+			offered = containerNames(containers)
+			return "sidecar", nil
+		}),
+	)
+
+	if _, err := app.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if strings.Join(offered, ",") != "main,sidecar" {
+		t.Errorf("offered containers = %v", offered)
+	}
+	for _, exec := range server.Commands() {
+		if exec.Container != "sidecar" {
+			t.Errorf("command %q ran in container %q", exec.Command, exec.Container)
+		}
+	}
+}
+
+func TestRunFailsWithoutContainerSelector(t *testing.T) {
+	server := k8stest.NewExecServer(nil)
+	defer server.Close()
+
+	app := newTestApp(t, server, fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main", "sidecar")))
+
+	_, err := app.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "specify one of: main, sidecar") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertCommands(t, server)
+}
+
+func TestSelectExecutionContainer(t *testing.T) {
+	sidecarPolicy := corev1.ContainerRestartPolicyAlways
+	pod := k8stest.RunningPod("default", "api-1", "main", "sidecar", "crashing")
+	pod.Spec.InitContainers = []corev1.Container{
+		{Name: "migrate", Image: "migrate"},
+		{Name: "proxy", Image: "proxy", RestartPolicy: &sidecarPolicy},
+	}
+	running := corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}
+	pod.Status.ContainerStatuses = []corev1.ContainerStatus{
+		{Name: "main", State: running},
+		{Name: "sidecar", State: running},
+		{Name: "crashing", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}}},
+	}
+	pod.Status.InitContainerStatuses = []corev1.ContainerStatus{
+		{Name: "migrate", State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Reason: "Completed"}}},
+		{Name: "proxy", State: running},
+	}
+
+	tests := []struct {
+		name        string
+		container   string
+		annotation  string
+		wantOffered string
+		want        string
+		wantErr     string
+	}{
+		{name: "offers running containers", wantOffered: "main,sidecar,proxy", want: "main"},
+		{name: "honors default container", annotation: "sidecar", want: "sidecar"},
+		{name: "ignores stopped default container", annotation: "crashing", wantOffered: "main,sidecar,proxy", want: "main"},
+		{name: "accepts running init container", container: "proxy", want: "proxy"},
+		{name: "rejects missing container", container: "mian", wantErr: "container mian not found in pod api-1, available: main, sidecar, crashing, migrate, proxy"},
+		{name: "rejects stopped container", container: "crashing", wantErr: "not running (waiting: CrashLoopBackOff)"},
+		{name: "rejects completed init container", container: "migrate", wantErr: "not running (terminated: Completed)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := pod.DeepCopy()
+			if tt.annotation != "" {
+				pod.Annotations = map[string]string{DefaultContainerAnnotation: tt.annotation}
+			}
+
+			var offered []string
+			app := &App{pod: pod, container: tt.container}
+			app.selectContainer = func(containers []Container) (string, error) {
+				offered = containerNames(containers)
+				return containers[0].Name, nil
+			}
+
+			err := app.selectExecutionContainer()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if app.container != tt.want || strings.Join(offered, ",") != tt.wantOffered {
+				t.Errorf("selected %q after offering %v", app.container, offered)
+			}
+		})
+	}
+}
+
+func TestRunFailsWhenPodIsMissing(t *testing.T) {
+	server := k8stest.NewExecServer(nil)
+	defer server.Close()
+
+	app := newTestApp(t, server, fake.NewSimpleClientset())
+
+	_, err := app.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "no running pods found for api") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertCommands(t, server)
+}
+
+func TestRunAbortsWhenNotConfirmed(t *testing.T) {
+	server := k8stest.NewExecServer(nil)
+	defer server.Close()
+
+	var plan Plan
+	app := newTestApp(t, server, fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main")),
+		WithConfirm(func(p Plan) error {
+			plan = p
+			return errors.New("action aborted by user")
+		}),
+	)
+
+	_, err := app.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "action aborted by user") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if plan.File != "./check.sh" || plan.Pod != "api-1" || plan.Container != "main" {
+		t.Errorf("unexpected plan: %+v", plan)
+	}
+	assertCommands(t, server)
+}
+
+func TestRunPlansEnvironmentAndDigest(t *testing.T) {
+	server := k8stest.NewExecServer(nil)
+	defer server.Close()
+
+	pod := k8stest.RunningPod("default", "api-1", "main")
+	pod.Spec.NodeName = "node-a"
+	var plan Plan
+	app := newTestApp(t, server, fake.NewSimpleClientset(pod),
+		WithKubeContext("prod"),
+		WithArgs([]string{"-x"}),
+		WithEnv([]string{"MODE=dry", "TOKEN=secret"}),
+		WithConfirm(func(p Plan) error {
+			plan = p
+			return nil
+		}),
+	)
+
+	result, err := app.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if plan.Context != "prod" || plan.Node != "node-a" || plan.Runner != "sh" || plan.FileSize != int64(len(testScript)) {
+		t.Errorf("unexpected plan: %+v", plan)
+	}
+	if strings.Join(plan.EnvKeys, ",") != "MODE,TOKEN" {
+		t.Errorf("env keys = %v", plan.EnvKeys)
+	}
+	if len(plan.FileSHA256) != 64 || result.FileSHA256 != plan.FileSHA256 {
+		t.Errorf("digest = %q, result digest = %q", plan.FileSHA256, result.FileSHA256)
+	}
+
+	const command = "env MODE=dry TOKEN=secret sh " + testUploadPath + " -x"
+	if strings.Join(plan.Command, " ") != command {
+		t.Errorf("planned command = %q", plan.Command)
+	}
+	assertCommands(t, server,
+		"cp /dev/stdin "+testUploadPath,
+		command,
+		"rm -f "+testUploadPath,
+	)
+}
+
+func TestNewAppRejectsInvalidEnv(t *testing.T) {
+	_, err := NewApp(
+		WithClient(&k8s.Client{}),
+		WithPodName("api"),
+		WithFile("check.sh", strings.NewReader(testScript), 0o644),
+		WithEnv([]string{"=value"}),
+	)
+	if err == nil || !strings.Contains(err.Error(), "expected KEY=VALUE") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestRunCleansUpWhenCopyFails(t *testing.T) {
+	server := k8stest.NewExecServer(nil)
+	defer server.Close()
+	server.FailCommand("cp", 1)
+
+	app := newTestApp(t, server, fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main")))
+
+	_, err := app.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "failed to copy file to pod") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertCommands(t, server,
+		"cp /dev/stdin "+testUploadPath,
+		"rm -f "+testUploadPath,
+	)
+}
+
+func TestRunKillsTimedOutCommand(t *testing.T) {
+	killed := make(chan struct{}, 1)
+	server := k8stest.NewExecServer(func(exec *k8stest.Exec) int {
+		script := exec.Command[2]
+		if script == killScript {
+			killed <- struct{}{}
+			return 0
+		}
+		<-exec.Done
+		return 0
+	})
+	defer server.Close()
+
+	app := newTestApp(t, server, fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main")),
+		WithTimeout(200*time.Millisecond),
+	)
+
+	result, err := app.Run(context.Background())
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("expected timeout error, got: %v", err)
+	}
+	if !result.TimedOut {
+		t.Error("result not marked as timed out")
+	}
+
+	select {
+	case <-killed:
+	default:
+		t.Error("remote process was not killed")
+	}
+
+	lines := commandLines(server)
+	if last := lines[len(lines)-2:]; last[0] != "rm -f "+testUploadPath || last[1] != "rm -f "+testUploadPath+".pid" {
+		t.Errorf("unexpected cleanup commands: %q", last)
+	}
+}
+
+// TestKillScriptKillsForkedProcesses runs the wrapper and the kill script locally, with a
+// command that forks the script like su does.
+func TestKillScriptKillsForkedProcesses(t *testing.T) {
+	for _, tool := range []string{"sh", "setsid"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s is not available", tool)
+		}
+	}
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "check.sh.pid")
+	childFile := filepath.Join(dir, "child")
+
+	// The outer shell forks the script like su, and the script forks a child of its own.
+	script := `sleep 30 & echo $! > "$0"; wait`
+	wrapper := exec.Command("sh", "-c", killableWrapper, pidFile, "sh", "-c", `sh -c "$1" "$0"; exit $?`, childFile, script)
+	if err := wrapper.Start(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- wrapper.Wait() }()
+
+	var child int
+	for deadline := time.Now().Add(5 * time.Second); child == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the command didn't start")
+		}
+		content, _ := os.ReadFile(childFile)
+		child, _ = strconv.Atoi(strings.TrimSpace(string(content)))
+	}
+
+	if err := exec.Command("sh", "-c", killScript, pidFile).Run(); err != nil {
+		t.Fatalf("kill script failed: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the wrapped command wasn't killed")
+	}
+	for deadline := time.Now().Add(5 * time.Second); processAlive(child); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("the forked process %d wasn't killed", child)
+		}
+	}
+}
+
+// processAlive reports whether the process runs, not counting zombies.
+func processAlive(pid int) bool {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return exec.Command("kill", "-0", strconv.Itoa(pid)).Run() == nil
+	}
+	_, fields, _ := strings.Cut(string(stat), ") ")
+	return !strings.HasPrefix(fields, "Z")
+}
+
+func TestRunCleansUpWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := k8stest.NewExecServer(func(exec *k8stest.Exec) int {
+		cancel()
+		<-exec.Done
+		return 0
+	})
+	defer server.Close()
+
+	app := newTestApp(t, server, fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main")),
+		WithTimeout(time.Minute),
+	)
+
+	if _, err := app.Run(ctx); err == nil {
+		t.Fatal("expected an error for the cancelled run")
+	}
+	lines := commandLines(server)
+	if last := lines[len(lines)-2:]; last[0] != "rm -f "+testUploadPath || last[1] != "rm -f "+testUploadPath+".pid" {
+		t.Errorf("unexpected cleanup commands: %q", last)
+	}
+	if files := server.Files(); len(files) != 0 {
+		t.Errorf("files left on the pod: %v", files)
+	}
+}
+
+func TestRunOnClonedPod(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		server := k8stest.NewExecServer(nil)
+		defer server.Close()
+
+		deployment := &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default"},
+			Spec: appsv1.DeploymentSpec{
+				Template: runningPodTemplate(),
+			},
+		}
+		clientset := fake.NewSimpleClientset(deployment)
+		clientset.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			pod := action.(k8stesting.CreateAction).GetObject().(*corev1.Pod)
+			pod.Name = pod.GenerateName + "abcde"
+			pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+			return false, nil, nil
+		})
+
+		app := newTestApp(t, server, clientset, WithPodName(""), WithClone("deploy/api"), WithKeepClone(keep))
+
+		result, err := app.Run(context.Background())
+		if err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		if result.Pod != "api-rop-abcde" {
+			t.Errorf("ran on pod %q", result.Pod)
+		}
+
+		pod, err := clientset.CoreV1().Pods("default").Get(context.Background(), "api-rop-abcde", metav1.GetOptions{})
+		if exists := err == nil; exists != keep {
+			t.Errorf("keep=%t: cloned pod exists=%t", keep, exists)
+		}
+		if keep && (pod.Annotations[k8s.KeepAnnotation] != "true" || pod.Annotations[k8s.InUseAnnotation] != "") {
+			t.Errorf("kept pod not marked for rop gc: %v", pod.Annotations)
+		}
+	}
+}
+
+func runningPodTemplate() corev1.PodTemplateSpec {
+	pod := k8stest.RunningPod("default", "", "main")
+	return corev1.PodTemplateSpec{ObjectMeta: pod.ObjectMeta, Spec: pod.Spec}
+}
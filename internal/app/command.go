@@ -0,0 +1,106 @@
+package app
+
+import (
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// commandBuilder assembles the command line executing the file. From the outside in, it
+// switches the user, applies the resource limits, changes to the working directory, sets
+// the environment and runs the file, through its runner for scripts. Each layer execs the
+// next, except su and runuser, which run the rest in a child process. The file may thus
+// not keep the PID of the command, so killed runs are killed as a process group.
+type commandBuilder struct {
+	filePath string
+	// runner is the interpreter of scripts; empty for binaries.
+	runner string
+	args   []string
+	env    []string
+	// workDir is changed to before running the file, when set.
+	workDir string
+	// userSwitch is the prefix running the rest as another user.
+	userSwitch []string
+	limits     ResourceLimits
+	// tools say how the container applies each limit; limits without one are skipped.
+	tools limitTools
+}
+
+// newCommandBuilder describes the execution of the file at filePath in the container.
+func (app *App) newCommandBuilder(filePath string) commandBuilder {
+	builder := commandBuilder{
+		filePath:   filePath,
+		args:       app.args,
+		env:        app.env,
+		workDir:    app.workDir,
+		userSwitch: app.userSwitch,
+		limits:     app.limits,
+		tools:      app.limitTools,
+	}
+	if app.fileType == "script" {
+		builder.runner = app.resolveRunner(filePath)
+		if builder.runner == "" {
+			log.Error().Msgf("Unable to infer runner for file extension: %s", filepath.Ext(filePath))
+		}
+	}
+	return builder
+}
+
+func (b commandBuilder) build() []string {
+	command := append(b.fileCommand(), b.args...)
+	if len(b.env) > 0 {
+		command = append(append([]string{"env"}, b.env...), command...)
+	}
+	if b.workDir != "" {
+		command = append([]string{"sh", "-c", `cd "$0" && exec "$@"`, b.workDir}, command...)
+	}
+	command = append(b.limitsPrefix(), command...)
+	return append(slices.Clone(b.userSwitch), command...)
+}
+
+func (b commandBuilder) fileCommand() []string {
+	if b.runner == "" {
+		return []string{b.filePath}
+	}
+	return []string{b.runner, b.filePath}
+}
+
+// limitsPrefix returns the commands applying the limits the container supports: nice and
+// ionice, then the memory and CPU time limits with prlimit or the ulimit of a shell.
+func (b commandBuilder) limitsPrefix() []string {
+	var prefix []string
+	if b.limits.Nice != 0 && b.tools.applies(limitNice) {
+		prefix = append(prefix, "nice", "-n", strconv.Itoa(b.limits.Nice))
+	}
+	if ionice, _ := b.limits.ioniceArgs(); ionice != nil && b.tools.applies(limitIONice) {
+		prefix = append(append(prefix, "ionice"), ionice...)
+	}
+
+	var prlimit, ulimits []string
+	if b.limits.MaxMemory > 0 {
+		switch b.tools["memory"] {
+		case "prlimit":
+			prlimit = append(prlimit, "--as="+strconv.FormatInt(b.limits.MaxMemory, 10))
+		case "ulimit":
+			ulimits = append(ulimits, "ulimit -v "+strconv.FormatInt(max(1, b.limits.MaxMemory/1024), 10))
+		}
+	}
+	if b.limits.MaxCPUTime > 0 {
+		switch b.tools["cpu"] {
+		case "prlimit":
+			prlimit = append(prlimit, "--cpu="+strconv.FormatInt(b.limits.cpuSeconds(), 10))
+		case "ulimit":
+			ulimits = append(ulimits, "ulimit -t "+strconv.FormatInt(b.limits.cpuSeconds(), 10))
+		}
+	}
+	if len(prlimit) > 0 {
+		prefix = append(append(append(prefix, "prlimit"), prlimit...), "--")
+	}
+	if len(ulimits) > 0 {
+		prefix = append(prefix, "sh", "-c", strings.Join(ulimits, " && ")+` && exec "$0" "$@"`)
+	}
+	return prefix
+}
@@ -0,0 +1,61 @@
+package app
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommandBuilder(t *testing.T) {
+	const file = "/tmp/rop-check.sh"
+	tests := []struct {
+		name    string
+		builder commandBuilder
+		want    string
+	}{
+		{"binary", commandBuilder{filePath: file, args: []string{"-v"}}, file + " -v"},
+		{"script", commandBuilder{filePath: file, runner: "sh", args: []string{"-v"}}, "sh " + file + " -v"},
+		{
+			"session as another user",
+			commandBuilder{
+				filePath: file, runner: "sh", env: []string{"A=1"}, workDir: "/tmp/rop-session",
+				userSwitch: []string{"runuser", "-u", "app", "--"},
+			},
+			`runuser -u app -- sh -c cd "$0" && exec "$@" /tmp/rop-session env A=1 sh ` + file,
+		},
+		{
+			"limits with ulimit",
+			commandBuilder{
+				filePath: file, runner: "sh",
+				limits: ResourceLimits{Nice: 10, IONice: "best-effort:7", MaxMemory: 512 << 20, MaxCPUTime: 1500 * time.Millisecond},
+				tools:  limitTools{"nice": "nice", "ionice": "ionice", "memory": "ulimit", "cpu": "ulimit"},
+			},
+			`nice -n 10 ionice -c 2 -n 7 sh -c ulimit -v 524288 && ulimit -t 2 && exec "$0" "$@" sh ` + file,
+		},
+		{
+			"limits with prlimit",
+			commandBuilder{
+				filePath: file, env: []string{"A=1"},
+				limits: ResourceLimits{IONice: "idle", MaxMemory: 1 << 30, MaxCPUTime: time.Minute},
+				tools:  limitTools{"ionice": "ionice", "memory": "prlimit", "cpu": "ulimit"},
+			},
+			`ionice -c 3 prlimit --as=1073741824 -- sh -c ulimit -t 60 && exec "$0" "$@" env A=1 ` + file,
+		},
+		{
+			"unsupported limits",
+			commandBuilder{
+				filePath: file,
+				limits:   ResourceLimits{Nice: 5, MaxMemory: 1 << 30},
+				tools:    limitTools{},
+			},
+			file,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := strings.Join(tt.builder.build(), " "); got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
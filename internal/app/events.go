@@ -0,0 +1,92 @@
+package app
+
+import (
+	"io"
+	"time"
+
+	"github.com/marianozunino/rop/internal/k8s"
+)
+
+// Event types, in the order they occur during a run.
+const (
+	EventTargetResolved = "target_resolved"
+	EventCopyStarted    = "copy_started"
+	EventCopyFinished   = "copy_finished"
+	EventExecStarted    = "exec_started"
+	EventStdout         = "stdout"
+	EventStderr         = "stderr"
+	EventExit           = "exit"
+	EventCleanup        = "cleanup"
+)
+
+// Event reports progress of a run. Every event carries its target, so events of runs on
+// several pods can share one handler.
+type Event struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	Namespace string    `json:"namespace"`
+	Pod       string    `json:"pod"`
+	Container string    `json:"container"`
+
+	// Path is the remote file copied or removed.
+	Path       string   `json:"path,omitempty"`
+	Bytes      int64    `json:"bytes,omitempty"`
+	DurationMS int64    `json:"duration_ms,omitempty"`
+	Command    []string `json:"command,omitempty"`
+	// Data is a chunk of stdout or stderr.
+	Data     string `json:"data,omitempty"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+	TimedOut bool   `json:"timed_out,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+func (app *App) emit(event Event) {
+	if app.onEvent == nil {
+		return
+	}
+
+	event.Time = time.Now()
+	event.Namespace = app.namespace
+	if app.pod != nil {
+		event.Namespace = app.pod.Namespace
+		event.Pod = app.pod.Name
+	}
+	event.Container = app.container
+	app.onEvent(event)
+}
+
+// eventWriter turns writes to an output stream into events.
+type eventWriter struct {
+	app       *App
+	eventType string
+}
+
+func (w eventWriter) Write(p []byte) (int, error) {
+	w.app.emit(Event{Type: w.eventType, Data: string(p)})
+	return len(p), nil
+}
+
+// commandStreams returns the streams of the executed file. With an event handler, its
+// output is also reported as events. Secrets are redacted from both, unless the command runs
+// in a terminal. The returned function must be called once the command has finished.
+func (app *App) commandStreams() (k8s.IOStreams, func()) {
+	streams := app.streams
+	if app.onEvent != nil {
+		streams.Out = teeWriter(streams.Out, eventWriter{app, EventStdout})
+		streams.ErrOut = teeWriter(streams.ErrOut, eventWriter{app, EventStderr})
+	}
+	if streams.TTY {
+		return streams, func() {}
+	}
+
+	var flush func()
+	streams.Out, streams.ErrOut, flush = app.redactStreams(streams.Out, streams.ErrOut)
+	return streams, flush
+}
+
+func teeWriter(w io.Writer, events eventWriter) io.Writer {
+	if w == nil {
+		return events
+	}
+	return io.MultiWriter(w, events)
+}
@@ -2,43 +2,65 @@ package app
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"os"
+	"maps"
+	"path"
 	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/rs/zerolog/log"
+	utilexec "k8s.io/client-go/util/exec"
 )
 
-func (app *App) executeFile(ctx context.Context) error {
-	file, err := os.Open(app.filePath)
-	if err != nil {
-		return fmt.Errorf("error opening file: %w", err)
-	}
-	defer file.Close()
+// ErrTimeout is returned when the remote execution exceeds the configured timeout.
+var ErrTimeout = errors.New("execution timed out")
 
-	fileInfo, err := file.Stat()
-	if err != nil {
-		return fmt.Errorf("error getting file info: %w", err)
+// killTimeout bounds the best-effort kill of a timed out remote process.
+const killTimeout = 10 * time.Second
+
+func (app *App) executeFile(ctx context.Context) (err error) {
+	if err := app.digestFile(); err != nil {
+		return err
 	}
 
-	app.determineFileType(fileInfo)
+	app.determineFileType()
 
 	tempPath := app.getDestinationPath()
 
-	defer app.cleanupFile(ctx, tempPath)
+	// The file is removed even when the run was interrupted.
+	defer app.traced(context.WithoutCancel(ctx), "cleanup", func(ctx context.Context) error {
+		app.cleanupFile(ctx, tempPath)
+		return nil
+	})
+	// Runs before the cleanup, so remote hooks can still use the file.
+	defer func() {
+		app.runFailureHooks(ctx, tempPath, err)
+	}()
 
-	if err := app.copyFileToPod(ctx, file, tempPath); err != nil {
+	err = app.traced(ctx, "copy", func(ctx context.Context) error {
+		return app.copyFileToPod(ctx, tempPath)
+	})
+	if err != nil {
 		return err
 	}
 
-	return app.runFile(ctx, tempPath)
+	err = app.traced(ctx, "run", func(ctx context.Context) error {
+		return app.runFile(ctx, tempPath)
+	})
+	if err == nil || app.result.TimedOut {
+		exitCode := app.result.ExitCode
+		app.emit(Event{Type: EventExit, ExitCode: &exitCode, TimedOut: app.result.TimedOut})
+	}
+	return err
 }
 
-func (app *App) determineFileType(fileInfo os.FileInfo) {
+func (app *App) determineFileType() {
 	if app.fileType == "auto" {
 		app.fileType = "script"
-		if fileInfo.Mode()&0o111 != 0 {
+		if app.fileMode&0o111 != 0 {
 			app.fileType = "binary"
 		}
 	}
@@ -46,63 +68,130 @@ func (app *App) determineFileType(fileInfo os.FileInfo) {
 
 func (app *App) getDestinationPath() string {
 	if app.destPath == "" {
-		app.destPath = "/tmp"
+		app.destPath = defaultDestPath
+	}
+	// Files of sessions keep their name, they live in the directory of the session.
+	if app.workDir != "" {
+		return fmt.Sprintf("%s/%s", app.destPath, filepath.Base(app.fileName))
 	}
-	return fmt.Sprintf("%s/%s", app.destPath, filepath.Base(app.filePath))
+	return fmt.Sprintf("%s/%s%s", app.destPath, app.uploadTag, filepath.Base(app.fileName))
 }
 
 func (app *App) cleanupFile(ctx context.Context, tempPath string) {
-	if err := app.client.DeleteFileFromContainer(ctx, app.pod, app.container, tempPath); err != nil {
-		log.Warn().Err(err).Msgf("Failed to delete file %s from pod", tempPath)
-	} else {
-		log.Debug().Msgf("Deleted file %s from pod", tempPath)
+	paths := []string{tempPath}
+	if app.usesPIDFile() {
+		paths = append(paths, pidFilePath(tempPath))
+	}
+
+	for _, path := range paths {
+		event := Event{Type: EventCleanup, Path: path}
+		if err := app.client.DeleteFileFromContainer(ctx, app.pod, app.container, path); err != nil {
+			log.Warn().Err(err).Msgf("Failed to delete file %s from pod", path)
+			event.Error = err.Error()
+		} else {
+			log.Debug().Msgf("Deleted file %s from pod", path)
+		}
+		app.emit(event)
 	}
 }
 
-func (app *App) copyFileToPod(ctx context.Context, file *os.File, tempPath string) error {
-	if err := app.client.CopyFileToContainer(ctx, file, app.pod, app.container, tempPath); err != nil {
+func (app *App) copyFileToPod(ctx context.Context, tempPath string) error {
+	if err := app.verifySignature(); err != nil {
+		return err
+	}
+	if err := app.runHooks(ctx, HookPreCopy, tempPath, nil); err != nil {
+		return err
+	}
+
+	if app.copyTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, app.copyTimeout)
+		defer cancel()
+	}
+
+	app.emit(Event{Type: EventCopyStarted, Path: tempPath, Bytes: app.fileSize})
+	start := time.Now()
+	err := app.client.CopyFileToContainer(ctx, app.file, app.pod, app.container, tempPath)
+
+	event := Event{Type: EventCopyFinished, Path: tempPath, Bytes: app.fileSize, DurationMS: time.Since(start).Milliseconds()}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	app.emit(event)
+
+	if err != nil {
+		if hint := destPathHint(app.pod, app.container, path.Dir(tempPath)); hint != "" {
+			return fmt.Errorf("failed to copy file to pod: %s: %w", hint, err)
+		}
 		return fmt.Errorf("failed to copy file to pod: %w", err)
 	}
 	return nil
 }
 
 func (app *App) runFile(ctx context.Context, tempPath string) error {
-	if app.fileType == "script" {
-		return app.executeScript(ctx, tempPath)
+	command := app.remoteCommand(tempPath)
+	if err := app.runHooks(ctx, HookPreExec, tempPath, nil); err != nil {
+		return err
+	}
+
+	var err error
+	if app.usesPIDFile() {
+		err = app.executeKillableCommand(ctx, command, pidFilePath(tempPath))
+	} else {
+		err = app.executeCommand(ctx, command)
 	}
-	return app.executeBinary(ctx, tempPath)
+	if app.result.Command != nil {
+		app.runHooks(ctx, HookPostExec, tempPath, err)
+	}
+	return err
 }
 
-func (app *App) executeScript(ctx context.Context, filePath string) error {
-	command := app.buildScriptCommand(filePath)
-	return app.executeCommand(ctx, command)
+// usesPIDFile reports whether the remote process may have to be killed, which requires
+// recording its PID.
+func (app *App) usesPIDFile() bool {
+	return app.timeout > 0 || app.interruptible
 }
 
-func (app *App) buildScriptCommand(filePath string) []string {
-	if app.runner != "" {
-		return append([]string{app.runner, filePath}, app.args...)
+// pidFilePath returns where the remote wrapper records the PID of the executed file.
+func pidFilePath(filePath string) string {
+	return filePath + ".pid"
+}
+
+// remoteCommand returns the command line executing the file, see commandBuilder. It is
+// built once, so the planned and the executed command are the same.
+func (app *App) remoteCommand(filePath string) []string {
+	if app.command == nil {
+		app.command = app.newCommandBuilder(filePath).build()
 	}
+	return app.command
+}
 
-	ext := filepath.Ext(filePath)
-	runner := app.inferRunner(ext)
-	if runner == "" {
-		log.Error().Msgf("Unable to infer runner for file extension: %s", ext)
-		return []string{filePath}
+// resolveRunner returns the custom runner, or the one inferred from the file extension.
+func (app *App) resolveRunner(filePath string) string {
+	if app.runner != "" {
+		return app.runner
 	}
+	return app.inferRunner(filepath.Ext(filePath))
+}
 
-	return append([]string{runner, filePath}, app.args...)
+// scriptRunners maps file extensions to the runners inferred for scripts.
+var scriptRunners = map[string]string{
+	".js":  "node",
+	".py":  "python",
+	".rb":  "ruby",
+	".sh":  "sh",
+	".php": "php",
 }
 
-func (app *App) inferRunner(ext string) string {
-	runners := map[string]string{
-		".js":  "node",
-		".py":  "python",
-		".rb":  "ruby",
-		".sh":  "sh",
-		".php": "php",
-	}
+// Runners returns the runners rop infers for scripts, sorted.
+func Runners() []string {
+	runners := slices.Collect(maps.Values(scriptRunners))
+	slices.Sort(runners)
+	return slices.Compact(runners)
+}
 
-	if runner, ok := runners[ext]; ok {
+func (app *App) inferRunner(ext string) string {
+	if runner, ok := scriptRunners[ext]; ok {
 		log.Debug().Msgf("Using %s as runner for %s files", runner, ext)
 		return runner
 	}
@@ -110,13 +199,81 @@ func (app *App) inferRunner(ext string) string {
 	return ""
 }
 
-func (app *App) executeBinary(ctx context.Context, filePath string) error {
-	command := append([]string{filePath}, app.args...)
-	return app.executeCommand(ctx, command)
-}
-
 func (app *App) executeCommand(ctx context.Context, command []string) error {
 	log.Debug().Msgf("Running command: %s", strings.Join(command, " "))
-	return app.client.RunCommandInPod(ctx, command, app.pod, app.container)
+	app.result.Command = command
+	app.emit(Event{Type: EventExecStarted, Command: command})
+	streams, flush := app.commandStreams()
+	err := app.client.RunCommandInPod(ctx, command, app.pod, app.container, streams)
+	flush()
+	return app.recordExitCode(err)
 }
 
+// recordExitCode stores the exit code of a remote command that ran to completion and
+// only returns errors that prevented it from doing so.
+func (app *App) recordExitCode(err error) error {
+	var exitErr utilexec.ExitError
+	if errors.As(err, &exitErr) {
+		app.result.ExitCode = exitErr.ExitStatus()
+		log.Debug().Msgf("Command exited with code %d", app.result.ExitCode)
+		return nil
+	}
+	return err
+}
+
+// killableWrapper records its PID in the file $0 and execs the command. It makes itself
+// the leader of a process group first, with setsid unless it already leads one, so that
+// killing the group also reaches the processes su and runuser fork to switch the user.
+const killableWrapper = `echo $$ > "$0" || exit 1
+if ! kill -0 -- -$$ 2>/dev/null && command -v setsid >/dev/null 2>&1; then exec setsid "$@"; fi
+exec "$@"`
+
+// executeKillableCommand runs the command through a wrapper that records its PID, so that
+// the remote process can be killed when the deadline is exceeded or, for interruptible
+// runs, when ctx is cancelled.
+func (app *App) executeKillableCommand(ctx context.Context, command []string, pidFile string) error {
+	wrapped := append([]string{"sh", "-c", killableWrapper, pidFile}, command...)
+
+	var runCtx context.Context
+	var cancel context.CancelFunc
+	if app.timeout > 0 {
+		runCtx, cancel = context.WithTimeout(ctx, app.timeout)
+	} else {
+		runCtx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	log.Debug().Msgf("Running command with PID file %s (timeout %s): %s", pidFile, app.timeout, strings.Join(wrapped, " "))
+	app.result.Command = command
+	app.emit(Event{Type: EventExecStarted, Command: command})
+	streams, flush := app.commandStreams()
+	err := app.client.RunCommandInPod(runCtx, wrapped, app.pod, app.container, streams)
+	flush()
+	switch {
+	case app.timeout > 0 && errors.Is(runCtx.Err(), context.DeadlineExceeded):
+		app.result.TimedOut = true
+		app.killRemoteProcess(context.WithoutCancel(ctx), pidFile)
+		return fmt.Errorf("%w after %s", ErrTimeout, app.timeout)
+	case app.interruptible && ctx.Err() != nil:
+		app.killRemoteProcess(context.WithoutCancel(ctx), pidFile)
+		return fmt.Errorf("interrupted: %w", ctx.Err())
+	}
+
+	return app.recordExitCode(err)
+}
+
+// killScript kills the process recorded in the PID file $0: the process group the wrapper
+// leads, falling back to the process and its direct children where setsid was missing.
+const killScript = `pid=$(cat "$0" 2>/dev/null) || exit 0
+kill -s TERM -- -"$pid" 2>/dev/null || { pkill -TERM -P "$pid" 2>/dev/null; kill -s TERM "$pid" 2>/dev/null; }
+exit 0`
+
+func (app *App) killRemoteProcess(ctx context.Context, pidFile string) {
+	ctx, cancel := context.WithTimeout(ctx, killTimeout)
+	defer cancel()
+
+	log.Debug().Msgf("Killing remote process recorded in %s", pidFile)
+	if err := app.client.RunAuxiliaryCommand(ctx, []string{"sh", "-c", killScript, pidFile}, app.pod, app.container); err != nil {
+		log.Warn().Err(err).Msg("Failed to kill remote process")
+	}
+}
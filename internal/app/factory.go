@@ -1,31 +1,126 @@
 package app
 
 import (
-	"flag"
+	"fmt"
+	"io"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/marianozunino/rop/internal/k8s"
-	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
+// Result describes a finished execution.
+type Result struct {
+	Namespace string
+	Pod       string
+	Container string
+	// Command is the command line executed in the container.
+	Command []string
+	// ExitCode is the exit code of the remote command.
+	ExitCode   int
+	TimedOut   bool
+	Duration   time.Duration
+	FileSHA256 string
+	// Signer names the trusted key the file was signed with, when it was verified.
+	Signer string
+	// Redactions counts the secrets redacted from the output.
+	Redactions int
+	// UnappliedLimits are the resource limits the container couldn't apply, e.g. "nice 10".
+	UnappliedLimits []string
+}
+
 type App struct {
-	filePath  string
+	fileName  string
+	file      io.Reader
+	fileMode  os.FileMode
 	podName   string
-	noConfirm bool
 	fileType  string
 	args      []string
+	env       []string
 	destPath  string
 	runner    string
+	cloneRef  string
+	keepClone bool
+	cloneInit bool
+
+	timeout     time.Duration
+	copyTimeout time.Duration
+	// interruptible runs kill the remote process when their context is cancelled.
+	interruptible bool
+	// workDir is the directory the command runs in; sessions set it to their directory.
+	workDir string
+	// uploadTag prefixes the name of the uploaded file, so it can be recognized if it is
+	// ever left behind.
+	uploadTag string
+	// asUser is the uid the command runs as; userSwitch is the command prefix switching to
+	// it, found in the container once the target is known.
+	asUser     string
+	userSwitch []string
+	// limits bound the resources of the command; limitTools say how the container applies
+	// them, found once the target is known.
+	limits     ResourceLimits
+	limitTools limitTools
+	// signaturePolicy is checked before the file is copied; verifiedSHA256 is the content
+	// that passed it, signed by verifiedSigner.
+	signaturePolicy SignaturePolicy
+	verifiedSHA256  string
+	verifiedSigner  string
+	// redaction enables redacting secrets from the output; redactor does it once the
+	// container is known.
+	redaction *Redaction
+	redactor  *redactor
+	hooks     []Hook
+
+	confirm         func(plan Plan) error
+	selectContainer func(containers []Container) (string, error)
+	streams         k8s.IOStreams
+	onEvent         func(event Event)
+	tracer          trace.Tracer
+
+	fileSize   int64
+	fileSHA256 string
+	command    []string
 
-	client      *k8s.Client
 	kubeContext string
+	restConfig  *rest.Config
+	clientset   kubernetes.Interface
+	client      k8s.PodClient
 	namespace   string
 	pod         *corev1.Pod
 	container   string
+	clonedPod   *corev1.Pod
+	// stopHeartbeat stops refreshing the in-use annotation of the cloned pod.
+	stopHeartbeat func()
+	result        *Result
 }
 
 // Option setters for App struct
+func WithRESTConfig(config *rest.Config) func(app *App) {
+	return func(app *App) {
+		app.restConfig = config
+	}
+}
+
+func WithClientset(clientset kubernetes.Interface) func(app *App) {
+	return func(app *App) {
+		app.clientset = clientset
+	}
+}
+
+// WithClient sets the client used to reach pods, in place of one built from the REST config.
+func WithClient(client k8s.PodClient) func(app *App) {
+	return func(app *App) {
+		app.client = client
+	}
+}
+
+// WithKubeContext sets the name of the kubeconfig context, shown in the plan.
 func WithKubeContext(context string) func(app *App) {
 	return func(app *App) {
 		app.kubeContext = context
@@ -38,9 +133,12 @@ func WithNamespace(namespace string) func(app *App) {
 	}
 }
 
-func WithFilePath(filePath string) func(app *App) {
+// WithFile sets the file to execute. The mode is used to detect binaries when the file type is 'auto'.
+func WithFile(name string, file io.Reader, mode os.FileMode) func(app *App) {
 	return func(app *App) {
-		app.filePath = filePath
+		app.fileName = name
+		app.file = file
+		app.fileMode = mode
 	}
 }
 
@@ -56,12 +154,6 @@ func WithContainerName(containerName string) func(app *App) {
 	}
 }
 
-func WithNoConfirm(noConfirm bool) func(app *App) {
-	return func(app *App) {
-		app.noConfirm = noConfirm
-	}
-}
-
 func WithFileType(fileType string) func(app *App) {
 	return func(app *App) {
 		app.fileType = fileType
@@ -74,39 +166,247 @@ func WithArgs(args []string) func(app *App) {
 	}
 }
 
+// WithEnv sets environment variables for the command, as KEY=VALUE pairs.
+func WithEnv(env []string) func(app *App) {
+	return func(app *App) {
+		app.env = env
+	}
+}
+
 func WithDestPath(destPath string) func(app *App) {
 	return func(app *App) {
 		app.destPath = destPath
 	}
 }
 
+// WithAsUser runs the command as the given numeric uid, switching to it with setpriv, runuser
+// or su, whichever the container has.
+func WithAsUser(uid string) func(app *App) {
+	return func(app *App) {
+		app.asUser = uid
+	}
+}
+
+// WithLimits bounds the resources of the command, with the tools the container has.
+func WithLimits(limits ResourceLimits) func(app *App) {
+	return func(app *App) {
+		app.limits = limits
+	}
+}
+
+// WithSignaturePolicy verifies the signature of the file before it is copied to the pod.
+func WithSignaturePolicy(policy SignaturePolicy) func(app *App) {
+	return func(app *App) {
+		app.signaturePolicy = policy
+	}
+}
+
+// WithRedaction redacts secrets from the output of the command. Nil disables it.
+func WithRedaction(redaction *Redaction) func(app *App) {
+	return func(app *App) {
+		app.redaction = redaction
+	}
+}
+
+// WithHooks sets the hooks run around the execution of the file.
+func WithHooks(hooks []Hook) func(app *App) {
+	return func(app *App) {
+		app.hooks = hooks
+	}
+}
+
 func WithRunner(runner string) func(app *App) {
 	return func(app *App) {
 		app.runner = runner
 	}
 }
 
+func WithClone(workloadRef string) func(app *App) {
+	return func(app *App) {
+		app.cloneRef = workloadRef
+	}
+}
+
+func WithKeepClone(keep bool) func(app *App) {
+	return func(app *App) {
+		app.keepClone = keep
+	}
+}
+
+// WithCloneInit also runs the init containers that aren't sidecars in the cloned pod.
+func WithCloneInit(run bool) func(app *App) {
+	return func(app *App) {
+		app.cloneInit = run
+	}
+}
+
+func WithTimeout(timeout time.Duration) func(app *App) {
+	return func(app *App) {
+		app.timeout = timeout
+	}
+}
+
+func WithCopyTimeout(timeout time.Duration) func(app *App) {
+	return func(app *App) {
+		app.copyTimeout = timeout
+	}
+}
+
+// WithConfirm sets the confirmation step run before execution. Returning an error aborts the run.
+func WithConfirm(confirm func(plan Plan) error) func(app *App) {
+	return func(app *App) {
+		app.confirm = confirm
+	}
+}
+
+// WithContainerSelector sets how a container is picked when the pod has several of them.
+func WithContainerSelector(selectContainer func(containers []Container) (string, error)) func(app *App) {
+	return func(app *App) {
+		app.selectContainer = selectContainer
+	}
+}
+
+// WithTracerProvider sets where spans of the run phases are reported. The global provider
+// is used by default.
+func WithTracerProvider(provider trace.TracerProvider) func(app *App) {
+	return func(app *App) {
+		if provider != nil {
+			app.tracer = provider.Tracer(tracerName)
+		}
+	}
+}
+
+// WithEvents sets a handler for progress events. Output events may be reported
+// concurrently from the stdout and stderr streams.
+func WithEvents(onEvent func(event Event)) func(app *App) {
+	return func(app *App) {
+		app.onEvent = onEvent
+	}
+}
+
+func WithStreams(streams k8s.IOStreams) func(app *App) {
+	return func(app *App) {
+		app.streams = streams
+	}
+}
+
 // Create a new App instance and validate required fields
-func NewApp(opts ...func(app *App)) *App {
-	app := &App{}
+func NewApp(opts ...func(app *App)) (*App, error) {
+	app := &App{
+		fileType: "auto",
+		tracer:   otel.Tracer(tracerName),
+	}
 	for _, opt := range opts {
 		opt(app)
 	}
 
-	app.validateRequiredFields()
+	if err := app.validateRequiredFields(); err != nil {
+		return nil, err
+	}
+
+	uploadTag, err := newUploadTag(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	app.uploadTag = uploadTag
 
-	return app
+	return app, nil
 }
 
-func (app *App) validateRequiredFields() {
-	if app.kubeContext == "" || app.filePath == "" || app.podName == "" {
-		log.Error().Msg("Error: context, file, and pod name are required")
-		flag.PrintDefaults()
-		os.Exit(1)
+// NewSessionApp creates an App for session operations that don't run a file, such as
+// starting a session or opening a shell in it.
+func NewSessionApp(opts ...func(app *App)) (*App, error) {
+	app := &App{tracer: otel.Tracer(tracerName)}
+	for _, opt := range opts {
+		opt(app)
+	}
+
+	if err := app.validateTarget(); err != nil {
+		return nil, err
+	}
+	if app.cloneRef != "" {
+		return nil, fmt.Errorf("sessions are not supported on cloned pods")
+	}
+
+	return app, nil
+}
+
+// NewGCApp creates an App for App.CollectGarbage. A pod name is optional and limits the
+// scan to that pod.
+func NewGCApp(opts ...func(app *App)) (*App, error) {
+	app := &App{tracer: otel.Tracer(tracerName)}
+	for _, opt := range opts {
+		opt(app)
+	}
+
+	if app.restConfig == nil && app.client == nil {
+		return nil, fmt.Errorf("a REST config is required")
+	}
+
+	return app, nil
+}
+
+func (app *App) validateRequiredFields() error {
+	if err := app.validateTarget(); err != nil {
+		return err
+	}
+
+	if app.file == nil || app.fileName == "" {
+		return fmt.Errorf("a file to execute is required")
 	}
 
 	if app.fileType != "auto" && app.fileType != "script" && app.fileType != "binary" {
-		log.Error().Msg("Error: type must be 'auto', 'script', or 'binary'")
-		os.Exit(1)
+		return fmt.Errorf("invalid file type: %s. Must be 'auto', 'script', or 'binary'", app.fileType)
+	}
+
+	for _, env := range app.env {
+		if key, _, ok := strings.Cut(env, "="); !ok || key == "" {
+			return fmt.Errorf("invalid environment variable %q, expected KEY=VALUE", env)
+		}
+	}
+
+	if app.asUser != "" {
+		if _, err := parseUID(app.asUser); err != nil {
+			return err
+		}
+	}
+
+	if app.timeout < 0 || app.copyTimeout < 0 {
+		return fmt.Errorf("timeouts must not be negative")
 	}
+
+	if err := app.limits.validate(); err != nil {
+		return err
+	}
+
+	return validateHooks(app.hooks)
+}
+
+func (app *App) validateTarget() error {
+	if app.restConfig == nil && app.client == nil {
+		return fmt.Errorf("a REST config is required")
+	}
+
+	if app.podName == "" && app.cloneRef == "" {
+		return fmt.Errorf("either a pod name or a workload to clone is required")
+	}
+
+	if app.podName != "" && app.cloneRef != "" {
+		return fmt.Errorf("pod and clone are mutually exclusive")
+	}
+
+	if app.cloneRef != "" {
+		if _, _, err := k8s.ParseWorkloadRef(app.cloneRef); err != nil {
+			return err
+		}
+	}
+
+	if app.keepClone && app.cloneRef == "" {
+		return fmt.Errorf("keeping the pod is only possible for cloned pods")
+	}
+	if app.cloneInit && app.cloneRef == "" {
+		return fmt.Errorf("running init containers is only possible for cloned pods")
+	}
+
+	return nil
 }
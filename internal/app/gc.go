@@ -0,0 +1,226 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marianozunino/rop/internal/k8s"
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Uploaded files are named "rop-<unix seconds>-<random hex>-<file name>", so files left
+// behind by runs that never cleaned up can be recognized and aged.
+var uploadName = regexp.MustCompile(`^rop-(\d+)-[0-9a-f]{8}-.+`)
+
+// newUploadTag returns the prefix for the names of the files uploaded by a run.
+func newUploadTag(now time.Time) (string, error) {
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("failed to generate upload name: %w", err)
+	}
+	return fmt.Sprintf("rop-%d-%s-", now.Unix(), hex.EncodeToString(id)), nil
+}
+
+// ParseUploadTime returns when the file with the given name was uploaded by rop, or false
+// if the name doesn't follow the naming scheme of uploads.
+func ParseUploadTime(name string) (time.Time, bool) {
+	match := uploadName.FindStringSubmatch(path.Base(name))
+	if match == nil {
+		return time.Time{}, false
+	}
+	seconds, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(seconds, 0), true
+}
+
+// GCOptions configures App.CollectGarbage.
+type GCOptions struct {
+	// Selector limits the scan to pods matching the label selector. All running pods of the
+	// namespace are scanned when neither it nor a pod name is set.
+	Selector string
+	// Dir is the directory searched for uploads. Defaults to the directory files are copied
+	// to in each container: /tmp, or a writable one for read-only root filesystems.
+	Dir string
+	// TTL is the age from which uploads are considered left behind.
+	TTL time.Duration
+	// DryRun only reports the uploads that would be removed.
+	DryRun bool
+}
+
+// Artifact is a file left behind on a pod by a run of rop, or a pod it cloned.
+type Artifact struct {
+	Pod       string
+	Container string
+	Path      string
+	// Clone is set for a cloned pod, which is deleted as a whole. Container and Path are
+	// then empty.
+	Clone bool
+	// Uploaded is when the file was uploaded, or the cloned pod created.
+	Uploaded time.Time
+	// Removed is set once the file was deleted, never during a dry run.
+	Removed bool
+	Err     error
+}
+
+// CollectGarbage finds uploads older than the TTL in the running containers of the
+// scanned pods and removes them. Uploads of runs whose process is still alive, as recorded
+// in their PID file, are kept. Pods that can't be scanned are logged and skipped. Unless
+// a single pod is scanned, pods cloned by runs that were killed before deleting them are
+// removed too once they are older than the TTL; kept clones and clones a run still uses
+// are left alone.
+func (app *App) CollectGarbage(ctx context.Context, opts GCOptions) ([]Artifact, error) {
+	app.result = &Result{}
+	if err := app.initialize(); err != nil {
+		return nil, fmt.Errorf("initialization failed: %w", err)
+	}
+
+	now := time.Now()
+	var artifacts []Artifact
+	expiredClones := map[string]bool{}
+	if app.podName == "" {
+		clones, err := app.collectClones(ctx, opts, now)
+		if err != nil {
+			return nil, err
+		}
+		for _, clone := range clones {
+			expiredClones[clone.Pod] = true
+		}
+		artifacts = append(artifacts, clones...)
+	}
+
+	var pods []corev1.Pod
+	if app.podName != "" {
+		pod, err := app.client.FindPodByName(ctx, app.podName)
+		if err != nil {
+			return nil, err
+		}
+		pods = append(pods, *pod)
+	} else {
+		var err error
+		pods, err = app.client.ListRunningPods(ctx, opts.Selector)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range pods {
+		pod := &pods[i]
+		if expiredClones[pod.Name] {
+			continue
+		}
+		for _, container := range PodContainers(pod) {
+			if !container.Runnable() {
+				continue
+			}
+
+			dir := opts.Dir
+			if dir == "" {
+				dir = writableDestPath(pod, container.Name)
+			}
+			found, err := app.findUploads(ctx, pod, container.Name, dir)
+			if err != nil {
+				log.Warn().Err(err).Msgf("Skipping container %s of pod %s", container.Name, pod.Name)
+				continue
+			}
+
+			var expired []Artifact
+			for _, file := range found {
+				uploaded, _ := ParseUploadTime(file)
+				if now.Sub(uploaded) < opts.TTL {
+					continue
+				}
+				expired = append(expired, Artifact{Pod: pod.Name, Container: container.Name, Path: file, Uploaded: uploaded})
+			}
+
+			if !opts.DryRun {
+				app.removeArtifacts(ctx, pod, expired)
+			}
+			artifacts = append(artifacts, expired...)
+		}
+	}
+	return artifacts, nil
+}
+
+// collectClones deletes the pods cloned by rop that are older than the TTL, except those
+// kept with --keep and those a run still uses.
+func (app *App) collectClones(ctx context.Context, opts GCOptions, now time.Time) ([]Artifact, error) {
+	pods, err := app.client.ListClonePods(ctx, opts.Selector)
+	if err != nil {
+		return nil, err
+	}
+
+	var clones []Artifact
+	for i := range pods {
+		pod := &pods[i]
+		created := pod.CreationTimestamp.Time
+		if now.Sub(created) < opts.TTL {
+			continue
+		}
+		if pod.Annotations[k8s.KeepAnnotation] != "" || k8s.CloneInUse(pod, now) {
+			log.Debug().Msgf("Skipping cloned pod %s, it is kept or still in use", pod.Name)
+			continue
+		}
+		clone := Artifact{Pod: pod.Name, Clone: true, Uploaded: created}
+		if !opts.DryRun {
+			if err := app.client.DeletePod(ctx, pod); err != nil {
+				clone.Err = err
+			} else {
+				clone.Removed = true
+				log.Debug().Msgf("Deleted cloned pod %s", pod.Name)
+			}
+		}
+		clones = append(clones, clone)
+	}
+	return clones, nil
+}
+
+// listUploadsScript lists the files in the directory $0 named like uploads, except those of
+// a run still going: an upload and its PID file are skipped while the process recorded in
+// the PID file is alive.
+const listUploadsScript = `for f in "$0"/rop-*; do
+  [ -f "$f" ] || continue
+  pid=$(cat "${f%.pid}.pid" 2>/dev/null)
+  if [ -n "$pid" ] && { [ -d "/proc/$pid" ] || kill -0 "$pid" 2>/dev/null; }; then continue; fi
+  echo "$f"
+done`
+
+// findUploads lists the files in dir named like uploads of rop, except those of runs still
+// going.
+func (app *App) findUploads(ctx context.Context, pod *corev1.Pod, container, dir string) ([]string, error) {
+	var stdout, stderr bytes.Buffer
+	streams := k8s.IOStreams{Out: &stdout, ErrOut: &stderr}
+	if err := app.client.RunCommandInPod(ctx, []string{"sh", "-c", listUploadsScript, dir}, pod, container, streams); err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w, stderr: %s", dir, err, stderr.String())
+	}
+
+	var files []string
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		if _, ok := ParseUploadTime(line); ok {
+			files = append(files, line)
+		}
+	}
+	return files, nil
+}
+
+func (app *App) removeArtifacts(ctx context.Context, pod *corev1.Pod, artifacts []Artifact) {
+	for i := range artifacts {
+		artifact := &artifacts[i]
+		if err := app.client.DeleteFileFromContainer(ctx, pod, artifact.Container, artifact.Path); err != nil {
+			artifact.Err = err
+			continue
+		}
+		artifact.Removed = true
+		log.Debug().Msgf("Removed %s from container %s of pod %s", artifact.Path, artifact.Container, pod.Name)
+	}
+}
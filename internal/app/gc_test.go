@@ -0,0 +1,227 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marianozunino/rop/internal/k8s"
+	"github.com/marianozunino/rop/internal/k8s/k8stest"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseUploadTime(t *testing.T) {
+	tag, err := newUploadTag(time.Unix(1700000000, 0))
+	if err != nil {
+		t.Fatalf("newUploadTag failed: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "/tmp/" + tag + "check.sh", want: true},
+		{name: "/tmp/" + tag + "check.sh.pid", want: true},
+		{name: "/tmp/check.sh"},
+		{name: "/tmp/rop-session-0a1b2c3d"},
+		{name: "/tmp/rop-1700000000-check.sh"},
+	}
+	for _, tt := range tests {
+		uploaded, ok := ParseUploadTime(tt.name)
+		if ok != tt.want {
+			t.Errorf("ParseUploadTime(%q) = %v, want %v", tt.name, ok, tt.want)
+		}
+		if ok && !uploaded.Equal(time.Unix(1700000000, 0)) {
+			t.Errorf("ParseUploadTime(%q) = %v", tt.name, uploaded)
+		}
+	}
+}
+
+func newTestGCApp(t *testing.T, server *k8stest.ExecServer, clientset *fake.Clientset) *App {
+	t.Helper()
+
+	client, err := k8s.NewClientForConfig(server.RESTConfig(), clientset, "default")
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+	app, err := NewGCApp(WithClient(client), WithNamespace("default"))
+	if err != nil {
+		t.Fatalf("creating app: %v", err)
+	}
+	return app
+}
+
+// listingServer answers the listing of uploads with the given files.
+func listingServer(files ...string) *k8stest.ExecServer {
+	return k8stest.NewExecServer(func(exec *k8stest.Exec) int {
+		for _, file := range files {
+			fmt.Fprintln(exec.Stdout, file)
+		}
+		return 0
+	})
+}
+
+func TestCollectGarbageRemovesExpiredUploads(t *testing.T) {
+	fresh := fmt.Sprintf("/tmp/rop-%d-0a1b2c3d-fresh.sh", time.Now().Unix())
+	server := listingServer("/tmp/rop-1700000000-0a1b2c3d-check.sh", fresh, "/tmp/unrelated")
+	defer server.Close()
+
+	app := newTestGCApp(t, server, fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main")))
+	artifacts, err := app.CollectGarbage(context.Background(), GCOptions{TTL: time.Hour})
+	if err != nil {
+		t.Fatalf("CollectGarbage failed: %v", err)
+	}
+
+	if len(artifacts) != 1 || artifacts[0].Path != "/tmp/rop-1700000000-0a1b2c3d-check.sh" || !artifacts[0].Removed {
+		t.Fatalf("unexpected artifacts: %+v", artifacts)
+	}
+	lines := commandLines(server)
+	if len(lines) != 2 || lines[1] != "rm -f /tmp/rop-1700000000-0a1b2c3d-check.sh" {
+		t.Fatalf("unexpected commands: %q", lines)
+	}
+}
+
+func TestCollectGarbageDryRun(t *testing.T) {
+	server := listingServer("/tmp/rop-1700000000-0a1b2c3d-check.sh")
+	defer server.Close()
+
+	app := newTestGCApp(t, server, fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main"), k8stest.RunningPod("default", "api-2", "main", "sidecar")))
+	artifacts, err := app.CollectGarbage(context.Background(), GCOptions{TTL: time.Hour, DryRun: true})
+	if err != nil {
+		t.Fatalf("CollectGarbage failed: %v", err)
+	}
+
+	if len(artifacts) != 3 {
+		t.Fatalf("expected an artifact per container, got %+v", artifacts)
+	}
+	for _, artifact := range artifacts {
+		if artifact.Removed {
+			t.Errorf("dry run removed %+v", artifact)
+		}
+	}
+	for _, line := range commandLines(server) {
+		if strings.HasPrefix(line, "rm ") {
+			t.Errorf("dry run ran %q", line)
+		}
+	}
+}
+
+func TestCollectGarbageSkipsFailingContainers(t *testing.T) {
+	server := k8stest.NewExecServer(func(exec *k8stest.Exec) int {
+		io.WriteString(exec.Stderr, "sh: not found\n")
+		return 127
+	})
+	defer server.Close()
+
+	app := newTestGCApp(t, server, fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main")))
+	artifacts, err := app.CollectGarbage(context.Background(), GCOptions{TTL: time.Hour})
+	if err != nil || len(artifacts) != 0 {
+		t.Fatalf("expected the container to be skipped, got %+v, %v", artifacts, err)
+	}
+}
+
+func TestCollectGarbageDeletesExpiredClones(t *testing.T) {
+	server := listingServer()
+	defer server.Close()
+
+	clone := func(name string, created time.Time) *corev1.Pod {
+		pod := k8stest.RunningPod("default", name, "main")
+		pod.Labels = map[string]string{k8s.ManagedByLabel: "rop"}
+		pod.CreationTimestamp = metav1.NewTime(created)
+		return pod
+	}
+	kept := clone("api-rop-kept", time.Now().Add(-2*time.Hour))
+	kept.Annotations = map[string]string{k8s.KeepAnnotation: "true"}
+	// A long run refreshes the in-use annotation; one of a killed run went stale.
+	running := clone("api-rop-running", time.Now().Add(-2*time.Hour))
+	running.Annotations = map[string]string{k8s.InUseAnnotation: time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)}
+	stale := clone("api-rop-stale", time.Now().Add(-2*time.Hour))
+	stale.Annotations = map[string]string{k8s.InUseAnnotation: time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)}
+	clientset := fake.NewSimpleClientset(
+		k8stest.RunningPod("default", "api-1", "main"),
+		clone("api-rop-old", time.Now().Add(-2*time.Hour)),
+		clone("api-rop-new", time.Now()),
+		kept, running, stale,
+	)
+
+	app := newTestGCApp(t, server, clientset)
+	artifacts, err := app.CollectGarbage(context.Background(), GCOptions{TTL: time.Hour})
+	if err != nil {
+		t.Fatalf("CollectGarbage failed: %v", err)
+	}
+	var removed []string
+	for _, artifact := range artifacts {
+		if !artifact.Clone || !artifact.Removed {
+			t.Errorf("unexpected artifact: %+v", artifact)
+		}
+		removed = append(removed, artifact.Pod)
+	}
+	slices.Sort(removed)
+	if want := []string{"api-rop-old", "api-rop-stale"}; !slices.Equal(removed, want) {
+		t.Fatalf("removed %q, want %q", removed, want)
+	}
+
+	pods, err := clientset.CoreV1().Pods("default").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, pod := range pods.Items {
+		names = append(names, pod.Name)
+	}
+	slices.Sort(names)
+	if want := []string{"api-1", "api-rop-kept", "api-rop-new", "api-rop-running"}; !slices.Equal(names, want) {
+		t.Errorf("pods after collecting = %q, want %q", names, want)
+	}
+	// The expired clones aren't scanned for uploads, they are gone with their files.
+	if len(server.Commands()) != 4 {
+		t.Errorf("expected the uploads of the remaining pods to be listed, got %q", commandLines(server))
+	}
+}
+
+func TestListUploadsScriptSkipsRunningUploads(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not available")
+	}
+	finished := exec.Command("sh", "-c", "exit 0")
+	if err := finished.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"rop-1700000000-0a1b2c3d-plain.sh":       "",
+		"rop-1700000000-1a1b2c3d-running.sh":     "",
+		"rop-1700000000-1a1b2c3d-running.sh.pid": strconv.Itoa(os.Getpid()),
+		"rop-1700000000-2a1b2c3d-done.sh":        "",
+		"rop-1700000000-2a1b2c3d-done.sh.pid":    strconv.Itoa(finished.Process.Pid),
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	output, err := exec.Command("sh", "-c", listUploadsScript, dir).Output()
+	if err != nil {
+		t.Fatalf("listing failed: %v", err)
+	}
+	var listed []string
+	for _, line := range strings.Fields(string(output)) {
+		listed = append(listed, filepath.Base(line))
+	}
+	want := []string{"rop-1700000000-0a1b2c3d-plain.sh", "rop-1700000000-2a1b2c3d-done.sh", "rop-1700000000-2a1b2c3d-done.sh.pid"}
+	if !slices.Equal(listed, want) {
+		t.Errorf("listed %q, want %q", listed, want)
+	}
+}
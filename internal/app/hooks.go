@@ -0,0 +1,191 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/marianozunino/rop/internal/k8s"
+	"github.com/rs/zerolog/log"
+)
+
+// Hook stages, in the order they run. Hooks of a stage run in the order they are given.
+const (
+	// HookPreCopy runs before the file is copied to the pod. A failure aborts the run.
+	HookPreCopy = "pre-copy"
+	// HookPreExec runs before the file is executed. A failure aborts the run.
+	HookPreExec = "pre-exec"
+	// HookPostExec runs after the file was executed, whatever its exit code.
+	HookPostExec = "post-exec"
+	// HookOnFailure runs when the run failed or the file exited with a non-zero code.
+	HookOnFailure = "on-failure"
+)
+
+// HookStages are the valid stages of hooks.
+var HookStages = []string{HookPreCopy, HookPreExec, HookPostExec, HookOnFailure}
+
+// ErrHookFailed is returned when a pre-copy or pre-exec hook fails.
+var ErrHookFailed = errors.New("hook failed")
+
+// Hook is a command run around the execution of the file. It receives the HookRun as JSON
+// on stdin and as ROP_* environment variables. Its output goes to the stderr of the run.
+type Hook struct {
+	Stage string
+	// Command is a local shell command, run with sh -c.
+	Command string
+	// Remote is a shell snippet run with sh -c in the target container. Exactly one of
+	// Command and Remote is set.
+	Remote string
+}
+
+func (hook Hook) String() string {
+	if hook.Remote != "" {
+		return hook.Stage + " (remote): " + hook.Remote
+	}
+	return hook.Stage + ": " + hook.Command
+}
+
+// validateHooks checks the stages of the hooks and that each runs exactly one command.
+func validateHooks(hooks []Hook) error {
+	for _, hook := range hooks {
+		if !slices.Contains(HookStages, hook.Stage) {
+			return fmt.Errorf("invalid hook stage %q, expected one of %s", hook.Stage, strings.Join(HookStages, ", "))
+		}
+		if (hook.Command == "") == (hook.Remote == "") {
+			return fmt.Errorf("a %s hook needs either a command or a remote snippet", hook.Stage)
+		}
+	}
+	return nil
+}
+
+// HookRun is the metadata of the run passed to hooks.
+type HookRun struct {
+	Hook       string   `json:"hook"`
+	Context    string   `json:"context"`
+	Namespace  string   `json:"namespace"`
+	Pod        string   `json:"pod"`
+	Container  string   `json:"container"`
+	File       string   `json:"file"`
+	FileSHA256 string   `json:"file_sha256"`
+	RemotePath string   `json:"remote_path"`
+	Command    []string `json:"command,omitempty"`
+	// ExitCode and TimedOut are only set for hooks running after the execution.
+	ExitCode *int   `json:"exit_code,omitempty"`
+	TimedOut bool   `json:"timed_out,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// environ returns the metadata as environment variables.
+func (run HookRun) environ() []string {
+	env := []string{
+		"ROP_HOOK=" + run.Hook,
+		"ROP_CONTEXT=" + run.Context,
+		"ROP_NAMESPACE=" + run.Namespace,
+		"ROP_POD=" + run.Pod,
+		"ROP_CONTAINER=" + run.Container,
+		"ROP_FILE=" + run.File,
+		"ROP_FILE_SHA256=" + run.FileSHA256,
+		"ROP_REMOTE_PATH=" + run.RemotePath,
+		"ROP_COMMAND=" + strings.Join(run.Command, " "),
+	}
+	if run.ExitCode != nil {
+		env = append(env, "ROP_EXIT_CODE="+strconv.Itoa(*run.ExitCode), "ROP_TIMED_OUT="+strconv.FormatBool(run.TimedOut))
+	}
+	if run.Error != "" {
+		env = append(env, "ROP_ERROR="+run.Error)
+	}
+	return env
+}
+
+// hookRun describes the current run to hooks of the stage.
+func (app *App) hookRun(stage, remotePath string, runErr error) HookRun {
+	run := HookRun{
+		Hook:       stage,
+		Context:    app.kubeContext,
+		Namespace:  app.pod.Namespace,
+		Pod:        app.pod.Name,
+		Container:  app.container,
+		File:       app.fileName,
+		FileSHA256: app.fileSHA256,
+		RemotePath: remotePath,
+		Command:    app.remoteCommand(remotePath),
+	}
+	if stage == HookPostExec || stage == HookOnFailure {
+		if app.result.Command != nil {
+			exitCode := app.result.ExitCode
+			run.ExitCode = &exitCode
+			run.TimedOut = app.result.TimedOut
+		}
+		if runErr != nil {
+			run.Error = runErr.Error()
+		}
+	}
+	return run
+}
+
+// runHooks runs the hooks of the stage in order. Pre-copy and pre-exec hooks stop at the
+// first failure and return it; failures of later stages are only logged.
+func (app *App) runHooks(ctx context.Context, stage, remotePath string, runErr error) error {
+	aborts := stage == HookPreCopy || stage == HookPreExec
+	if !aborts {
+		// Hooks after the execution run even when it was cancelled.
+		ctx = context.WithoutCancel(ctx)
+	}
+
+	for _, hook := range app.hooks {
+		if hook.Stage != stage {
+			continue
+		}
+
+		log.Debug().Msgf("Running hook %s", hook)
+		err := app.runHook(ctx, hook, app.hookRun(stage, remotePath, runErr))
+		switch {
+		case err != nil && aborts:
+			return fmt.Errorf("%w: %s: %w", ErrHookFailed, hook, err)
+		case err != nil:
+			log.Warn().Err(err).Msgf("Hook %s failed", hook)
+		}
+	}
+	return nil
+}
+
+func (app *App) runHook(ctx context.Context, hook Hook, run HookRun) error {
+	metadata, err := json.Marshal(run)
+	if err != nil {
+		return fmt.Errorf("error encoding hook metadata: %w", err)
+	}
+	output := app.streams.ErrOut
+	if output == nil {
+		output = io.Discard
+	}
+
+	if hook.Remote != "" {
+		command := append(append([]string{"env"}, run.environ()...), "sh", "-c", hook.Remote)
+		streams := k8s.IOStreams{In: bytes.NewReader(metadata), Out: output, ErrOut: output}
+		return app.client.RunCommandInPod(ctx, command, app.pod, app.container, streams)
+	}
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", hook.Command)
+	cmd.Env = append(os.Environ(), run.environ()...)
+	cmd.Stdin = bytes.NewReader(metadata)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	return cmd.Run()
+}
+
+// runFailureHooks runs the on-failure hooks when the run failed or the file exited with a
+// non-zero code.
+func (app *App) runFailureHooks(ctx context.Context, remotePath string, runErr error) {
+	if runErr == nil && app.result.ExitCode == 0 && !app.result.TimedOut {
+		return
+	}
+	app.runHooks(ctx, HookOnFailure, remotePath, runErr)
+}
@@ -0,0 +1,141 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/marianozunino/rop/internal/k8s"
+	"github.com/marianozunino/rop/internal/k8s/k8stest"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// recordingHooks returns local hooks of every stage appending their stage, pod and exit code
+// to the log in dir, and saving their stdin to <stage>.json.
+func recordingHooks(dir string) []Hook {
+	var hooks []Hook
+	for _, stage := range HookStages {
+		hooks = append(hooks, Hook{
+			Stage:   stage,
+			Command: fmt.Sprintf(`echo $ROP_HOOK $ROP_POD $ROP_EXIT_CODE >> %[1]s/log && cat > %[1]s/$ROP_HOOK.json`, dir),
+		})
+	}
+	return hooks
+}
+
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(content)), "\n")
+}
+
+func TestRunHooks(t *testing.T) {
+	server := k8stest.NewExecServer(func(exec *k8stest.Exec) int { return 3 })
+	defer server.Close()
+	dir := t.TempDir()
+
+	app := newTestApp(t, server, fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main")),
+		WithKubeContext("prod"),
+		WithHooks(recordingHooks(dir)),
+	)
+	result, err := app.Run(context.Background())
+	if err != nil || result.ExitCode != 3 {
+		t.Fatalf("Run = (%+v, %v)", result, err)
+	}
+
+	want := []string{"pre-copy api-1", "pre-exec api-1", "post-exec api-1 3", "on-failure api-1 3"}
+	if got := readLines(t, filepath.Join(dir, "log")); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("hooks ran as %q, want %q", got, want)
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, "post-exec.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var run HookRun
+	if err := json.Unmarshal(content, &run); err != nil {
+		t.Fatalf("invalid metadata %s: %v", content, err)
+	}
+	if run.Context != "prod" || run.RemotePath != testUploadPath || run.ExitCode == nil || *run.ExitCode != 3 ||
+		strings.Join(run.Command, " ") != "sh "+testUploadPath {
+		t.Errorf("unexpected metadata: %s", content)
+	}
+}
+
+func TestFailingPreHookAbortsRun(t *testing.T) {
+	server := k8stest.NewExecServer(nil)
+	defer server.Close()
+	dir := t.TempDir()
+
+	hooks := append([]Hook{{Stage: HookPreExec, Command: "echo change log is down >&2; exit 1"}}, recordingHooks(dir)...)
+	var stderr strings.Builder
+	app := newTestApp(t, server, fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main")),
+		WithHooks(hooks),
+		WithStreams(k8s.IOStreams{Out: io.Discard, ErrOut: &stderr}),
+	)
+	_, err := app.Run(context.Background())
+	if !errors.Is(err, ErrHookFailed) || !strings.Contains(err.Error(), "pre-exec: echo change log is down") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stderr.String() != "change log is down\n" {
+		t.Errorf("unexpected hook output: %q", stderr.String())
+	}
+
+	assertCommands(t, server,
+		"cp /dev/stdin "+testUploadPath,
+		"rm -f "+testUploadPath,
+	)
+	want := []string{"pre-copy api-1", "on-failure api-1"}
+	if got := readLines(t, filepath.Join(dir, "log")); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("hooks ran as %q, want %q", got, want)
+	}
+}
+
+func TestRemoteHook(t *testing.T) {
+	var metadata []byte
+	server := k8stest.NewExecServer(func(exec *k8stest.Exec) int {
+		if exec.Command[0] == "env" {
+			metadata, _ = io.ReadAll(exec.Stdin)
+		}
+		return 0
+	})
+	defer server.Close()
+
+	app := newTestApp(t, server, fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main")),
+		WithHooks([]Hook{{Stage: HookPostExec, Remote: `pg_dump app > "/backup/$ROP_FILE_SHA256.sql"`}}),
+	)
+	if _, err := app.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	lines := commandLines(server)
+	if len(lines) != 4 || !strings.HasPrefix(lines[2], "env ROP_HOOK=post-exec ROP_CONTEXT= ROP_NAMESPACE=default ROP_POD=api-1 ") ||
+		!strings.HasSuffix(lines[2], ` ROP_EXIT_CODE=0 ROP_TIMED_OUT=false sh -c pg_dump app > "/backup/$ROP_FILE_SHA256.sql"`) {
+		t.Errorf("unexpected commands: %q", lines)
+	}
+	if !strings.Contains(string(metadata), `"hook":"post-exec"`) {
+		t.Errorf("unexpected metadata: %s", metadata)
+	}
+}
+
+func TestNewAppRejectsInvalidHooks(t *testing.T) {
+	for _, hook := range []Hook{
+		{Stage: "after", Command: "true"},
+		{Stage: HookPreExec},
+		{Stage: HookPreExec, Command: "true", Remote: "true"},
+	} {
+		_, err := NewApp(WithPodName("api"), WithFile("check.sh", strings.NewReader(testScript), 0o644), WithHooks([]Hook{hook}))
+		if err == nil {
+			t.Errorf("expected an error for %+v", hook)
+		}
+	}
+}
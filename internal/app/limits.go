@@ -0,0 +1,197 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marianozunino/rop/internal/k8s"
+	"github.com/rs/zerolog/log"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// ResourceLimits keep the executed file from starving the containers it shares a pod with.
+// The zero value sets no limits.
+type ResourceLimits struct {
+	// Nice is the niceness of the process, from -20 to 19. Zero leaves it unchanged, and
+	// negative values need CAP_SYS_NICE.
+	Nice int
+	// IONice is the I/O scheduling class, "idle", "best-effort" or "realtime", optionally
+	// followed by a level from 0 (highest) to 7, e.g. "best-effort:7".
+	IONice string
+	// MaxMemory bounds the virtual memory of the process, in bytes.
+	MaxMemory int64
+	// MaxCPUTime bounds the CPU time of the process, rounded up to seconds.
+	MaxCPUTime time.Duration
+}
+
+// ioniceClasses maps the I/O scheduling classes onto the numbers ionice takes.
+var ioniceClasses = map[string]string{"realtime": "1", "best-effort": "2", "idle": "3"}
+
+func (limits ResourceLimits) validate() error {
+	if limits.Nice < -20 || limits.Nice > 19 {
+		return fmt.Errorf("invalid niceness %d, expected -20 to 19", limits.Nice)
+	}
+	if _, err := limits.ioniceArgs(); err != nil {
+		return err
+	}
+	if limits.MaxMemory < 0 || limits.MaxCPUTime < 0 {
+		return fmt.Errorf("resource limits must not be negative")
+	}
+	return nil
+}
+
+// ioniceArgs returns the arguments of ionice setting the scheduling class, if any.
+func (limits ResourceLimits) ioniceArgs() ([]string, error) {
+	if limits.IONice == "" {
+		return nil, nil
+	}
+	name, level, hasLevel := strings.Cut(limits.IONice, ":")
+	class, ok := ioniceClasses[name]
+	if !ok {
+		return nil, fmt.Errorf("invalid I/O scheduling class %q, expected idle, best-effort or realtime", name)
+	}
+	if !hasLevel {
+		return []string{"-c", class}, nil
+	}
+	if n, err := strconv.Atoi(level); err != nil || n < 0 || n > 7 || name == "idle" {
+		return nil, fmt.Errorf("invalid I/O scheduling level %q for %s, expected 0 to 7 for best-effort or realtime", level, name)
+	}
+	return []string{"-c", class, "-n", level}, nil
+}
+
+// cpuSeconds returns MaxCPUTime in whole seconds, at least one.
+func (limits ResourceLimits) cpuSeconds() int64 {
+	return max(1, int64((limits.MaxCPUTime+time.Second-1)/time.Second))
+}
+
+// Limits that can be requested, as reported by limitsProbe and named in messages.
+const (
+	limitNice       = "nice"
+	limitIONice     = "ionice"
+	limitMaxMemory  = "max memory"
+	limitMaxCPUTime = "max CPU time"
+)
+
+// requested returns the limits that are set, each with its value for messages.
+func (limits ResourceLimits) requested() [][2]string {
+	var requested [][2]string
+	if limits.Nice != 0 {
+		requested = append(requested, [2]string{limitNice, strconv.Itoa(limits.Nice)})
+	}
+	if limits.IONice != "" {
+		requested = append(requested, [2]string{limitIONice, limits.IONice})
+	}
+	if limits.MaxMemory > 0 {
+		requested = append(requested, [2]string{limitMaxMemory, resource.NewQuantity(limits.MaxMemory, resource.BinarySI).String()})
+	}
+	if limits.MaxCPUTime > 0 {
+		requested = append(requested, [2]string{limitMaxCPUTime, (time.Duration(limits.cpuSeconds()) * time.Second).String()})
+	}
+	return requested
+}
+
+// limitsProbe checks which of the requested limits the container can apply. Its arguments
+// are the niceness, the ionice arguments, the memory limit in KiB and the CPU time in
+// seconds, each empty when not requested. It prints one line per limit that works, naming
+// the tool that applies it. The niceness that took effect is compared with the expected
+// one, since nice only warns and runs the command anyway when it may not lower it.
+const limitsProbe = `n=$0 io=$1 mem=$2 cpu=$3
+if [ -n "$n" ]; then
+  want=$(($(nice 2>/dev/null) + n)); [ "$want" -gt 19 ] && want=19; [ "$want" -lt -20 ] && want=-20
+  if [ "$(nice -n "$n" nice 2>/dev/null)" = "$want" ]; then echo nice; fi
+fi
+if [ -n "$io" ] && ionice $io true 2>/dev/null; then echo ionice; fi
+if [ -n "$mem" ]; then
+  if (ulimit -v "$mem") 2>/dev/null; then echo "memory ulimit"
+  elif prlimit --as="$((mem * 1024))" true 2>/dev/null; then echo "memory prlimit"; fi
+fi
+if [ -n "$cpu" ]; then
+  if (ulimit -t "$cpu") 2>/dev/null; then echo "cpu ulimit"
+  elif prlimit --cpu="$cpu" true 2>/dev/null; then echo "cpu prlimit"; fi
+fi
+exit 0`
+
+// limitTools records how the container applies each limit, e.g. "memory" to "prlimit".
+type limitTools map[string]string
+
+// prepareLimits finds out how the requested limits can be applied in the container, as
+// the user the file runs as. Limits that can't be applied are logged, shown in the plan
+// and reported in the result; the file still runs without them.
+func (app *App) prepareLimits(ctx context.Context) error {
+	requested := app.limits.requested()
+	if len(requested) == 0 || app.limitTools != nil {
+		return nil
+	}
+
+	args := make([]string, 4)
+	if app.limits.Nice != 0 {
+		args[0] = strconv.Itoa(app.limits.Nice)
+	}
+	ionice, _ := app.limits.ioniceArgs()
+	args[1] = strings.Join(ionice, " ")
+	if app.limits.MaxMemory > 0 {
+		args[2] = strconv.FormatInt(max(1, app.limits.MaxMemory/1024), 10)
+	}
+	if app.limits.MaxCPUTime > 0 {
+		args[3] = strconv.FormatInt(app.limits.cpuSeconds(), 10)
+	}
+
+	probe := append(append(slices.Clone(app.userSwitch), "sh", "-c", limitsProbe), args...)
+	var stdout bytes.Buffer
+	if err := app.client.RunCommandInPod(ctx, probe, app.pod, app.container, k8s.IOStreams{Out: &stdout}); err != nil {
+		return fmt.Errorf("failed to check which resource limits can be applied: %w", err)
+	}
+
+	app.limitTools = limitTools{}
+	for _, line := range strings.Split(strings.TrimSpace(stdout.String()), "\n") {
+		kind, tool, ok := strings.Cut(line, " ")
+		if !ok {
+			tool = kind
+		}
+		if kind != "" {
+			app.limitTools[kind] = tool
+		}
+	}
+
+	for _, limit := range requested {
+		if !app.limitTools.applies(limit[0]) {
+			log.Warn().Msgf("Can't apply %s %s in container %s, running without it", limit[0], limit[1], app.container)
+			app.result.UnappliedLimits = append(app.result.UnappliedLimits, limit[0]+" "+limit[1])
+		}
+	}
+	return nil
+}
+
+// applies reports whether the container can apply the limit.
+func (tools limitTools) applies(limit string) bool {
+	switch limit {
+	case limitNice:
+		return tools["nice"] != ""
+	case limitIONice:
+		return tools["ionice"] != ""
+	case limitMaxMemory:
+		return tools["memory"] != ""
+	case limitMaxCPUTime:
+		return tools["cpu"] != ""
+	}
+	return false
+}
+
+// describeLimits lists the requested limits for the plan, marking those the container
+// can't apply.
+func (app *App) describeLimits() []string {
+	var described []string
+	for _, limit := range app.limits.requested() {
+		description := limit[0] + " " + limit[1]
+		if !app.limitTools.applies(limit[0]) {
+			description += " (not applied)"
+		}
+		described = append(described, description)
+	}
+	return described
+}
@@ -0,0 +1,119 @@
+package app
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marianozunino/rop/internal/k8s/k8stest"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRunAppliesLimits(t *testing.T) {
+	server := k8stest.NewExecServer(func(exec *k8stest.Exec) int {
+		if exec.Command[0] == "sh" && strings.HasPrefix(exec.Command[2], "n=$0") {
+			io.WriteString(exec.Stdout, "nice\nmemory prlimit\n")
+		}
+		return 0
+	})
+	defer server.Close()
+
+	var plan Plan
+	app := newTestApp(t, server, fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main")),
+		WithLimits(ResourceLimits{Nice: 10, IONice: "idle", MaxMemory: 256 << 20, MaxCPUTime: 30 * time.Second}),
+		WithConfirm(func(p Plan) error {
+			plan = p
+			return nil
+		}),
+	)
+	result, err := app.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	lines := commandLines(server)
+	if len(lines) != 4 || !strings.HasSuffix(lines[0], " 10 -c 3 262144 30") {
+		t.Fatalf("unexpected commands: %q", lines)
+	}
+	if want := "nice -n 10 prlimit --as=268435456 -- sh " + testUploadPath; lines[2] != want {
+		t.Errorf("ran %q, want %q", lines[2], want)
+	}
+	if got := strings.Join(result.UnappliedLimits, ", "); got != "ionice idle, max CPU time 30s" {
+		t.Errorf("unapplied limits: %s", got)
+	}
+	if got := strings.Join(plan.Limits, ", "); got != "nice 10, ionice idle (not applied), max memory 256Mi, max CPU time 30s (not applied)" {
+		t.Errorf("planned limits: %s", got)
+	}
+}
+
+func TestRunWithoutLimitsSkipsProbe(t *testing.T) {
+	server := k8stest.NewExecServer(nil)
+	defer server.Close()
+
+	app := newTestApp(t, server, fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main")))
+	if _, err := app.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	assertCommands(t, server,
+		"cp /dev/stdin "+testUploadPath,
+		"sh "+testUploadPath,
+		"rm -f "+testUploadPath,
+	)
+}
+
+func TestNewAppRejectsInvalidLimits(t *testing.T) {
+	tests := []struct {
+		limits  ResourceLimits
+		wantErr string
+	}{
+		{ResourceLimits{Nice: 20}, "invalid niceness 20"},
+		{ResourceLimits{IONice: "low"}, `invalid I/O scheduling class "low"`},
+		{ResourceLimits{IONice: "idle:3"}, `invalid I/O scheduling level "3" for idle`},
+		{ResourceLimits{IONice: "best-effort:8"}, `invalid I/O scheduling level "8"`},
+		{ResourceLimits{MaxCPUTime: -time.Second}, "must not be negative"},
+	}
+	server := k8stest.NewExecServer(nil)
+	defer server.Close()
+
+	for _, tt := range tests {
+		_, err := NewApp(WithRESTConfig(server.RESTConfig()), WithPodName("api"), WithFile("check.sh", strings.NewReader(testScript), 0o644), WithLimits(tt.limits))
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("NewApp with %+v: got %v, want %q", tt.limits, err, tt.wantErr)
+		}
+	}
+}
+
+func TestLimitsProbeChecksEffectiveNiceness(t *testing.T) {
+	// Like GNU nice without the privilege to lower the niceness: it warns and runs the
+	// command unchanged, exiting with 0.
+	bin := t.TempDir()
+	fakeNice := "#!/bin/sh\nif [ \"$1\" = -n ]; then echo 'nice: cannot set niceness' >&2; shift 2; exec \"$@\"; fi\necho 0\n"
+	if err := os.WriteFile(filepath.Join(bin, "nice"), []byte(fakeNice), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		nice string
+		want string
+	}{
+		{os.Getenv("PATH"), "5", "nice\n"},
+		{bin + string(os.PathListSeparator) + os.Getenv("PATH"), "-5", ""},
+	}
+	for _, tt := range tests {
+		probe := exec.Command("sh", "-c", limitsProbe, tt.nice, "", "", "")
+		probe.Env = append(os.Environ(), "PATH="+tt.path)
+		output, err := probe.Output()
+		if err != nil {
+			t.Fatalf("probe failed: %v", err)
+		}
+		if string(output) != tt.want {
+			t.Errorf("probe for nice %s printed %q, want %q", tt.nice, output, tt.want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Plan describes an execution about to happen, as shown for confirmation.
+type Plan struct {
+	Server    string `json:"server"`
+	Context   string `json:"context"`
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	Container string `json:"container"`
+	// Owner is the workload owning the pod, e.g. "deployment/api".
+	Owner      string    `json:"owner,omitempty"`
+	Node       string    `json:"node"`
+	PodCreated time.Time `json:"pod_created"`
+	Restarts   int32     `json:"restarts"`
+
+	File       string `json:"file"`
+	FileSize   int64  `json:"file_size"`
+	FileSHA256 string `json:"file_sha256"`
+	DestPath   string `json:"dest_path"`
+	// Signer names the trusted key the file was signed with, when it was verified.
+	Signer string `json:"signer,omitempty"`
+	// User is the uid the command runs as, when it was switched.
+	User string `json:"user,omitempty"`
+	// Limits are the requested resource limits, e.g. "nice 10", marked "(not applied)" when
+	// the container can't apply them.
+	Limits []string `json:"limits,omitempty"`
+	// Runner is the interpreter of scripts; empty for binaries.
+	Runner string   `json:"runner,omitempty"`
+	Args   []string `json:"args,omitempty"`
+	// EnvKeys are the names of the environment variables set for the command.
+	EnvKeys []string `json:"env_keys,omitempty"`
+	// Command is the full command line executed in the container.
+	Command []string `json:"command"`
+	// Hooks are run around the execution, e.g. "pre-exec: ./notify.sh".
+	Hooks []string `json:"hooks,omitempty"`
+}
+
+func (app *App) buildPlan(ctx context.Context) (Plan, error) {
+	if err := app.digestFile(); err != nil {
+		return Plan{}, err
+	}
+	if err := app.verifySignature(); err != nil {
+		return Plan{}, err
+	}
+
+	app.determineFileType()
+	destPath := app.getDestinationPath()
+	command := app.remoteCommand(destPath)
+
+	plan := Plan{
+		Context:    app.kubeContext,
+		Namespace:  app.pod.Namespace,
+		Pod:        app.pod.Name,
+		Container:  app.container,
+		Node:       app.pod.Spec.NodeName,
+		PodCreated: app.pod.CreationTimestamp.Time,
+		File:       app.fileName,
+		FileSize:   app.fileSize,
+		FileSHA256: app.fileSHA256,
+		DestPath:   destPath,
+		Signer:     app.result.Signer,
+		User:       app.asUser,
+		Limits:     app.describeLimits(),
+		Args:       app.args,
+		Command:    command,
+	}
+
+	if app.restConfig != nil {
+		plan.Server = app.restConfig.Host
+	}
+
+	for _, status := range app.pod.Status.ContainerStatuses {
+		plan.Restarts += status.RestartCount
+	}
+
+	if app.fileType == "script" {
+		plan.Runner = app.resolveRunner(destPath)
+	}
+
+	for _, hook := range app.hooks {
+		plan.Hooks = append(plan.Hooks, hook.String())
+	}
+
+	for _, env := range app.env {
+		key, _, _ := strings.Cut(env, "=")
+		plan.EnvKeys = append(plan.EnvKeys, key)
+	}
+
+	owner, err := app.client.GetPodOwner(ctx, app.pod)
+	if err != nil {
+		log.Debug().Err(err).Msg("Unable to resolve the owner of the pod")
+	}
+	plan.Owner = owner
+
+	return plan, nil
+}
+
+// digestFile records the size and SHA-256 of the file. The content is buffered in memory,
+// so that the bytes that are verified, approved and shown in the plan are exactly the ones
+// copied, even if the file changes on disk in the meantime.
+func (app *App) digestFile() error {
+	if app.fileSHA256 != "" {
+		return nil
+	}
+
+	content, err := io.ReadAll(app.file)
+	if err != nil {
+		return fmt.Errorf("error reading file: %w", err)
+	}
+	app.file = bytes.NewReader(content)
+
+	sum := sha256.Sum256(content)
+	app.fileSize = int64(len(content))
+	app.fileSHA256 = hex.EncodeToString(sum[:])
+	app.result.FileSHA256 = app.fileSHA256
+	return nil
+}
+
+// rewindFile moves the file back to where it started, so it can be copied again.
+func (app *App) rewindFile() error {
+	seeker, ok := app.file.(io.Seeker)
+	if !ok {
+		return fmt.Errorf("file can't be rewound")
+	}
+	if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("error rewinding file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,582 @@
+package app
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marianozunino/rop/internal/k8s"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/yaml"
+)
+
+// Playbook is a sequence of steps, each running a file on a pod. Steps run in order and
+// may use the output, exit code and artifacts of earlier steps in their args and env:
+//
+//	${steps.<name>.output}            the stdout of the step, without the trailing newline
+//	${steps.<name>.exitCode}          the exit code of the step
+//	${steps.<name>.artifacts.<file>}  an artifact of the step, copied next to the file of
+//	                                  the referencing step; expands to its remote path
+type Playbook struct {
+	// Context and Namespace are the defaults of the steps.
+	Context   string         `json:"context,omitempty"`
+	Namespace string         `json:"namespace,omitempty"`
+	Steps     []PlaybookStep `json:"steps"`
+}
+
+// PlaybookStep is a single execution of a playbook.
+type PlaybookStep struct {
+	Name      string `json:"name"`
+	Context   string `json:"context,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Pod       string `json:"pod,omitempty"`
+	Clone     string `json:"clone,omitempty"`
+	Container string `json:"container,omitempty"`
+	// File is resolved relative to the playbook.
+	File     string            `json:"file"`
+	Type     string            `json:"type,omitempty"`
+	Runner   string            `json:"runner,omitempty"`
+	Args     []string          `json:"args,omitempty"`
+	Env      map[string]string `json:"env,omitempty"`
+	DestPath string            `json:"destPath,omitempty"`
+	AsUser   string            `json:"asUser,omitempty"`
+	Timeout  metav1.Duration   `json:"timeout,omitempty"`
+	// OnFailure is "abort" (the default) to stop the playbook when the step fails or exits
+	// with a non-zero code, or "continue" to go on with the next step.
+	OnFailure string `json:"onFailure,omitempty"`
+	// Artifacts are remote files fetched after the step into the artifacts directory,
+	// as <step name>/<file name>.
+	Artifacts []string `json:"artifacts,omitempty"`
+}
+
+const (
+	OnFailureAbort    = "abort"
+	OnFailureContinue = "continue"
+)
+
+var (
+	stepName      = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	stepReference = regexp.MustCompile(`\$\{steps\.([A-Za-z0-9_-]+)\.(output|exitCode|artifacts\.([^}]+))\}`)
+)
+
+// ErrPlaybookFailed is returned when a step that aborts on failure failed.
+var ErrPlaybookFailed = errors.New("playbook failed")
+
+// LoadPlaybook reads and validates a playbook. Files of the steps are made relative to the
+// directory of the playbook.
+func LoadPlaybook(file string) (*Playbook, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read playbook: %w", err)
+	}
+
+	playbook := &Playbook{}
+	if err := yaml.UnmarshalStrict(content, playbook); err != nil {
+		return nil, fmt.Errorf("failed to parse playbook %s: %w", file, err)
+	}
+
+	for i := range playbook.Steps {
+		step := &playbook.Steps[i]
+		if step.File != "" && !filepath.IsAbs(step.File) {
+			step.File = filepath.Join(filepath.Dir(file), step.File)
+		}
+	}
+
+	if err := playbook.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid playbook %s: %w", file, err)
+	}
+	return playbook, nil
+}
+
+// Validate checks the steps and their references to earlier steps.
+func (p *Playbook) Validate() error {
+	if len(p.Steps) == 0 {
+		return fmt.Errorf("no steps")
+	}
+
+	artifacts := map[string][]string{}
+	for i, step := range p.Steps {
+		if !stepName.MatchString(step.Name) {
+			return fmt.Errorf("step %d: invalid name %q, use letters, digits, '-' and '_'", i+1, step.Name)
+		}
+		if _, ok := artifacts[step.Name]; ok {
+			return fmt.Errorf("step %s: duplicate name", step.Name)
+		}
+		if step.File == "" {
+			return fmt.Errorf("step %s: a file is required", step.Name)
+		}
+		if (step.Pod == "") == (step.Clone == "") {
+			return fmt.Errorf("step %s: either pod or clone is required", step.Name)
+		}
+		if step.Context == "" && p.Context == "" {
+			return fmt.Errorf("step %s: a context is required", step.Name)
+		}
+		if step.OnFailure != "" && step.OnFailure != OnFailureAbort && step.OnFailure != OnFailureContinue {
+			return fmt.Errorf("step %s: invalid onFailure %q, expected %q or %q", step.Name, step.OnFailure, OnFailureAbort, OnFailureContinue)
+		}
+		if step.Timeout.Duration < 0 {
+			return fmt.Errorf("step %s: timeout must not be negative", step.Name)
+		}
+
+		var names []string
+		for _, artifact := range step.Artifacts {
+			if !path.IsAbs(artifact) {
+				return fmt.Errorf("step %s: artifact %s must be an absolute path", step.Name, artifact)
+			}
+			name := path.Base(artifact)
+			if slices.Contains(names, name) {
+				return fmt.Errorf("step %s: artifacts must have distinct file names, %s is repeated", step.Name, name)
+			}
+			names = append(names, name)
+		}
+
+		for _, value := range step.templates() {
+			for _, match := range stepReference.FindAllStringSubmatch(value, -1) {
+				declared, ok := artifacts[match[1]]
+				if !ok {
+					return fmt.Errorf("step %s: %s refers to a step that doesn't run before it", step.Name, match[0])
+				}
+				if match[3] != "" && !slices.Contains(declared, match[3]) {
+					return fmt.Errorf("step %s: %s refers to an artifact step %s doesn't declare", step.Name, match[0], match[1])
+				}
+			}
+		}
+		artifacts[step.Name] = names
+	}
+	return nil
+}
+
+// templates returns the values of the step that may refer to earlier steps.
+func (s PlaybookStep) templates() []string {
+	values := slices.Clone(s.Args)
+	for _, key := range s.envKeys() {
+		values = append(values, s.Env[key])
+	}
+	return values
+}
+
+func (s PlaybookStep) envKeys() []string {
+	keys := make([]string, 0, len(s.Env))
+	for key := range s.Env {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// PlaybookPlan describes the steps of a playbook about to run, as shown for approval.
+type PlaybookPlan struct {
+	Steps []StepPlan `json:"steps"`
+}
+
+// StepPlan describes a step before it runs. Pods are not resolved yet and references to
+// earlier steps are not expanded.
+type StepPlan struct {
+	Name       string        `json:"name"`
+	Context    string        `json:"context"`
+	Namespace  string        `json:"namespace"`
+	Pod        string        `json:"pod,omitempty"`
+	Clone      string        `json:"clone,omitempty"`
+	Container  string        `json:"container,omitempty"`
+	File       string        `json:"file"`
+	FileSize   int64         `json:"file_size"`
+	FileSHA256 string        `json:"file_sha256"`
+	Runner     string        `json:"runner,omitempty"`
+	Args       []string      `json:"args,omitempty"`
+	EnvKeys    []string      `json:"env_keys,omitempty"`
+	Timeout    time.Duration `json:"timeout,omitempty"`
+	OnFailure  string        `json:"on_failure"`
+	Artifacts  []string      `json:"artifacts,omitempty"`
+}
+
+// PlaybookOptions configures RunPlaybook.
+type PlaybookOptions struct {
+	// Connect returns the REST config for a kubeconfig context, and the namespace to use
+	// when neither the step nor the playbook sets one.
+	Connect func(kubeContext, namespace string) (*rest.Config, string, error)
+	// Streams receive the output of every step; the stdout of steps is also captured for
+	// later steps.
+	Streams k8s.IOStreams
+	// ArtifactsDir is the local directory artifacts are fetched into. Defaults to
+	// "rop-artifacts".
+	ArtifactsDir string
+	// Confirm is called once with the plan of all steps before the first one runs.
+	// Returning an error aborts the playbook.
+	Confirm func(plan PlaybookPlan) error
+	// Options are applied to the App of every step, e.g. WithEvents.
+	Options []func(app *App)
+	// TrustedKeys verify the signatures of the files of steps, read from <file>.minisig.
+	// RequireSignature reports whether steps in a context must run signed files. Optional.
+	TrustedKeys      []TrustedKey
+	RequireSignature func(kubeContext string) bool
+	// Hooks returns the hooks of steps in a context, in place of those set in Options.
+	// Optional.
+	Hooks func(kubeContext string) []Hook
+	// OnStepStart and OnStep are called before and after every step.
+	OnStepStart func(index int, step PlaybookStep)
+	OnStep      func(run StepRun)
+}
+
+// StepRun describes a finished step of a playbook.
+type StepRun struct {
+	Index int
+	Name  string
+	// Result is nil when the step failed before its file ran.
+	Result *Result
+	// Output is the captured stdout of the step.
+	Output string
+	// Artifacts are the local paths of the fetched artifacts.
+	Artifacts []string
+	Err       error
+}
+
+// Failed reports whether the step counts as failed for its onFailure behavior.
+func (r StepRun) Failed() bool {
+	return r.Err != nil || r.Result == nil || r.Result.ExitCode != 0 || r.Result.TimedOut
+}
+
+// RunPlaybook runs the steps of the playbook in order, after confirming them once. It
+// returns the runs of the steps that ran, and ErrPlaybookFailed when a step that aborts on
+// failure failed.
+func RunPlaybook(ctx context.Context, playbook *Playbook, opts PlaybookOptions) ([]StepRun, error) {
+	if opts.ArtifactsDir == "" {
+		opts.ArtifactsDir = "rop-artifacts"
+	}
+
+	plan, planned, err := planPlaybook(playbook, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Confirm != nil {
+		if err := opts.Confirm(plan); err != nil {
+			return nil, fmt.Errorf("action not confirmed: %w", err)
+		}
+	}
+
+	var runs []StepRun
+	for i, step := range playbook.Steps {
+		if ctx.Err() != nil {
+			return runs, ctx.Err()
+		}
+		if opts.OnStepStart != nil {
+			opts.OnStepStart(i, step)
+		}
+
+		run := runPlaybookStep(ctx, playbook, step, planned[i], runs, opts)
+		run.Index = i
+		runs = append(runs, run)
+		if opts.OnStep != nil {
+			opts.OnStep(run)
+		}
+
+		if run.Failed() && step.OnFailure != OnFailureContinue {
+			return runs, fmt.Errorf("%w: step %s", ErrPlaybookFailed, step.Name)
+		}
+	}
+	return runs, nil
+}
+
+// plannedStep is what was read for a step when planning. The step runs the content that
+// was shown in the plan, even if its file changes before the step starts.
+type plannedStep struct {
+	namespace string
+	content   []byte
+	mode      os.FileMode
+}
+
+// planPlaybook describes every step, resolves the namespaces of the steps and reads their
+// files.
+func planPlaybook(playbook *Playbook, opts PlaybookOptions) (PlaybookPlan, []plannedStep, error) {
+	var plan PlaybookPlan
+	var planned []plannedStep
+	for _, step := range playbook.Steps {
+		kubeContext := cmp.Or(step.Context, playbook.Context)
+		_, namespace, err := opts.Connect(kubeContext, cmp.Or(step.Namespace, playbook.Namespace))
+		if err != nil {
+			return PlaybookPlan{}, nil, fmt.Errorf("step %s: %w", step.Name, err)
+		}
+
+		content, mode, err := readLocalFile(step.File)
+		if err != nil {
+			return PlaybookPlan{}, nil, fmt.Errorf("step %s: %w", step.Name, err)
+		}
+		planned = append(planned, plannedStep{namespace: namespace, content: content, mode: mode})
+		digest := sha256.Sum256(content)
+
+		plan.Steps = append(plan.Steps, StepPlan{
+			Name:       step.Name,
+			Context:    kubeContext,
+			Namespace:  namespace,
+			Pod:        step.Pod,
+			Clone:      step.Clone,
+			Container:  step.Container,
+			File:       step.File,
+			FileSize:   int64(len(content)),
+			FileSHA256: hex.EncodeToString(digest[:]),
+			Runner:     step.Runner,
+			Args:       step.Args,
+			EnvKeys:    step.envKeys(),
+			Timeout:    step.Timeout.Duration,
+			OnFailure:  cmp.Or(step.OnFailure, OnFailureAbort),
+			Artifacts:  step.Artifacts,
+		})
+	}
+	return plan, planned, nil
+}
+
+func readLocalFile(name string) ([]byte, os.FileMode, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error opening file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, fmt.Errorf("error getting file info: %w", err)
+	}
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error reading file: %w", err)
+	}
+	return content, info.Mode(), nil
+}
+
+// runPlaybookStep builds the App of the step and runs it.
+func runPlaybookStep(ctx context.Context, playbook *Playbook, step PlaybookStep, planned plannedStep, previous []StepRun, opts PlaybookOptions) StepRun {
+	run := StepRun{Name: step.Name}
+	kubeContext := cmp.Or(step.Context, playbook.Context)
+
+	restConfig, _, err := opts.Connect(kubeContext, planned.namespace)
+	if err != nil {
+		run.Err = err
+		return run
+	}
+
+	output := &syncBuffer{}
+	streams := opts.Streams
+	streams.In = nil
+	streams.Out = output
+	if opts.Streams.Out != nil {
+		streams.Out = io.MultiWriter(opts.Streams.Out, output)
+	}
+
+	signature, err := ReadSignature(step.File)
+	if err != nil {
+		run.Err = err
+		return run
+	}
+	policy := SignaturePolicy{TrustedKeys: opts.TrustedKeys, Signature: signature}
+	if opts.RequireSignature != nil {
+		policy.Required = opts.RequireSignature(kubeContext)
+	}
+
+	env := make([]string, 0, len(step.Env))
+	for _, key := range step.envKeys() {
+		env = append(env, key+"="+step.Env[key])
+	}
+
+	appOpts := append([]func(app *App){
+		WithStreams(streams),
+		WithRESTConfig(restConfig),
+		WithKubeContext(kubeContext),
+		WithNamespace(planned.namespace),
+		WithPodName(step.Pod),
+		WithClone(step.Clone),
+		WithContainerName(step.Container),
+		WithFile(step.File, bytes.NewReader(planned.content), planned.mode),
+		WithArgs(step.Args),
+		WithEnv(env),
+		WithDestPath(step.DestPath),
+		WithAsUser(step.AsUser),
+		WithRunner(step.Runner),
+		WithTimeout(step.Timeout.Duration),
+		WithSignaturePolicy(policy),
+	}, opts.Options...)
+	if opts.Hooks != nil {
+		appOpts = append(appOpts, WithHooks(opts.Hooks(kubeContext)))
+	}
+	if step.Type != "" {
+		appOpts = append(appOpts, WithFileType(step.Type))
+	}
+	app, err := NewApp(appOpts...)
+	if err != nil {
+		run.Err = fmt.Errorf("invalid step: %w", err)
+		return run
+	}
+	app.confirm = nil
+
+	run.Result, run.Artifacts, run.Err = app.runStep(ctx, step, previous, opts.ArtifactsDir)
+	run.Output = output.String()
+	return run
+}
+
+// expandStepReferences replaces references to earlier steps in the args and env. It
+// returns the local artifacts to copy to the pod, by remote path. The pod must be prepared,
+// so artifacts are copied to the directory the file is copied to.
+func (app *App) expandStepReferences(previous []StepRun, artifactsDir string) map[string]string {
+	runs := map[string]StepRun{}
+	for _, run := range previous {
+		runs[run.Name] = run
+	}
+
+	inputs := map[string]string{}
+	expand := func(value string) string {
+		return stepReference.ReplaceAllStringFunc(value, func(reference string) string {
+			match := stepReference.FindStringSubmatch(reference)
+			run := runs[match[1]]
+			switch {
+			case match[2] == "output":
+				return strings.TrimSuffix(run.Output, "\n")
+			case match[2] == "exitCode":
+				if run.Result == nil {
+					return ""
+				}
+				return strconv.Itoa(run.Result.ExitCode)
+			default:
+				remote := path.Join(app.destPath, app.uploadTag+match[3])
+				inputs[remote] = filepath.Join(artifactsDir, match[1], match[3])
+				return remote
+			}
+		})
+	}
+
+	args := make([]string, len(app.args))
+	for i, arg := range app.args {
+		args[i] = expand(arg)
+	}
+	app.args = args
+	for i, env := range app.env {
+		app.env[i] = expand(env)
+	}
+	return inputs
+}
+
+// runStep runs the file like Run does, additionally copying the artifacts of earlier steps
+// it references to the pod before and fetching its artifacts after the execution.
+func (app *App) runStep(ctx context.Context, step PlaybookStep, previous []StepRun, artifactsDir string) (result *Result, artifacts []string, err error) {
+	start := time.Now()
+	app.result = &Result{}
+
+	ctx, span := app.tracer.Start(ctx, "rop.step")
+	defer func() {
+		span.SetAttributes(attribute.String("rop.step", step.Name))
+		span.SetAttributes(app.targetAttributes()...)
+		span.SetAttributes(app.resultAttributes()...)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	if err := app.traced(ctx, "initialize", func(context.Context) error { return app.initialize() }); err != nil {
+		return nil, nil, fmt.Errorf("initialization failed: %w", err)
+	}
+
+	defer app.releaseClonedPod(context.WithoutCancel(ctx))
+
+	if err := app.traced(ctx, "preparePodExecution", app.preparePodExecution); err != nil {
+		return nil, nil, fmt.Errorf("pod preparation failed: %w", err)
+	}
+
+	inputs := app.expandStepReferences(previous, artifactsDir)
+	defer app.removeInputs(context.WithoutCancel(ctx), inputs)
+	if err := app.copyInputs(ctx, inputs); err != nil {
+		return nil, nil, err
+	}
+
+	err = app.traced(ctx, "executeFile", app.executeFile)
+	app.result.Duration = time.Since(start)
+	if err != nil {
+		return app.result, nil, fmt.Errorf("file execution failed: %w", err)
+	}
+
+	artifacts, err = app.fetchArtifacts(ctx, step, artifactsDir)
+	if err != nil {
+		return app.result, artifacts, err
+	}
+	return app.result, artifacts, nil
+}
+
+func (app *App) copyInputs(ctx context.Context, inputs map[string]string) error {
+	for remote, local := range inputs {
+		file, err := os.Open(local)
+		if err != nil {
+			return fmt.Errorf("error opening artifact: %w", err)
+		}
+		err = app.client.CopyFileToContainer(ctx, file, app.pod, app.container, remote)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("failed to copy artifact %s to pod: %w", local, err)
+		}
+		log.Debug().Msgf("Copied artifact %s to %s", local, remote)
+	}
+	return nil
+}
+
+func (app *App) removeInputs(ctx context.Context, inputs map[string]string) {
+	for remote := range inputs {
+		if err := app.client.DeleteFileFromContainer(ctx, app.pod, app.container, remote); err != nil {
+			log.Warn().Err(err).Msgf("Failed to delete file %s from pod", remote)
+		}
+	}
+}
+
+// fetchArtifacts copies the artifacts of the step from the pod into
+// <artifactsDir>/<step name>.
+func (app *App) fetchArtifacts(ctx context.Context, step PlaybookStep, artifactsDir string) ([]string, error) {
+	if len(step.Artifacts) == 0 {
+		return nil, nil
+	}
+
+	dir := filepath.Join(artifactsDir, step.Name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create artifacts directory: %w", err)
+	}
+
+	var fetched []string
+	for _, artifact := range step.Artifacts {
+		local := filepath.Join(dir, path.Base(artifact))
+		if err := app.fetchArtifact(ctx, artifact, local); err != nil {
+			return fetched, err
+		}
+		log.Debug().Msgf("Fetched artifact %s to %s", artifact, local)
+		fetched = append(fetched, local)
+	}
+	return fetched, nil
+}
+
+func (app *App) fetchArtifact(ctx context.Context, remote, local string) error {
+	file, err := os.Create(local)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", local, err)
+	}
+
+	err = app.client.CopyFileFromContainer(ctx, app.pod, app.container, remote, file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(local)
+		return fmt.Errorf("failed to fetch artifact %s: %w", remote, err)
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package app
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/marianozunino/rop/internal/k8s/k8stest"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	file := filepath.Join(dir, name)
+	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+		t.Fatalf("writing %s: %v", name, err)
+	}
+	return file
+}
+
+func testPlaybookOptions(t *testing.T, server *k8stest.ExecServer) PlaybookOptions {
+	return PlaybookOptions{
+		Connect: func(kubeContext, namespace string) (*rest.Config, string, error) {
+			return server.RESTConfig(), cmp.Or(namespace, "default"), nil
+		},
+		ArtifactsDir: t.TempDir(),
+		Options:      []func(app *App){WithClientset(fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main")))},
+	}
+}
+
+func TestLoadPlaybook(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "collect.sh", "echo collect\n")
+	file := writeFile(t, dir, "plan.yaml", `
+context: staging
+steps:
+  - name: collect
+    pod: api
+    file: collect.sh
+    timeout: 5m
+    env:
+      LEVEL: debug
+    artifacts: [/tmp/report.json]
+`)
+
+	playbook, err := LoadPlaybook(file)
+	if err != nil {
+		t.Fatalf("LoadPlaybook failed: %v", err)
+	}
+	step := playbook.Steps[0]
+	if step.File != filepath.Join(dir, "collect.sh") || step.Timeout.Duration.String() != "5m0s" || step.Env["LEVEL"] != "debug" {
+		t.Errorf("unexpected step: %+v", step)
+	}
+}
+
+func TestPlaybookValidate(t *testing.T) {
+	step := func(name, args string) PlaybookStep {
+		return PlaybookStep{Name: name, Pod: "api", File: "check.sh", Args: []string{args}, Artifacts: []string{"/tmp/report.json"}}
+	}
+
+	tests := []struct {
+		name  string
+		steps []PlaybookStep
+		err   string
+	}{
+		{name: "valid", steps: []PlaybookStep{step("a", ""), step("b", "${steps.a.artifacts.report.json} ${steps.a.output}")}},
+		{name: "no steps", err: "no steps"},
+		{name: "duplicate", steps: []PlaybookStep{step("a", ""), step("a", "")}, err: "duplicate"},
+		{name: "invalid name", steps: []PlaybookStep{step("a b", "")}, err: "invalid name"},
+		{name: "later step", steps: []PlaybookStep{step("a", "${steps.b.output}"), step("b", "")}, err: "doesn't run before"},
+		{name: "unknown artifact", steps: []PlaybookStep{step("a", ""), step("b", "${steps.a.artifacts.other}")}, err: "doesn't declare"},
+		{name: "pod and clone", steps: []PlaybookStep{{Name: "a", Pod: "api", Clone: "deploy/api", File: "x"}}, err: "either pod or clone"},
+		{name: "on failure", steps: []PlaybookStep{{Name: "a", Pod: "api", File: "x", OnFailure: "retry"}}, err: "invalid onFailure"},
+		{name: "relative artifact", steps: []PlaybookStep{{Name: "a", Pod: "api", File: "x", Artifacts: []string{"report.json"}}}, err: "absolute"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := (&Playbook{Context: "staging", Steps: tt.steps}).Validate()
+			if tt.err == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("expected error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestRunPlaybookPassesOutputsAndArtifacts(t *testing.T) {
+	var server *k8stest.ExecServer
+	server = k8stest.NewExecServer(func(exec *k8stest.Exec) int {
+		switch {
+		case exec.Command[0] == "cat":
+			io.WriteString(exec.Stdout, `{"errors":3}`)
+		case strings.HasSuffix(exec.Command[1], "collect.sh"):
+			io.WriteString(exec.Stdout, "api-1 is slow\n")
+		default:
+			input, _ := server.File(exec.Command[len(exec.Command)-1])
+			exec.Stdout.Write(input)
+		}
+		return 0
+	})
+	defer server.Close()
+
+	dir := t.TempDir()
+	playbook := &Playbook{Context: "staging", Steps: []PlaybookStep{
+		{Name: "collect", Pod: "api", File: writeFile(t, dir, "collect.sh", "echo\n"), Artifacts: []string{"/var/log/report.json"}},
+		{Name: "analyze", Pod: "api", File: writeFile(t, dir, "analyze.sh", "echo\n"),
+			Args: []string{"${steps.collect.output}", "${steps.collect.artifacts.report.json}"}},
+	}}
+
+	opts := testPlaybookOptions(t, server)
+	var plan PlaybookPlan
+	opts.Confirm = func(p PlaybookPlan) error {
+		plan = p
+		return nil
+	}
+	runs, err := RunPlaybook(context.Background(), playbook, opts)
+	if err != nil {
+		t.Fatalf("RunPlaybook failed: %v", err)
+	}
+
+	if len(plan.Steps) != 2 || plan.Steps[1].OnFailure != OnFailureAbort || plan.Steps[0].FileSHA256 == "" {
+		t.Errorf("unexpected plan: %+v", plan)
+	}
+	if len(runs) != 2 || runs[0].Failed() || runs[1].Failed() {
+		t.Fatalf("unexpected runs: %+v", runs)
+	}
+
+	fetched, err := os.ReadFile(filepath.Join(opts.ArtifactsDir, "collect", "report.json"))
+	if err != nil || string(fetched) != `{"errors":3}` {
+		t.Errorf("artifact not fetched: %q, %v", fetched, err)
+	}
+	if runs[1].Output != `{"errors":3}` {
+		t.Errorf("artifact not passed to the next step, output %q", runs[1].Output)
+	}
+
+	analyze := commandLines(server)
+	var command string
+	for _, line := range analyze {
+		if strings.Contains(line, "analyze.sh") && strings.HasPrefix(line, "sh ") {
+			command = line
+		}
+	}
+	if !strings.Contains(command, " api-1 is slow /tmp/rop-") || !strings.HasSuffix(command, "-report.json") {
+		t.Errorf("references not expanded: %q", command)
+	}
+	if files := server.Files(); len(files) != 0 {
+		t.Errorf("files left on the pod: %v", files)
+	}
+}
+
+func TestRunPlaybookOnFailure(t *testing.T) {
+	server := k8stest.NewExecServer(func(exec *k8stest.Exec) int { return 1 })
+	defer server.Close()
+
+	dir := t.TempDir()
+	file := writeFile(t, dir, "check.sh", "exit 1\n")
+	playbook := &Playbook{Context: "staging", Steps: []PlaybookStep{
+		{Name: "first", Pod: "api", File: file, OnFailure: OnFailureContinue},
+		{Name: "second", Pod: "api", File: file},
+		{Name: "third", Pod: "api", File: file},
+	}}
+
+	runs, err := RunPlaybook(context.Background(), playbook, testPlaybookOptions(t, server))
+	if !errors.Is(err, ErrPlaybookFailed) || !strings.Contains(err.Error(), "second") {
+		t.Fatalf("expected the playbook to fail at the second step, got %v", err)
+	}
+	if len(runs) != 2 || runs[0].Result.ExitCode != 1 {
+		t.Fatalf("unexpected runs: %+v", runs)
+	}
+}
+
+func TestRunPlaybookRunsPlannedContent(t *testing.T) {
+	var uploaded []byte
+	var server *k8stest.ExecServer
+	server = k8stest.NewExecServer(func(exec *k8stest.Exec) int {
+		if exec.Command[0] == "sh" {
+			uploaded, _ = server.File(exec.Command[1])
+		}
+		return 0
+	})
+	defer server.Close()
+
+	file := writeFile(t, t.TempDir(), "check.sh", "echo planned\n")
+	playbook := &Playbook{Context: "staging", Steps: []PlaybookStep{{Name: "check", Pod: "api", File: file}}}
+
+	opts := testPlaybookOptions(t, server)
+	// The file is edited after the plan was confirmed.
+	opts.Confirm = func(PlaybookPlan) error {
+		return os.WriteFile(file, []byte("echo tampered\n"), 0o644)
+	}
+	if _, err := RunPlaybook(context.Background(), playbook, opts); err != nil {
+		t.Fatalf("RunPlaybook failed: %v", err)
+	}
+	if string(uploaded) != "echo planned\n" {
+		t.Errorf("uploaded file = %q, want the planned content", uploaded)
+	}
+}
+
+func TestRunPlaybookCopiesInputsToWritableDestPath(t *testing.T) {
+	var server *k8stest.ExecServer
+	server = k8stest.NewExecServer(func(exec *k8stest.Exec) int {
+		if exec.Command[0] == "cat" {
+			io.WriteString(exec.Stdout, `{"errors":3}`)
+		}
+		return 0
+	})
+	defer server.Close()
+
+	dir := t.TempDir()
+	playbook := &Playbook{Context: "staging", Steps: []PlaybookStep{
+		{Name: "collect", Pod: "api", File: writeFile(t, dir, "collect.sh", "echo\n"), Artifacts: []string{"/var/log/report.json"}},
+		{Name: "analyze", Pod: "api", File: writeFile(t, dir, "analyze.sh", "echo\n"), Args: []string{"${steps.collect.artifacts.report.json}"}},
+	}}
+
+	// The root filesystem is read-only, so files go to the emptyDir at /cache.
+	opts := testPlaybookOptions(t, server)
+	opts.Options = []func(app *App){WithClientset(fake.NewSimpleClientset(readOnlyPod("/cache")))}
+	if _, err := RunPlaybook(context.Background(), playbook, opts); err != nil {
+		t.Fatalf("RunPlaybook failed: %v", err)
+	}
+
+	var command string
+	for _, line := range commandLines(server) {
+		if strings.HasPrefix(line, "cp /dev/stdin ") && strings.HasSuffix(line, "-report.json") {
+			command = line
+		}
+	}
+	if !strings.HasPrefix(command, "cp /dev/stdin /cache/rop-") {
+		t.Errorf("artifact not copied to /cache: %q", command)
+	}
+}
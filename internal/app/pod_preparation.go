@@ -2,46 +2,145 @@ package app
 
 import (
 	"fmt"
-	"os"
+	"strings"
 
-	"github.com/marianozunino/rop/internal/ui"
 	"github.com/rs/zerolog/log"
 	corev1 "k8s.io/api/core/v1"
 )
 
+// DefaultContainerAnnotation names the container kubectl uses when none is given.
+const DefaultContainerAnnotation = "kubectl.kubernetes.io/default-container"
+
+// Container describes a container of the target pod, as offered for selection.
+type Container struct {
+	Name  string
+	Image string
+	// Init is set for init containers, including restartable (sidecar) ones.
+	Init bool
+	// State is "running", "waiting: <reason>", "terminated: <reason>" or "unknown" when
+	// the pod reports no status for the container.
+	State string
+}
+
+// Runnable reports whether commands can be executed in the container. Containers without
+// a status are assumed to be runnable, init containers only when they are known to run.
+func (c Container) Runnable() bool {
+	if c.Init {
+		return c.State == "running"
+	}
+	return c.State == "running" || c.State == "unknown"
+}
+
+// PodContainers lists the containers of the pod followed by its init containers.
+func PodContainers(pod *corev1.Pod) []Container {
+	states := map[string]string{}
+	for _, status := range append(pod.Status.ContainerStatuses, pod.Status.InitContainerStatuses...) {
+		states[status.Name] = containerState(status.State)
+	}
+
+	var containers []Container
+	add := func(specs []corev1.Container, init bool) {
+		for _, spec := range specs {
+			state, ok := states[spec.Name]
+			if !ok {
+				state = "unknown"
+			}
+			containers = append(containers, Container{Name: spec.Name, Image: spec.Image, Init: init, State: state})
+		}
+	}
+	add(pod.Spec.Containers, false)
+	add(pod.Spec.InitContainers, true)
+	return containers
+}
+
+func containerState(state corev1.ContainerState) string {
+	switch {
+	case state.Running != nil:
+		return "running"
+	case state.Terminated != nil:
+		return "terminated: " + state.Terminated.Reason
+	case state.Waiting != nil:
+		return "waiting: " + state.Waiting.Reason
+	default:
+		return "unknown"
+	}
+}
+
 // PreparePodEnvironment handles the preparation steps for pod execution
 func (app *App) PreparePodEnvironment() error {
 	if err := app.selectExecutionContainer(); err != nil {
 		return fmt.Errorf("container selection failed: %w", err)
 	}
 
+	if app.destPath == "" {
+		app.destPath = writableDestPath(app.pod, app.container)
+	}
+
 	return nil
 }
 
 func (app *App) selectExecutionContainer() error {
+	containers := PodContainers(app.pod)
+
 	if app.container != "" {
-		log.Debug().Msgf("Using pre-selected container: %s", app.container)
-		return nil
+		return app.checkContainer(containers, app.container)
 	}
 
-	containers := app.pod.Spec.Containers
+	var runnable []Container
+	for _, container := range containers {
+		if container.Runnable() {
+			runnable = append(runnable, container)
+		} else if !container.Init {
+			log.Warn().Msgf("Skipping container %s (%s)", container.Name, container.State)
+		}
+	}
+
+	if len(runnable) == 0 {
+		return fmt.Errorf("pod %s has no running containers", app.pod.Name)
+	}
+
+	if name := app.pod.Annotations[DefaultContainerAnnotation]; name != "" {
+		for _, container := range runnable {
+			if container.Name == name {
+				app.container = name
+				log.Debug().Msgf("Using default container from annotation: %s", app.container)
+				return nil
+			}
+		}
+		log.Warn().Msgf("Default container %s of pod %s is missing or not running", name, app.pod.Name)
+	}
 
-	if len(containers) == 1 {
-		app.container = containers[0].Name
+	if len(runnable) == 1 {
+		app.container = runnable[0].Name
 		log.Debug().Msgf("Single container found, using: %s", app.container)
 		return nil
 	}
 
-	return app.promptForContainer(containers)
+	return app.promptForContainer(runnable)
 }
 
-func (app *App) promptForContainer(containers []corev1.Container) error {
-	containerNames := make([]string, len(containers))
-	for i, container := range containers {
-		containerNames[i] = container.Name
+// checkContainer verifies a container given by name exists and can run commands.
+func (app *App) checkContainer(containers []Container, name string) error {
+	for _, container := range containers {
+		if container.Name != name {
+			continue
+		}
+		if !container.Runnable() {
+			return fmt.Errorf("container %s of pod %s is not running (%s)", name, app.pod.Name, container.State)
+		}
+		log.Debug().Msgf("Using pre-selected container: %s", app.container)
+		return nil
+	}
+
+	return fmt.Errorf("container %s not found in pod %s, available: %s", name, app.pod.Name, strings.Join(containerNames(containers), ", "))
+}
+
+func (app *App) promptForContainer(containers []Container) error {
+	if app.selectContainer == nil {
+		return fmt.Errorf("pod has multiple containers, specify one of: %s", strings.Join(containerNames(containers), ", "))
 	}
 
-	selectedContainer, err := ui.RunContainerSelection(containerNames)
+	selectedContainer, err := app.selectContainer(containers)
 	if err != nil {
 		return fmt.Errorf("error running container selection: %w", err)
 	}
@@ -51,16 +150,10 @@ func (app *App) promptForContainer(containers []corev1.Container) error {
 	return nil
 }
 
-func (app *App) validateInputFile() error {
-	fileInfo, err := os.Stat(app.filePath)
-	if os.IsNotExist(err) {
-		return fmt.Errorf("input file not found: %s", app.filePath)
-	}
-	if err != nil {
-		return fmt.Errorf("error checking input file: %w", err)
+func containerNames(containers []Container) []string {
+	names := make([]string, len(containers))
+	for i, container := range containers {
+		names[i] = container.Name
 	}
-
-	log.Debug().Msgf("Input file '%s' exists, size: %d bytes", app.filePath, fileInfo.Size())
-	return nil
+	return names
 }
-
@@ -0,0 +1,286 @@
+package app
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// redactedText replaces secrets in the output of the command.
+const redactedText = "[REDACTED]"
+
+const (
+	// minSecretLength is the length below which the values of Secret-backed environment
+	// variables are not redacted, since they would match unrelated output.
+	minSecretLength = 6
+	// maxLineLength bounds the output held back while waiting for the end of a line.
+	maxLineLength = 64 * 1024
+)
+
+// Redaction configures the redaction of secrets from the output of the command. Known secret
+// formats (AWS keys, JWTs and PEM blocks) and the values of Secret-backed environment
+// variables of the container are always redacted.
+type Redaction struct {
+	// Patterns are redacted in addition. When a pattern has capturing groups, only the
+	// groups are redacted, e.g. `password=(\S+)`.
+	Patterns []*regexp.Regexp
+}
+
+// builtinRedactions match known secret formats.
+var builtinRedactions = []*regexp.Regexp{
+	// AWS access key IDs.
+	regexp.MustCompile(`\b(?:AKIA|ASIA|ABIA|ACCA)[A-Z0-9]{16}\b`),
+	// AWS secret access keys, which can only be told apart by their name.
+	regexp.MustCompile(`(?i)aws_?secret_?access_?key["']?\s*[:=]\s*["']?([A-Za-z0-9/+]{40})\b`),
+	// JSON Web Tokens.
+	regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{4,}\.eyJ[A-Za-z0-9_-]{4,}\.[A-Za-z0-9_-]*`),
+	// PEM blocks on a single line, e.g. in JSON. Blocks spanning lines are handled by the
+	// writer.
+	regexp.MustCompile(`-----BEGIN [A-Z0-9 ]+-----(.+?)-----END [A-Z0-9 ]+-----`),
+}
+
+var (
+	pemBegin = regexp.MustCompile(`-----BEGIN [A-Z0-9 ]+-----`)
+	pemEnd   = regexp.MustCompile(`-----END [A-Z0-9 ]+-----`)
+)
+
+// redactor replaces secrets in lines of output.
+type redactor struct {
+	patterns []*regexp.Regexp
+	// values are literal secrets, longest first.
+	values []string
+}
+
+func newRedactor(redaction *Redaction, values []string) *redactor {
+	values = slices.DeleteFunc(slices.Clone(values), func(value string) bool {
+		return len(value) < minSecretLength
+	})
+	slices.SortFunc(values, func(a, b string) int {
+		return cmp.Compare(len(b), len(a))
+	})
+	return &redactor{
+		patterns: append(slices.Clone(builtinRedactions), redaction.Patterns...),
+		values:   slices.Compact(values),
+	}
+}
+
+// redact replaces the secrets in line and returns how many it replaced.
+func (r *redactor) redact(line string) (string, int) {
+	count := 0
+	for _, value := range r.values {
+		if n := strings.Count(line, value); n > 0 {
+			line = strings.ReplaceAll(line, value, redactedText)
+			count += n
+		}
+	}
+
+	for _, pattern := range r.patterns {
+		matches := pattern.FindAllStringSubmatchIndex(line, -1)
+		if matches == nil {
+			continue
+		}
+
+		var b strings.Builder
+		last := 0
+		for _, match := range matches {
+			// Without capturing groups, the whole match is redacted.
+			spans := match[2:]
+			if len(spans) == 0 {
+				spans = match[:2]
+			}
+			for i := 0; i < len(spans); i += 2 {
+				// Skip unmatched groups, overlaps and what was already redacted.
+				if spans[i] < last || line[spans[i]:spans[i+1]] == redactedText {
+					continue
+				}
+				b.WriteString(line[last:spans[i]])
+				b.WriteString(redactedText)
+				last = spans[i+1]
+				count++
+			}
+		}
+		b.WriteString(line[last:])
+		line = b.String()
+	}
+	return line, count
+}
+
+// redactingWriter redacts secrets from the output written to it line by line, so secrets
+// split across writes are found. Lines spanning PEM blocks are dropped.
+type redactingWriter struct {
+	redactor *redactor
+	w        io.Writer
+	count    *atomic.Int64
+
+	mu    sync.Mutex
+	buf   []byte
+	inPEM bool
+	err   error
+}
+
+func (w *redactingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 && len(w.buf) < maxLineLength {
+			break
+		}
+		if i < 0 {
+			i = len(w.buf) - 1
+		}
+		w.writeLine(string(w.buf[:i+1]))
+		w.buf = w.buf[i+1:]
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	return len(p), nil
+}
+
+// Flush writes the last line, even if it isn't terminated.
+func (w *redactingWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.buf) > 0 {
+		w.writeLine(string(w.buf))
+		w.buf = nil
+	}
+	// The output ended within a PEM block.
+	if w.inPEM && w.err == nil {
+		w.inPEM = false
+		w.count.Add(1)
+		_, w.err = io.WriteString(w.w, redactedText+"\n")
+	}
+	return w.err
+}
+
+func (w *redactingWriter) writeLine(line string) {
+	if w.err != nil {
+		return
+	}
+
+	switch {
+	case w.inPEM && pemEnd.MatchString(line):
+		w.inPEM = false
+		w.count.Add(1)
+		_, w.err = io.WriteString(w.w, redactedText+"\n"+line)
+		return
+	case w.inPEM:
+		return
+	}
+
+	line, n := w.redactor.redact(line)
+	w.count.Add(int64(n))
+	// A block starting on this line and ending on a later one hides the lines up to its end.
+	if begin := pemBegin.FindAllStringIndex(line, -1); begin != nil && !pemEnd.MatchString(line[begin[len(begin)-1][1]:]) {
+		w.inPEM = true
+		line = line[:begin[len(begin)-1][1]] + "\n"
+	}
+	_, w.err = io.WriteString(w.w, line)
+}
+
+// redactStreams wraps the output streams, so secrets are redacted before they are written.
+// Calling the returned function writes what is left and adds the number of redactions to
+// the result.
+func (app *App) redactStreams(out, errOut io.Writer) (io.Writer, io.Writer, func()) {
+	if app.redactor == nil {
+		return out, errOut, func() {}
+	}
+
+	var count atomic.Int64
+	var writers []*redactingWriter
+	wrap := func(w io.Writer) io.Writer {
+		if w == nil {
+			return nil
+		}
+		writer := &redactingWriter{redactor: app.redactor, w: w, count: &count}
+		writers = append(writers, writer)
+		return writer
+	}
+	out, errOut = wrap(out), wrap(errOut)
+
+	return out, errOut, func() {
+		for _, writer := range writers {
+			if err := writer.Flush(); err != nil {
+				log.Warn().Err(err).Msg("Failed to write output")
+			}
+		}
+		if n := count.Load(); n > 0 {
+			log.Debug().Msgf("Redacted %d secrets from the output", n)
+			app.result.Redactions += int(n)
+		}
+	}
+}
+
+// prepareRedaction collects the secrets redacted from the output once the container is
+// known.
+func (app *App) prepareRedaction(ctx context.Context) {
+	if app.redaction == nil || app.redactor != nil {
+		return
+	}
+	app.redactor = newRedactor(app.redaction, app.secretEnvValues(ctx))
+}
+
+// secretEnvValues returns the values of the environment variables of the container that
+// come from Secrets. Secrets that can't be read are skipped with a warning.
+func (app *App) secretEnvValues(ctx context.Context) []string {
+	spec := containerSpec(app.pod, app.container)
+	if spec == nil {
+		return nil
+	}
+
+	secrets := map[string]*corev1.Secret{}
+	secret := func(name string) *corev1.Secret {
+		if s, ok := secrets[name]; ok {
+			return s
+		}
+		s, err := app.client.GetSecret(ctx, name)
+		switch {
+		case apierrors.IsNotFound(err):
+			// Only optional references can be missing, so there is nothing to redact.
+			log.Debug().Msgf("Secret %s doesn't exist", name)
+		case err != nil:
+			log.Warn().Err(err).Msgf("Can't read secret %s, its values are not redacted from the output", name)
+		}
+		secrets[name] = s
+		return s
+	}
+
+	var values []string
+	for _, env := range spec.Env {
+		if env.ValueFrom == nil || env.ValueFrom.SecretKeyRef == nil {
+			continue
+		}
+		ref := env.ValueFrom.SecretKeyRef
+		if s := secret(ref.Name); s != nil {
+			if value, ok := s.Data[ref.Key]; ok {
+				values = append(values, string(value))
+			}
+		}
+	}
+	for _, envFrom := range spec.EnvFrom {
+		if envFrom.SecretRef == nil {
+			continue
+		}
+		if s := secret(envFrom.SecretRef.Name); s != nil {
+			for _, value := range s.Data {
+				values = append(values, string(value))
+			}
+		}
+	}
+	return values
+}
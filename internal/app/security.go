@@ -0,0 +1,220 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/marianozunino/rop/internal/k8s"
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// defaultDestPath is where files are copied to when the container can write to it.
+	defaultDestPath = "/tmp"
+	// devShmPath is a tmpfs every container has, writable even with a read-only root
+	// filesystem.
+	devShmPath = "/dev/shm"
+)
+
+// containerSpec returns the spec of the named container or init container of the pod.
+func containerSpec(pod *corev1.Pod, name string) *corev1.Container {
+	for _, specs := range [][]corev1.Container{pod.Spec.Containers, pod.Spec.InitContainers} {
+		for i := range specs {
+			if specs[i].Name == name {
+				return &specs[i]
+			}
+		}
+	}
+	return nil
+}
+
+func readOnlyRootFilesystem(spec *corev1.Container) bool {
+	sc := spec.SecurityContext
+	return sc != nil && sc.ReadOnlyRootFilesystem != nil && *sc.ReadOnlyRootFilesystem
+}
+
+// writableMounts returns where the container mounts emptyDir volumes it can write to. Other
+// writable volumes are left alone, since their content outlives the pod.
+func writableMounts(pod *corev1.Pod, spec *corev1.Container) []string {
+	emptyDirs := map[string]bool{}
+	for _, volume := range pod.Spec.Volumes {
+		if volume.EmptyDir != nil {
+			emptyDirs[volume.Name] = true
+		}
+	}
+
+	var mounts []string
+	for _, mount := range spec.VolumeMounts {
+		if emptyDirs[mount.Name] && !mount.ReadOnly && mount.SubPath == "" {
+			mounts = append(mounts, mount.MountPath)
+		}
+	}
+	return mounts
+}
+
+// writableDestPath picks the directory files are copied to when none was given: /tmp,
+// unless the root filesystem of the container is read-only. Then a writable emptyDir mount
+// is used, preferring one at /tmp, or /dev/shm when there is none.
+func writableDestPath(pod *corev1.Pod, container string) string {
+	spec := containerSpec(pod, container)
+	if spec == nil || !readOnlyRootFilesystem(spec) {
+		return defaultDestPath
+	}
+
+	mounts := writableMounts(pod, spec)
+	switch {
+	case slices.Contains(mounts, defaultDestPath):
+		return defaultDestPath
+	case len(mounts) > 0:
+		log.Debug().Msgf("Container %s has a read-only root filesystem, using emptyDir mount %s", container, mounts[0])
+		return mounts[0]
+	default:
+		log.Debug().Msgf("Container %s has a read-only root filesystem and no emptyDir mount, using %s", container, devShmPath)
+		return devShmPath
+	}
+}
+
+// destPathHint explains why files can't be written to dir in the container, or returns an
+// empty string when the container spec gives no reason.
+func destPathHint(pod *corev1.Pod, container, dir string) string {
+	spec := containerSpec(pod, container)
+	if spec == nil || !readOnlyRootFilesystem(spec) {
+		return ""
+	}
+
+	writable := append(writableMounts(pod, spec), devShmPath)
+	for _, mount := range writable {
+		if dir == mount || strings.HasPrefix(dir, strings.TrimSuffix(mount, "/")+"/") {
+			return ""
+		}
+	}
+	return fmt.Sprintf("%s is on the read-only root filesystem of container %s, writable directories are: %s",
+		dir, container, strings.Join(writable, ", "))
+}
+
+// parseUID validates the user given to run as.
+func parseUID(user string) (int64, error) {
+	uid, err := strconv.ParseInt(user, 10, 64)
+	if err != nil || uid < 0 {
+		return 0, fmt.Errorf("invalid user %q, expected a numeric uid", user)
+	}
+	return uid, nil
+}
+
+// checkUserSwitch explains from the security context why the container can't switch to
+// uid, or returns nil when it may be able to.
+func checkUserSwitch(pod *corev1.Pod, container string, uid int64) error {
+	spec := containerSpec(pod, container)
+	if spec == nil {
+		return nil
+	}
+
+	var runAsUser *int64
+	var runAsNonRoot *bool
+	if sc := pod.Spec.SecurityContext; sc != nil {
+		runAsUser, runAsNonRoot = sc.RunAsUser, sc.RunAsNonRoot
+	}
+	sc := spec.SecurityContext
+	if sc != nil && sc.RunAsUser != nil {
+		runAsUser = sc.RunAsUser
+	}
+	if sc != nil && sc.RunAsNonRoot != nil {
+		runAsNonRoot = sc.RunAsNonRoot
+	}
+
+	switch {
+	case runAsUser != nil && *runAsUser == uid:
+		return nil
+	case runAsUser != nil && *runAsUser != 0:
+		return fmt.Errorf("container %s runs as uid %d (securityContext.runAsUser), switching to uid %d needs root", container, *runAsUser, uid)
+	case runAsUser == nil && runAsNonRoot != nil && *runAsNonRoot:
+		return fmt.Errorf("container %s must not run as root (securityContext.runAsNonRoot), switching to uid %d needs root", container, uid)
+	}
+
+	if sc != nil && sc.Capabilities != nil {
+		has := func(capabilities []corev1.Capability, capability corev1.Capability) bool {
+			return slices.ContainsFunc(capabilities, func(c corev1.Capability) bool {
+				return strings.EqualFold(string(c), string(capability)) || strings.EqualFold(string(c), "ALL")
+			})
+		}
+		for _, capability := range []corev1.Capability{"SETUID", "SETGID"} {
+			if has(sc.Capabilities.Drop, capability) && !has(sc.Capabilities.Add, capability) {
+				return fmt.Errorf("container %s drops capability %s (securityContext.capabilities), which switching users needs", container, capability)
+			}
+		}
+	}
+	return nil
+}
+
+// userSwitchProbe finds how the container can run commands as the uid given as $0. It
+// prints "none" when the container already runs as that user, or the tool to use followed
+// by its arguments. When no tool works, it explains why on stderr and fails.
+const userSwitchProbe = `u=$0
+current=$(id -u)
+if [ "$current" = "$u" ]; then echo none; exit 0; fi
+if [ "$current" != 0 ]; then echo "the container runs as uid $current, switching to uid $u needs root" >&2; exit 1; fi
+entry=$(grep "^[^:]*:[^:]*:$u:" /etc/passwd 2>/dev/null | head -n 1)
+name=$(echo "$entry" | cut -d: -f1)
+gid=$(echo "$entry" | cut -d: -f4)
+if command -v setpriv >/dev/null 2>&1; then echo "setpriv ${gid:-$u}"; exit 0; fi
+if [ -z "$name" ]; then echo "setpriv is not available and uid $u has no entry in /etc/passwd for runuser or su" >&2; exit 1; fi
+if command -v runuser >/dev/null 2>&1; then echo "runuser $name"; exit 0; fi
+if command -v su >/dev/null 2>&1; then echo "su $name"; exit 0; fi
+echo "none of setpriv, runuser or su is available" >&2
+exit 1`
+
+// prepareUserSwitch finds how the command can be run as the requested user and fails with
+// an explanation when it can't.
+func (app *App) prepareUserSwitch(ctx context.Context) error {
+	if app.asUser == "" || app.userSwitch != nil {
+		return nil
+	}
+
+	uid, err := parseUID(app.asUser)
+	if err != nil {
+		return err
+	}
+	if err := checkUserSwitch(app.pod, app.container, uid); err != nil {
+		return fmt.Errorf("can't run as uid %d: %w", uid, err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	streams := k8s.IOStreams{Out: &stdout, ErrOut: &stderr}
+	err = app.client.RunCommandInPod(ctx, []string{"sh", "-c", userSwitchProbe, app.asUser}, app.pod, app.container, streams)
+	if err != nil {
+		if reason := strings.TrimSpace(stderr.String()); reason != "" {
+			return fmt.Errorf("can't run as uid %d in container %s: %s", uid, app.container, reason)
+		}
+		return fmt.Errorf("failed to check how to run as uid %d: %w", uid, err)
+	}
+
+	app.userSwitch, err = userSwitchCommand(strings.TrimSpace(stdout.String()), app.asUser)
+	if err != nil {
+		return err
+	}
+	log.Debug().Msgf("Running as uid %s with: %s", app.asUser, strings.Join(app.userSwitch, " "))
+	return nil
+}
+
+// userSwitchCommand returns the command prefix running a command as uid, for the tool
+// reported by userSwitchProbe.
+func userSwitchCommand(probe, uid string) ([]string, error) {
+	tool, arg, _ := strings.Cut(probe, " ")
+	switch tool {
+	case "none":
+		return []string{}, nil
+	case "setpriv":
+		return []string{"setpriv", "--reuid=" + uid, "--regid=" + arg, "--clear-groups", "--"}, nil
+	case "runuser":
+		return []string{"runuser", "-u", arg, "--"}, nil
+	case "su":
+		return []string{"su", "-s", "/bin/sh", arg, "-c", `exec "$0" "$@"`}, nil
+	default:
+		return nil, fmt.Errorf("unexpected result checking how to switch users: %q", probe)
+	}
+}
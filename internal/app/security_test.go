@@ -0,0 +1,201 @@
+package app
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/marianozunino/rop/internal/k8s/k8stest"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// readOnlyPod returns a pod whose container "main" has a read-only root filesystem and
+// mounts the given emptyDir volumes, keyed by mount path.
+func readOnlyPod(emptyDirs ...string) *corev1.Pod {
+	pod := k8stest.RunningPod("default", "api-1", "main")
+	readOnly := true
+	pod.Spec.Containers[0].SecurityContext = &corev1.SecurityContext{ReadOnlyRootFilesystem: &readOnly}
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+		Name:         "config",
+		VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{}},
+	})
+	pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{Name: "config", MountPath: "/etc/api"})
+	for i, mountPath := range emptyDirs {
+		name := "scratch-" + string(rune('a'+i))
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+			Name:         name,
+			VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+		})
+		pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{Name: name, MountPath: mountPath})
+	}
+	return pod
+}
+
+func TestWritableDestPath(t *testing.T) {
+	tests := []struct {
+		name string
+		pod  *corev1.Pod
+		want string
+	}{
+		{"writable root filesystem", k8stest.RunningPod("default", "api-1", "main"), "/tmp"},
+		{"emptyDir mount", readOnlyPod("/cache"), "/cache"},
+		{"emptyDir at /tmp preferred", readOnlyPod("/cache", "/tmp"), "/tmp"},
+		{"no emptyDir", readOnlyPod(), "/dev/shm"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := writableDestPath(tt.pod, "main"); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunPicksWritableDestination(t *testing.T) {
+	server := k8stest.NewExecServer(nil)
+	defer server.Close()
+
+	app := newTestApp(t, server, fake.NewSimpleClientset(readOnlyPod("/cache")))
+	if _, err := app.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	path := "/cache/" + testUploadTag + "check.sh"
+	assertCommands(t, server,
+		"cp /dev/stdin "+path,
+		"sh "+path,
+		"rm -f "+path,
+	)
+}
+
+func TestRunExplainsReadOnlyDestination(t *testing.T) {
+	server := k8stest.NewExecServer(nil)
+	defer server.Close()
+	server.FailCommand("cp", 1)
+
+	app := newTestApp(t, server, fake.NewSimpleClientset(readOnlyPod("/cache")), WithDestPath("/opt"))
+	_, err := app.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "/opt is on the read-only root filesystem of container main, writable directories are: /cache, /dev/shm") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestCheckUserSwitch(t *testing.T) {
+	uid := func(id int64) *int64 { return &id }
+	nonRoot := true
+
+	tests := []struct {
+		name    string
+		pod     *corev1.PodSecurityContext
+		context *corev1.SecurityContext
+		wantErr string
+	}{
+		{name: "no security context"},
+		{name: "already the user", context: &corev1.SecurityContext{RunAsUser: uid(1000)}},
+		{
+			name:    "runs as another user",
+			pod:     &corev1.PodSecurityContext{RunAsUser: uid(1001)},
+			wantErr: "runs as uid 1001 (securityContext.runAsUser)",
+		},
+		{
+			name:    "must not run as root",
+			pod:     &corev1.PodSecurityContext{RunAsNonRoot: &nonRoot},
+			wantErr: "securityContext.runAsNonRoot",
+		},
+		{
+			name:    "container overrides the pod",
+			pod:     &corev1.PodSecurityContext{RunAsUser: uid(1001)},
+			context: &corev1.SecurityContext{RunAsUser: uid(0)},
+		},
+		{
+			name:    "capabilities dropped",
+			context: &corev1.SecurityContext{Capabilities: &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}}},
+			wantErr: "drops capability SETUID",
+		},
+		{
+			name: "capabilities added back",
+			context: &corev1.SecurityContext{Capabilities: &corev1.Capabilities{
+				Drop: []corev1.Capability{"ALL"},
+				Add:  []corev1.Capability{"SETUID", "SETGID"},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := k8stest.RunningPod("default", "api-1", "main")
+			pod.Spec.SecurityContext = tt.pod
+			pod.Spec.Containers[0].SecurityContext = tt.context
+
+			err := checkUserSwitch(pod, "main", 1000)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("got %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunAsUser(t *testing.T) {
+	tests := []struct {
+		probe string
+		want  string
+	}{
+		{"none", "sh " + testUploadPath},
+		{"setpriv 1000", "setpriv --reuid=1000 --regid=1000 --clear-groups -- sh " + testUploadPath},
+		{"runuser app", "runuser -u app -- sh " + testUploadPath},
+		{"su app", `su -s /bin/sh app -c exec "$0" "$@" sh ` + testUploadPath},
+	}
+	for _, tt := range tests {
+		t.Run(tt.probe, func(t *testing.T) {
+			server := k8stest.NewExecServer(func(exec *k8stest.Exec) int {
+				if exec.Command[0] == "sh" && exec.Command[1] == "-c" {
+					io.WriteString(exec.Stdout, tt.probe+"\n")
+				}
+				return 0
+			})
+			defer server.Close()
+
+			app := newTestApp(t, server, fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main")), WithAsUser("1000"))
+			if _, err := app.Run(context.Background()); err != nil {
+				t.Fatalf("Run failed: %v", err)
+			}
+
+			lines := commandLines(server)
+			if len(lines) != 4 || !strings.HasPrefix(lines[0], "sh -c u=$0") || lines[2] != tt.want {
+				t.Errorf("unexpected commands: %q", lines)
+			}
+		})
+	}
+}
+
+func TestRunAsUserExplainsFailure(t *testing.T) {
+	server := k8stest.NewExecServer(func(exec *k8stest.Exec) int {
+		io.WriteString(exec.Stderr, "none of setpriv, runuser or su is available\n")
+		return 1
+	})
+	defer server.Close()
+
+	app := newTestApp(t, server, fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main")), WithAsUser("1000"))
+	_, err := app.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "can't run as uid 1000 in container main: none of setpriv, runuser or su is available") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if lines := commandLines(server); len(lines) != 1 {
+		t.Errorf("the file was copied or run: %q", lines)
+	}
+}
+
+func TestNewAppRejectsInvalidUser(t *testing.T) {
+	server := k8stest.NewExecServer(nil)
+	defer server.Close()
+
+	_, err := NewApp(WithRESTConfig(server.RESTConfig()), WithPodName("api"),
+		WithFile("check.sh", strings.NewReader(testScript), 0o644), WithAsUser("app"))
+	if err == nil || !strings.Contains(err.Error(), "expected a numeric uid") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,225 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+// SessionDirPrefix starts the names of the working directories of sessions.
+const SessionDirPrefix = "rop-session-"
+
+// ErrSessionGone is returned when the pod or the working directory of a session no longer
+// exist, e.g. because the pod was replaced.
+var ErrSessionGone = errors.New("session is gone")
+
+// Session is a working directory on a pod that is kept between runs.
+type Session struct {
+	ID        string    `json:"id"`
+	Context   string    `json:"context"`
+	Namespace string    `json:"namespace"`
+	Pod       string    `json:"pod"`
+	Container string    `json:"container"`
+	Dir       string    `json:"dir"`
+	Created   time.Time `json:"created"`
+	LastUsed  time.Time `json:"lastUsed"`
+	// Files maps the names of the files copied into Dir to the SHA-256 of their content.
+	Files map[string]string `json:"files,omitempty"`
+}
+
+// NewSessionID returns a random session ID.
+func NewSessionID() (string, error) {
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("failed to generate session ID: %w", err)
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// StartSession resolves the target pod and container and creates the working directory of
+// a new session below the destination path.
+func (app *App) StartSession(ctx context.Context, id string) (*Session, error) {
+	app.result = &Result{}
+	if err := app.initialize(); err != nil {
+		return nil, fmt.Errorf("initialization failed: %w", err)
+	}
+
+	pod, err := app.resolvePod(ctx)
+	if err != nil {
+		return nil, err
+	}
+	app.pod = pod
+	if err := app.PreparePodEnvironment(); err != nil {
+		return nil, fmt.Errorf("failed to prepare pod environment: %w", err)
+	}
+
+	dir := path.Join(app.destPath, SessionDirPrefix+id)
+	if err := app.client.RunAuxiliaryCommand(ctx, []string{"mkdir", "-p", dir}, app.pod, app.container); err != nil {
+		return nil, fmt.Errorf("failed to create session directory %s: %w", dir, err)
+	}
+	log.Debug().Msgf("Created session directory %s in pod %s", dir, app.pod.Name)
+
+	now := time.Now()
+	return &Session{
+		ID:        id,
+		Context:   app.kubeContext,
+		Namespace: app.pod.Namespace,
+		Pod:       app.pod.Name,
+		Container: app.container,
+		Dir:       dir,
+		Created:   now,
+		LastUsed:  now,
+		Files:     map[string]string{},
+	}, nil
+}
+
+// attachSession points the app at the pod and container of the session and checks that its
+// working directory still exists. The pod is looked up by its exact name, since the files of
+// the session only live there.
+func (app *App) attachSession(ctx context.Context, session *Session) error {
+	if app.result == nil {
+		app.result = &Result{}
+	}
+	if err := app.initialize(); err != nil {
+		return fmt.Errorf("initialization failed: %w", err)
+	}
+
+	pod, err := app.client.GetPod(ctx, session.Pod)
+	if apierrors.IsNotFound(err) || (err == nil && pod.DeletionTimestamp != nil) {
+		return fmt.Errorf("%w: pod %s no longer exists", ErrSessionGone, session.Pod)
+	}
+	if err != nil {
+		return err
+	}
+	app.pod = pod
+	app.container = session.Container
+	app.result.Pod = pod.Name
+	app.result.Container = app.container
+
+	err = app.client.RunAuxiliaryCommand(ctx, []string{"test", "-d", session.Dir}, app.pod, app.container)
+	var exitErr utilexec.ExitError
+	if errors.As(err, &exitErr) {
+		return fmt.Errorf("%w: directory %s no longer exists in pod %s", ErrSessionGone, session.Dir, session.Pod)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check session directory: %w", err)
+	}
+	return nil
+}
+
+// CheckSession returns ErrSessionGone when the session can't be used anymore.
+func (app *App) CheckSession(ctx context.Context, session *Session) error {
+	return app.attachSession(ctx, session)
+}
+
+// RunInSession runs the file in the working directory of the session. The file is copied
+// only when the session doesn't hold it with the same content yet, and it is kept after the
+// run. The session is updated with the copied file.
+func (app *App) RunInSession(ctx context.Context, session *Session) (*Result, error) {
+	start := time.Now()
+	app.result = &Result{Namespace: session.Namespace}
+
+	if err := app.attachSession(ctx, session); err != nil {
+		return nil, err
+	}
+	app.destPath = session.Dir
+	app.workDir = session.Dir
+	if err := app.prepareUserSwitch(ctx); err != nil {
+		return nil, err
+	}
+	if err := app.prepareLimits(ctx); err != nil {
+		return nil, err
+	}
+	app.prepareRedaction(ctx)
+
+	if app.confirm != nil {
+		plan, err := app.buildPlan(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build execution plan: %w", err)
+		}
+		if err := app.confirm(plan); err != nil {
+			return nil, fmt.Errorf("action not confirmed: %w", err)
+		}
+	}
+
+	if err := app.digestFile(); err != nil {
+		return nil, err
+	}
+	app.determineFileType()
+	tempPath := app.getDestinationPath()
+
+	name := filepath.Base(app.fileName)
+	if session.Files[name] == app.fileSHA256 {
+		log.Debug().Msgf("%s is unchanged in session %s, skipping the copy", name, session.ID)
+	} else {
+		if err := app.copyFileToPod(ctx, tempPath); err != nil {
+			app.runFailureHooks(ctx, tempPath, err)
+			return nil, err
+		}
+		if session.Files == nil {
+			session.Files = map[string]string{}
+		}
+		session.Files[name] = app.fileSHA256
+	}
+	session.LastUsed = time.Now()
+
+	err := app.runFile(ctx, tempPath)
+	app.runFailureHooks(ctx, tempPath, err)
+	if app.usesPIDFile() {
+		if err := app.client.DeleteFileFromContainer(context.WithoutCancel(ctx), app.pod, app.container, pidFilePath(tempPath)); err != nil {
+			log.Warn().Err(err).Msg("Failed to delete PID file from pod")
+		}
+	}
+	app.result.Duration = time.Since(start)
+	if err != nil {
+		return app.result, fmt.Errorf("file execution failed: %w", err)
+	}
+	return app.result, nil
+}
+
+// SessionShell opens an interactive shell in the working directory of the session, using
+// bash when the container has it.
+func (app *App) SessionShell(ctx context.Context, session *Session) error {
+	if err := app.attachSession(ctx, session); err != nil {
+		return err
+	}
+	session.LastUsed = time.Now()
+
+	script := `cd "$0" || exit 1
+if command -v bash >/dev/null 2>&1; then exec bash; fi
+exec sh`
+	err := app.client.RunCommandInPod(ctx, []string{"sh", "-c", script, session.Dir}, app.pod, app.container, app.streams)
+
+	// The exit code of the last command in the shell is no failure of the session.
+	var exitErr utilexec.ExitError
+	if errors.As(err, &exitErr) {
+		return nil
+	}
+	return err
+}
+
+// EndSession removes the working directory of the session.
+func (app *App) EndSession(ctx context.Context, session *Session) error {
+	if !strings.HasPrefix(path.Base(session.Dir), SessionDirPrefix) {
+		return fmt.Errorf("refusing to remove %s, it isn't a session directory", session.Dir)
+	}
+	if err := app.attachSession(ctx, session); err != nil {
+		return err
+	}
+
+	if err := app.client.RunAuxiliaryCommand(ctx, []string{"rm", "-rf", session.Dir}, app.pod, app.container); err != nil {
+		return fmt.Errorf("failed to remove session directory %s: %w", session.Dir, err)
+	}
+	log.Debug().Msgf("Removed session directory %s from pod %s", session.Dir, session.Pod)
+	return nil
+}
@@ -0,0 +1,149 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/marianozunino/rop/internal/k8s"
+	"github.com/marianozunino/rop/internal/k8s/k8stest"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestSessionApp(t *testing.T, server *k8stest.ExecServer, clientset *fake.Clientset) *App {
+	t.Helper()
+
+	client, err := k8s.NewClientForConfig(server.RESTConfig(), clientset, "default")
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+
+	app, err := NewSessionApp(WithClient(client), WithNamespace("default"), WithPodName("api"))
+	if err != nil {
+		t.Fatalf("creating app: %v", err)
+	}
+	return app
+}
+
+func TestSessionKeepsFilesBetweenRuns(t *testing.T) {
+	server := k8stest.NewExecServer(nil)
+	defer server.Close()
+	clientset := fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main"))
+
+	session, err := newTestSessionApp(t, server, clientset).StartSession(context.Background(), "abc")
+	if err != nil {
+		t.Fatalf("StartSession failed: %v", err)
+	}
+	if session.Pod != "api-1" || session.Container != "main" || session.Dir != "/tmp/rop-session-abc" {
+		t.Fatalf("unexpected session: %+v", session)
+	}
+
+	for range 2 {
+		app := newTestApp(t, server, clientset, WithPodName(session.Pod), WithContainerName(session.Container))
+		if _, err := app.RunInSession(context.Background(), session); err != nil {
+			t.Fatalf("RunInSession failed: %v", err)
+		}
+	}
+
+	run := `sh -c cd "$0" && exec "$@" /tmp/rop-session-abc sh /tmp/rop-session-abc/check.sh`
+	assertCommands(t, server,
+		"mkdir -p /tmp/rop-session-abc",
+		"test -d /tmp/rop-session-abc",
+		"cp /dev/stdin /tmp/rop-session-abc/check.sh",
+		run,
+		"test -d /tmp/rop-session-abc",
+		run,
+	)
+	if content, ok := server.File("/tmp/rop-session-abc/check.sh"); !ok || string(content) != testScript {
+		t.Errorf("file not kept in the session: %q", content)
+	}
+	if session.Files["check.sh"] == "" {
+		t.Errorf("session doesn't record the copied file: %+v", session.Files)
+	}
+}
+
+func TestRunInSessionCopiesChangedFile(t *testing.T) {
+	server := k8stest.NewExecServer(nil)
+	defer server.Close()
+	clientset := fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main"))
+
+	session := &Session{ID: "abc", Namespace: "default", Pod: "api-1", Container: "main", Dir: "/tmp/rop-session-abc",
+		Files: map[string]string{"check.sh": "outdated"}}
+	app := newTestApp(t, server, clientset, WithPodName(session.Pod))
+	if _, err := app.RunInSession(context.Background(), session); err != nil {
+		t.Fatalf("RunInSession failed: %v", err)
+	}
+
+	if lines := commandLines(server); len(lines) != 3 || lines[1] != "cp /dev/stdin /tmp/rop-session-abc/check.sh" {
+		t.Fatalf("expected the changed file to be copied, got %q", lines)
+	}
+}
+
+func TestEndSessionRemovesDirectory(t *testing.T) {
+	server := k8stest.NewExecServer(nil)
+	defer server.Close()
+
+	session := &Session{ID: "abc", Namespace: "default", Pod: "api-1", Container: "main", Dir: "/tmp/rop-session-abc"}
+	app := newTestSessionApp(t, server, fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main")))
+	if err := app.EndSession(context.Background(), session); err != nil {
+		t.Fatalf("EndSession failed: %v", err)
+	}
+
+	assertCommands(t, server,
+		"test -d /tmp/rop-session-abc",
+		"rm -rf /tmp/rop-session-abc",
+	)
+}
+
+func TestEndSessionRefusesOtherDirectories(t *testing.T) {
+	server := k8stest.NewExecServer(nil)
+	defer server.Close()
+
+	session := &Session{ID: "abc", Namespace: "default", Pod: "api-1", Container: "main", Dir: "/"}
+	app := newTestSessionApp(t, server, fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main")))
+	if err := app.EndSession(context.Background(), session); err == nil || !strings.Contains(err.Error(), "refusing") {
+		t.Fatalf("expected EndSession to refuse, got %v", err)
+	}
+	assertCommands(t, server)
+}
+
+func TestCheckSessionReportsGoneSessions(t *testing.T) {
+	tests := []struct {
+		name    string
+		pod     string
+		failDir bool
+	}{
+		{name: "pod replaced", pod: "api-0"},
+		{name: "directory removed", pod: "api-1", failDir: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := k8stest.NewExecServer(nil)
+			defer server.Close()
+			if tt.failDir {
+				server.FailCommand("test", 1)
+			}
+
+			session := &Session{ID: "abc", Namespace: "default", Pod: tt.pod, Container: "main", Dir: "/tmp/rop-session-abc"}
+			app := newTestSessionApp(t, server, fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main")))
+			if err := app.CheckSession(context.Background(), session); !errors.Is(err, ErrSessionGone) {
+				t.Fatalf("expected ErrSessionGone, got %v", err)
+			}
+		})
+	}
+}
+
+func TestNewSessionAppRejectsClones(t *testing.T) {
+	server := k8stest.NewExecServer(nil)
+	defer server.Close()
+
+	client, err := k8s.NewClientForConfig(server.RESTConfig(), fake.NewSimpleClientset(), "default")
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+	if _, err := NewSessionApp(WithClient(client), WithClone("deploy/api")); err == nil {
+		t.Fatal("expected sessions on cloned pods to be rejected")
+	}
+}
@@ -0,0 +1,144 @@
+package app
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"aead.dev/minisign"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrSignature is returned when a file has no valid signature of a trusted key but needs
+// one, or when its signature doesn't verify.
+var ErrSignature = errors.New("signature verification failed")
+
+// TrustedKey is a minisign public key that files may be signed with.
+type TrustedKey struct {
+	// Name identifies the signer, e.g. in the plan and the audit log.
+	Name      string
+	PublicKey minisign.PublicKey
+}
+
+// ParseTrustedKey parses a minisign public key, as printed by "minisign -G" or stored in
+// a .pub file, with or without its comment line.
+func ParseTrustedKey(name, publicKey string) (TrustedKey, error) {
+	var key minisign.PublicKey
+	if err := key.UnmarshalText([]byte(strings.TrimSpace(publicKey))); err != nil {
+		return TrustedKey{}, fmt.Errorf("invalid public key %q: %w", name, err)
+	}
+	return TrustedKey{Name: name, PublicKey: key}, nil
+}
+
+// SignatureSuffix is appended to the name of a file to find its detached signature.
+const SignatureSuffix = ".minisig"
+
+// ReadSignature reads the detached signature next to file, or returns nil when it has none.
+func ReadSignature(file string) ([]byte, error) {
+	signature, err := os.ReadFile(file + SignatureSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading signature: %w", err)
+	}
+	return signature, nil
+}
+
+// SignaturePolicy configures the verification of the file before it is copied to the pod.
+type SignaturePolicy struct {
+	TrustedKeys []TrustedKey
+	// Signature is the detached minisign signature (.minisig) of the file, nil when there
+	// is none.
+	Signature []byte
+	// Required rejects files without a valid signature of a trusted key. Otherwise only
+	// files that come with a signature are verified.
+	Required bool
+}
+
+// verifySignature checks the signature of the file against the trusted keys and records
+// the signer. The result is kept for the content, so checking again is cheap.
+func (app *App) verifySignature() error {
+	policy := app.signaturePolicy
+	if policy.Signature == nil && !policy.Required {
+		return nil
+	}
+	if err := app.digestFile(); err != nil {
+		return err
+	}
+	if app.verifiedSHA256 == app.fileSHA256 {
+		app.result.Signer = app.verifiedSigner
+		return nil
+	}
+
+	if policy.Signature == nil {
+		return fmt.Errorf("%w: %s is not signed, which context %s requires", ErrSignature, app.fileName, app.kubeContext)
+	}
+
+	var signature minisign.Signature
+	if err := signature.UnmarshalText(policy.Signature); err != nil {
+		return fmt.Errorf("%w: invalid signature of %s: %w", ErrSignature, app.fileName, err)
+	}
+
+	var key *TrustedKey
+	for i := range policy.TrustedKeys {
+		if policy.TrustedKeys[i].PublicKey.ID() == signature.KeyID {
+			key = &policy.TrustedKeys[i]
+			break
+		}
+	}
+	if key == nil {
+		return fmt.Errorf("%w: %s is signed with key %X, which is not trusted", ErrSignature, app.fileName, signature.KeyID)
+	}
+
+	verified, err := app.verifyContent(key.PublicKey, signature.Algorithm)
+	if err != nil {
+		return err
+	}
+	if !verified {
+		return fmt.Errorf("%w: the signature of %s by %s doesn't match its content", ErrSignature, app.fileName, key.Name)
+	}
+
+	log.Debug().Msgf("Verified signature of %s by %s (%q)", app.fileName, key.Name, signature.TrustedComment)
+	app.verifiedSHA256 = app.fileSHA256
+	app.verifiedSigner = key.Name
+	app.result.Signer = key.Name
+	return nil
+}
+
+// setSignature replaces the signature of the file, which then has to be verified again.
+func (app *App) setSignature(signature []byte) {
+	if bytes.Equal(signature, app.signaturePolicy.Signature) {
+		return
+	}
+	app.signaturePolicy.Signature = signature
+	app.verifiedSHA256 = ""
+	app.verifiedSigner = ""
+}
+
+// verifyContent verifies the signature over the content of the file and rewinds it.
+// Prehashed signatures, the default of minisign, are verified while streaming the file.
+func (app *App) verifyContent(key minisign.PublicKey, algorithm uint16) (bool, error) {
+	if err := app.rewindFile(); err != nil {
+		return false, err
+	}
+	defer app.rewindFile()
+
+	signature := app.signaturePolicy.Signature
+	if algorithm == minisign.HashEdDSA {
+		reader := minisign.NewReader(app.file)
+		if _, err := io.Copy(io.Discard, reader); err != nil {
+			return false, fmt.Errorf("error reading file: %w", err)
+		}
+		return reader.Verify(key, signature), nil
+	}
+
+	content, err := io.ReadAll(app.file)
+	if err != nil {
+		return false, fmt.Errorf("error reading file: %w", err)
+	}
+	return minisign.Verify(key, content, signature), nil
+}
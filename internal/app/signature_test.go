@@ -0,0 +1,273 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"aead.dev/minisign"
+	"github.com/marianozunino/rop/internal/k8s/k8stest"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func generateKey(t *testing.T) (minisign.PublicKey, minisign.PrivateKey) {
+	t.Helper()
+	public, private, err := minisign.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return public, private
+}
+
+// signPrehashed signs like minisign does by default.
+func signPrehashed(private minisign.PrivateKey, message string) []byte {
+	reader := minisign.NewReader(strings.NewReader(message))
+	io.Copy(io.Discard, reader)
+	return reader.Sign(private)
+}
+
+func TestParseTrustedKey(t *testing.T) {
+	public, _ := generateKey(t)
+	text, _ := public.MarshalText()
+
+	for _, publicKey := range []string{string(text), public.String() + "\n"} {
+		key, err := ParseTrustedKey("security", publicKey)
+		if err != nil || key.PublicKey.ID() != public.ID() {
+			t.Errorf("ParseTrustedKey(%q) = (%+v, %v)", publicKey, key, err)
+		}
+	}
+
+	if _, err := ParseTrustedKey("broken", "RWQ"); err == nil {
+		t.Error("expected an error for an invalid key")
+	}
+}
+
+func TestRunVerifiesSignature(t *testing.T) {
+	public, private := generateKey(t)
+	untrusted, untrustedPrivate := generateKey(t)
+	trusted := []TrustedKey{{Name: "other", PublicKey: untrusted}, {Name: "security", PublicKey: public}}
+
+	tests := []struct {
+		name       string
+		content    string
+		policy     SignaturePolicy
+		wantErr    string
+		wantSigner string
+	}{
+		{
+			name:   "unsigned and not required",
+			policy: SignaturePolicy{TrustedKeys: trusted},
+		},
+		{
+			name:       "prehashed signature",
+			policy:     SignaturePolicy{TrustedKeys: trusted, Signature: signPrehashed(private, testScript), Required: true},
+			wantSigner: "security",
+		},
+		{
+			name:       "legacy signature",
+			policy:     SignaturePolicy{TrustedKeys: trusted, Signature: minisign.Sign(private, []byte(testScript))},
+			wantSigner: "security",
+		},
+		{
+			name:    "unsigned but required",
+			policy:  SignaturePolicy{TrustedKeys: trusted, Required: true},
+			wantErr: "./check.sh is not signed, which context prod requires",
+		},
+		{
+			name:    "untrusted key",
+			policy:  SignaturePolicy{TrustedKeys: trusted[1:], Signature: signPrehashed(untrustedPrivate, testScript)},
+			wantErr: "which is not trusted",
+		},
+		{
+			name:    "modified content",
+			content: "echo tampered\n",
+			policy:  SignaturePolicy{TrustedKeys: trusted, Signature: signPrehashed(private, testScript)},
+			wantErr: "the signature of ./check.sh by security doesn't match its content",
+		},
+		{
+			name:    "garbage signature",
+			policy:  SignaturePolicy{TrustedKeys: trusted, Signature: []byte("not a signature")},
+			wantErr: "invalid signature of ./check.sh",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := k8stest.NewExecServer(nil)
+			defer server.Close()
+
+			content := testScript
+			if tt.content != "" {
+				content = tt.content
+			}
+			app := newTestApp(t, server, fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main")),
+				WithKubeContext("prod"),
+				WithFile("./check.sh", bytes.NewReader([]byte(content)), 0o644),
+				WithSignaturePolicy(tt.policy),
+			)
+
+			result, err := app.Run(context.Background())
+			if tt.wantErr != "" {
+				if !errors.Is(err, ErrSignature) || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got %v, want a signature error containing %q", err, tt.wantErr)
+				}
+				if lines := commandLines(server); len(lines) != 0 && strings.HasPrefix(lines[0], "cp ") {
+					t.Errorf("the file was copied: %q", lines)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Run failed: %v", err)
+			}
+			if result.Signer != tt.wantSigner {
+				t.Errorf("signer = %q, want %q", result.Signer, tt.wantSigner)
+			}
+			assertCommands(t, server,
+				"cp /dev/stdin "+testUploadPath,
+				"sh "+testUploadPath,
+				"rm -f "+testUploadPath,
+			)
+		})
+	}
+}
+
+func TestPlanShowsSigner(t *testing.T) {
+	public, private := generateKey(t)
+	server := k8stest.NewExecServer(nil)
+	defer server.Close()
+
+	var plan Plan
+	app := newTestApp(t, server, fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main")),
+		WithSignaturePolicy(SignaturePolicy{
+			TrustedKeys: []TrustedKey{{Name: "security", PublicKey: public}},
+			Signature:   signPrehashed(private, testScript),
+		}),
+		WithConfirm(func(p Plan) error {
+			plan = p
+			return nil
+		}),
+	)
+	if _, err := app.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if plan.Signer != "security" {
+		t.Errorf("plan signer = %q", plan.Signer)
+	}
+}
+
+func TestRunCopiesVerifiedContent(t *testing.T) {
+	public, private := generateKey(t)
+	var uploaded []byte
+	var server *k8stest.ExecServer
+	server = k8stest.NewExecServer(func(exec *k8stest.Exec) int {
+		uploaded, _ = server.File(testUploadPath)
+		return 0
+	})
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "check.sh")
+	if err := os.WriteFile(path, []byte(testScript), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var plan Plan
+	app := newTestApp(t, server, fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main")),
+		WithFile("./check.sh", file, 0o644),
+		WithSignaturePolicy(SignaturePolicy{
+			TrustedKeys: []TrustedKey{{Name: "security", PublicKey: public}},
+			Signature:   signPrehashed(private, testScript),
+			Required:    true,
+		}),
+		// The file is edited while the confirmation prompt is open.
+		WithConfirm(func(p Plan) error {
+			plan = p
+			return os.WriteFile(path, []byte("echo tampered\n"), 0o644)
+		}),
+	)
+	result, err := app.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if string(uploaded) != testScript {
+		t.Errorf("uploaded file = %q, want the verified %q", uploaded, testScript)
+	}
+	if result.Signer != "security" || result.FileSHA256 != plan.FileSHA256 || plan.FileSHA256 != fmt.Sprintf("%x", sha256.Sum256([]byte(testScript))) {
+		t.Errorf("unexpected signer or digest: result %+v, plan digest %s", result, plan.FileSHA256)
+	}
+}
+
+func TestWatchReloadsSignature(t *testing.T) {
+	public, private := generateKey(t)
+	var server *k8stest.ExecServer
+	server = k8stest.NewExecServer(echoUploadedFile(&server))
+	defer server.Close()
+
+	app := newTestApp(t, server, fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main")),
+		WithSignaturePolicy(SignaturePolicy{
+			TrustedKeys: []TrustedKey{{Name: "security", PublicKey: public}},
+			Required:    true,
+		}),
+	)
+
+	// The file is edited before the second run and signed again before the third.
+	versions := []struct{ content, signed string }{
+		{"echo 1\n", "echo 1\n"},
+		{"echo 2\n", "echo 1\n"},
+		{"echo 2\n", "echo 2\n"},
+		{"echo 2\n", "echo 2\n"},
+	}
+	number := 0
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var runs []WatchRun
+	err := app.Watch(ctx, WatchOptions{
+		Next: every(time.Millisecond),
+		OpenFile: func() (io.ReadCloser, error) {
+			number++
+			return io.NopCloser(strings.NewReader(versions[number-1].content)), nil
+		},
+		OpenSignature: func() ([]byte, error) {
+			return signPrehashed(private, versions[number-1].signed), nil
+		},
+		OnRun: func(run WatchRun) {
+			runs = append(runs, run)
+			if len(runs) == len(versions) {
+				cancel()
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+
+	if len(runs) != len(versions) {
+		t.Fatalf("got %d runs", len(runs))
+	}
+	if !errors.Is(runs[1].Err, ErrSignature) || runs[1].Result != nil {
+		t.Errorf("edited file without a new signature ran: %+v", runs[1])
+	}
+	for _, i := range []int{0, 2, 3} {
+		run := runs[i]
+		if run.Err != nil || run.Output != versions[i].content || run.Result.Signer != "security" {
+			t.Errorf("run %d: err %v, output %q, result %+v", run.Number, run.Err, run.Output, run.Result)
+		}
+	}
+	if !runs[2].Copied || runs[3].Copied {
+		t.Errorf("copied = %t, %t", runs[2].Copied, runs[3].Copied)
+	}
+}
@@ -0,0 +1,54 @@
+package app
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// tracerName identifies the spans of rop.
+const tracerName = "github.com/marianozunino/rop"
+
+// traced runs fn in a span named name. The target is added to the span when fn returns, so
+// spans started before the pod is resolved carry it as well.
+func (app *App) traced(ctx context.Context, name string, fn func(ctx context.Context) error) error {
+	ctx, span := app.tracer.Start(ctx, name)
+	defer span.End()
+
+	err := fn(ctx)
+	span.SetAttributes(app.targetAttributes()...)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+func (app *App) targetAttributes() []attribute.KeyValue {
+	attributes := []attribute.KeyValue{
+		attribute.String("k8s.namespace.name", app.namespace),
+		attribute.String("rop.file", app.fileName),
+	}
+	if app.kubeContext != "" {
+		attributes = append(attributes, attribute.String("rop.context", app.kubeContext))
+	}
+	if app.cloneRef != "" {
+		attributes = append(attributes, attribute.String("rop.clone", app.cloneRef))
+	}
+	if app.pod != nil {
+		attributes = append(attributes, attribute.String("k8s.pod.name", app.pod.Name))
+	}
+	if app.container != "" {
+		attributes = append(attributes, attribute.String("k8s.container.name", app.container))
+	}
+	return attributes
+}
+
+// resultAttributes describe the outcome of the executed command.
+func (app *App) resultAttributes() []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.Int("rop.exit_code", app.result.ExitCode),
+		attribute.Bool("rop.timed_out", app.result.TimedOut),
+	}
+}
@@ -0,0 +1,89 @@
+package app
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/marianozunino/rop/internal/k8s/k8stest"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRunRecordsSpans(t *testing.T) {
+	server := k8stest.NewExecServer(func(exec *k8stest.Exec) int { return 1 })
+	defer server.Close()
+
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	app := newTestApp(t, server, fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main")),
+		WithKubeContext("staging"),
+		WithTracerProvider(provider),
+	)
+	if _, err := app.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	spans := map[string]tracetest.SpanStub{}
+	var names []string
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+		names = append(names, span.Name)
+	}
+
+	want := "initialize preparePodExecution copy run cleanup executeFile rop.run"
+	if strings.Join(names, " ") != want {
+		t.Fatalf("spans = %v, want %s", names, want)
+	}
+
+	parents := map[string]string{
+		"initialize":          "rop.run",
+		"preparePodExecution": "rop.run",
+		"executeFile":         "rop.run",
+		"copy":                "executeFile",
+		"run":                 "executeFile",
+		"cleanup":             "executeFile",
+	}
+	for child, parent := range parents {
+		if spans[child].Parent.SpanID() != spans[parent].SpanContext.SpanID() {
+			t.Errorf("span %s is not a child of %s", child, parent)
+		}
+	}
+
+	attributes := map[attribute.Key]attribute.Value{}
+	for _, kv := range spans["rop.run"].Attributes {
+		attributes[kv.Key] = kv.Value
+	}
+	if attributes["k8s.pod.name"].AsString() != "api-1" || attributes["k8s.container.name"].AsString() != "main" ||
+		attributes["rop.context"].AsString() != "staging" || attributes["rop.exit_code"].AsInt64() != 1 {
+		t.Errorf("unexpected attributes: %v", spans["rop.run"].Attributes)
+	}
+	if spans["rop.run"].Status.Code == codes.Error {
+		t.Error("a non-zero exit code must not mark the run as failed")
+	}
+}
+
+func TestRunRecordsFailedPhase(t *testing.T) {
+	server := k8stest.NewExecServer(nil)
+	defer server.Close()
+	server.FailCommand("cp", 1)
+
+	exporter := tracetest.NewInMemoryExporter()
+	app := newTestApp(t, server, fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main")),
+		WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))),
+	)
+	if _, err := app.Run(context.Background()); err == nil {
+		t.Fatal("expected the copy to fail")
+	}
+
+	for _, span := range exporter.GetSpans() {
+		failed := span.Status.Code == codes.Error
+		if wantFailed := span.Name != "initialize" && span.Name != "preparePodExecution" && span.Name != "cleanup"; failed != wantFailed {
+			t.Errorf("span %s failed=%t", span.Name, failed)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+// WatchOptions configures App.Watch.
+type WatchOptions struct {
+	// Next returns when to run after a run that started at the given time.
+	Next func(last time.Time) time.Time
+	// Trigger starts a run whenever it receives, e.g. when the local file is saved. A run
+	// still going is interrupted and its remote process killed. At least one of Next and
+	// Trigger is required.
+	Trigger <-chan struct{}
+	// Stream writes the output of the runs to the streams of the App as it comes instead
+	// of capturing it in WatchRun.Output.
+	Stream bool
+	// FollowPod resolves the pod again when the current one stops running, e.g. during a
+	// rolling restart. It has no effect on cloned pods.
+	FollowPod bool
+	// StopOnFailure ends the watch after the first run that doesn't exit with 0.
+	StopOnFailure bool
+	// OpenFile reopens the local file on every tick, so changes are picked up. The file is
+	// only copied again when its SHA-256 changed. Without it, the file is copied once. Either
+	// way it is copied again when it is gone from the pod, e.g. removed by rop gc.
+	OpenFile func() (io.ReadCloser, error)
+	// OpenSignature reads the detached signature of the file again whenever it is reopened,
+	// returning nil when there is none, so a file signed again after an edit verifies.
+	OpenSignature func() ([]byte, error)
+	// OnRun is called after every run.
+	OnRun func(run WatchRun)
+}
+
+// WatchRun describes one run of a watch.
+type WatchRun struct {
+	// Number counts runs, starting at 1.
+	Number int
+	Pod    string
+	Start  time.Time
+	// Copied is set when the file was copied before this run.
+	Copied bool
+	// Output is the combined stdout and stderr of the run, unless it was streamed.
+	Output string
+	// Interrupted is set when a trigger cut the run short.
+	Interrupted bool
+	ExitCode    int
+	TimedOut    bool
+	Duration    time.Duration
+	// Redactions counts the secrets redacted from the output.
+	Redactions int
+	// Err is set when the run couldn't be completed, e.g. because the pod went away.
+	Err error
+	// Result is the result of the run as for a single run, nil when the file didn't run.
+	Result *Result
+}
+
+// ErrWatchFailed is returned when a watch with StopOnFailure ends because of a failed run.
+var ErrWatchFailed = errors.New("run failed")
+
+// Watch runs the file on the target pod on every tick of opts.Next until ctx is done. The
+// target is resolved and confirmed once; the file stays on the pod between runs.
+func (app *App) Watch(ctx context.Context, opts WatchOptions) error {
+	if opts.Next == nil && opts.Trigger == nil {
+		return fmt.Errorf("a schedule or a trigger is required")
+	}
+	// The remote process of the current run is killed when the watch ends, not only when a
+	// trigger interrupts it.
+	app.interruptible = true
+
+	app.result = &Result{}
+	if err := app.initialize(); err != nil {
+		return fmt.Errorf("initialization failed: %w", err)
+	}
+
+	defer app.releaseClonedPod(context.WithoutCancel(ctx))
+
+	if err := app.preparePodExecution(ctx); err != nil {
+		return fmt.Errorf("pod preparation failed: %w", err)
+	}
+
+	if err := app.digestFile(); err != nil {
+		return err
+	}
+	app.determineFileType()
+	tempPath := app.getDestinationPath()
+	app.streams.In = nil
+
+	copiedSHA256 := ""
+	defer func() {
+		if copiedSHA256 != "" {
+			app.cleanupFile(context.WithoutCancel(ctx), tempPath)
+		}
+	}()
+
+	for number := 1; ; number++ {
+		run := WatchRun{Number: number, Start: time.Now()}
+		app.result = &Result{}
+
+		run.Err = app.prepareWatchRun(ctx, opts, &copiedSHA256, &run, tempPath)
+		if run.Err == nil {
+			run.Err = app.interruptibleWatchRun(ctx, opts, tempPath, &run)
+		}
+		run.Duration = time.Since(run.Start)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if opts.OnRun != nil {
+			opts.OnRun(run)
+		}
+		if run.Interrupted {
+			continue
+		}
+		app.runFailureHooks(ctx, tempPath, run.Err)
+		if opts.StopOnFailure && (run.Err != nil || run.ExitCode != 0 || run.TimedOut) {
+			return fmt.Errorf("%w: run %d", ErrWatchFailed, run.Number)
+		}
+
+		var tick <-chan time.Time
+		if opts.Next != nil {
+			tick = time.After(time.Until(opts.Next(run.Start)))
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-tick:
+		case <-opts.Trigger:
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// prepareWatchRun follows the pod if needed and copies the file when it isn't on the pod
+// yet, is gone from it or changed locally.
+func (app *App) prepareWatchRun(ctx context.Context, opts WatchOptions, copiedSHA256 *string, run *WatchRun, tempPath string) error {
+	if opts.FollowPod && app.clonedPod == nil {
+		moved, err := app.followPod(ctx)
+		if err != nil {
+			return err
+		}
+		if moved {
+			*copiedSHA256 = ""
+		}
+	}
+	run.Pod = app.pod.Name
+
+	if opts.OpenFile != nil {
+		if err := app.reloadFile(opts.OpenFile); err != nil {
+			return err
+		}
+	}
+	if opts.OpenSignature != nil {
+		signature, err := opts.OpenSignature()
+		if err != nil {
+			return err
+		}
+		app.setSignature(signature)
+	}
+	// Verified on every run, so a replaced signature applies even when the file is unchanged.
+	if err := app.verifySignature(); err != nil {
+		return err
+	}
+
+	if *copiedSHA256 == app.fileSHA256 {
+		if app.remoteFileExists(ctx, tempPath) {
+			return nil
+		}
+		log.Info().Msgf("File is gone from the pod, copying it again")
+	} else if *copiedSHA256 != "" {
+		log.Info().Msgf("File changed, copying it again")
+	}
+	if err := app.rewindFile(); err != nil {
+		return err
+	}
+	if err := app.copyFileToPod(ctx, tempPath); err != nil {
+		return err
+	}
+	*copiedSHA256 = app.fileSHA256
+	run.Copied = true
+	return nil
+}
+
+// remoteFileExists reports whether the file copied to path is still on the pod, e.g. it
+// wasn't removed by rop gc. Containers without test(1) are assumed to still have it.
+func (app *App) remoteFileExists(ctx context.Context, path string) bool {
+	err := app.client.RunAuxiliaryCommand(ctx, []string{"test", "-f", path}, app.pod, app.container)
+	var exitErr utilexec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitStatus() == 1 {
+		return false
+	}
+	if err != nil {
+		log.Debug().Err(err).Msgf("Couldn't check for %s on the pod", path)
+	}
+	return true
+}
+
+// followPod resolves the pod again when the current one is gone or no longer running, and
+// reports whether it changed.
+func (app *App) followPod(ctx context.Context) (bool, error) {
+	current, err := app.client.FindPodByName(ctx, app.pod.Name)
+	if err == nil && current.Name == app.pod.Name && current.DeletionTimestamp == nil && current.Status.Phase == corev1.PodRunning {
+		return false, nil
+	}
+
+	pod, err := app.resolvePod(ctx)
+	if err != nil {
+		return false, err
+	}
+	log.Info().Msgf("Pod %s is gone, following to %s", app.pod.Name, pod.Name)
+	app.pod = pod
+
+	if err := app.PreparePodEnvironment(); err != nil {
+		return false, fmt.Errorf("failed to prepare pod environment: %w", err)
+	}
+	return true, nil
+}
+
+// reloadFile reads the local file again and keeps it when its content changed.
+func (app *App) reloadFile(open func() (io.ReadCloser, error)) error {
+	file, err := open()
+	if err != nil {
+		return fmt.Errorf("error opening file: %w", err)
+	}
+	defer file.Close()
+
+	// The content is buffered by digestFile, so the file can be closed afterwards.
+	previous := app.fileSHA256
+	app.file = file
+	app.fileSHA256 = ""
+	if err := app.digestFile(); err != nil {
+		return err
+	}
+	if app.fileSHA256 != previous {
+		log.Debug().Msgf("File digest changed from %s to %s", previous, app.fileSHA256)
+	}
+	return nil
+}
+
+// interruptibleWatchRun executes the file once, killing it when a trigger arrives first.
+func (app *App) interruptibleWatchRun(ctx context.Context, opts WatchOptions, tempPath string, run *WatchRun) error {
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- app.watchRun(runCtx, opts, tempPath, run)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-opts.Trigger:
+		log.Info().Msg("Change detected, interrupting the current run")
+		cancel()
+		<-done
+		run.Interrupted = true
+		return nil
+	}
+}
+
+// watchRun executes the file once, capturing its output unless it is streamed.
+func (app *App) watchRun(ctx context.Context, opts WatchOptions, tempPath string, run *WatchRun) error {
+	streams := app.streams
+	defer func() { app.streams = streams }()
+
+	output := &syncBuffer{}
+	if !opts.Stream {
+		app.streams.Out = output
+		app.streams.ErrOut = output
+	}
+	app.result = &Result{Namespace: app.namespace, Pod: app.pod.Name, Container: app.container, FileSHA256: app.fileSHA256}
+	if app.verifiedSHA256 == app.fileSHA256 {
+		app.result.Signer = app.verifiedSigner
+	}
+
+	err := app.runFile(ctx, tempPath)
+	app.result.Duration = time.Since(run.Start)
+	run.Result = app.result
+	run.Output = output.String()
+	run.ExitCode = app.result.ExitCode
+	run.TimedOut = app.result.TimedOut
+	run.Redactions = app.result.Redactions
+	return err
+}
+
+// syncBuffer is a buffer safe for the concurrent writes of stdout and stderr.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,265 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/marianozunino/rop/internal/k8s/k8stest"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func every(interval time.Duration) func(time.Time) time.Time {
+	return func(last time.Time) time.Time { return last.Add(interval) }
+}
+
+// echoUploadedFile makes the server print the uploaded script instead of running it.
+func echoUploadedFile(server **k8stest.ExecServer) k8stest.ExecFunc {
+	return func(exec *k8stest.Exec) int {
+		content, _ := (*server).File(testUploadPath)
+		exec.Stdout.Write(content)
+		return 0
+	}
+}
+
+func TestWatchCopiesOnlyChangedFiles(t *testing.T) {
+	var server *k8stest.ExecServer
+	server = k8stest.NewExecServer(echoUploadedFile(&server))
+	defer server.Close()
+
+	app := newTestApp(t, server, fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main")))
+
+	versions := []string{"echo 1\n", "echo 1\n", "echo 2\n"}
+	opened := 0
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var runs []WatchRun
+	err := app.Watch(ctx, WatchOptions{
+		Next: every(time.Millisecond),
+		OpenFile: func() (io.ReadCloser, error) {
+			opened++
+			return io.NopCloser(strings.NewReader(versions[opened-1])), nil
+		},
+		OnRun: func(run WatchRun) {
+			runs = append(runs, run)
+			if len(runs) == len(versions) {
+				cancel()
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+
+	if len(runs) != 3 {
+		t.Fatalf("got %d runs", len(runs))
+	}
+	for i, run := range runs {
+		if run.Number != i+1 || run.Output != versions[i] || run.Err != nil {
+			t.Errorf("unexpected run: %+v", run)
+		}
+	}
+	if !runs[0].Copied || runs[1].Copied || !runs[2].Copied {
+		t.Errorf("copied = %t, %t, %t", runs[0].Copied, runs[1].Copied, runs[2].Copied)
+	}
+	if files := server.Files(); len(files) != 0 {
+		t.Errorf("files left on the pod: %v", files)
+	}
+}
+
+func TestWatchStopsOnFailure(t *testing.T) {
+	server := k8stest.NewExecServer(func(exec *k8stest.Exec) int { return 2 })
+	defer server.Close()
+
+	app := newTestApp(t, server, fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main")))
+
+	runs := 0
+	err := app.Watch(context.Background(), WatchOptions{
+		Next:          every(time.Millisecond),
+		StopOnFailure: true,
+		OnRun:         func(run WatchRun) { runs++ },
+	})
+	if !errors.Is(err, ErrWatchFailed) || runs != 1 {
+		t.Fatalf("got error %v after %d runs", err, runs)
+	}
+	if files := server.Files(); len(files) != 0 {
+		t.Errorf("files left on the pod: %v", files)
+	}
+}
+
+func TestWatchFollowsReplacedPod(t *testing.T) {
+	var server *k8stest.ExecServer
+	server = k8stest.NewExecServer(echoUploadedFile(&server))
+	defer server.Close()
+
+	clientset := fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main"))
+	app := newTestApp(t, server, clientset)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var runs []WatchRun
+	err := app.Watch(ctx, WatchOptions{
+		Next:      every(time.Millisecond),
+		FollowPod: true,
+		OnRun: func(run WatchRun) {
+			runs = append(runs, run)
+			if len(runs) == 1 {
+				pods := clientset.CoreV1().Pods("default")
+				pods.Delete(ctx, "api-1", metav1.DeleteOptions{})
+				pods.Create(ctx, k8stest.RunningPod("default", "api-2", "main"), metav1.CreateOptions{})
+				return
+			}
+			cancel()
+		},
+	})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+
+	if runs[0].Pod != "api-1" || runs[1].Pod != "api-2" || !runs[1].Copied || runs[1].Output != testScript {
+		t.Errorf("unexpected runs: %+v", runs)
+	}
+}
+
+func TestWatchTriggerInterruptsRun(t *testing.T) {
+	killed := make(chan struct{}, 1)
+	started := make(chan struct{}, 1)
+	var runs int32
+	server := k8stest.NewExecServer(func(exec *k8stest.Exec) int {
+		if exec.Command[2] == killScript {
+			killed <- struct{}{}
+			return 0
+		}
+		if atomic.AddInt32(&runs, 1) == 1 {
+			started <- struct{}{}
+			<-exec.Done
+		}
+		return 0
+	})
+	defer server.Close()
+
+	app := newTestApp(t, server, fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	trigger := make(chan struct{}, 1)
+	go func() {
+		<-started
+		trigger <- struct{}{}
+	}()
+
+	var got []WatchRun
+	err := app.Watch(ctx, WatchOptions{
+		Trigger: trigger,
+		OnRun: func(run WatchRun) {
+			got = append(got, run)
+			if len(got) == 2 {
+				cancel()
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+
+	if len(got) != 2 || !got[0].Interrupted || got[1].Interrupted || got[1].Err != nil {
+		t.Fatalf("unexpected runs: %+v", got)
+	}
+	select {
+	case <-killed:
+	default:
+		t.Error("interrupted remote process was not killed")
+	}
+	if files := server.Files(); len(files) != 0 {
+		t.Errorf("files left on the pod: %v", files)
+	}
+}
+
+func TestWatchKillsRunWhenCancelled(t *testing.T) {
+	killed := make(chan struct{}, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := k8stest.NewExecServer(func(exec *k8stest.Exec) int {
+		if exec.Command[2] == killScript {
+			killed <- struct{}{}
+			return 0
+		}
+		// Ctrl-C while the first run is still going.
+		cancel()
+		<-exec.Done
+		return 0
+	})
+	defer server.Close()
+
+	app := newTestApp(t, server, fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main")))
+
+	err := app.Watch(ctx, WatchOptions{
+		Next: every(time.Hour),
+		OnRun: func(run WatchRun) {
+			t.Errorf("unexpected run: %+v", run)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+
+	select {
+	case <-killed:
+	default:
+		t.Error("remote process was not killed")
+	}
+	if files := server.Files(); len(files) != 0 {
+		t.Errorf("files left on the pod: %v", files)
+	}
+}
+
+func TestWatchCopiesRemovedFileAgain(t *testing.T) {
+	var server *k8stest.ExecServer
+	server = k8stest.NewExecServer(echoUploadedFile(&server))
+	defer server.Close()
+
+	app := newTestApp(t, server, fake.NewSimpleClientset(k8stest.RunningPod("default", "api-1", "main")),
+		WithFile("./check.sh", strings.NewReader("echo 1\n"), 0o755))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var runs []WatchRun
+	err := app.Watch(ctx, WatchOptions{
+		Next: every(time.Millisecond),
+		OnRun: func(run WatchRun) {
+			runs = append(runs, run)
+			switch len(runs) {
+			case 1:
+				// The file is removed between runs, as rop gc does with old uploads.
+				if err := app.client.DeleteFileFromContainer(ctx, app.pod, app.container, testUploadPath); err != nil {
+					t.Errorf("removing the file: %v", err)
+				}
+			case 3:
+				cancel()
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+
+	if len(runs) != 3 {
+		t.Fatalf("got %d runs", len(runs))
+	}
+	for _, run := range runs {
+		if run.Err != nil || run.Output != "echo 1\n" {
+			t.Errorf("unexpected run: %+v", run)
+		}
+	}
+	if !runs[0].Copied || !runs[1].Copied || runs[2].Copied {
+		t.Errorf("copied = %t, %t, %t", runs[0].Copied, runs[1].Copied, runs[2].Copied)
+	}
+}
@@ -0,0 +1,337 @@
+// Package approval implements a four-eyes workflow for runs. A run is requested and stored
+// as a ConfigMap in the cluster, approved by a second user, and can then be used once,
+// until it expires, to run the file with the requested digest on the requested target.
+package approval
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// DefaultNamespace is where approvals are stored unless configured otherwise.
+const DefaultNamespace = "rop-approvals"
+
+// ErrNotApproved is returned when a run has no valid approval.
+var ErrNotApproved = errors.New("run not approved")
+
+// States of an approval.
+const (
+	StatePending  = "pending"
+	StateApproved = "approved"
+	StateUsed     = "used"
+	StateExpired  = "expired"
+)
+
+const (
+	namePrefix     = "rop-approval-"
+	dataKey        = "approval.json"
+	managedByLabel = "app.kubernetes.io/managed-by"
+	stateLabel     = "rop/approval-state"
+)
+
+// Approval is a requested run and its approval.
+type Approval struct {
+	ID        string `json:"id"`
+	Context   string `json:"context"`
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod,omitempty"`
+	// Clone is the workload reference, when the run is on a cloned pod. CloneInit is set
+	// when the clone also runs the init containers that aren't sidecars.
+	Clone     string   `json:"clone,omitempty"`
+	CloneInit bool     `json:"clone_init,omitempty"`
+	Container string   `json:"container,omitempty"`
+	File      string   `json:"file"`
+	SHA256    string   `json:"sha256"`
+	Args      []string `json:"args,omitempty"`
+	// Env, Type, Runner, AsUser, DestPath and the limits say how the file runs. They are
+	// shown to the approver, and runs with other values aren't approved.
+	Env        []string      `json:"env,omitempty"`
+	Type       string        `json:"type,omitempty"`
+	Runner     string        `json:"runner,omitempty"`
+	AsUser     string        `json:"as_user,omitempty"`
+	DestPath   string        `json:"dest_path,omitempty"`
+	Nice       int           `json:"nice,omitempty"`
+	IONice     string        `json:"ionice,omitempty"`
+	MaxMemory  string        `json:"max_memory,omitempty"`
+	MaxCPUTime time.Duration `json:"max_cpu_time,omitempty"`
+	Reason     string        `json:"reason,omitempty"`
+
+	RequestedBy string    `json:"requested_by"`
+	RequestedAt time.Time `json:"requested_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+
+	ApprovedBy string     `json:"approved_by,omitempty"`
+	ApprovedAt *time.Time `json:"approved_at,omitempty"`
+	UsedBy     string     `json:"used_by,omitempty"`
+	UsedAt     *time.Time `json:"used_at,omitempty"`
+
+	// resourceVersion guards against concurrent updates, e.g. two runs using the approval.
+	resourceVersion string
+}
+
+// State returns StatePending, StateApproved, StateUsed or StateExpired.
+func (a *Approval) State(now time.Time) string {
+	switch {
+	case a.UsedAt != nil:
+		return StateUsed
+	case !now.Before(a.ExpiresAt):
+		return StateExpired
+	case a.ApprovedAt != nil:
+		return StateApproved
+	default:
+		return StatePending
+	}
+}
+
+// Valid checks that the approval was granted, is unexpired and wasn't used yet.
+func (a *Approval) Valid(now time.Time) error {
+	switch state := a.State(now); state {
+	case StateApproved:
+		return nil
+	case StateExpired:
+		return fmt.Errorf("%w: request %s expired at %s", ErrNotApproved, a.ID, a.ExpiresAt.Format(time.RFC3339))
+	case StateUsed:
+		return fmt.Errorf("%w: request %s was already used by %s", ErrNotApproved, a.ID, a.UsedBy)
+	default:
+		return fmt.Errorf("%w: request %s is still %s", ErrNotApproved, a.ID, state)
+	}
+}
+
+// Check verifies that the approval allows running the content with the given SHA-256 in the
+// namespace of the context now.
+func (a *Approval) Check(kubeContext, namespace, sha256 string, now time.Time) error {
+	if err := a.Valid(now); err != nil {
+		return err
+	}
+	if kubeContext != a.Context {
+		return fmt.Errorf("%w: request %s is for context %s, not %s", ErrNotApproved, a.ID, a.Context, kubeContext)
+	}
+	if namespace != a.Namespace {
+		return fmt.Errorf("%w: request %s is for namespace %s, not %s", ErrNotApproved, a.ID, a.Namespace, namespace)
+	}
+	if sha256 != a.SHA256 {
+		return fmt.Errorf("%w: the SHA-256 of the file is %s, but %s was approved", ErrNotApproved, sha256, a.SHA256)
+	}
+	return nil
+}
+
+// Store keeps approvals as ConfigMaps.
+type Store struct {
+	Clientset kubernetes.Interface
+	// Namespace holds the ConfigMaps. Defaults to DefaultNamespace.
+	Namespace string
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+func (s *Store) namespace() string {
+	if s.Namespace == "" {
+		return DefaultNamespace
+	}
+	return s.Namespace
+}
+
+func (s *Store) now() time.Time {
+	if s.Now == nil {
+		return time.Now().UTC()
+	}
+	return s.Now()
+}
+
+// Request stores the requested run, pending until approved, and returns it with its ID.
+// It expires ttl from now.
+func (s *Store) Request(ctx context.Context, request Approval, ttl time.Duration) (*Approval, error) {
+	if request.RequestedBy == "" {
+		return nil, fmt.Errorf("the requesting user is unknown")
+	}
+	if ttl <= 0 {
+		return nil, fmt.Errorf("the expiry must be positive")
+	}
+
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to generate request ID: %w", err)
+	}
+
+	now := s.now()
+	approval := request
+	approval.ID = hex.EncodeToString(id)
+	approval.RequestedAt = now
+	approval.ExpiresAt = now.Add(ttl)
+	approval.ApprovedBy, approval.ApprovedAt = "", nil
+	approval.UsedBy, approval.UsedAt = "", nil
+
+	configMap, err := s.configMap(&approval)
+	if err != nil {
+		return nil, err
+	}
+	created, err := s.Clientset.CoreV1().ConfigMaps(s.namespace()).Create(ctx, configMap, metav1.CreateOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("namespace %s for approvals doesn't exist: %w", s.namespace(), err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error storing request: %w", err)
+	}
+	approval.resourceVersion = created.ResourceVersion
+	return &approval, nil
+}
+
+// Get returns the approval with the ID.
+func (s *Store) Get(ctx context.Context, id string) (*Approval, error) {
+	configMap, err := s.Clientset.CoreV1().ConfigMaps(s.namespace()).Get(ctx, namePrefix+id, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("%w: no request %s in namespace %s", ErrNotApproved, id, s.namespace())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting request %s: %w", id, err)
+	}
+	return decode(configMap)
+}
+
+// List returns the stored approvals, oldest first.
+func (s *Store) List(ctx context.Context) ([]*Approval, error) {
+	configMaps, err := s.Clientset.CoreV1().ConfigMaps(s.namespace()).List(ctx, metav1.ListOptions{LabelSelector: stateLabel})
+	if err != nil {
+		return nil, fmt.Errorf("error listing requests: %w", err)
+	}
+
+	var approvals []*Approval
+	for i := range configMaps.Items {
+		approval, err := decode(&configMaps.Items[i])
+		if err != nil {
+			return nil, err
+		}
+		approvals = append(approvals, approval)
+	}
+	slices.SortFunc(approvals, func(a, b *Approval) int { return a.RequestedAt.Compare(b.RequestedAt) })
+	return approvals, nil
+}
+
+// Approve grants the pending request with the ID. Nobody can approve their own request.
+func (s *Store) Approve(ctx context.Context, id, approver string) (*Approval, error) {
+	approval, err := s.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if approver == "" {
+		return nil, fmt.Errorf("the approving user is unknown")
+	}
+	now := s.now()
+	if state := approval.State(now); state != StatePending {
+		return nil, fmt.Errorf("request %s can't be approved, it is %s", id, state)
+	}
+	if approver == approval.RequestedBy {
+		return nil, fmt.Errorf("request %s must be approved by someone else than %s, who requested it", id, approver)
+	}
+
+	approval.ApprovedBy = approver
+	approval.ApprovedAt = &now
+	if err := s.update(ctx, approval); err != nil {
+		return nil, err
+	}
+	return approval, nil
+}
+
+// Use marks the approval as used by user, so that it can't be used again. It is read again
+// first, and fails when it isn't valid anymore or was used concurrently.
+func (s *Store) Use(ctx context.Context, approval *Approval, user string) error {
+	current, err := s.Get(ctx, approval.ID)
+	if err != nil {
+		return err
+	}
+	now := s.now()
+	if err := current.Valid(now); err != nil {
+		return err
+	}
+
+	current.UsedBy = user
+	current.UsedAt = &now
+	err = s.update(ctx, current)
+	if apierrors.IsConflict(err) {
+		return fmt.Errorf("%w: request %s was changed or used concurrently", ErrNotApproved, approval.ID)
+	}
+	if err != nil {
+		return err
+	}
+	*approval = *current
+	return nil
+}
+
+func (s *Store) update(ctx context.Context, approval *Approval) error {
+	configMap, err := s.configMap(approval)
+	if err != nil {
+		return err
+	}
+	configMap.ResourceVersion = approval.resourceVersion
+
+	updated, err := s.Clientset.CoreV1().ConfigMaps(s.namespace()).Update(ctx, configMap, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("error updating request %s: %w", approval.ID, err)
+	}
+	approval.resourceVersion = updated.ResourceVersion
+	return nil
+}
+
+func (s *Store) configMap(approval *Approval) (*corev1.ConfigMap, error) {
+	data, err := json.MarshalIndent(approval, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("error encoding request: %w", err)
+	}
+
+	// The label only helps with kubectl; the state is always derived from the data.
+	state := approval.State(s.now())
+	if state == StateExpired {
+		state = StatePending
+		if approval.ApprovedAt != nil {
+			state = StateApproved
+		}
+	}
+
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      namePrefix + approval.ID,
+			Namespace: s.namespace(),
+			Labels: map[string]string{
+				managedByLabel: "rop",
+				stateLabel:     state,
+			},
+		},
+		Data: map[string]string{dataKey: string(data)},
+	}, nil
+}
+
+func decode(configMap *corev1.ConfigMap) (*Approval, error) {
+	var approval Approval
+	if err := json.Unmarshal([]byte(configMap.Data[dataKey]), &approval); err != nil {
+		return nil, fmt.Errorf("invalid request in ConfigMap %s: %w", configMap.Name, err)
+	}
+	if namePrefix+approval.ID != configMap.Name {
+		return nil, fmt.Errorf("invalid request in ConfigMap %s: its ID is %q", configMap.Name, approval.ID)
+	}
+	approval.resourceVersion = configMap.ResourceVersion
+	return &approval, nil
+}
+
+// Identity returns the name the cluster authenticates the user of the clientset as.
+func Identity(ctx context.Context, clientset kubernetes.Interface) (string, error) {
+	review, err := clientset.AuthenticationV1().SelfSubjectReviews().Create(ctx, &authenticationv1.SelfSubjectReview{}, metav1.CreateOptions{})
+	if err != nil {
+		return "", fmt.Errorf("error reviewing the current user: %w", err)
+	}
+	if review.Status.UserInfo.Username == "" {
+		return "", fmt.Errorf("the cluster didn't return a user name")
+	}
+	return review.Status.UserInfo.Username, nil
+}
@@ -0,0 +1,165 @@
+package approval
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const testSHA256 = "3f9a1c2e"
+
+func testRequest() Approval {
+	return Approval{
+		Context:     "prod-eu",
+		Namespace:   "payments",
+		Pod:         "api-7d9f",
+		File:        "fix.sh",
+		SHA256:      testSHA256,
+		Args:        []string{"--apply"},
+		RequestedBy: "alice",
+	}
+}
+
+// testStore returns a store whose clock is advanced by moving *now.
+func testStore() (*Store, *time.Time) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	return &Store{Clientset: fake.NewSimpleClientset(), Now: func() time.Time { return now }}, &now
+}
+
+func TestApprovalWorkflow(t *testing.T) {
+	store, now := testStore()
+	ctx := context.Background()
+
+	requested, err := store.Request(ctx, testRequest(), time.Hour)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if len(requested.ID) != 8 || !requested.ExpiresAt.Equal(now.Add(time.Hour)) {
+		t.Errorf("unexpected request: %+v", requested)
+	}
+
+	pending, err := store.Get(ctx, requested.ID)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if err := pending.Check("prod-eu", "payments", testSHA256, *now); !errors.Is(err, ErrNotApproved) || !strings.Contains(err.Error(), "still pending") {
+		t.Errorf("pending request passed the check: %v", err)
+	}
+
+	if _, err := store.Approve(ctx, requested.ID, "alice"); err == nil || !strings.Contains(err.Error(), "someone else") {
+		t.Errorf("the requester approved their own request: %v", err)
+	}
+	approved, err := store.Approve(ctx, requested.ID, "bob")
+	if err != nil {
+		t.Fatalf("Approve failed: %v", err)
+	}
+	if _, err := store.Approve(ctx, requested.ID, "carol"); err == nil {
+		t.Error("an approved request was approved again")
+	}
+
+	*now = now.Add(30 * time.Minute)
+	approval, err := store.Get(ctx, requested.ID)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if approval.ApprovedBy != "bob" || approval.State(*now) != StateApproved || strings.Join(approval.Args, " ") != "--apply" {
+		t.Errorf("unexpected approval: %+v", approval)
+	}
+
+	checks := []struct {
+		context, namespace, sha256 string
+		wantErr                    string
+	}{
+		{"prod-eu", "payments", testSHA256, ""},
+		{"prod-eu", "payments", "0000", "the SHA-256 of the file is 0000, but 3f9a1c2e was approved"},
+		{"prod-us", "payments", testSHA256, "is for context prod-eu"},
+		{"prod-eu", "default", testSHA256, "is for namespace payments"},
+	}
+	for _, check := range checks {
+		err := approval.Check(check.context, check.namespace, check.sha256, *now)
+		if check.wantErr == "" && err != nil {
+			t.Errorf("Check(%+v) failed: %v", check, err)
+		}
+		if check.wantErr != "" && (!errors.Is(err, ErrNotApproved) || !strings.Contains(err.Error(), check.wantErr)) {
+			t.Errorf("Check(%+v) = %v, want %q", check, err, check.wantErr)
+		}
+	}
+
+	if err := store.Use(ctx, approval, "alice"); err != nil {
+		t.Fatalf("Use failed: %v", err)
+	}
+	if approval.State(*now) != StateUsed {
+		t.Errorf("the used approval is %s", approval.State(*now))
+	}
+	if err := store.Use(ctx, approved, "alice"); !errors.Is(err, ErrNotApproved) || !strings.Contains(err.Error(), "already used by alice") {
+		t.Errorf("the approval was used twice: %v", err)
+	}
+
+	approvals, err := store.List(ctx)
+	if err != nil || len(approvals) != 1 || approvals[0].State(*now) != StateUsed {
+		t.Errorf("List = (%+v, %v)", approvals, err)
+	}
+}
+
+func TestApprovalExpires(t *testing.T) {
+	store, now := testStore()
+	ctx := context.Background()
+
+	requested, err := store.Request(ctx, testRequest(), time.Hour)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	approval, err := store.Approve(ctx, requested.ID, "bob")
+	if err != nil {
+		t.Fatalf("Approve failed: %v", err)
+	}
+
+	*now = now.Add(time.Hour)
+	if err := approval.Check("prod-eu", "payments", testSHA256, *now); !errors.Is(err, ErrNotApproved) || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("expired approval passed the check: %v", err)
+	}
+	if err := store.Use(ctx, approval, "alice"); !errors.Is(err, ErrNotApproved) {
+		t.Errorf("expired approval was used: %v", err)
+	}
+
+	expired, err := store.Request(ctx, testRequest(), time.Minute)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	*now = now.Add(time.Minute)
+	if _, err := store.Approve(ctx, expired.ID, "bob"); err == nil || !strings.Contains(err.Error(), "it is expired") {
+		t.Errorf("expired request was approved: %v", err)
+	}
+}
+
+func TestGetUnknownRequest(t *testing.T) {
+	store, _ := testStore()
+	_, err := store.Get(context.Background(), "deadbeef")
+	if !errors.Is(err, ErrNotApproved) || !strings.Contains(err.Error(), "no request deadbeef in namespace rop-approvals") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	if _, err := Identity(context.Background(), clientset); err == nil {
+		t.Error("expected an error without a user name")
+	}
+
+	clientset.PrependReactor("create", "selfsubjectreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := &authenticationv1.SelfSubjectReview{}
+		review.Status.UserInfo.Username = "alice@example.com"
+		return true, review, nil
+	})
+	user, err := Identity(context.Background(), clientset)
+	if err != nil || user != "alice@example.com" {
+		t.Errorf("Identity = (%q, %v)", user, err)
+	}
+}
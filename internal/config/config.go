@@ -0,0 +1,161 @@
+// Package config loads the optional rop configuration file, by default
+// <user config dir>/rop/config.yaml, overridable with $ROP_CONFIG.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Config is the content of the configuration file.
+type Config struct {
+	// ProtectedContexts are kubeconfig context names, or shell patterns such as "prod-*",
+	// that are highlighted when confirming an execution.
+	ProtectedContexts []string `json:"protectedContexts"`
+	// TrustedKeys are the minisign public keys signatures of files are verified against.
+	TrustedKeys []TrustedKey `json:"trustedKeys"`
+	// SignedContexts are context names or patterns that only run files signed by one of
+	// the trusted keys. In other contexts, signatures are verified when a file has one.
+	SignedContexts []string `json:"signedContexts"`
+	// ApprovalContexts are context names or patterns whose runs need a request approved by
+	// a second user.
+	ApprovalContexts []string `json:"approvalContexts"`
+	// ApprovalNamespace holds the ConfigMaps of approval requests. Defaults to
+	// "rop-approvals".
+	ApprovalNamespace string `json:"approvalNamespace"`
+	// RedactPatterns are regular expressions redacted from the output of files, in addition
+	// to the built-in secret formats. With capturing groups, only the groups are redacted.
+	RedactPatterns []string `json:"redactPatterns"`
+	// Hooks are commands run around executions.
+	Hooks []Hook `json:"hooks"`
+	// Webhooks are notified of every run.
+	Webhooks []Webhook `json:"webhooks"`
+}
+
+// TrustedKey is a named minisign public key.
+type TrustedKey struct {
+	Name string `json:"name"`
+	// PublicKey is the base64 key, as in the second line of a minisign .pub file.
+	PublicKey string `json:"publicKey"`
+}
+
+// Hook is a local command or a remote snippet run at a stage of executions.
+type Hook struct {
+	// Stage is "pre-copy", "pre-exec", "post-exec" or "on-failure".
+	Stage string `json:"stage"`
+	// Command is run locally with sh -c; Remote is run with sh -c in the target container.
+	Command string `json:"command"`
+	Remote  string `json:"remote"`
+	// Contexts restricts the hook to context names or patterns. Empty means all contexts.
+	Contexts []string `json:"contexts"`
+}
+
+// Webhook is a URL runs are posted to.
+type Webhook struct {
+	URL string `json:"url"`
+	// Format is "generic" (the default) or "slack".
+	Format string `json:"format"`
+	// Contexts restricts the webhook to runs in context names or patterns. Empty means all
+	// contexts.
+	Contexts []string `json:"contexts"`
+}
+
+// Path returns the location of the configuration file.
+func Path() (string, error) {
+	if path := os.Getenv("ROP_CONFIG"); path != "" {
+		return path, nil
+	}
+
+	base, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find config directory: %w", err)
+	}
+	return filepath.Join(base, "rop", "config.yaml"), nil
+}
+
+// Load reads the configuration file. A missing file yields an empty config.
+func Load() (*Config, error) {
+	path, err := Path()
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &Config{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config %s: %w", path, err)
+	}
+
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// IsProtected reports whether the context matches one of the protected context patterns.
+func (c *Config) IsProtected(context string) bool {
+	return matchesAny(c.ProtectedContexts, context)
+}
+
+// RequiresSignature reports whether only signed files may run in the context.
+func (c *Config) RequiresSignature(context string) bool {
+	return matchesAny(c.SignedContexts, context)
+}
+
+// RequiresApproval reports whether runs in the context need an approved request.
+func (c *Config) RequiresApproval(context string) bool {
+	return matchesAny(c.ApprovalContexts, context)
+}
+
+// RedactRegexps compiles the redact patterns.
+func (c *Config) RedactRegexps() ([]*regexp.Regexp, error) {
+	regexps := make([]*regexp.Regexp, 0, len(c.RedactPatterns))
+	for _, pattern := range c.RedactPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redact pattern %q: %w", pattern, err)
+		}
+		regexps = append(regexps, re)
+	}
+	return regexps, nil
+}
+
+// HooksFor returns the hooks that apply to the context, in order.
+func (c *Config) HooksFor(context string) []Hook {
+	var hooks []Hook
+	for _, hook := range c.Hooks {
+		if len(hook.Contexts) == 0 || matchesAny(hook.Contexts, context) {
+			hooks = append(hooks, hook)
+		}
+	}
+	return hooks
+}
+
+// WebhooksFor returns the webhooks notified of runs in the context.
+func (c *Config) WebhooksFor(context string) []Webhook {
+	var webhooks []Webhook
+	for _, webhook := range c.Webhooks {
+		if len(webhook.Contexts) == 0 || matchesAny(webhook.Contexts, context) {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+	return webhooks
+}
+
+func matchesAny(patterns []string, context string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, context); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	t.Setenv("ROP_CONFIG", path)
+
+	cfg, err := Load()
+	if err != nil || len(cfg.ProtectedContexts) != 0 {
+		t.Fatalf("missing file: got (%+v, %v)", cfg, err)
+	}
+
+	if err := os.WriteFile(path, []byte("protectedContexts:\n  - prod-*\n  - admin\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = Load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	for context, want := range map[string]bool{"prod-eu": true, "admin": true, "staging": false, "admin-2": false} {
+		if got := cfg.IsProtected(context); got != want {
+			t.Errorf("IsProtected(%q) = %t, want %t", context, got, want)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("protectedContext: [prod]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(); err == nil {
+		t.Error("expected an error for an unknown field")
+	}
+}
+
+func TestRequiresSignature(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	t.Setenv("ROP_CONFIG", path)
+
+	content := `trustedKeys:
+  - name: security
+    publicKey: RWQf6LRCGA9i53mlYecO4IzT51TGPpvWucNSCh1CBM0QTaLn73Y7GFO3
+signedContexts:
+  - prod-*
+`
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	if len(cfg.TrustedKeys) != 1 || cfg.TrustedKeys[0].Name != "security" {
+		t.Errorf("unexpected trusted keys: %+v", cfg.TrustedKeys)
+	}
+	if !cfg.RequiresSignature("prod-eu") || cfg.RequiresSignature("staging") {
+		t.Error("unexpected signature policy")
+	}
+}
+
+func TestRequiresApproval(t *testing.T) {
+	cfg := &Config{ApprovalContexts: []string{"prod-*", "admin@production"}}
+	if !cfg.RequiresApproval("prod-eu") || !cfg.RequiresApproval("admin@production") || cfg.RequiresApproval("staging") {
+		t.Error("unexpected approval policy")
+	}
+}
+
+func TestRedactRegexps(t *testing.T) {
+	cfg := &Config{RedactPatterns: []string{`password=(\S+)`, `tok_[a-z0-9]+`}}
+	regexps, err := cfg.RedactRegexps()
+	if err != nil || len(regexps) != 2 || !regexps[0].MatchString("password=x") {
+		t.Fatalf("RedactRegexps() = (%v, %v)", regexps, err)
+	}
+
+	cfg.RedactPatterns = append(cfg.RedactPatterns, `(unclosed`)
+	if _, err := cfg.RedactRegexps(); err == nil || !strings.Contains(err.Error(), `invalid redact pattern "(unclosed"`) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestHooksFor(t *testing.T) {
+	cfg := &Config{Hooks: []Hook{
+		{Stage: "pre-exec", Command: "./changelog.sh", Contexts: []string{"prod-*"}},
+		{Stage: "post-exec", Remote: "sync"},
+	}}
+
+	if hooks := cfg.HooksFor("prod-eu"); len(hooks) != 2 || hooks[0].Command != "./changelog.sh" {
+		t.Errorf("HooksFor(prod-eu) = %+v", hooks)
+	}
+	if hooks := cfg.HooksFor("staging"); len(hooks) != 1 || hooks[0].Remote != "sync" {
+		t.Errorf("HooksFor(staging) = %+v", hooks)
+	}
+}
+
+func TestWebhooksFor(t *testing.T) {
+	cfg := &Config{Webhooks: []Webhook{
+		{URL: "https://hooks.slack.com/services/T0/B0/x", Format: "slack", Contexts: []string{"prod-*"}},
+		{URL: "https://audit.example.com/rop"},
+	}}
+
+	if webhooks := cfg.WebhooksFor("prod-eu"); len(webhooks) != 2 || webhooks[0].Format != "slack" {
+		t.Errorf("WebhooksFor(prod-eu) = %+v", webhooks)
+	}
+	if webhooks := cfg.WebhooksFor("staging"); len(webhooks) != 1 || webhooks[0].URL != "https://audit.example.com/rop" {
+		t.Errorf("WebhooksFor(staging) = %+v", webhooks)
+	}
+}
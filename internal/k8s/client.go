@@ -1,79 +1,136 @@
 package k8s
 
 import (
+	"context"
 	"fmt"
-	"os"
-	"path/filepath"
+	"io"
+	"net"
+	"time"
 
 	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
-	"k8s.io/client-go/util/homedir"
+	"k8s.io/client-go/tools/remotecommand"
 )
 
-type Client struct {
-	Clientset    *kubernetes.Clientset
-	ClientConfig clientcmd.ClientConfig
-	Config       *rest.Config
-	Namespace    string
-	Context      string
+// PodClient is what rop needs from a cluster: pod lookup, file transfer, exec and deletion.
+type PodClient interface {
+	FindPodByName(ctx context.Context, podName string) (*corev1.Pod, error)
+	GetPod(ctx context.Context, podName string) (*corev1.Pod, error)
+	ListRunningPods(ctx context.Context, selector string) ([]corev1.Pod, error)
+	CreateClonePod(ctx context.Context, ref string, initContainers bool) (*corev1.Pod, error)
+	ListClonePods(ctx context.Context, selector string) ([]corev1.Pod, error)
+	DeletePod(ctx context.Context, pod *corev1.Pod) error
+	AnnotatePod(ctx context.Context, pod *corev1.Pod, annotations map[string]any) error
+	GetPodOwner(ctx context.Context, pod *corev1.Pod) (string, error)
+	GetSecret(ctx context.Context, name string) (*corev1.Secret, error)
+	CopyFileToContainer(ctx context.Context, file io.Reader, pod *corev1.Pod, container, destPath string) error
+	CopyFileFromContainer(ctx context.Context, pod *corev1.Pod, container, srcPath string, file io.Writer) error
+	RunCommandInPod(ctx context.Context, command []string, pod *corev1.Pod, container string, streams IOStreams) error
+	RunAuxiliaryCommand(ctx context.Context, command []string, pod *corev1.Pod, container string) error
+	DeleteFileFromContainer(ctx context.Context, pod *corev1.Pod, container, filePath string) error
 }
 
-func NewClient(kubeContext, namespace string) (*Client, error) {
-	client := &Client{
-		Context:   kubeContext,
-		Namespace: namespace,
-	}
+var _ PodClient = (*Client)(nil)
 
-	if err := client.initializeKubernetesClient(); err != nil {
-		return nil, fmt.Errorf("failed to initialize Kubernetes client: %w", err)
-	}
+type Client struct {
+	Clientset kubernetes.Interface
+	Config    *rest.Config
+	Namespace string
 
-	return client, nil
+	// restClient builds exec requests. It is derived from Config rather than taken from
+	// Clientset, so that exec keeps working with fake clientsets.
+	restClient rest.Interface
 }
 
-func (c *Client) buildConfigWithContextAndNamespace(kubeconfigPath string) (*rest.Config, error) {
-	loadingRules := &clientcmd.ClientConfigLoadingRules{ExplicitPath: kubeconfigPath}
-	overrides := &clientcmd.ConfigOverrides{CurrentContext: c.Context}
+// IOStreams are the streams attached to a command executed in a pod.
+type IOStreams struct {
+	In     io.Reader
+	Out    io.Writer
+	ErrOut io.Writer
 
-	c.ClientConfig = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides)
+	// TTY allocates a terminal for the command; its stderr is then merged into Out.
+	TTY bool
+	// Resize reports terminal size changes when TTY is set. Optional.
+	Resize remotecommand.TerminalSizeQueue
+}
 
-	config, err := c.ClientConfig.ClientConfig()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get client config: %w", err)
+// NewClientForConfig creates a client for the given config. The clientset is optional and
+// is built from the config when nil.
+func NewClientForConfig(config *rest.Config, clientset kubernetes.Interface, namespace string) (*Client, error) {
+	if config == nil {
+		return nil, fmt.Errorf("a REST config is required")
 	}
 
-	if c.Namespace == "" {
-		c.Namespace, _, err = c.ClientConfig.Namespace()
+	if clientset == nil {
+		var err error
+		clientset, err = kubernetes.NewForConfig(config)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get namespace from context: %w", err)
+			return nil, fmt.Errorf("failed to create Kubernetes clientset: %w", err)
 		}
-		log.Debug().Msgf("Using namespace from context: %s", c.Namespace)
 	}
 
-	log.Debug().Msgf("Using namespace: %s", c.Namespace)
-	return config, nil
+	coreClient, err := corev1client.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create core REST client: %w", err)
+	}
+
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+	log.Debug().Msgf("Using namespace: %s", namespace)
+
+	return &Client{
+		Clientset:  clientset,
+		Config:     config,
+		Namespace:  namespace,
+		restClient: coreClient.RESTClient(),
+	}, nil
 }
 
-func (c *Client) initializeKubernetesClient() error {
-	kubeconfig := filepath.Join(homedir.HomeDir(), ".kube", "config")
-	if envPath := os.Getenv("KUBECONFIG"); envPath != "" {
-		kubeconfig = envPath
+// Kubeconfig is the kubeconfig file to use, like kubectl's --kubeconfig. When empty, the
+// files in $KUBECONFIG or ~/.kube/config are used.
+var Kubeconfig string
+
+// loadingRules returns where the kubeconfig is read from.
+func loadingRules() *clientcmd.ClientConfigLoadingRules {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if Kubeconfig != "" {
+		log.Debug().Msgf("Using kubeconfig: %s", Kubeconfig)
+		rules.ExplicitPath = Kubeconfig
 	}
-	log.Debug().Msgf("Using kubeconfig: %s", kubeconfig)
+	return rules
+}
+
+// LoadConfig loads the REST config of the given kubeconfig context. When namespace is empty,
+// the namespace of the context is returned instead. A positive connectTimeout bounds API
+// requests and dialing the API server.
+func LoadConfig(kubeContext, namespace string, connectTimeout time.Duration) (*rest.Config, string, error) {
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: kubeContext}
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules(), overrides)
 
-	config, err := c.buildConfigWithContextAndNamespace(kubeconfig)
+	config, err := clientConfig.ClientConfig()
 	if err != nil {
-		return err
+		return nil, "", fmt.Errorf("failed to get client config: %w", err)
 	}
-	c.Config = config
 
-	c.Clientset, err = kubernetes.NewForConfig(c.Config)
-	if err != nil {
-		return fmt.Errorf("failed to create Kubernetes clientset: %w", err)
+	if namespace == "" {
+		namespace, _, err = clientConfig.Namespace()
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to get namespace from context: %w", err)
+		}
+		log.Debug().Msgf("Using namespace from context: %s", namespace)
 	}
 
-	return nil
-}
+	if connectTimeout > 0 {
+		log.Debug().Msgf("Using connect timeout: %s", connectTimeout)
+		config.Timeout = connectTimeout
+		config.Dial = (&net.Dialer{Timeout: connectTimeout}).DialContext
+	}
 
+	return config, namespace, nil
+}
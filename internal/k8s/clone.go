@@ -0,0 +1,292 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// ManagedByLabel marks pods created by rop so they can be told apart from workload pods.
+	ManagedByLabel = "app.kubernetes.io/managed-by"
+	managedByValue = "rop"
+
+	clonePodReadyTimeout = 5 * time.Minute
+
+	// KeepAnnotation marks a clone kept after its run, which rop gc leaves alone.
+	KeepAnnotation = "rop/keep"
+	// InUseAnnotation holds when a run last used the clone. Runs refresh it every
+	// CloneHeartbeat, so clones of runs that were killed can be told apart from those of
+	// runs still going.
+	InUseAnnotation = "rop/in-use"
+	CloneHeartbeat  = time.Minute
+)
+
+// CloneInUse reports whether a run used the clone within the last few heartbeats.
+func CloneInUse(pod *corev1.Pod, now time.Time) bool {
+	used, err := time.Parse(time.RFC3339, pod.Annotations[InUseAnnotation])
+	return err == nil && now.Sub(used) < 3*CloneHeartbeat
+}
+
+// ParseWorkloadRef splits a reference such as "deploy/api" into its kind and name.
+func ParseWorkloadRef(ref string) (kind, name string, err error) {
+	kind, name, ok := strings.Cut(ref, "/")
+	if !ok || kind == "" || name == "" {
+		return "", "", fmt.Errorf("invalid workload reference %q, expected <kind>/<name> (e.g. 'deploy/api')", ref)
+	}
+	return strings.ToLower(kind), name, nil
+}
+
+// GetPodTemplate returns the pod template of the referenced workload.
+func (c *Client) GetPodTemplate(ctx context.Context, ref string) (*corev1.PodTemplateSpec, error) {
+	kind, name, err := ParseWorkloadRef(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug().Msgf("Getting %s %s from namespace %s", kind, name, c.Namespace)
+	apps := c.Clientset.AppsV1()
+	batch := c.Clientset.BatchV1()
+
+	switch kind {
+	case "deploy", "deployment", "deployments":
+		obj, err := apps.Deployments(c.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("error getting deployment: %w", err)
+		}
+		return &obj.Spec.Template, nil
+	case "sts", "statefulset", "statefulsets":
+		obj, err := apps.StatefulSets(c.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("error getting statefulset: %w", err)
+		}
+		return &obj.Spec.Template, nil
+	case "ds", "daemonset", "daemonsets":
+		obj, err := apps.DaemonSets(c.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("error getting daemonset: %w", err)
+		}
+		return &obj.Spec.Template, nil
+	case "rs", "replicaset", "replicasets":
+		obj, err := apps.ReplicaSets(c.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("error getting replicaset: %w", err)
+		}
+		return &obj.Spec.Template, nil
+	case "job", "jobs":
+		obj, err := batch.Jobs(c.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("error getting job: %w", err)
+		}
+		return &obj.Spec.Template, nil
+	case "cj", "cronjob", "cronjobs":
+		obj, err := batch.CronJobs(c.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("error getting cronjob: %w", err)
+		}
+		return &obj.Spec.JobTemplate.Spec.Template, nil
+	default:
+		return nil, fmt.Errorf("unsupported workload kind %q", kind)
+	}
+}
+
+// ListWorkloadRefs returns references to the workloads of the namespace that pods can be
+// cloned from, such as "deploy/api", sorted by kind and name.
+func (c *Client) ListWorkloadRefs(ctx context.Context) ([]string, error) {
+	apps := c.Clientset.AppsV1()
+	batch := c.Clientset.BatchV1()
+	var refs []string
+
+	deployments, err := apps.Deployments(c.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing deployments: %w", err)
+	}
+	for _, obj := range deployments.Items {
+		refs = append(refs, "deploy/"+obj.Name)
+	}
+
+	statefulSets, err := apps.StatefulSets(c.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing statefulsets: %w", err)
+	}
+	for _, obj := range statefulSets.Items {
+		refs = append(refs, "sts/"+obj.Name)
+	}
+
+	daemonSets, err := apps.DaemonSets(c.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing daemonsets: %w", err)
+	}
+	for _, obj := range daemonSets.Items {
+		refs = append(refs, "ds/"+obj.Name)
+	}
+
+	cronJobs, err := batch.CronJobs(c.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing cronjobs: %w", err)
+	}
+	for _, obj := range cronJobs.Items {
+		refs = append(refs, "cj/"+obj.Name)
+	}
+
+	return refs, nil
+}
+
+// CreateClonePod creates a throwaway pod from the referenced workload's pod template and
+// waits until it is ready. The clone keeps the image, env, volumes and service account of
+// the original, but carries none of its labels so no Service routes traffic to it, and
+// every container just sleeps. Sidecars are kept as they are; other init containers are
+// dropped unless initContainers is set. The clone is annotated as in use from the start,
+// see InUseAnnotation.
+func (c *Client) CreateClonePod(ctx context.Context, ref string, initContainers bool) (*corev1.Pod, error) {
+	template, err := c.GetPodTemplate(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	_, name, _ := ParseWorkloadRef(ref)
+	pod := buildClonePod(name, c.Namespace, template, initContainers)
+
+	created, err := c.Clientset.CoreV1().Pods(c.Namespace).Create(ctx, pod, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error creating clone pod: %w", err)
+	}
+	log.Debug().Msgf("Created clone pod %s from %s", created.Name, ref)
+
+	ready, err := c.waitForPodReady(ctx, created.Name)
+	if err != nil {
+		return created, err
+	}
+
+	return ready, nil
+}
+
+// DeletePod deletes the given pod without waiting for a graceful shutdown.
+func (c *Client) DeletePod(ctx context.Context, pod *corev1.Pod) error {
+	gracePeriod := int64(0)
+	err := c.Clientset.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{
+		GracePeriodSeconds: &gracePeriod,
+	})
+	if err != nil {
+		return fmt.Errorf("error deleting pod %s: %w", pod.Name, err)
+	}
+	return nil
+}
+
+// AnnotatePod sets the given annotations of the pod; nil values remove them.
+func (c *Client) AnnotatePod(ctx context.Context, pod *corev1.Pod, annotations map[string]any) error {
+	patch, err := json.Marshal(map[string]any{"metadata": map[string]any{"annotations": annotations}})
+	if err != nil {
+		return fmt.Errorf("error encoding annotations: %w", err)
+	}
+	_, err = c.Clientset.CoreV1().Pods(pod.Namespace).Patch(ctx, pod.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("error annotating pod %s: %w", pod.Name, err)
+	}
+	return nil
+}
+
+// ListClonePods returns the pods cloned by rop in the namespace, in any phase, that also
+// match the label selector when it is set.
+func (c *Client) ListClonePods(ctx context.Context, selector string) ([]corev1.Pod, error) {
+	cloneSelector := ManagedByLabel + "=" + managedByValue
+	if selector != "" {
+		cloneSelector += "," + selector
+	}
+	pods, err := c.Clientset.CoreV1().Pods(c.Namespace).List(ctx, metav1.ListOptions{LabelSelector: cloneSelector})
+	if err != nil {
+		return nil, fmt.Errorf("error listing cloned pods: %w", err)
+	}
+	return pods.Items, nil
+}
+
+func buildClonePod(name, namespace string, template *corev1.PodTemplateSpec, initContainers bool) *corev1.Pod {
+	spec := *template.Spec.DeepCopy()
+	spec.RestartPolicy = corev1.RestartPolicyNever
+	spec.NodeName = ""
+	spec.InitContainers = cloneInitContainers(spec.InitContainers, initContainers)
+
+	for i := range spec.Containers {
+		container := &spec.Containers[i]
+		container.Command = []string{"sleep", "infinity"}
+		container.Args = nil
+		container.LivenessProbe = nil
+		container.ReadinessProbe = nil
+		container.StartupProbe = nil
+		container.Lifecycle = nil
+		container.Ports = nil
+	}
+
+	annotations := maps.Clone(template.Annotations)
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[InUseAnnotation] = time.Now().UTC().Format(time.RFC3339)
+
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: fmt.Sprintf("%s-rop-", name),
+			Namespace:    namespace,
+			Labels:       map[string]string{ManagedByLabel: managedByValue},
+			Annotations:  annotations,
+		},
+		Spec: spec,
+	}
+}
+
+// cloneInitContainers returns the init containers a clone runs: native sidecars, such as
+// proxies the containers connect through, and the others only when all is set. They are
+// dropped by default, since they may run migrations or other side effects we don't want
+// to repeat.
+func cloneInitContainers(initContainers []corev1.Container, all bool) []corev1.Container {
+	var kept []corev1.Container
+	for _, container := range initContainers {
+		sidecar := container.RestartPolicy != nil && *container.RestartPolicy == corev1.ContainerRestartPolicyAlways
+		if sidecar || all {
+			kept = append(kept, container)
+		} else {
+			log.Debug().Msgf("Not running init container %s in the clone", container.Name)
+		}
+	}
+	return kept
+}
+
+func (c *Client) waitForPodReady(ctx context.Context, podName string) (*corev1.Pod, error) {
+	log.Debug().Msgf("Waiting for pod %s to become ready", podName)
+
+	var pod *corev1.Pod
+	err := wait.PollUntilContextTimeout(ctx, time.Second, clonePodReadyTimeout, true, func(ctx context.Context) (bool, error) {
+		current, err := c.Clientset.CoreV1().Pods(c.Namespace).Get(ctx, podName, metav1.GetOptions{})
+		if err != nil {
+			return false, fmt.Errorf("error getting pod %s: %w", podName, err)
+		}
+		pod = current
+
+		switch current.Status.Phase {
+		case corev1.PodFailed, corev1.PodSucceeded:
+			return false, fmt.Errorf("pod %s terminated with phase %s", podName, current.Status.Phase)
+		}
+
+		for _, condition := range current.Status.Conditions {
+			if condition.Type == corev1.PodReady && condition.Status == corev1.ConditionTrue {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		return pod, fmt.Errorf("pod %s did not become ready: %w", podName, err)
+	}
+
+	log.Debug().Msgf("Pod %s is ready", podName)
+	return pod, nil
+}
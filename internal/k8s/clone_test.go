@@ -0,0 +1,122 @@
+package k8s
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseWorkloadRef(t *testing.T) {
+	kind, name, err := ParseWorkloadRef("Deploy/api")
+	if err != nil || kind != "deploy" || name != "api" {
+		t.Errorf("got (%q, %q, %v)", kind, name, err)
+	}
+
+	for _, ref := range []string{"api", "deploy/", "/api"} {
+		if _, _, err := ParseWorkloadRef(ref); err == nil {
+			t.Errorf("expected an error for %q", ref)
+		}
+	}
+}
+
+func TestBuildClonePod(t *testing.T) {
+	always := corev1.ContainerRestartPolicyAlways
+	template := &corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels:      map[string]string{"app": "api"},
+			Annotations: map[string]string{"note": "kept"},
+		},
+		Spec: corev1.PodSpec{
+			ServiceAccountName: "api",
+			Volumes: []corev1.Volume{
+				{Name: "config", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+				{Name: "data", VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "data"}}},
+			},
+			InitContainers: []corev1.Container{
+				{Name: "migrate", VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: "/data"}}},
+				{Name: "render-config", VolumeMounts: []corev1.VolumeMount{{Name: "config", MountPath: "/config"}}},
+				{Name: "proxy", RestartPolicy: &always},
+			},
+			Containers: []corev1.Container{{
+				Name:           "main",
+				Image:          "api:1.0",
+				Command:        []string{"/api"},
+				Args:           []string{"serve"},
+				Env:            []corev1.EnvVar{{Name: "MODE", Value: "prod"}},
+				ReadinessProbe: &corev1.Probe{},
+			}},
+		},
+	}
+
+	pod := buildClonePod("api", "default", template, false)
+
+	if pod.GenerateName != "api-rop-" || pod.Namespace != "default" {
+		t.Errorf("unexpected metadata: %+v", pod.ObjectMeta)
+	}
+	if len(pod.Labels) != 1 || pod.Labels[ManagedByLabel] != "rop" {
+		t.Errorf("labels were not stripped: %v", pod.Labels)
+	}
+	if pod.Annotations["note"] != "kept" {
+		t.Errorf("annotations were not kept: %v", pod.Annotations)
+	}
+	if !CloneInUse(pod, time.Now()) || CloneInUse(pod, time.Now().Add(time.Hour)) {
+		t.Errorf("clone not marked as in use: %v", pod.Annotations)
+	}
+	if len(template.Annotations) != 1 {
+		t.Errorf("template annotations were modified: %v", template.Annotations)
+	}
+	if pod.Spec.ServiceAccountName != "api" || pod.Spec.RestartPolicy != corev1.RestartPolicyNever || len(pod.Spec.Volumes) != 2 {
+		t.Errorf("unexpected spec: %+v", pod.Spec)
+	}
+	if got, want := initContainerNames(pod), []string{"proxy"}; !slices.Equal(got, want) {
+		t.Errorf("init containers = %v, want %v", got, want)
+	}
+	all := buildClonePod("api", "default", template, true)
+	if got, want := initContainerNames(all), []string{"migrate", "render-config", "proxy"}; !slices.Equal(got, want) {
+		t.Errorf("init containers with all of them = %v, want %v", got, want)
+	}
+
+	container := pod.Spec.Containers[0]
+	if container.Image != "api:1.0" || len(container.Env) != 1 {
+		t.Errorf("image or env not kept: %+v", container)
+	}
+	if len(container.Command) != 2 || container.Command[0] != "sleep" || container.Args != nil || container.ReadinessProbe != nil {
+		t.Errorf("container not neutralized: %+v", container)
+	}
+	if template.Spec.Containers[0].Command[0] != "/api" {
+		t.Error("template was modified")
+	}
+}
+
+func TestListWorkloadRefs(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "payments"}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "other"}},
+		&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "payments"}},
+		&batchv1.CronJob{ObjectMeta: metav1.ObjectMeta{Name: "report", Namespace: "payments"}},
+	)
+	client := &Client{Clientset: clientset, Namespace: "payments"}
+
+	refs, err := client.ListWorkloadRefs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"deploy/api", "sts/db", "cj/report"}; !slices.Equal(refs, want) {
+		t.Errorf("got %v, want %v", refs, want)
+	}
+}
+
+func initContainerNames(pod *corev1.Pod) []string {
+	var names []string
+	for _, container := range pod.Spec.InitContainers {
+		names = append(names, container.Name)
+	}
+	return names
+}
@@ -0,0 +1,98 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/util/retry"
+)
+
+// transientBackoff bounds the retries of housekeeping execs such as copies and cleanups.
+var transientBackoff = wait.Backoff{
+	Steps:    4,
+	Duration: 500 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.1,
+}
+
+// stream runs the command in the container, preferring the WebSocket protocol and falling
+// back to SPDY when the upgrade fails (e.g. older API servers or proxies).
+func (c *Client) stream(ctx context.Context, pod *corev1.Pod, container string, command []string, opts remotecommand.StreamOptions) error {
+	exec, err := c.newExecutor(pod, container, command, opts)
+	if err != nil {
+		return err
+	}
+	return exec.StreamWithContext(ctx, opts)
+}
+
+func (c *Client) newExecutor(pod *corev1.Pod, container string, command []string, opts remotecommand.StreamOptions) (remotecommand.Executor, error) {
+	req := c.restClient.Post().
+		Resource("pods").
+		Name(pod.Name).
+		Namespace(pod.Namespace).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: container,
+			Command:   command,
+			Stdin:     opts.Stdin != nil,
+			Stdout:    opts.Stdout != nil,
+			Stderr:    opts.Stderr != nil,
+			TTY:       opts.Tty,
+		}, scheme.ParameterCodec)
+
+	spdyExec, err := remotecommand.NewSPDYExecutor(c.Config, "POST", req.URL())
+	if err != nil {
+		return nil, fmt.Errorf("error creating SPDY executor: %w", err)
+	}
+
+	websocketExec, err := remotecommand.NewWebSocketExecutor(c.Config, "GET", req.URL().String())
+	if err != nil {
+		return nil, fmt.Errorf("error creating WebSocket executor: %w", err)
+	}
+
+	exec, err := remotecommand.NewFallbackExecutor(websocketExec, spdyExec, shouldFallback)
+	if err != nil {
+		return nil, fmt.Errorf("error creating fallback executor: %w", err)
+	}
+	return exec, nil
+}
+
+func shouldFallback(err error) bool {
+	return httpstream.IsUpgradeFailure(err) || httpstream.IsHTTPSProxyError(err)
+}
+
+// retryTransient retries fn with backoff while it fails with a transient connection error.
+func retryTransient(ctx context.Context, fn func() error) error {
+	attempt := 0
+	return retry.OnError(transientBackoff, func(err error) bool {
+		if ctx.Err() != nil || !isTransient(err) {
+			return false
+		}
+		attempt++
+		log.Debug().Err(err).Msgf("Transient exec failure, retrying (attempt %d)", attempt)
+		return true
+	}, fn)
+}
+
+func isTransient(err error) bool {
+	var statusErr *apierrors.StatusError
+	if errors.As(err, &statusErr) {
+		return apierrors.IsTooManyRequests(err) || apierrors.IsServerTimeout(err) ||
+			apierrors.IsServiceUnavailable(err) || apierrors.IsTimeout(err)
+	}
+
+	return httpstream.IsUpgradeFailure(err) ||
+		utilnet.IsConnectionReset(err) ||
+		utilnet.IsConnectionRefused(err) ||
+		utilnet.IsProbableEOF(err)
+}
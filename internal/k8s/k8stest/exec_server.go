@@ -0,0 +1,280 @@
+// Package k8stest provides an in-process stand-in for the exec endpoint of the Kubernetes
+// API server, so exec based flows can be tested without a cluster.
+package k8stest
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/apimachinery/pkg/util/httpstream/spdy"
+	remotecommandconsts "k8s.io/apimachinery/pkg/util/remotecommand"
+	"k8s.io/client-go/rest"
+)
+
+// Exec is a command executed in a container of the fake cluster.
+type Exec struct {
+	Namespace string
+	Pod       string
+	Container string
+	Command   []string
+
+	// Stdin is nil when the client attached no stdin.
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	// Done is closed when the client goes away, e.g. because its context was cancelled.
+	Done <-chan bool
+}
+
+// ExecFunc handles a command and returns its exit code.
+type ExecFunc func(exec *Exec) int
+
+// ExecServer serves pod exec requests over SPDY. WebSocket upgrades are rejected, so clients
+// exercise their fallback path. Copies into the container ("cp /dev/stdin <path>"),
+// removals ("rm -f <path>") and existence checks ("test -f <path>") are applied to an
+// in-memory file system; every other command is passed to the ExecFunc.
+type ExecServer struct {
+	server *httptest.Server
+	run    ExecFunc
+
+	mu       sync.Mutex
+	files    map[string][]byte
+	commands []Exec
+	failures map[string]int
+}
+
+// NewExecServer starts a server. A nil run function makes every command exit with 0.
+func NewExecServer(run ExecFunc) *ExecServer {
+	s := &ExecServer{
+		run:      run,
+		files:    map[string][]byte{},
+		failures: map[string]int{},
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveExec))
+	return s
+}
+
+// Close shuts the server down.
+func (s *ExecServer) Close() {
+	s.server.Close()
+}
+
+// RESTConfig returns a config pointing at the server.
+func (s *ExecServer) RESTConfig() *rest.Config {
+	return &rest.Config{Host: s.server.URL}
+}
+
+// File returns the content of a file in the fake file system.
+func (s *ExecServer) File(path string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	content, ok := s.files[path]
+	return content, ok
+}
+
+// Files returns the paths currently present in the fake file system.
+func (s *ExecServer) Files() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	paths := make([]string, 0, len(s.files))
+	for path := range s.files {
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// FailCommand makes every command named name exit with exitCode, including the built-in
+// cp and rm handling.
+func (s *ExecServer) FailCommand(name string, exitCode int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[name] = exitCode
+}
+
+// Commands returns the commands received so far, in order. The streams of the returned
+// execs are not set.
+func (s *ExecServer) Commands() []Exec {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Exec(nil), s.commands...)
+}
+
+func (s *ExecServer) serveExec(w http.ResponseWriter, req *http.Request) {
+	// Path: /api/v1/namespaces/<namespace>/pods/<pod>/exec
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if len(parts) != 7 || parts[6] != "exec" {
+		http.NotFound(w, req)
+		return
+	}
+
+	if strings.EqualFold(req.Header.Get(httpstream.HeaderUpgrade), "websocket") {
+		http.Error(w, "websocket is not supported", http.StatusBadRequest)
+		return
+	}
+
+	query := req.URL.Query()
+	exec := &Exec{
+		Namespace: parts[3],
+		Pod:       parts[5],
+		Container: query.Get("container"),
+		Command:   query["command"],
+	}
+
+	streams, err := acceptStreams(w, req, query.Get("stdin") == "true", query.Get("stdout") == "true", query.Get("stderr") == "true")
+	if err != nil {
+		return
+	}
+	defer streams.conn.Close()
+
+	s.mu.Lock()
+	s.commands = append(s.commands, Exec{Namespace: exec.Namespace, Pod: exec.Pod, Container: exec.Container, Command: exec.Command})
+	s.mu.Unlock()
+
+	exec.Done = streams.conn.CloseChan()
+	if streams.stdin != nil {
+		exec.Stdin = streams.stdin
+	}
+	exec.Stdout = io.Discard
+	if streams.stdout != nil {
+		exec.Stdout = streams.stdout
+	}
+	exec.Stderr = io.Discard
+	if streams.stderr != nil {
+		exec.Stderr = streams.stderr
+	}
+
+	exitCode := s.handle(exec)
+
+	if streams.stdout != nil {
+		streams.stdout.Close()
+	}
+	if streams.stderr != nil {
+		streams.stderr.Close()
+	}
+	streams.writeExitCode(exitCode)
+}
+
+func (s *ExecServer) handle(exec *Exec) int {
+	command := exec.Command
+
+	s.mu.Lock()
+	exitCode, fail := s.failures[command[0]]
+	s.mu.Unlock()
+	if fail {
+		io.WriteString(exec.Stderr, command[0]+": failed\n")
+		return exitCode
+	}
+
+	switch {
+	case len(command) == 3 && command[0] == "cp" && command[1] == "/dev/stdin":
+		if exec.Stdin == nil {
+			return 1
+		}
+		content, err := io.ReadAll(exec.Stdin)
+		if err != nil {
+			return 1
+		}
+		s.mu.Lock()
+		s.files[command[2]] = content
+		s.mu.Unlock()
+		return 0
+	case len(command) == 3 && command[0] == "rm" && command[1] == "-f":
+		s.mu.Lock()
+		delete(s.files, command[2])
+		s.mu.Unlock()
+		return 0
+	case len(command) == 3 && command[0] == "test" && command[1] == "-f":
+		s.mu.Lock()
+		_, ok := s.files[command[2]]
+		s.mu.Unlock()
+		if !ok {
+			return 1
+		}
+		return 0
+	case s.run == nil:
+		return 0
+	default:
+		return s.run(exec)
+	}
+}
+
+type execStreams struct {
+	conn        httpstream.Connection
+	stdin       httpstream.Stream
+	stdout      httpstream.Stream
+	stderr      httpstream.Stream
+	errorStream httpstream.Stream
+}
+
+// acceptStreams upgrades the request and waits for the streams the client announced.
+func acceptStreams(w http.ResponseWriter, req *http.Request, stdin, stdout, stderr bool) (*execStreams, error) {
+	if _, err := httpstream.Handshake(req, w, []string{remotecommandconsts.StreamProtocolV4Name}); err != nil {
+		return nil, err
+	}
+
+	streamCh := make(chan httpstream.Stream)
+	conn := spdy.NewResponseUpgrader().UpgradeResponse(w, req, func(stream httpstream.Stream, replySent <-chan struct{}) error {
+		streamCh <- stream
+		return nil
+	})
+	if conn == nil {
+		return nil, errors.New("unable to upgrade connection")
+	}
+
+	expected := 1
+	for _, enabled := range []bool{stdin, stdout, stderr} {
+		if enabled {
+			expected++
+		}
+	}
+
+	streams := &execStreams{conn: conn}
+	for received := 0; received < expected; received++ {
+		stream := <-streamCh
+		switch stream.Headers().Get(corev1.StreamType) {
+		case corev1.StreamTypeError:
+			streams.errorStream = stream
+		case corev1.StreamTypeStdin:
+			streams.stdin = stream
+		case corev1.StreamTypeStdout:
+			streams.stdout = stream
+		case corev1.StreamTypeStderr:
+			streams.stderr = stream
+		default:
+			conn.Close()
+			return nil, errors.New("unexpected stream type")
+		}
+	}
+
+	return streams, nil
+}
+
+func (s *execStreams) writeExitCode(exitCode int) {
+	status := metav1.Status{Status: metav1.StatusSuccess}
+	if exitCode != 0 {
+		status = apierrors.NewInternalError(errors.New("command failed")).ErrStatus
+		status.Reason = remotecommandconsts.NonZeroExitCodeReason
+		status.Details = &metav1.StatusDetails{
+			Causes: []metav1.StatusCause{{
+				Type:    remotecommandconsts.ExitCodeCauseType,
+				Message: strconv.Itoa(exitCode),
+			}},
+		}
+	}
+
+	content, err := json.Marshal(status)
+	if err != nil {
+		return
+	}
+	s.errorStream.Write(content)
+}
@@ -4,44 +4,48 @@ import (
 	"bytes"
 	"context"
 	"fmt"
-	"os"
+	"io"
+	"sort"
+	"strings"
 
 	"github.com/rs/zerolog/log"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 	"k8s.io/client-go/tools/remotecommand"
 )
 
 func GetAvailableContexts() ([]string, error) {
-	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
-	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{}).RawConfig()
+	config, err := rawKubeconfig()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get kubeconfig: %w", err)
+		return nil, err
 	}
 
 	contexts := make([]string, 0, len(config.Contexts))
 	for name := range config.Contexts {
 		contexts = append(contexts, name)
 	}
+	sort.Strings(contexts)
 
 	return contexts, nil
 }
 
-func GetAvailableNamespaces(ctx string) ([]string, error) {
-	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
-		clientcmd.NewDefaultClientConfigLoadingRules(),
-		&clientcmd.ConfigOverrides{CurrentContext: ctx},
-	).ClientConfig()
+// GetCurrentContext returns the current context of the kubeconfig.
+func GetCurrentContext() (string, error) {
+	config, err := rawKubeconfig()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get client config: %w", err)
+		return "", err
 	}
+	return config.CurrentContext, nil
+}
 
-	clientset, err := kubernetes.NewForConfig(config)
+func GetAvailableNamespaces(ctx string) ([]string, error) {
+	clientset, err := clientsetForContext(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create clientset: %w", err)
+		return nil, err
 	}
 
 	namespaceList, err := clientset.CoreV1().Namespaces().List(context.Background(), metav1.ListOptions{})
@@ -57,35 +61,90 @@ func GetAvailableNamespaces(ctx string) ([]string, error) {
 	return namespaces, nil
 }
 
-func (c *Client) RunCommandInPod(ctx context.Context, command []string, pod *corev1.Pod, container string) error {
-	req := c.Clientset.CoreV1().RESTClient().Post().
-		Resource("pods").
-		Name(pod.Name).
-		Namespace(pod.Namespace).
-		SubResource("exec").
-		VersionedParams(&corev1.PodExecOptions{
-			Container: container,
-			Command:   command,
-			Stdin:     true,
-			Stdout:    true,
-			Stderr:    true,
-			TTY:       false,
-		}, scheme.ParameterCodec)
-
-	exec, err := remotecommand.NewSPDYExecutor(c.Config, "POST", req.URL())
+// GetAvailablePods lists the pods of a namespace, sorted by name.
+func GetAvailablePods(ctx, namespace string) ([]corev1.Pod, error) {
+	clientset, err := clientsetForContext(ctx)
 	if err != nil {
-		return fmt.Errorf("error creating SPDY executor: %w", err)
+		return nil, err
 	}
 
-	return exec.StreamWithContext(ctx, remotecommand.StreamOptions{
-		Stdin:  os.Stdin,
-		Stdout: os.Stdout,
-		Stderr: os.Stderr,
+	podList, err := clientset.CoreV1().Pods(namespace).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %w", err)
+	}
+
+	pods := podList.Items
+	sort.Slice(pods, func(i, j int) bool { return pods[i].Name < pods[j].Name })
+	return pods, nil
+}
+
+func rawKubeconfig() (*clientcmdapi.Config, error) {
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules(), &clientcmd.ConfigOverrides{}).RawConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get kubeconfig: %w", err)
+	}
+	return &config, nil
+}
+
+func clientsetForContext(ctx string) (kubernetes.Interface, error) {
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		loadingRules(),
+		&clientcmd.ConfigOverrides{CurrentContext: ctx},
+	).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client config: %w", err)
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create clientset: %w", err)
+	}
+	return clientset, nil
+}
+
+func (c *Client) RunCommandInPod(ctx context.Context, command []string, pod *corev1.Pod, container string, streams IOStreams) error {
+	// The user's command is never retried: it may have side effects even if the stream failed.
+	opts := remotecommand.StreamOptions{
+		Stdin:  streams.In,
+		Stdout: streams.Out,
+		Stderr: streams.ErrOut,
+	}
+	if streams.TTY {
+		opts.Stderr = nil
+		opts.Tty = true
+		opts.TerminalSizeQueue = streams.Resize
+	}
+	return c.stream(ctx, pod, container, command, opts)
+}
+
+// RunAuxiliaryCommand runs a housekeeping command (such as a cleanup) without stdin, retrying
+// transient connection failures.
+func (c *Client) RunAuxiliaryCommand(ctx context.Context, command []string, pod *corev1.Pod, container string) error {
+	return retryTransient(ctx, func() error {
+		var stderr bytes.Buffer
+		err := c.stream(ctx, pod, container, command, remotecommand.StreamOptions{
+			Stdout: io.Discard,
+			Stderr: &stderr,
+		})
+		if err != nil {
+			return fmt.Errorf("error running %q: %w, stderr: %s", strings.Join(command, " "), err, stderr.String())
+		}
+		return nil
 	})
 }
 
+// FindPodByName returns the pod with the given name or, failing that, the first running pod
+// whose app.kubernetes.io/name label matches it.
 func (c *Client) FindPodByName(ctx context.Context, podName string) (*corev1.Pod, error) {
 	log.Debug().Msgf("Getting pod %s from namespace %s", podName, c.Namespace)
+	pod, err := c.Clientset.CoreV1().Pods(c.Namespace).Get(ctx, podName, metav1.GetOptions{})
+	if err == nil {
+		return pod, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("error getting pod: %w", err)
+	}
+
 	pods, err := c.Clientset.CoreV1().Pods(c.Namespace).List(ctx, metav1.ListOptions{
 		FieldSelector: "status.phase=Running",
 		LabelSelector: fmt.Sprintf("app.kubernetes.io/name=%s", podName),
@@ -100,44 +159,110 @@ func (c *Client) FindPodByName(ctx context.Context, podName string) (*corev1.Pod
 	return &pods.Items[0], nil
 }
 
-func (c *Client) CopyFileToContainer(ctx context.Context, file *os.File, pod *corev1.Pod, container, destPath string) error {
-	log.Debug().Msgf("Copying file %s to container %s in pod %s", file.Name(), container, pod.Name)
+// GetPod returns the pod with exactly the given name. A missing pod is reported with an
+// error for which apierrors.IsNotFound holds.
+func (c *Client) GetPod(ctx context.Context, podName string) (*corev1.Pod, error) {
+	pod, err := c.Clientset.CoreV1().Pods(c.Namespace).Get(ctx, podName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error getting pod %s: %w", podName, err)
+	}
+	return pod, nil
+}
 
-	command := []string{"cp", "/dev/stdin", destPath}
-	req := c.Clientset.CoreV1().RESTClient().Post().
-		Resource("pods").
-		Name(pod.Name).
-		Namespace(pod.Namespace).
-		SubResource("exec").
-		VersionedParams(&corev1.PodExecOptions{
-			Container: container,
-			Command:   command,
-			Stdin:     true,
-			Stdout:    true,
-			Stderr:    true,
-			TTY:       false,
-		}, scheme.ParameterCodec)
-
-	exec, err := remotecommand.NewSPDYExecutor(c.Config, "POST", req.URL())
+// GetSecret returns the secret with the given name.
+func (c *Client) GetSecret(ctx context.Context, name string) (*corev1.Secret, error) {
+	secret, err := c.Clientset.CoreV1().Secrets(c.Namespace).Get(ctx, name, metav1.GetOptions{})
 	if err != nil {
-		return fmt.Errorf("error creating SPDY executor: %w", err)
+		return nil, fmt.Errorf("error getting secret %s: %w", name, err)
 	}
+	return secret, nil
+}
 
-	var stdout, stderr bytes.Buffer
-	err = exec.StreamWithContext(ctx, remotecommand.StreamOptions{
-		Stdin:  file,
-		Stdout: &stdout,
-		Stderr: &stderr,
+// ListRunningPods returns the running pods of the namespace matching the label selector,
+// or all of them when it is empty.
+func (c *Client) ListRunningPods(ctx context.Context, selector string) ([]corev1.Pod, error) {
+	pods, err := c.Clientset.CoreV1().Pods(c.Namespace).List(ctx, metav1.ListOptions{
+		FieldSelector: "status.phase=Running",
+		LabelSelector: selector,
 	})
 	if err != nil {
-		return fmt.Errorf("error copying file to pod: %w, stderr: %s", err, stderr.String())
+		return nil, fmt.Errorf("error listing pods: %w", err)
+	}
+	return pods.Items, nil
+}
+
+// ListNamespaces returns the names of the namespaces of the cluster.
+func (c *Client) ListNamespaces(ctx context.Context) ([]string, error) {
+	namespaceList, err := c.Clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list namespaces: %w", err)
 	}
 
-	log.Debug().Msgf("File copied to pod: %s", stdout.String())
+	namespaces := make([]string, len(namespaceList.Items))
+	for i, ns := range namespaceList.Items {
+		namespaces[i] = ns.Name
+	}
+	return namespaces, nil
+}
+
+// CopyFileToContainer streams file into destPath in the container. Transient failures are
+// only retried when file is an io.Seeker, since a retry must send the whole file again.
+func (c *Client) CopyFileToContainer(ctx context.Context, file io.Reader, pod *corev1.Pod, container, destPath string) error {
+	log.Debug().Msgf("Copying file to %s in container %s in pod %s", destPath, container, pod.Name)
+
+	command := []string{"cp", "/dev/stdin", destPath}
+	seeker, canRetry := file.(io.Seeker)
+	var start int64
+	if canRetry {
+		// Pipes may implement io.Seeker without supporting it.
+		var err error
+		start, err = seeker.Seek(0, io.SeekCurrent)
+		canRetry = err == nil
+	}
+
+	attempt := func() error {
+		if canRetry {
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return fmt.Errorf("error rewinding file: %w", err)
+			}
+		}
+
+		var stdout, stderr bytes.Buffer
+		err := c.stream(ctx, pod, container, command, remotecommand.StreamOptions{
+			Stdin:  file,
+			Stdout: &stdout,
+			Stderr: &stderr,
+		})
+		if err != nil {
+			return fmt.Errorf("error copying file to pod: %w, stderr: %s", err, stderr.String())
+		}
+
+		log.Debug().Msgf("File copied to pod: %s", stdout.String())
+		return nil
+	}
+
+	if !canRetry {
+		return attempt()
+	}
+	return retryTransient(ctx, attempt)
+}
+
+// CopyFileFromContainer streams srcPath in the container into file. It is not retried, since
+// file may already have received part of the content.
+func (c *Client) CopyFileFromContainer(ctx context.Context, pod *corev1.Pod, container, srcPath string, file io.Writer) error {
+	log.Debug().Msgf("Copying %s from container %s in pod %s", srcPath, container, pod.Name)
+
+	var stderr bytes.Buffer
+	err := c.stream(ctx, pod, container, []string{"cat", srcPath}, remotecommand.StreamOptions{
+		Stdout: file,
+		Stderr: &stderr,
+	})
+	if err != nil {
+		return fmt.Errorf("error copying %s: %w, stderr: %s", srcPath, err, stderr.String())
+	}
 	return nil
 }
 
 func (c *Client) DeleteFileFromContainer(ctx context.Context, pod *corev1.Pod, container, filePath string) error {
-	return c.RunCommandInPod(ctx, []string{"rm", "-f", filePath}, pod, container)
+	return c.RunAuxiliaryCommand(ctx, []string{"rm", "-f", filePath}, pod, container)
 }
-
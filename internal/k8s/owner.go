@@ -0,0 +1,44 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// GetPodOwner returns the workload owning the pod, e.g. "deployment/api". ReplicaSets and
+// Jobs are followed to their Deployment or CronJob. It returns "" for bare pods.
+func (c *Client) GetPodOwner(ctx context.Context, pod *corev1.Pod) (string, error) {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return "", nil
+	}
+
+	var parent *metav1.OwnerReference
+	switch owner.Kind {
+	case "ReplicaSet":
+		rs, err := c.Clientset.AppsV1().ReplicaSets(pod.Namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+		if err != nil {
+			return formatOwner(owner), fmt.Errorf("error getting replicaset %s: %w", owner.Name, err)
+		}
+		parent = metav1.GetControllerOf(rs)
+	case "Job":
+		job, err := c.Clientset.BatchV1().Jobs(pod.Namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+		if err != nil {
+			return formatOwner(owner), fmt.Errorf("error getting job %s: %w", owner.Name, err)
+		}
+		parent = metav1.GetControllerOf(job)
+	}
+
+	if parent != nil {
+		return formatOwner(parent), nil
+	}
+	return formatOwner(owner), nil
+}
+
+func formatOwner(owner *metav1.OwnerReference) string {
+	return strings.ToLower(owner.Kind) + "/" + owner.Name
+}
@@ -47,3 +47,14 @@ func ConfigureLogger(debug bool) {
 
 	log.Logger = logger
 }
+
+// ConfigureJSONLogger logs JSON objects to stderr, for machine-readable output modes.
+func ConfigureJSONLogger(debug bool) {
+	level := zerolog.InfoLevel
+	if debug {
+		level = zerolog.DebugLevel
+	}
+	zerolog.SetGlobalLevel(level)
+
+	log.Logger = zerolog.New(os.Stderr).With().Timestamp().Logger()
+}
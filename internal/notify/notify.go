@@ -0,0 +1,274 @@
+// Package notify posts a message about every run to webhooks, as generic JSON or in the
+// format of Slack incoming webhooks. Notifications are best effort: failures are retried
+// and then only logged.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Webhook formats.
+const (
+	FormatGeneric = "generic"
+	FormatSlack   = "slack"
+)
+
+// Webhook is a URL notifications are posted to.
+type Webhook struct {
+	URL string
+	// Format is FormatGeneric (the default) or FormatSlack.
+	Format string
+}
+
+// Notification describes a run. It is the payload of generic webhooks.
+type Notification struct {
+	Time      time.Time `json:"time"`
+	User      string    `json:"user"`
+	Context   string    `json:"context"`
+	Namespace string    `json:"namespace"`
+	Pod       string    `json:"pod,omitempty"`
+	Container string    `json:"container,omitempty"`
+	File      string    `json:"file"`
+	SHA256    string    `json:"sha256,omitempty"`
+	Command   []string  `json:"command,omitempty"`
+	// ExitCode is nil when the run failed before the file was executed.
+	ExitCode   *int   `json:"exit_code,omitempty"`
+	TimedOut   bool   `json:"timed_out,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+	// Output is the end of the combined stdout and stderr of the run.
+	Output string `json:"output,omitempty"`
+}
+
+// Success reports whether the file ran and exited with code zero.
+func (n Notification) Success() bool {
+	return n.Error == "" && n.ExitCode != nil && *n.ExitCode == 0
+}
+
+// Notifier posts notifications to webhooks.
+type Notifier struct {
+	Webhooks []Webhook
+	// Client sends the requests. Defaults to http.DefaultClient.
+	Client *http.Client
+	// Timeout bounds every attempt. Defaults to 5 seconds.
+	Timeout time.Duration
+	// Attempts is how often a notification is tried per webhook. Defaults to 3.
+	Attempts int
+	// Backoff is the delay before the second attempt, doubled for every further one.
+	// Defaults to 500 milliseconds.
+	Backoff time.Duration
+}
+
+// Notify posts the notification to every webhook. Failures are logged, never returned, so
+// that notifications can't fail a run.
+func (n *Notifier) Notify(ctx context.Context, notification Notification) {
+	// A run interrupted by the user is still reported.
+	ctx = context.WithoutCancel(ctx)
+
+	var wg sync.WaitGroup
+	for _, webhook := range n.Webhooks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := n.Send(ctx, webhook, notification); err != nil {
+				log.Warn().Err(err).Msg("Failed to send notification")
+			} else {
+				log.Debug().Msgf("Sent notification to %s", redactURL(webhook.URL))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Send posts the notification to the webhook, retrying server errors and failed
+// connections.
+func (n *Notifier) Send(ctx context.Context, webhook Webhook, notification Notification) error {
+	payload, err := encode(webhook.Format, notification)
+	if err != nil {
+		return err
+	}
+
+	attempts := n.Attempts
+	if attempts <= 0 {
+		attempts = 3
+	}
+	backoff := n.Backoff
+	if backoff <= 0 {
+		backoff = 500 * time.Millisecond
+	}
+
+	for attempt := 1; ; attempt++ {
+		retry, err := n.post(ctx, webhook.URL, payload)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt == attempts {
+			return fmt.Errorf("notifying %s: %w", redactURL(webhook.URL), err)
+		}
+
+		log.Debug().Err(err).Msgf("Notification attempt %d failed, retrying in %s", attempt, backoff)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// post sends the payload once and reports whether a failure is worth retrying.
+func (n *Notifier) post(ctx context.Context, url string, payload []byte) (bool, error) {
+	timeout := n.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "rop")
+
+	client := n.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	var urlErr *neturl.Error
+	if errors.As(err, &urlErr) {
+		// Keep the URL, which holds the token of the webhook, out of the logs.
+		err = urlErr.Err
+	}
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+func encode(format string, notification Notification) ([]byte, error) {
+	switch format {
+	case "", FormatGeneric:
+		return json.Marshal(notification)
+	case FormatSlack:
+		return json.Marshal(map[string]string{"text": slackText(notification)})
+	default:
+		return nil, fmt.Errorf("unknown webhook format %q, expected %q or %q", format, FormatGeneric, FormatSlack)
+	}
+}
+
+// slackText renders the notification as Slack mrkdwn.
+func slackText(n Notification) string {
+	var status string
+	switch {
+	case n.Error != "":
+		status = ":x: failed: " + n.Error
+	case n.TimedOut:
+		status = ":hourglass: timed out"
+	case n.Success():
+		status = ":white_check_mark: exit 0"
+	case n.ExitCode == nil:
+		status = ":x: not executed"
+	default:
+		status = fmt.Sprintf(":x: exit %d", *n.ExitCode)
+	}
+
+	target := n.Namespace
+	if n.Pod != "" {
+		target += "/" + n.Pod
+	}
+	if n.Container != "" {
+		target += " (" + n.Container + ")"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%s* ran `%s` on `%s` %s: %s in %s", n.User, n.File, n.Context, target, status,
+		(time.Duration(n.DurationMS) * time.Millisecond).String())
+	if n.SHA256 != "" {
+		fmt.Fprintf(&b, "\nSHA-256 `%s`", n.SHA256)
+	}
+	if n.Output != "" {
+		fmt.Fprintf(&b, "\n```%s```", strings.ReplaceAll(n.Output, "```", "'''"))
+	}
+	return b.String()
+}
+
+// redactURL drops the path of webhook URLs from messages, since it usually holds the
+// secret token of the webhook.
+func redactURL(url string) string {
+	scheme, rest, ok := strings.Cut(url, "://")
+	if !ok {
+		return "webhook"
+	}
+	host, _, _ := strings.Cut(rest, "/")
+	return scheme + "://" + host + "/..."
+}
+
+// Tail keeps the last bytes written to it, for the output of notifications. It is safe for
+// concurrent use.
+type Tail struct {
+	size int
+
+	mu        sync.Mutex
+	buf       []byte
+	truncated bool
+}
+
+// NewTail returns a Tail keeping the last size bytes.
+func NewTail(size int) *Tail {
+	return &Tail{size: size}
+}
+
+func (t *Tail) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.size {
+		t.buf = t.buf[len(t.buf)-t.size:]
+		t.truncated = true
+	}
+	return len(p), nil
+}
+
+// Reset drops the kept output, e.g. before the next run.
+func (t *Tail) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf, t.truncated = nil, false
+}
+
+// String returns the kept output. When older output was dropped, it starts at a line.
+func (t *Tail) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tail := string(t.buf)
+	if t.truncated {
+		if i := strings.IndexByte(tail, '\n'); i >= 0 && i < len(tail)-1 {
+			tail = tail[i+1:]
+		}
+	}
+	return tail
+}
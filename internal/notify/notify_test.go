@@ -0,0 +1,169 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testNotification() Notification {
+	exitCode := 0
+	return Notification{
+		User:       "alice",
+		Context:    "prod-eu",
+		Namespace:  "payments",
+		Pod:        "api-7d9f",
+		Container:  "main",
+		File:       "check.sh",
+		SHA256:     "3f9a1c2e",
+		ExitCode:   &exitCode,
+		DurationMS: 1210,
+		Output:     "ok\n",
+	}
+}
+
+// webhookServer answers with the given statuses in turn, then with 200, and records the
+// bodies it received.
+func webhookServer(t *testing.T, statuses ...int) (*httptest.Server, *[]string) {
+	t.Helper()
+	var bodies []string
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected request %s with content type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if n := int(requests.Add(1)); n <= len(statuses) {
+			w.WriteHeader(statuses[n-1])
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &bodies
+}
+
+func TestSendGeneric(t *testing.T) {
+	server, bodies := webhookServer(t)
+	notifier := &Notifier{}
+
+	if err := notifier.Send(context.Background(), Webhook{URL: server.URL}, testNotification()); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	var got Notification
+	if len(*bodies) != 1 || json.Unmarshal([]byte((*bodies)[0]), &got) != nil {
+		t.Fatalf("unexpected requests: %q", *bodies)
+	}
+	if got.User != "alice" || got.Pod != "api-7d9f" || got.ExitCode == nil || *got.ExitCode != 0 || got.Output != "ok\n" {
+		t.Errorf("unexpected payload: %s", (*bodies)[0])
+	}
+}
+
+func TestSendSlack(t *testing.T) {
+	server, bodies := webhookServer(t)
+	notifier := &Notifier{}
+
+	notification := testNotification()
+	exitCode := 2
+	notification.ExitCode = &exitCode
+	if err := notifier.Send(context.Background(), Webhook{URL: server.URL, Format: FormatSlack}, notification); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	var got map[string]string
+	if len(*bodies) != 1 || json.Unmarshal([]byte((*bodies)[0]), &got) != nil {
+		t.Fatalf("unexpected requests: %q", *bodies)
+	}
+	want := "*alice* ran `check.sh` on `prod-eu` payments/api-7d9f (main): :x: exit 2 in 1.21s\nSHA-256 `3f9a1c2e`\n```ok\n```"
+	if got["text"] != want {
+		t.Errorf("got text:\n%s\nwant:\n%s", got["text"], want)
+	}
+}
+
+func TestSendRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		requests int
+		wantErr  string
+	}{
+		{"server errors", []int{http.StatusBadGateway, http.StatusTooManyRequests}, 3, ""},
+		{"persistent server errors", []int{500, 500, 500, 500}, 3, "unexpected status 500 Internal Server Error"},
+		{"client error", []int{http.StatusNotFound}, 1, "unexpected status 404 Not Found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, bodies := webhookServer(t, tt.statuses...)
+			notifier := &Notifier{Backoff: time.Millisecond}
+
+			err := notifier.Send(context.Background(), Webhook{URL: server.URL + "/T000/B000/secret"}, testNotification())
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("got %v, want an error containing %q", err, tt.wantErr)
+			case err != nil && strings.Contains(err.Error(), "secret"):
+				t.Errorf("the error leaks the webhook path: %v", err)
+			}
+			if len(*bodies) != tt.requests {
+				t.Errorf("got %d requests, want %d", len(*bodies), tt.requests)
+			}
+		})
+	}
+}
+
+func TestSendTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	notifier := &Notifier{Timeout: 20 * time.Millisecond, Attempts: 2, Backoff: time.Millisecond}
+	start := time.Now()
+	err := notifier.Send(context.Background(), Webhook{URL: server.URL}, testNotification())
+	if err == nil || !strings.Contains(err.Error(), "deadline exceeded") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Send took %s", elapsed)
+	}
+}
+
+func TestNotifyNeverFails(t *testing.T) {
+	server, bodies := webhookServer(t)
+	notifier := &Notifier{
+		Webhooks: []Webhook{{URL: "http://127.0.0.1:1"}, {URL: server.URL, Format: "teams"}, {URL: server.URL}},
+		Attempts: 1,
+	}
+
+	notifier.Notify(context.Background(), testNotification())
+	if len(*bodies) != 1 {
+		t.Errorf("got %d requests, want 1", len(*bodies))
+	}
+}
+
+func TestTail(t *testing.T) {
+	tail := NewTail(16)
+	io.WriteString(tail, "first line\n")
+	if tail.String() != "first line\n" {
+		t.Errorf("got %q", tail.String())
+	}
+
+	io.WriteString(tail, "second line\nthird\n")
+	if tail.String() != "third\n" {
+		t.Errorf("got %q", tail.String())
+	}
+	tail.Reset()
+	io.WriteString(tail, "next run\n")
+	if tail.String() != "next run\n" {
+		t.Errorf("after Reset, got %q", tail.String())
+	}
+}
@@ -0,0 +1,118 @@
+// Package telemetry sets up tracing for the rop command: spans are exported over OTLP when
+// OTEL_EXPORTER_OTLP_ENDPOINT is set, and can be summarized as a timing breakdown.
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// exportEnabled reports whether the standard OTLP environment variables ask for export.
+func exportEnabled() bool {
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// NewTracerProvider returns a provider exporting over OTLP/HTTP when configured through the
+// environment and feeding timings when not nil. It returns nil when neither is wanted.
+func NewTracerProvider(ctx context.Context, version string, timings *Timings) (*sdktrace.TracerProvider, error) {
+	var opts []sdktrace.TracerProviderOption
+
+	if exportEnabled() {
+		exporter, err := otlptracehttp.New(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+		}
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+	if timings != nil {
+		opts = append(opts, sdktrace.WithSpanProcessor(timings))
+	}
+	if len(opts) == 0 {
+		return nil, nil
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithAttributes(
+			attribute.String("service.name", "rop"),
+			attribute.String("service.version", version),
+		),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create telemetry resource: %w", err)
+	}
+
+	return sdktrace.NewTracerProvider(append(opts, sdktrace.WithResource(res))...), nil
+}
+
+// Timings collects finished spans to print a breakdown of where a run spent its time.
+type Timings struct {
+	mu    sync.Mutex
+	spans []sdktrace.ReadOnlySpan
+}
+
+var _ sdktrace.SpanProcessor = (*Timings)(nil)
+
+func (t *Timings) OnStart(context.Context, sdktrace.ReadWriteSpan) {}
+
+func (t *Timings) OnEnd(span sdktrace.ReadOnlySpan) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.spans = append(t.spans, span)
+}
+
+func (t *Timings) Shutdown(context.Context) error   { return nil }
+func (t *Timings) ForceFlush(context.Context) error { return nil }
+
+// Write prints the spans as a tree, children indented below their parent in start order.
+func (t *Timings) Write(w io.Writer) {
+	t.mu.Lock()
+	spans := append([]sdktrace.ReadOnlySpan(nil), t.spans...)
+	t.mu.Unlock()
+
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].StartTime().Before(spans[j].StartTime())
+	})
+
+	known := map[trace.SpanID]bool{}
+	children := map[trace.SpanID][]sdktrace.ReadOnlySpan{}
+	for _, span := range spans {
+		known[span.SpanContext().SpanID()] = true
+	}
+	var roots []sdktrace.ReadOnlySpan
+	for _, span := range spans {
+		parent := span.Parent().SpanID()
+		if known[parent] {
+			children[parent] = append(children[parent], span)
+		} else {
+			roots = append(roots, span)
+		}
+	}
+
+	fmt.Fprintln(w, "Timings:")
+	var write func(span sdktrace.ReadOnlySpan, depth int)
+	write = func(span sdktrace.ReadOnlySpan, depth int) {
+		name := strings.Repeat("  ", depth+1) + span.Name()
+		duration := span.EndTime().Sub(span.StartTime())
+		fmt.Fprintf(w, "%-28s %10s\n", name, duration.Round(time.Millisecond))
+		for _, child := range children[span.SpanContext().SpanID()] {
+			write(child, depth+1)
+		}
+	}
+	for _, root := range roots {
+		write(root, 0)
+	}
+}
@@ -0,0 +1,34 @@
+package telemetry
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func TestTimingsWrite(t *testing.T) {
+	timings := &Timings{}
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(timings)).Tracer("test")
+
+	ctx, root := tracer.Start(context.Background(), "rop.run")
+	ctx, execute := tracer.Start(ctx, "executeFile")
+	_, copySpan := tracer.Start(ctx, "copy")
+	copySpan.End()
+	execute.End()
+	root.End()
+
+	var b strings.Builder
+	timings.Write(&b)
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("unexpected output:\n%s", b.String())
+	}
+	for i, prefix := range []string{"Timings:", "  rop.run", "    executeFile", "      copy"} {
+		if !strings.HasPrefix(lines[i], prefix+" ") && lines[i] != prefix {
+			t.Errorf("line %d = %q, want prefix %q", i, lines[i], prefix)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package ui
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/marianozunino/rop/internal/approval"
+	"k8s.io/apimachinery/pkg/util/duration"
+)
+
+// RenderApproval describes a requested run and the state of its approval, one field per line.
+func RenderApproval(a *approval.Approval, now time.Time) string {
+	target := podStyle.Render(a.Pod)
+	if a.Clone != "" {
+		target = podStyle.Render("clone of " + a.Clone)
+		if a.CloneInit {
+			target += labelStyle.Render(" with init containers")
+		}
+	}
+	if a.Container != "" {
+		target += labelStyle.Render(" / ") + containerStyle.Render(a.Container)
+	}
+
+	state := a.State(now)
+	switch state {
+	case approval.StatePending, approval.StateApproved:
+		state += fmt.Sprintf(", expires in %s", duration.HumanDuration(a.ExpiresAt.Sub(now)))
+	case approval.StateUsed:
+		state += " by " + a.UsedBy
+	}
+
+	rows := [][2]string{
+		{"Request", a.ID},
+		{"Target", fmt.Sprintf("%s %s %s", podStyle.Render(a.Context), labelStyle.Render("/"), a.Namespace)},
+		{"Pod", target},
+		{"File", a.File},
+		{"SHA-256", a.SHA256},
+	}
+	if len(a.Args) > 0 {
+		rows = append(rows, [2]string{"Args", commandStyle.Render(strings.Join(a.Args, " "))})
+	}
+	if len(a.Env) > 0 {
+		rows = append(rows, [2]string{"Env", commandStyle.Render(strings.Join(a.Env, " "))})
+	}
+	settings := [][2]string{
+		{"Type", a.Type},
+		{"Runner", a.Runner},
+		{"User", a.AsUser},
+		{"Dest path", a.DestPath},
+	}
+	for _, setting := range settings {
+		if setting[1] != "" {
+			rows = append(rows, setting)
+		}
+	}
+	if limits := approvalLimits(a); len(limits) > 0 {
+		rows = append(rows, [2]string{"Limits", strings.Join(limits, ", ")})
+	}
+	if a.Reason != "" {
+		rows = append(rows, [2]string{"Reason", a.Reason})
+	}
+	rows = append(rows, [2]string{"Requested", fmt.Sprintf("by %s, %s ago", a.RequestedBy, duration.HumanDuration(now.Sub(a.RequestedAt)))})
+	if a.ApprovedAt != nil {
+		rows = append(rows, [2]string{"Approved", fmt.Sprintf("by %s, %s ago", a.ApprovedBy, duration.HumanDuration(now.Sub(*a.ApprovedAt)))})
+	}
+	rows = append(rows, [2]string{"State", state})
+
+	var b strings.Builder
+	for _, row := range rows {
+		fmt.Fprintf(&b, "%s %s\n", labelStyle.Render(fmt.Sprintf("%-12s", row[0])), row[1])
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// approvalLimits lists the resource limits of the requested run, e.g. "nice 10".
+func approvalLimits(a *approval.Approval) []string {
+	var limits []string
+	if a.Nice != 0 {
+		limits = append(limits, fmt.Sprintf("nice %d", a.Nice))
+	}
+	if a.IONice != "" {
+		limits = append(limits, "ionice "+a.IONice)
+	}
+	if a.MaxMemory != "" {
+		limits = append(limits, "max memory "+a.MaxMemory)
+	}
+	if a.MaxCPUTime != 0 {
+		limits = append(limits, "max CPU time "+a.MaxCPUTime.String())
+	}
+	return limits
+}
+
+// ConfirmApproval shows the requested run on stderr and asks whether to approve it.
+func ConfirmApproval(a *approval.Approval) error {
+	fmt.Fprintf(os.Stderr, "%s\n\n", RenderApproval(a, time.Now()))
+	return confirm()
+}
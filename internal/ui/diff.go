@@ -0,0 +1,151 @@
+package ui
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/marianozunino/rop/internal/app"
+)
+
+var (
+	addedStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("2")) // Green
+	removedStyle = lipgloss.NewStyle().Foreground(lipgloss.Color(protectedStyleStr))
+)
+
+// maxDiffLines bounds the outputs compared line by line; longer outputs are only reported
+// as changed or unchanged.
+const maxDiffLines = 2000
+
+// RenderWatchRun describes a run of a watch: a header line followed by the output. When
+// previous is set, the output is shown as a diff against it.
+func RenderWatchRun(run app.WatchRun, previous *app.WatchRun) string {
+	var b strings.Builder
+
+	header := fmt.Sprintf("── #%d %s on %s", run.Number, run.Start.Format(time.TimeOnly), run.Pod)
+	b.WriteString(labelStyle.Render(header) + " ")
+	switch {
+	case run.Err != nil:
+		b.WriteString(removedStyle.Render("error: " + run.Err.Error()))
+	case run.ExitCode != 0:
+		b.WriteString(removedStyle.Render(fmt.Sprintf("exit %d", run.ExitCode)))
+	default:
+		b.WriteString(addedStyle.Render("exit 0"))
+	}
+	b.WriteString(labelStyle.Render(fmt.Sprintf(" in %s", run.Duration.Round(time.Millisecond))))
+	if run.Copied && run.Number > 1 {
+		b.WriteString(commandStyle.Render(" (file changed, copied again)"))
+	}
+	if run.Redactions > 0 {
+		b.WriteString(labelStyle.Render(fmt.Sprintf(", %d secret(s) redacted", run.Redactions)))
+	}
+	b.WriteString("\n")
+
+	switch {
+	case previous == nil || previous.Err != nil:
+		b.WriteString(run.Output)
+	case previous.Output == run.Output:
+		b.WriteString(labelStyle.Render("(output unchanged)") + "\n")
+	default:
+		for _, line := range diffLines(splitLines(previous.Output), splitLines(run.Output)) {
+			switch line.op {
+			case '+':
+				b.WriteString(addedStyle.Render("+ "+line.text) + "\n")
+			case '-':
+				b.WriteString(removedStyle.Render("- "+line.text) + "\n")
+			default:
+				b.WriteString("  " + line.text + "\n")
+			}
+		}
+	}
+
+	return b.String()
+}
+
+func splitLines(output string) []string {
+	if output == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+}
+
+type diffLine struct {
+	op   byte // ' ', '+' or '-'
+	text string
+}
+
+// diffLines compares two outputs line by line using their longest common subsequence.
+func diffLines(a, b []string) []diffLine {
+	if len(a) > maxDiffLines || len(b) > maxDiffLines {
+		var lines []diffLine
+		for _, text := range a {
+			lines = append(lines, diffLine{'-', text})
+		}
+		for _, text := range b {
+			lines = append(lines, diffLine{'+', text})
+		}
+		return lines
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var lines []diffLine
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, diffLine{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, diffLine{'-', a[i]})
+			i++
+		default:
+			lines = append(lines, diffLine{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		lines = append(lines, diffLine{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		lines = append(lines, diffLine{'+', b[j]})
+	}
+	return lines
+}
+
+// RenderReloadRun summarizes a run of the file watching mode.
+func RenderReloadRun(run app.WatchRun, file string) string {
+	var status string
+	switch {
+	case run.Interrupted:
+		status = commandStyle.Render("interrupted by a change")
+	case run.Err != nil:
+		status = removedStyle.Render("error: " + run.Err.Error())
+	case run.ExitCode != 0:
+		status = removedStyle.Render(fmt.Sprintf("exit %d", run.ExitCode))
+	default:
+		status = addedStyle.Render("exit 0")
+	}
+
+	header := fmt.Sprintf("── #%d on %s ", run.Number, run.Pod)
+	footer := fmt.Sprintf(" in %s", run.Duration.Round(time.Millisecond))
+	if !run.Interrupted {
+		footer += fmt.Sprintf(", waiting for changes to %s", file)
+	}
+	return labelStyle.Render(header) + status + labelStyle.Render(footer)
+}
@@ -0,0 +1,21 @@
+package ui
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	previous := []string{"db: ok", "cache: ok", "queue: 3"}
+	current := []string{"db: ok", "cache: down", "queue: 3", "disk: 91%"}
+
+	var got []string
+	for _, line := range diffLines(previous, current) {
+		got = append(got, string(line.op)+line.text)
+	}
+
+	want := []string{" db: ok", "-cache: ok", "+cache: down", " queue: 3", "+disk: 91%"}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("diff:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
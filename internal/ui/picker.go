@@ -0,0 +1,223 @@
+package ui
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/charmbracelet/huh"
+	"github.com/marianozunino/rop/internal/app"
+	"github.com/marianozunino/rop/internal/k8s"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/term"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/duration"
+)
+
+// Target is what the interactive picker asks for. Pod is a pod name.
+type Target struct {
+	Context   string `json:"context"`
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	Container string `json:"container"`
+	File      string `json:"file"`
+}
+
+// IsInteractive reports whether stdin is a terminal, so prompts can be shown.
+func IsInteractive() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// RunTargetPicker prompts for every field of target that is empty, in order: context,
+// namespace, pod, container and file. The fields of previous are used as defaults.
+// When skipPod is set (e.g. when running on a cloned pod), pod and container are left alone.
+func RunTargetPicker(target, previous Target, skipPod bool) (Target, error) {
+	var err error
+
+	if target.Context == "" {
+		if target.Context, err = pickContext(previous.Context); err != nil {
+			return target, err
+		}
+	}
+
+	if target.Namespace == "" {
+		defaultNamespace := previous.Namespace
+		if previous.Context != target.Context {
+			defaultNamespace = ""
+		}
+		if target.Namespace, err = pickNamespace(target.Context, defaultNamespace); err != nil {
+			return target, err
+		}
+	}
+
+	if !skipPod && target.Pod == "" {
+		pod, err := pickPod(target.Context, target.Namespace, previous.Pod)
+		if err != nil {
+			return target, err
+		}
+		target.Pod = pod.Name
+
+		if target.Container == "" {
+			if target.Container, err = pickContainer(pod, previous.Container); err != nil {
+				return target, err
+			}
+		}
+	}
+
+	if target.File == "" {
+		if target.File, err = pickFile(previous.File); err != nil {
+			return target, err
+		}
+	}
+
+	return target, nil
+}
+
+func pickContext(previous string) (string, error) {
+	contexts, err := k8s.GetAvailableContexts()
+	if err != nil {
+		return "", err
+	}
+	if len(contexts) == 0 {
+		return "", fmt.Errorf("no contexts found in kubeconfig")
+	}
+
+	choice := previous
+	if choice == "" {
+		if current, err := k8s.GetCurrentContext(); err == nil {
+			choice = current
+		}
+	}
+
+	return runSelect("Kubernetes context", huh.NewOptions(contexts...), choice)
+}
+
+func pickNamespace(kubeContext, previous string) (string, error) {
+	choice := previous
+	if choice == "" {
+		if _, namespace, err := k8s.LoadConfig(kubeContext, "", 0); err == nil {
+			choice = namespace
+		}
+	}
+
+	namespaces, err := k8s.GetAvailableNamespaces(kubeContext)
+	if err != nil {
+		// Listing namespaces is often forbidden, so let the user type one instead.
+		log.Debug().Err(err).Msg("Unable to list namespaces")
+		err := huh.NewInput().
+			Title("Namespace").
+			Value(&choice).
+			Run()
+		if err != nil {
+			return "", fmt.Errorf("error running namespace input: %w", err)
+		}
+		return choice, nil
+	}
+
+	return runSelect("Namespace", huh.NewOptions(namespaces...), choice)
+}
+
+func pickPod(kubeContext, namespace, previous string) (*corev1.Pod, error) {
+	pods, err := k8s.GetAvailablePods(kubeContext, namespace)
+	if err != nil {
+		return nil, err
+	}
+	if len(pods) == 0 {
+		return nil, fmt.Errorf("no pods found in namespace %s", namespace)
+	}
+
+	options := make([]huh.Option[string], len(pods))
+	for i, pod := range pods {
+		options[i] = huh.NewOption(describePod(&pod), pod.Name)
+	}
+
+	choice, err := runSelect("Pod", options, previous)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range pods {
+		if pods[i].Name == choice {
+			return &pods[i], nil
+		}
+	}
+	return nil, fmt.Errorf("pod %s not found", choice)
+}
+
+func describePod(pod *corev1.Pod) string {
+	restarts := int32(0)
+	for _, status := range pod.Status.ContainerStatuses {
+		restarts += status.RestartCount
+	}
+
+	status := string(pod.Status.Phase)
+	if pod.DeletionTimestamp != nil {
+		status = "Terminating"
+	}
+
+	age := duration.HumanDuration(time.Since(pod.CreationTimestamp.Time))
+	return fmt.Sprintf("%s  %s, age %s, %d restarts, node %s", pod.Name, status, age, restarts, pod.Spec.NodeName)
+}
+
+// pickContainer asks for one of the running containers, unless there is only one or the
+// pod names a default container, which are left for the run to choose.
+func pickContainer(pod *corev1.Pod, previous string) (string, error) {
+	var runnable []app.Container
+	for _, container := range app.PodContainers(pod) {
+		if container.Runnable() {
+			runnable = append(runnable, container)
+		}
+	}
+	if len(runnable) <= 1 || pod.Annotations[app.DefaultContainerAnnotation] != "" {
+		return "", nil
+	}
+	return runSelect("Container", containerOptions(runnable), previous)
+}
+
+func pickFile(previous string) (string, error) {
+	directory := "."
+	if previous != "" {
+		directory = filepath.Dir(previous)
+		if _, err := os.Stat(directory); err != nil {
+			directory = "."
+		}
+	}
+
+	var file string
+	err := huh.NewFilePicker().
+		Title("File to execute").
+		CurrentDirectory(directory).
+		Picking(true).
+		Height(15).
+		Value(&file).
+		Run()
+	if err != nil {
+		return "", fmt.Errorf("error running file picker: %w", err)
+	}
+
+	if file == "" {
+		return "", fmt.Errorf("no file selected")
+	}
+	return file, nil
+}
+
+// runSelect shows a filterable select (type / to filter) with previous preselected.
+func runSelect(title string, options []huh.Option[string], previous string) (string, error) {
+	choice := previous
+	err := huh.NewSelect[string]().
+		Title(title).
+		Description("Type / to filter").
+		Options(options...).
+		Height(15).
+		Value(&choice).
+		Run()
+	if err != nil {
+		return "", fmt.Errorf("error running %s selection: %w", title, err)
+	}
+
+	if choice == "" {
+		return "", fmt.Errorf("no %s selected", title)
+	}
+	return choice, nil
+}
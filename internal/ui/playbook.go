@@ -0,0 +1,106 @@
+package ui
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/marianozunino/rop/internal/app"
+)
+
+// RenderPlaybookPlan describes the steps of a playbook, one block per step. Steps in
+// protected contexts are shown in red, with a warning on top.
+func RenderPlaybookPlan(plan app.PlaybookPlan, isProtected func(context string) bool) string {
+	var b strings.Builder
+
+	for _, step := range plan.Steps {
+		if isProtected(step.Context) {
+			b.WriteString(protectedStyle.Render("WARNING: the playbook runs in protected contexts") + "\n\n")
+			break
+		}
+	}
+
+	for i, step := range plan.Steps {
+		contextName := podStyle.Render(step.Context)
+		if isProtected(step.Context) {
+			contextName = protectedStyle.Render(step.Context + " (protected)")
+		}
+
+		target := podStyle.Render(step.Pod)
+		if step.Clone != "" {
+			target = podStyle.Render("clone of " + step.Clone)
+		}
+		if step.Container != "" {
+			target += labelStyle.Render(" / ") + containerStyle.Render(step.Container)
+		}
+
+		rows := [][2]string{
+			{"Target", fmt.Sprintf("%s %s %s", contextName, labelStyle.Render("/"), step.Namespace)},
+			{"Pod", target},
+			{"File", fmt.Sprintf("%s (%s)", step.File, formatSize(step.FileSize))},
+			{"SHA-256", step.FileSHA256},
+		}
+		if step.Runner != "" {
+			rows = append(rows, [2]string{"Runner", step.Runner})
+		}
+		if len(step.Args) > 0 {
+			rows = append(rows, [2]string{"Args", commandStyle.Render(strings.Join(step.Args, " "))})
+		}
+		if len(step.EnvKeys) > 0 {
+			rows = append(rows, [2]string{"Env", strings.Join(step.EnvKeys, ", ")})
+		}
+		if step.Timeout > 0 {
+			rows = append(rows, [2]string{"Timeout", step.Timeout.String()})
+		}
+		rows = append(rows, [2]string{"On failure", step.OnFailure})
+		if len(step.Artifacts) > 0 {
+			rows = append(rows, [2]string{"Artifacts", strings.Join(step.Artifacts, ", ")})
+		}
+
+		fmt.Fprintf(&b, "%s\n", labelStyle.Render(fmt.Sprintf("Step %d/%d: ", i+1, len(plan.Steps)))+step.Name)
+		for _, row := range rows {
+			fmt.Fprintf(&b, "  %s %s\n", labelStyle.Render(fmt.Sprintf("%-12s", row[0])), row[1])
+		}
+		b.WriteString("\n")
+	}
+	return strings.TrimSuffix(b.String(), "\n\n")
+}
+
+// ConfirmPlaybook shows the plan of the playbook on stderr and asks whether to go ahead.
+func ConfirmPlaybook(plan app.PlaybookPlan, isProtected func(context string) bool) error {
+	fmt.Fprintf(os.Stderr, "%s\n\n", RenderPlaybookPlan(plan, isProtected))
+	return confirm()
+}
+
+// RenderStepStart is the header printed before the output of a step.
+func RenderStepStart(index, total int, step app.PlaybookStep) string {
+	return labelStyle.Render(fmt.Sprintf("── step %d/%d ", index+1, total)) + step.Name
+}
+
+// RenderStepRun summarizes a finished step.
+func RenderStepRun(run app.StepRun) string {
+	var status string
+	switch {
+	case run.Err != nil:
+		status = removedStyle.Render("error: " + run.Err.Error())
+	case run.Result.TimedOut:
+		status = removedStyle.Render("timed out")
+	case run.Result.ExitCode != 0:
+		status = removedStyle.Render(fmt.Sprintf("exit %d", run.Result.ExitCode))
+	default:
+		status = addedStyle.Render("exit 0")
+	}
+
+	summary := labelStyle.Render("── "+run.Name+" ") + status
+	if run.Result != nil {
+		summary += labelStyle.Render(fmt.Sprintf(" on %s in %s", run.Result.Pod, run.Result.Duration.Round(time.Millisecond)))
+		if run.Result.Redactions > 0 {
+			summary += labelStyle.Render(fmt.Sprintf(", %d secret(s) redacted", run.Result.Redactions))
+		}
+	}
+	for _, artifact := range run.Artifacts {
+		summary += "\n" + labelStyle.Render("   artifact ") + artifact
+	}
+	return summary
+}
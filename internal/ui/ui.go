@@ -2,12 +2,17 @@ package ui
 
 import (
 	"fmt"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/charmbracelet/huh"
 	"github.com/charmbracelet/lipgloss"
+	"github.com/marianozunino/rop/internal/app"
+	"k8s.io/apimachinery/pkg/util/duration"
 )
 
-func RunContainerSelection(containers []string) (string, error) {
+func RunContainerSelection(containers []app.Container) (string, error) {
 	if len(containers) == 0 {
 		return "", fmt.Errorf("no containers available")
 	}
@@ -15,7 +20,7 @@ func RunContainerSelection(containers []string) (string, error) {
 	var choice string
 	err := huh.NewSelect[string]().
 		Title("Multiple containers detected, please select one:").
-		Options(huh.NewOptions(containers...)...).
+		Options(containerOptions(containers)...).
 		Value(&choice).
 		Run()
 	if err != nil {
@@ -29,28 +34,125 @@ func RunContainerSelection(containers []string) (string, error) {
 	return choice, nil
 }
 
+// containerOptions labels each container with its image and state.
+func containerOptions(containers []app.Container) []huh.Option[string] {
+	options := make([]huh.Option[string], len(containers))
+	for i, container := range containers {
+		label := fmt.Sprintf("%s  %s, %s", container.Name, container.Image, container.State)
+		if container.Init {
+			label += ", init"
+		}
+		options[i] = huh.NewOption(label, container.Name)
+	}
+	return options
+}
+
 const (
 	commandStyleStr   = "3" // Yellow
 	podStyleStr       = "6" // Cyan
 	containerStyleStr = "5" // Magenta
+	protectedStyleStr = "1" // Red
+	labelStyleStr     = "8" // Grey
 )
 
 var (
 	commandStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color(commandStyleStr))
 	podStyle       = lipgloss.NewStyle().Foreground(lipgloss.Color(podStyleStr))
 	containerStyle = lipgloss.NewStyle().Foreground(lipgloss.Color(containerStyleStr))
+	protectedStyle = lipgloss.NewStyle().Foreground(lipgloss.Color(protectedStyleStr)).Bold(true)
+	labelStyle     = lipgloss.NewStyle().Foreground(lipgloss.Color(labelStyleStr))
 )
 
-func ConfirmAction(command, podName, container string) error {
+// RenderPlan describes the execution plan, one field per line. Protected contexts are
+// shown in red with a warning.
+func RenderPlan(plan app.Plan, protected bool) string {
+	contextName := podStyle.Render(plan.Context)
+	if protected {
+		contextName = protectedStyle.Render(plan.Context + " (protected)")
+	}
+
+	target := podStyle.Render(plan.Pod)
+	if plan.Owner != "" {
+		target += labelStyle.Render(" of " + plan.Owner)
+	}
+
+	podInfo := fmt.Sprintf("node %s", plan.Node)
+	if !plan.PodCreated.IsZero() {
+		podInfo += fmt.Sprintf(", age %s", duration.HumanDuration(time.Since(plan.PodCreated)))
+	}
+	podInfo += fmt.Sprintf(", %d restarts", plan.Restarts)
+
+	rows := [][2]string{
+		{"Server", plan.Server},
+		{"Context", contextName},
+		{"Namespace", plan.Namespace},
+		{"Pod", target},
+		{"", labelStyle.Render(podInfo)},
+		{"Container", containerStyle.Render(plan.Container)},
+		{"File", fmt.Sprintf("%s (%s)", plan.File, formatSize(plan.FileSize))},
+		{"SHA-256", plan.FileSHA256},
+		{"Destination", plan.DestPath},
+	}
+	if plan.Signer != "" {
+		rows = append(rows, [2]string{"Signed by", plan.Signer})
+	}
+	if plan.User != "" {
+		rows = append(rows, [2]string{"User", plan.User})
+	}
+	if len(plan.Limits) > 0 {
+		rows = append(rows, [2]string{"Limits", strings.Join(plan.Limits, ", ")})
+	}
+	if plan.Runner != "" {
+		rows = append(rows, [2]string{"Runner", plan.Runner})
+	}
+	if len(plan.Args) > 0 {
+		rows = append(rows, [2]string{"Args", strings.Join(plan.Args, " ")})
+	}
+	if len(plan.EnvKeys) > 0 {
+		rows = append(rows, [2]string{"Env", strings.Join(plan.EnvKeys, ", ")})
+	}
+	rows = append(rows, [2]string{"Command", commandStyle.Render(strings.Join(plan.Command, " "))})
+	for i, hook := range plan.Hooks {
+		label := ""
+		if i == 0 {
+			label = "Hooks"
+		}
+		rows = append(rows, [2]string{label, hook})
+	}
+
+	var b strings.Builder
+	if protected {
+		b.WriteString(protectedStyle.Render("WARNING: this context is protected") + "\n\n")
+	}
+	for _, row := range rows {
+		fmt.Fprintf(&b, "%s %s\n", labelStyle.Render(fmt.Sprintf("%-12s", row[0])), row[1])
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// ConfirmAction shows the plan on stderr and asks whether to go ahead.
+func ConfirmAction(plan app.Plan, protected bool) error {
+	fmt.Fprintf(os.Stderr, "%s\n\n", RenderPlan(plan, protected))
+	return confirm()
+}
+
+func confirm() error {
 	var confirm bool
 	err := huh.NewForm(
 		huh.NewGroup(
-			huh.NewNote().Description(
-				fmt.Sprintf("Are you sure you want to execute '%s' on pod '%s' in container '%s'?",
-					commandStyle.Render(command),
-					podStyle.Render(podName),
-					containerStyle.Render(container)),
-			),
 			huh.NewConfirm().Title("Confirm action?").Affirmative("Yes").Negative("No").Value(&confirm),
 		),
 	).Run()
@@ -0,0 +1,98 @@
+package rop
+
+import (
+	"cmp"
+	"context"
+
+	"github.com/marianozunino/rop/internal/app"
+	"github.com/marianozunino/rop/internal/k8s"
+	"k8s.io/client-go/rest"
+)
+
+// Playbook is a sequence of steps, each running a file on a pod, see LoadPlaybook.
+type Playbook = app.Playbook
+
+// PlaybookStep is a single execution of a playbook.
+type PlaybookStep = app.PlaybookStep
+
+// PlaybookPlan describes the steps of a playbook about to run, as passed to
+// ApplyOptions.Confirm.
+type PlaybookPlan = app.PlaybookPlan
+
+// StepPlan describes a step of a playbook before it runs.
+type StepPlan = app.StepPlan
+
+// StepRun describes a finished step of a playbook.
+type StepRun = app.StepRun
+
+// OnFailure behaviors of playbook steps.
+const (
+	OnFailureAbort    = app.OnFailureAbort
+	OnFailureContinue = app.OnFailureContinue
+)
+
+// ErrPlaybookFailed is returned by Runner.Apply when a step that aborts on failure failed.
+var ErrPlaybookFailed = app.ErrPlaybookFailed
+
+// LoadPlaybook reads and validates a YAML playbook. Files of the steps are relative to the
+// directory of the playbook.
+func LoadPlaybook(file string) (*Playbook, error) {
+	return app.LoadPlaybook(file)
+}
+
+// ApplyOptions configures Runner.Apply.
+type ApplyOptions struct {
+	// Connect returns the REST config for the kubeconfig context of a step, and the
+	// namespace to use when the step sets none. Without it, every step uses the REST
+	// config of the Runner and the "default" namespace.
+	Connect func(kubeContext, namespace string) (*rest.Config, string, error)
+	// ArtifactsDir is the local directory artifacts are fetched into. Defaults to
+	// "rop-artifacts".
+	ArtifactsDir string
+	// Confirm is called once with the plan of all steps before the first one runs.
+	// Returning an error aborts the playbook.
+	Confirm func(plan PlaybookPlan) error
+	// OnStepStart and OnStep are called before and after every step.
+	OnStepStart func(index int, step PlaybookStep)
+	OnStep      func(run StepRun)
+	// RequireSignature reports whether steps in a kubeconfig context must run files signed
+	// by a trusted key, see WithTrustedKeys. Files with a <file>.minisig signature are
+	// always verified.
+	RequireSignature func(kubeContext string) bool
+	// Hooks returns the hooks of steps in a kubeconfig context, in place of those set with
+	// WithHooks. Optional.
+	Hooks func(kubeContext string) []Hook
+}
+
+// Apply runs the steps of the playbook in order, each like Run, after confirming all of
+// them once. The output of the steps is written to the stdout and stderr of the Runner. It
+// returns the runs of the steps that ran, and ErrPlaybookFailed when a step that aborts on
+// failure failed.
+func (r *Runner) Apply(ctx context.Context, playbook *Playbook, opts ApplyOptions) ([]StepRun, error) {
+	connect := opts.Connect
+	if connect == nil {
+		connect = func(_, namespace string) (*rest.Config, string, error) {
+			return r.config, cmp.Or(namespace, "default"), nil
+		}
+	}
+
+	return app.RunPlaybook(ctx, playbook, app.PlaybookOptions{
+		Connect:      connect,
+		Streams:      k8s.IOStreams{Out: r.stdout, ErrOut: r.stderr},
+		ArtifactsDir: opts.ArtifactsDir,
+		Confirm:      opts.Confirm,
+		Options: []func(*app.App){
+			app.WithClientset(r.clientset),
+			app.WithContainerSelector(r.selectContainer),
+			app.WithEvents(r.onEvent),
+			app.WithTracerProvider(r.tracerProvider),
+			app.WithRedaction(r.redaction),
+			app.WithHooks(r.hooks),
+		},
+		OnStepStart:      opts.OnStepStart,
+		OnStep:           opts.OnStep,
+		TrustedKeys:      r.trustedKeys,
+		RequireSignature: opts.RequireSignature,
+		Hooks:            opts.Hooks,
+	})
+}
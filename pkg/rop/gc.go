@@ -0,0 +1,41 @@
+package rop
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/marianozunino/rop/internal/app"
+)
+
+// GCOptions configures Runner.CollectGarbage.
+type GCOptions = app.GCOptions
+
+// Artifact is a file left behind on a pod by a run that couldn't clean up, or a pod it
+// cloned.
+type Artifact = app.Artifact
+
+// ParseUploadTime returns when the file with the given name was uploaded by rop. Uploads
+// are named "rop-<unix seconds>-<random hex>-<file name>"; other names return false.
+func ParseUploadTime(name string) (time.Time, bool) {
+	return app.ParseUploadTime(name)
+}
+
+// CollectGarbage scans the running pods of the namespace, or only pod when it is set, for
+// files uploaded by rop longer than opts.TTL ago and removes them, unless opts.DryRun is set.
+// Unless pod is set, pods cloned by rop longer than opts.TTL ago are deleted as well. The
+// found files and pods are returned with the outcome of their removal.
+func (r *Runner) CollectGarbage(ctx context.Context, namespace, pod string, opts GCOptions) ([]Artifact, error) {
+	a, err := app.NewGCApp(
+		app.WithRESTConfig(r.config),
+		app.WithClientset(r.clientset),
+		app.WithKubeContext(r.contextName),
+		app.WithNamespace(namespace),
+		app.WithPodName(pod),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request: %w", err)
+	}
+
+	return a.CollectGarbage(ctx, opts)
+}
@@ -0,0 +1,405 @@
+// Package rop runs scripts and binaries on Kubernetes pods. It is the library behind the
+// rop command line tool and can be embedded in other tools:
+//
+//	runner, err := rop.NewRunner(
+//		rop.WithRESTConfig(config),
+//		rop.WithStdout(os.Stdout),
+//		rop.WithStderr(os.Stderr),
+//	)
+//	if err != nil {
+//		return err
+//	}
+//	result, err := runner.Run(ctx, rop.Request{
+//		Target: rop.Target{Namespace: "default", Pod: "api"},
+//		File:   rop.File{Name: "check.sh", Reader: strings.NewReader(script)},
+//	})
+//
+// rop logs through zerolog's global logger.
+package rop
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/marianozunino/rop/internal/app"
+	"github.com/marianozunino/rop/internal/k8s"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// Plan describes an execution about to happen and is passed to the confirmation step.
+type Plan = app.Plan
+
+// Container describes a container offered by the container selection.
+type Container = app.Container
+
+// Result describes a finished execution.
+type Result = app.Result
+
+// Event reports progress of a run, see WithEvents.
+type Event = app.Event
+
+// Event types, in the order they occur during a run.
+const (
+	EventTargetResolved = app.EventTargetResolved
+	EventCopyStarted    = app.EventCopyStarted
+	EventCopyFinished   = app.EventCopyFinished
+	EventExecStarted    = app.EventExecStarted
+	EventStdout         = app.EventStdout
+	EventStderr         = app.EventStderr
+	EventExit           = app.EventExit
+	EventCleanup        = app.EventCleanup
+)
+
+// WatchOptions configures Runner.Watch.
+type WatchOptions = app.WatchOptions
+
+// WatchRun describes one run of a watch.
+type WatchRun = app.WatchRun
+
+// ErrWatchFailed is returned by Runner.Watch when it stops because of a failed run.
+var ErrWatchFailed = app.ErrWatchFailed
+
+// ErrTimeout is returned when the execution exceeds Request.Timeout.
+var ErrTimeout = app.ErrTimeout
+
+// ErrSignature is returned when the file has no valid signature of a trusted key but needs
+// one, or when its signature doesn't verify.
+var ErrSignature = app.ErrSignature
+
+// ResourceLimits bound the resources of the executed file, see Request.Limits.
+type ResourceLimits = app.ResourceLimits
+
+// Hook is a command run around the execution of the file, see WithHooks.
+type Hook = app.Hook
+
+// HookRun is the metadata of the run passed to hooks, as JSON on stdin and as ROP_*
+// environment variables.
+type HookRun = app.HookRun
+
+// Hook stages, in the order they run.
+const (
+	HookPreCopy   = app.HookPreCopy
+	HookPreExec   = app.HookPreExec
+	HookPostExec  = app.HookPostExec
+	HookOnFailure = app.HookOnFailure
+)
+
+// ErrHookFailed is returned when a pre-copy or pre-exec hook fails, before the file is
+// copied or executed.
+var ErrHookFailed = app.ErrHookFailed
+
+// Redaction configures the redaction of secrets from the output, see WithRedaction.
+type Redaction = app.Redaction
+
+// TrustedKey is a minisign public key that files may be signed with, see WithTrustedKeys.
+type TrustedKey = app.TrustedKey
+
+// ReadSignature reads the detached minisign signature next to file (file + ".minisig"), or
+// returns nil when it has none.
+func ReadSignature(file string) ([]byte, error) {
+	return app.ReadSignature(file)
+}
+
+// ParseTrustedKey parses a minisign public key, with or without its comment line.
+func ParseTrustedKey(name, publicKey string) (TrustedKey, error) {
+	return app.ParseTrustedKey(name, publicKey)
+}
+
+// Target identifies where the file runs.
+type Target struct {
+	// Namespace of the pod. Defaults to "default".
+	Namespace string
+	// Pod is the name of the pod or, when no pod has that name, matched against the
+	// app.kubernetes.io/name label of running pods, taking the first one.
+	Pod string
+	// Clone is a workload reference (e.g. "deploy/api") to create a throwaway pod from,
+	// as an alternative to Pod.
+	Clone string
+	// KeepClone keeps the cloned pod after execution.
+	KeepClone bool
+	// CloneInit also runs the init containers of the workload that aren't sidecars in the
+	// cloned pod. They are dropped by default, since they may have side effects such as
+	// migrations.
+	CloneInit bool
+	// Container is optional for single-container pods.
+	Container string
+}
+
+// File is the script or binary to execute.
+type File struct {
+	// Name is used for the remote file name and to infer the runner of scripts.
+	Name string
+	// Reader is read once and buffered in memory, so the content that is verified and shown
+	// in the plan is the one copied, even if the file changes meanwhile.
+	Reader io.Reader
+	// Mode is used to detect binaries when Request.Type is "auto".
+	Mode os.FileMode
+	// Signature is the detached minisign signature of the file (its .minisig), verified
+	// against the trusted keys before the file is copied. Optional.
+	Signature []byte
+}
+
+// Request describes a single execution.
+type Request struct {
+	Target Target
+	File   File
+	// Type is "script", "binary" or "auto" (the default).
+	Type string
+	Args []string
+	// Env are KEY=VALUE environment variables set for the command.
+	Env []string
+	// DestPath is the remote directory the file is copied to. Defaults to "/tmp", or to a
+	// writable emptyDir mount or /dev/shm when the container's root filesystem is read-only.
+	DestPath string
+	// AsUser is a numeric uid to run the file as. The container must run as root and have
+	// setpriv, runuser or su.
+	AsUser string
+	// Interpreter is a custom runner for scripts (e.g. "python"). Inferred from the
+	// file extension when empty.
+	Interpreter string
+	// Limits bound the niceness, I/O priority, memory and CPU time of the executed file,
+	// with nice, ionice, and prlimit or ulimit in the container. Limits the container can't
+	// apply are skipped, marked in the plan and listed in Result.UnappliedLimits.
+	Limits ResourceLimits
+	// Timeout bounds the execution; zero means no timeout.
+	Timeout time.Duration
+	// CopyTimeout bounds the file transfer; zero means no timeout.
+	CopyTimeout time.Duration
+	// RequireSignature rejects files without a valid signature of a trusted key.
+	RequireSignature bool
+}
+
+// Runner executes files on pods of a cluster.
+type Runner struct {
+	contextName     string
+	config          *rest.Config
+	clientset       kubernetes.Interface
+	stdin           io.Reader
+	stdout          io.Writer
+	stderr          io.Writer
+	confirm         func(plan Plan) error
+	selectContainer func(containers []Container) (string, error)
+	onEvent         func(event Event)
+	tracerProvider  trace.TracerProvider
+	tty             bool
+	resize          remotecommand.TerminalSizeQueue
+	trustedKeys     []TrustedKey
+	redaction       *Redaction
+	hooks           []Hook
+}
+
+// Option configures a Runner.
+type Option func(r *Runner)
+
+// WithRESTConfig sets the config used to reach the cluster. It is required, since
+// streaming commands to pods needs the transport settings of the config.
+func WithRESTConfig(config *rest.Config) Option {
+	return func(r *Runner) {
+		r.config = config
+	}
+}
+
+// WithContextName sets the kubeconfig context name the REST config was built from. It is
+// only informational and shown in the plan.
+func WithContextName(name string) Option {
+	return func(r *Runner) {
+		r.contextName = name
+	}
+}
+
+// WithClientset sets the clientset used for API lookups. It is built from the REST
+// config when not set.
+func WithClientset(clientset kubernetes.Interface) Option {
+	return func(r *Runner) {
+		r.clientset = clientset
+	}
+}
+
+// WithStdin attaches a reader to the stdin of the remote command.
+func WithStdin(stdin io.Reader) Option {
+	return func(r *Runner) {
+		r.stdin = stdin
+	}
+}
+
+// WithStdout sets where the stdout of the remote command is written. Discarded by default.
+func WithStdout(stdout io.Writer) Option {
+	return func(r *Runner) {
+		r.stdout = stdout
+	}
+}
+
+// WithStderr sets where the stderr of the remote command is written. Discarded by default.
+func WithStderr(stderr io.Writer) Option {
+	return func(r *Runner) {
+		r.stderr = stderr
+	}
+}
+
+// WithConfirm sets a step that runs before execution. Returning an error aborts the run.
+func WithConfirm(confirm func(plan Plan) error) Option {
+	return func(r *Runner) {
+		r.confirm = confirm
+	}
+}
+
+// WithContainerSelector sets how a container is picked when the target pod has several
+// running containers, none was requested and the pod names no default container. Without
+// a selector, such runs fail.
+func WithContainerSelector(selectContainer func(containers []Container) (string, error)) Option {
+	return func(r *Runner) {
+		r.selectContainer = selectContainer
+	}
+}
+
+// WithEvents sets a handler for progress events, including chunks of the output of the
+// remote command. The handler must be safe for concurrent use: output events are reported
+// from the stdout and stderr streams concurrently, and a Runner may be shared by concurrent
+// runs on several pods, whose events carry their own target.
+func WithEvents(onEvent func(event Event)) Option {
+	return func(r *Runner) {
+		r.onEvent = onEvent
+	}
+}
+
+// WithTracerProvider sets where OpenTelemetry spans of the run phases (initialize,
+// preparePodExecution, executeFile with copy, run and cleanup) are reported. The global
+// provider is used by default.
+func WithTracerProvider(provider trace.TracerProvider) Option {
+	return func(r *Runner) {
+		r.tracerProvider = provider
+	}
+}
+
+// WithTrustedKeys sets the keys signatures of files are verified against. See File.Signature
+// and Request.RequireSignature.
+func WithTrustedKeys(keys ...TrustedKey) Option {
+	return func(r *Runner) {
+		r.trustedKeys = keys
+	}
+}
+
+// WithRedaction redacts secrets from the output of the remote command before it is written
+// and reported as events: known secret formats (AWS keys, JWTs and PEM blocks), the values
+// of the environment variables of the container that come from Secrets, and the patterns of
+// redaction. The output is then passed on line by line. Result.Redactions counts the
+// redacted secrets. Output to a terminal is not redacted.
+func WithRedaction(redaction Redaction) Option {
+	return func(r *Runner) {
+		r.redaction = &redaction
+	}
+}
+
+// WithHooks sets commands run around the execution of files: pre-copy and pre-exec hooks
+// abort the run when they fail, post-exec hooks run after the execution whatever its exit
+// code, and on-failure hooks when the run failed or the file exited with a non-zero code.
+// The output of hooks is written to the stderr of the Runner.
+func WithHooks(hooks ...Hook) Option {
+	return func(r *Runner) {
+		r.hooks = hooks
+	}
+}
+
+// NewRunner creates a Runner.
+func NewRunner(opts ...Option) (*Runner, error) {
+	r := &Runner{
+		stdout: io.Discard,
+		stderr: io.Discard,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	if r.config == nil {
+		return nil, fmt.Errorf("a REST config is required")
+	}
+
+	return r, nil
+}
+
+// Run copies the file to the target pod, executes it and removes it again. A non-zero exit
+// code of the remote command is reported in the result rather than as an error.
+func (r *Runner) Run(ctx context.Context, req Request) (*Result, error) {
+	a, err := r.newApp(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.Run(ctx)
+}
+
+// Watch runs the file on the target pod repeatedly, as scheduled by opts.Next, until ctx
+// is done. The target is resolved and confirmed once and the file stays on the pod between
+// runs. Cancelling ctx ends the watch without an error, killing the remote process of a run
+// still going.
+func (r *Runner) Watch(ctx context.Context, req Request, opts WatchOptions) error {
+	a, err := r.newApp(req)
+	if err != nil {
+		return err
+	}
+
+	return a.Watch(ctx, opts)
+}
+
+// Every returns a schedule for WatchOptions.Next running every interval. Runs that take
+// longer than the interval are followed by the next one right away.
+func Every(interval time.Duration) func(last time.Time) time.Time {
+	return func(last time.Time) time.Time {
+		return last.Add(interval)
+	}
+}
+
+func (r *Runner) newApp(req Request) (*app.App, error) {
+	opts := []func(*app.App){
+		app.WithRESTConfig(r.config),
+		app.WithClientset(r.clientset),
+		app.WithKubeContext(r.contextName),
+		app.WithNamespace(req.Target.Namespace),
+		app.WithPodName(req.Target.Pod),
+		app.WithClone(req.Target.Clone),
+		app.WithKeepClone(req.Target.KeepClone),
+		app.WithCloneInit(req.Target.CloneInit),
+		app.WithContainerName(req.Target.Container),
+		app.WithFile(req.File.Name, req.File.Reader, req.File.Mode),
+		app.WithArgs(req.Args),
+		app.WithEnv(req.Env),
+		app.WithDestPath(req.DestPath),
+		app.WithAsUser(req.AsUser),
+		app.WithLimits(req.Limits),
+		app.WithRunner(req.Interpreter),
+		app.WithTimeout(req.Timeout),
+		app.WithCopyTimeout(req.CopyTimeout),
+		app.WithSignaturePolicy(app.SignaturePolicy{
+			TrustedKeys: r.trustedKeys,
+			Signature:   req.File.Signature,
+			Required:    req.RequireSignature,
+		}),
+		app.WithStreams(k8s.IOStreams{In: r.stdin, Out: r.stdout, ErrOut: r.stderr}),
+		app.WithRedaction(r.redaction),
+		app.WithHooks(r.hooks),
+		app.WithConfirm(r.confirm),
+		app.WithContainerSelector(r.selectContainer),
+		app.WithEvents(r.onEvent),
+		app.WithTracerProvider(r.tracerProvider),
+	}
+	if req.Type != "" {
+		opts = append(opts, app.WithFileType(req.Type))
+	}
+
+	a, err := app.NewApp(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request: %w", err)
+	}
+	return a, nil
+}
+
+// Runners returns the runners inferred for scripts from their file extension, sorted.
+func Runners() []string {
+	return app.Runners()
+}
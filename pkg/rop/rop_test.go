@@ -0,0 +1,137 @@
+package rop_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/marianozunino/rop/internal/k8s/k8stest"
+	"github.com/marianozunino/rop/pkg/rop"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const script = "echo hello\n"
+
+func newTestRunner(t *testing.T, server *k8stest.ExecServer, opts ...rop.Option) *rop.Runner {
+	t.Helper()
+	defaults := []rop.Option{
+		rop.WithRESTConfig(server.RESTConfig()),
+		rop.WithClientset(fake.NewSimpleClientset(k8stest.RunningPod("payments", "api-7d9f", "main"))),
+		rop.WithContextName("staging"),
+	}
+	runner, err := rop.NewRunner(append(defaults, opts...)...)
+	if err != nil {
+		t.Fatalf("NewRunner failed: %v", err)
+	}
+	return runner
+}
+
+func request(pod string) rop.Request {
+	return rop.Request{
+		Target: rop.Target{Namespace: "payments", Pod: pod},
+		File:   rop.File{Name: "./check.sh", Reader: strings.NewReader(script), Mode: 0o644},
+		Args:   []string{"--verbose"},
+	}
+}
+
+func commandLines(server *k8stest.ExecServer) []string {
+	var lines []string
+	for _, exec := range server.Commands() {
+		lines = append(lines, strings.Join(exec.Command, " "))
+	}
+	return lines
+}
+
+func TestNewRunnerRequiresRESTConfig(t *testing.T) {
+	if _, err := rop.NewRunner(rop.WithClientset(fake.NewSimpleClientset())); err == nil {
+		t.Fatal("expected an error without a REST config")
+	}
+}
+
+func TestRunnerRun(t *testing.T) {
+	for _, pod := range []string{"api-7d9f", "api"} {
+		t.Run(pod, func(t *testing.T) {
+			var server *k8stest.ExecServer
+			server = k8stest.NewExecServer(func(exec *k8stest.Exec) int {
+				content, _ := server.File(exec.Command[1])
+				exec.Stdout.Write(content)
+				return 3
+			})
+			defer server.Close()
+
+			var stdout bytes.Buffer
+			runner := newTestRunner(t, server, rop.WithStdout(&stdout))
+			result, err := runner.Run(context.Background(), request(pod))
+			if err != nil {
+				t.Fatalf("Run failed: %v", err)
+			}
+
+			if result.Namespace != "payments" || result.Pod != "api-7d9f" || result.Container != "main" {
+				t.Errorf("unexpected target: %+v", result)
+			}
+			if result.ExitCode != 3 {
+				t.Errorf("exit code = %d, want 3", result.ExitCode)
+			}
+			if stdout.String() != script {
+				t.Errorf("stdout = %q", stdout.String())
+			}
+
+			lines := commandLines(server)
+			if len(lines) != 3 || !strings.HasPrefix(lines[0], "cp /dev/stdin /tmp/rop-") ||
+				!strings.HasPrefix(lines[1], "sh /tmp/rop-") || !strings.HasSuffix(lines[1], "-check.sh --verbose") ||
+				!strings.HasPrefix(lines[2], "rm -f /tmp/rop-") {
+				t.Errorf("unexpected commands: %q", lines)
+			}
+			if files := server.Files(); len(files) != 0 {
+				t.Errorf("files left on the pod: %v", files)
+			}
+		})
+	}
+}
+
+func TestRunnerPlan(t *testing.T) {
+	server := k8stest.NewExecServer(nil)
+	defer server.Close()
+
+	errDeclined := errors.New("declined")
+	var plan rop.Plan
+	runner := newTestRunner(t, server, rop.WithConfirm(func(p rop.Plan) error {
+		plan = p
+		return errDeclined
+	}))
+	_, err := runner.Run(context.Background(), request("api"))
+	if !errors.Is(err, errDeclined) {
+		t.Fatalf("expected the run to be declined, got %v", err)
+	}
+
+	if plan.Context != "staging" || plan.Namespace != "payments" || plan.Pod != "api-7d9f" || plan.Container != "main" {
+		t.Errorf("unexpected plan target: %+v", plan)
+	}
+	if plan.File != "./check.sh" || plan.FileSize != int64(len(script)) || plan.Runner != "sh" {
+		t.Errorf("unexpected plan file: %+v", plan)
+	}
+	if command := strings.Join(plan.Command, " "); !strings.HasSuffix(command, "-check.sh --verbose") {
+		t.Errorf("unexpected plan command: %q", command)
+	}
+	if lines := commandLines(server); len(lines) != 0 {
+		t.Errorf("commands ran although the plan was declined: %q", lines)
+	}
+}
+
+func TestRunnerRejectsInvalidRequest(t *testing.T) {
+	server := k8stest.NewExecServer(nil)
+	defer server.Close()
+
+	runner := newTestRunner(t, server)
+	req := request("api")
+	req.Env = []string{"NOVALUE"}
+	_, err := runner.Run(context.Background(), req)
+	if err == nil || !strings.Contains(err.Error(), "invalid request") {
+		t.Fatalf("expected an invalid request error, got %v", err)
+	}
+	if lines := commandLines(server); len(lines) != 0 {
+		t.Errorf("commands ran for an invalid request: %q", lines)
+	}
+}
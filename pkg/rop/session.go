@@ -0,0 +1,118 @@
+package rop
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/marianozunino/rop/internal/app"
+	"github.com/marianozunino/rop/internal/k8s"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// Session is a working directory on a pod that is kept between runs, see
+// Runner.StartSession.
+type Session = app.Session
+
+// ErrSessionGone is returned when the pod or the working directory of a session no longer
+// exist.
+var ErrSessionGone = app.ErrSessionGone
+
+// NewSessionID returns a random session ID.
+func NewSessionID() (string, error) {
+	return app.NewSessionID()
+}
+
+// WithTerminal allocates a terminal for Runner.SessionShell, with resize reporting the
+// size changes of the local terminal. resize may be nil.
+func WithTerminal(resize remotecommand.TerminalSizeQueue) Option {
+	return func(r *Runner) {
+		r.tty = true
+		r.resize = resize
+	}
+}
+
+// StartSession creates the working directory of a new session with the given ID on the
+// target pod, below dir ("/tmp" when empty). The session must be kept by the caller and
+// passed to the other session methods.
+func (r *Runner) StartSession(ctx context.Context, id string, target Target, dir string) (*Session, error) {
+	a, err := r.newSessionApp(target, app.WithDestPath(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	return a.StartSession(ctx, id)
+}
+
+// RunInSession runs the file in the working directory of the session. The file is only
+// copied when the session doesn't hold it with the same content yet, and it stays on the pod
+// after the run. The target and destination path of the request are taken from the session,
+// which is updated and should be stored again.
+func (r *Runner) RunInSession(ctx context.Context, session *Session, req Request) (*Result, error) {
+	req.Target = sessionTarget(session)
+	req.DestPath = session.Dir
+	a, err := r.newApp(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.RunInSession(ctx, session)
+}
+
+// SessionShell opens an interactive shell in the working directory of the session, attached
+// to the stdin, stdout and stderr of the Runner. See WithTerminal.
+func (r *Runner) SessionShell(ctx context.Context, session *Session) error {
+	a, err := r.newSessionApp(sessionTarget(session))
+	if err != nil {
+		return err
+	}
+
+	return a.SessionShell(ctx, session)
+}
+
+// EndSession removes the working directory of the session from its pod.
+func (r *Runner) EndSession(ctx context.Context, session *Session) error {
+	a, err := r.newSessionApp(sessionTarget(session))
+	if err != nil {
+		return err
+	}
+
+	return a.EndSession(ctx, session)
+}
+
+// CheckSession returns ErrSessionGone when the pod or the working directory of the session
+// no longer exist.
+func (r *Runner) CheckSession(ctx context.Context, session *Session) error {
+	a, err := r.newSessionApp(sessionTarget(session))
+	if err != nil {
+		return err
+	}
+
+	return a.CheckSession(ctx, session)
+}
+
+func sessionTarget(session *Session) Target {
+	return Target{Namespace: session.Namespace, Pod: session.Pod, Container: session.Container}
+}
+
+func (r *Runner) newSessionApp(target Target, extra ...func(*app.App)) (*app.App, error) {
+	opts := []func(*app.App){
+		app.WithRESTConfig(r.config),
+		app.WithClientset(r.clientset),
+		app.WithKubeContext(r.contextName),
+		app.WithNamespace(target.Namespace),
+		app.WithPodName(target.Pod),
+		app.WithClone(target.Clone),
+		app.WithContainerName(target.Container),
+		app.WithStreams(k8s.IOStreams{In: r.stdin, Out: r.stdout, ErrOut: r.stderr, TTY: r.tty, Resize: r.resize}),
+		app.WithRedaction(r.redaction),
+		app.WithHooks(r.hooks),
+		app.WithEvents(r.onEvent),
+		app.WithContainerSelector(r.selectContainer),
+	}
+
+	a, err := app.NewSessionApp(append(opts, extra...)...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request: %w", err)
+	}
+	return a, nil
+}